@@ -0,0 +1,152 @@
+// Sanity-check the data directory before running the analyses over it, eg before a big seed run.
+// For each day in the time window, the CSV files in the day's `YYYY/MM/DD` directory are parsed and
+// the number of files, rows, and dropped rows are reported.  Files that can't be read are reported
+// too, as are fields that appear more than once in a row (the last value is used by the analyses,
+// but duplicates usually mean that the log producer is buggy).  The check fails if the percentage
+// of dropped rows across the window exceeds --max-dropped or if any file could not be read.
+//
+// A day without a directory is marked as such, to tell it apart from a day whose directory is
+// empty; many missing days usually mean that the data path or --prefix is wrong.  With --prefix the
+// day directories are taken to be in that subdirectory of the data path, eg `cluster`.
+//
+// Report format:
+//
+//   Date        Files    Rows  Dropped
+//   2023-09-05      3       8        0
+//   ...
+//   Total           3       8        0 (0.0%)
+
+package check
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"naicreport/storage"
+	"naicreport/util"
+)
+
+const (
+	defaultMaxDropped = 5
+)
+
+type dayStats struct {
+	date        time.Time
+	missing     bool // no directory for the day
+	files       int
+	rows        int
+	droppedRows int
+	badFiles    []string // files that could not be read, with the errors
+	duplicates  []string // duplicate fields, with file name and line number
+}
+
+func Check(progname string, args []string) error {
+	progOpts := util.NewStandardOptions(progname + " check")
+	maxDroppedPtr := progOpts.Container.Float64("max-dropped", defaultMaxDropped,
+		"Maximum percentage of dropped rows before the check fails")
+	prefixPtr := progOpts.Container.String("prefix", "",
+		"Subdirectory of the data path that holds the YYYY/MM/DD directories")
+	err := progOpts.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	days, err := checkDataPath(progOpts.DataPath, *prefixPtr, progOpts.From, progOpts.To)
+	if err != nil {
+		return err
+	}
+	missing := 0
+	for _, d := range days {
+		if d.missing {
+			missing++
+		}
+	}
+	progOpts.Log.Infof("check: %d of %d days have no directory", missing, len(days))
+
+	var output strings.Builder
+	rows, droppedRows, badFiles := writeDays(&output, days)
+	err = util.WriteOutput(progOpts.OutputFile, output.String())
+	if err != nil {
+		return err
+	}
+
+	if badFiles > 0 {
+		return fmt.Errorf("%d files could not be read", badFiles)
+	}
+	if rows > 0 && percentDropped(droppedRows, rows) > *maxDroppedPtr {
+		return fmt.Errorf("%.1f%% of the rows were dropped, more than the maximum %g%%",
+			percentDropped(droppedRows, rows), *maxDroppedPtr)
+	}
+	return progOpts.WriteRunManifest()
+}
+
+// Write the report and return the total number of rows, dropped rows, and unreadable files.
+
+func writeDays(out io.Writer, days []*dayStats) (int, int, int) {
+	var files, rows, droppedRows, badFiles int
+	fmt.Fprintf(out, "%-10s %6s %7s %8s\n", "Date", "Files", "Rows", "Dropped")
+	for _, d := range days {
+		fmt.Fprintf(out, "%-10s %6d %7d %8d\n", d.date.Format("2006-01-02"), d.files, d.rows, d.droppedRows)
+		if d.missing {
+			fmt.Fprintf(out, "  No directory\n")
+		}
+		for _, f := range d.badFiles {
+			fmt.Fprintf(out, "  Unreadable: %s\n", f)
+		}
+		for _, f := range d.duplicates {
+			fmt.Fprintf(out, "  Duplicate field: %s\n", f)
+		}
+		files += d.files
+		rows += d.rows
+		droppedRows += d.droppedRows
+		badFiles += len(d.badFiles)
+	}
+	fmt.Fprintf(out, "%-10s %6d %7d %8d (%.1f%%)\n", "Total", files, rows, droppedRows,
+		percentDropped(droppedRows, rows))
+	return rows, droppedRows, badFiles
+}
+
+func percentDropped(droppedRows, rows int) float64 {
+	if rows == 0 {
+		return 0
+	}
+	return float64(droppedRows) / float64(rows) * 100
+}
+
+// Collect the statistics for each day in the window, in order.  An error is returned only if the
+// data directory can't be enumerated.  The day directories are under the subdirectory prefix of
+// dataPath if prefix is not "".
+
+func checkDataPath(dataPath, prefix string, from, to time.Time) ([]*dayStats, error) {
+	days := make([]*dayStats, 0)
+	for d := from; d.Before(to); d = d.AddDate(0, 0, 1) {
+		files, report, err := storage.EnumerateFilesWithReport(dataPath, prefix, d, d.AddDate(0, 0, 1), "*.csv")
+		if err != nil {
+			return nil, err
+		}
+		stats := &dayStats{
+			date:       d,
+			missing:    len(report.Missing) > 0,
+			badFiles:   make([]string, 0),
+			duplicates: make([]string, 0),
+		}
+		for _, filePath := range files {
+			stats.files++
+			_, diag, err := storage.ReadFreeCSVWithDiagnostics(path.Join(dataPath, filePath))
+			if err != nil {
+				stats.badFiles = append(stats.badFiles, fmt.Sprintf("%s: %v", filePath, err))
+				continue
+			}
+			stats.rows += diag.Rows
+			stats.droppedRows += diag.DroppedRows
+			for _, d := range diag.DuplicateFields {
+				stats.duplicates = append(stats.duplicates, fmt.Sprintf("%s:%d: %s", filePath, d.Line, d.Field))
+			}
+		}
+		days = append(days, stats)
+	}
+	return days, nil
+}
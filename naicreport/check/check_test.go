@@ -0,0 +1,59 @@
+package check
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckDataPath(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+
+	dataPath := path.Join(wd, "../../sonar_test_data0")
+	from := time.Date(2023, 9, 4, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 9, 6, 0, 0, 0, 0, time.UTC)
+	days, err := checkDataPath(dataPath, "", from, to)
+	if err != nil {
+		t.Fatalf("checkDataPath failed %v", err)
+	}
+	if len(days) != 2 || days[0].date != from || days[1].files != 3 || len(days[1].badFiles) != 0 ||
+		days[0].missing || days[1].missing {
+		t.Fatalf("Bad days %v", days)
+	}
+
+	var output strings.Builder
+	rows, droppedRows, badFiles := writeDays(&output, days)
+	if rows != days[0].rows+days[1].rows || droppedRows != 0 || badFiles != 0 {
+		t.Fatalf("Bad totals %d %d %d", rows, droppedRows, badFiles)
+	}
+}
+
+func TestCheckDataPathPrefix(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+
+	// 2023/05/29 is a file, not a directory
+	from := time.Date(2023, 5, 29, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	days, err := checkDataPath(path.Join(wd, "../.."), "sonar_test_data0", from, to)
+	if err != nil {
+		t.Fatalf("checkDataPath failed %v", err)
+	}
+	if len(days) != 3 || !days[0].missing || days[1].missing || days[1].files != 1 ||
+		days[2].missing || days[2].files == 0 {
+		t.Fatalf("Bad days %v", days)
+	}
+
+	var output strings.Builder
+	writeDays(&output, days)
+	if strings.Count(output.String(), "No directory") != 1 {
+		t.Fatalf("Bad output %s", output.String())
+	}
+}
@@ -0,0 +1,53 @@
+// Check the system config file that is passed to sonalyze (and to some naicreport commands) with
+// --config-file, so that errors in it are caught before they surface as opaque sonalyze errors.
+// Each problem is reported with the file name and line number, and the check fails if there are
+// any.  See util.CheckSystemConfig for the rules.
+
+package check
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"naicreport/util"
+)
+
+func ConfigCheck(progname string, args []string) error {
+	container := flag.NewFlagSet(progname+" config-check", flag.ExitOnError)
+	configFilenamePtr := container.String("config-file", "", "Path to system config file (required)")
+	err := container.Parse(args)
+	if err != nil {
+		return err
+	}
+	configFilename, err := util.CleanPath(*configFilenamePtr, "-config-file")
+	if err != nil {
+		return err
+	}
+
+	problems, err := util.CheckSystemConfig(configFilename)
+	if err != nil {
+		return err
+	}
+	var output strings.Builder
+	writeProblems(&output, configFilename, problems)
+	err = util.WriteOutput("", output.String())
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems in the system config", len(problems))
+	}
+	return nil
+}
+
+func writeProblems(out io.Writer, filename string, problems []string) {
+	if len(problems) == 0 {
+		fmt.Fprintf(out, "%s: OK\n", filename)
+		return
+	}
+	for _, p := range problems {
+		fmt.Fprintln(out, p)
+	}
+}
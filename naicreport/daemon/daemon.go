@@ -0,0 +1,330 @@
+// Run the stateful analyses on a schedule in a long-running process, instead of from cron.
+//
+// `--every` gives the interval for each signal that is to be run, eg `cpuhog=1h,memhog=6h`.  Each
+// signal is run at startup and then at its interval, one signal at a time.  Each run is a run of the
+// analysis's verb with the daemon's other options, with the relative times of --from and --to
+// evaluated at the time of the run, and always with --since-last-run, so that consecutive runs
+// leave no gaps in the log data that are analyzed (and so that the daemon and the cron jobs it
+// replaces can be switched between freely).  The reports are written to stdout, --jsonl is the
+// most useful format for a consumer of the stream.  With --webhook <url> the reports of a run are
+// also posted to the URL, and with --mail-to <addresses> they are also mailed through the SMTP
+// server --smtp-server, see sinks.go.  A run whose reports can't be sent fails, and its violations
+// are reported again by the next run.
+//
+// A failed run is logged and the signal is run again at its next time.  On SIGTERM or SIGINT the
+// daemon finishes the current run, if any, and exits.
+//
+// With --listen <addr>, the daemon serves /healthz at that address: the status is 200 if the most
+// recent run of every signal succeeded and 503 if not, and the body has a line per signal with the
+// time and outcome of its most recent run.
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"naicreport/mlcpuhog"
+	"naicreport/mldeadweight"
+	"naicreport/mlgpuhog"
+	"naicreport/mlmemhog"
+	"naicreport/util"
+)
+
+type runner func(
+	context.Context,
+	*util.StandardOptions,
+	*util.AnalysisOptions,
+	func([]*util.JobReport) error,
+) error
+
+var runners = map[string]runner{
+	"cpuhog": func(
+		ctx context.Context,
+		progOpts *util.StandardOptions,
+		analysisOpts *util.AnalysisOptions,
+		emit func([]*util.JobReport) error,
+	) error {
+		return mlcpuhog.Run(ctx, progOpts, analysisOpts, mlcpuhog.DefaultCpuPeakScale, emit)
+	},
+	"deadweight": func(
+		ctx context.Context,
+		progOpts *util.StandardOptions,
+		analysisOpts *util.AnalysisOptions,
+		emit func([]*util.JobReport) error,
+	) error {
+		return mldeadweight.Run(ctx, progOpts, analysisOpts, false, emit)
+	},
+	"gpuhog": mlgpuhog.Run,
+	"memhog": mlmemhog.Run,
+}
+
+// The events of the signals, for the header of the CSV output of a run without events.
+
+var newEvents = map[string]func() any{
+	"cpuhog":     mlcpuhog.NewEvent,
+	"deadweight": mldeadweight.NewEvent,
+	"gpuhog":     mlgpuhog.NewEvent,
+	"memhog":     mlmemhog.NewEvent,
+}
+
+// A signal to be run, and its interval.
+
+type scheduled struct {
+	signal string
+	every  time.Duration
+}
+
+type daemonOptions struct {
+	every  string
+	listen string
+	sinks  sinkOptions
+}
+
+func Daemon(progname string, args []string) error {
+	progOpts, analysisOpts, daemonOpts, err := parseOptions(progname, args)
+	if err != nil {
+		return err
+	}
+	if progOpts.FromStdin() {
+		return errors.New("The daemon can't read from stdin")
+	}
+	if progOpts.OutputFile != "" {
+		return errors.New("The daemon writes the reports to stdout, --output-file is not supported")
+	}
+	if analysisOpts.DryRun || analysisOpts.Seed {
+		return errors.New("The daemon can't be run with --dry-run or --seed")
+	}
+	if analysisOpts.Fields != "" {
+		return errors.New("The daemon runs analyses with different fields, --fields is not supported")
+	}
+	if analysisOpts.Diff != "" {
+		return errors.New("The daemon runs several analyses, --diff is not supported")
+	}
+	if analysisOpts.ExitEvents {
+		return errors.New("The daemon does not exit when there are events, --exit-events is not supported")
+	}
+	err = progOpts.CheckDataPaths(true)
+	if err != nil {
+		return err
+	}
+	schedule, err := parseEvery(daemonOpts.every)
+	if err != nil {
+		return err
+	}
+	err = daemonOpts.sinks.check()
+	if err != nil {
+		return err
+	}
+	log := progOpts.Log
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	health := newHealth(schedule)
+	if daemonOpts.listen != "" {
+		listener, err := net.Listen("tcp", daemonOpts.listen)
+		if err != nil {
+			return err
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", health)
+		server := &http.Server{Handler: mux}
+		go server.Serve(listener)
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			server.Shutdown(shutdownCtx)
+		}()
+	}
+
+	// A zero time means the signal is to be run at once.
+	next := make([]time.Time, len(schedule))
+	for {
+		i := earliest(next)
+		wait := next[i].Sub(progOpts.Clock.Now())
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+			case <-timer.C:
+			}
+		}
+		if ctx.Err() != nil {
+			log.Infof("Shutting down")
+			return nil
+		}
+
+		// The run is not cancelled by a shutdown request, so that it is completed and its state
+		// written.
+		s := schedule[i]
+		err := runSignal(context.Background(), progname, args, s.signal)
+		health.record(s.signal, progOpts.Clock.Now(), err)
+		if err != nil {
+			log.Errorf("%s: %v", s.signal, err)
+		}
+		next[i] = progOpts.Clock.Now().Add(s.every)
+	}
+}
+
+// The options are parsed anew for every run, so that relative times are relative to the time of the
+// run.  The arguments have been parsed once already, so they are known to be good.
+
+func parseOptions(
+	progname string,
+	args []string,
+) (*util.StandardOptions, *util.AnalysisOptions, *daemonOptions, error) {
+	progOpts := util.NewStandardOptions(progname + " daemon")
+	analysisOpts := util.NewAnalysisOptions(progOpts)
+	daemonOpts := &daemonOptions{}
+	progOpts.Container.StringVar(&daemonOpts.every, "every", "",
+		"Comma-separated list of signal=interval, eg cpuhog=1h,memhog=6h (required)")
+	progOpts.Container.StringVar(&daemonOpts.listen, "listen", "",
+		"Serve /healthz at this address, eg :8080")
+	progOpts.Container.StringVar(&daemonOpts.sinks.webhook, "webhook", "",
+		"Also post the reports of each run to this http or https URL")
+	progOpts.Container.StringVar(&daemonOpts.sinks.mailTo, "mail-to", "",
+		"Also mail the reports of each run to this comma-separated list of addresses")
+	progOpts.Container.StringVar(&daemonOpts.sinks.mailFrom, "mail-from", "naicreport@localhost",
+		"The sender of the mail, see -mail-to")
+	progOpts.Container.StringVar(&daemonOpts.sinks.smtpServer, "smtp-server", "localhost:25",
+		"The SMTP server host:port for the mail, see -mail-to")
+	err := progOpts.Parse(args)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return progOpts, analysisOpts, daemonOpts, nil
+}
+
+func runSignal(ctx context.Context, progname string, args []string, name string) error {
+	progOpts, analysisOpts, daemonOpts, err := parseOptions(progname, args)
+	if err != nil {
+		return err
+	}
+	analysisOpts.SinceLastRun = true
+	err = runners[name](ctx, progOpts, analysisOpts, func(reports []*util.JobReport) error {
+		var output strings.Builder
+		err := util.WriteReports(&output, reports, newEvents[name](), analysisOpts)
+		if err != nil {
+			return err
+		}
+		err = util.WriteReportOutput(progOpts.OutputFile, output.String(), len(reports) == 0,
+			analysisOpts.QuietIfEmpty)
+		if err != nil {
+			return err
+		}
+		return daemonOpts.sinks.send(name, output.String(), len(reports), analysisOpts)
+	})
+	if err != nil {
+		return err
+	}
+	return progOpts.WriteRunManifest()
+}
+
+// The format of `every` is a comma-separated list of signal=interval, where the signal is one of
+// cpuhog, deadweight, gpuhog, and memhog and the interval is a positive Go duration.  The schedule
+// is sorted by signal name.
+
+func parseEvery(every string) ([]scheduled, error) {
+	if every == "" {
+		return nil, errors.New("-every requires a value")
+	}
+	schedule := make([]scheduled, 0)
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(every, ",") {
+		name, interval, found := strings.Cut(strings.TrimSpace(item), "=")
+		if !found {
+			return nil, fmt.Errorf("Bad -every item %s, must be signal=interval", item)
+		}
+		if _, ok := runners[name]; !ok {
+			return nil, fmt.Errorf("Unknown signal %s, must be cpuhog, deadweight, gpuhog, or memhog", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("Signal %s is given twice", name)
+		}
+		seen[name] = true
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("Bad interval for %s: %s", name, interval)
+		}
+		schedule = append(schedule, scheduled{name, d})
+	}
+	sort.Slice(schedule, func(i, j int) bool {
+		return schedule[i].signal < schedule[j].signal
+	})
+	return schedule, nil
+}
+
+// The index of the earliest time, the first one if there are several.
+
+func earliest(times []time.Time) int {
+	k := 0
+	for i, t := range times {
+		if t.Before(times[k]) {
+			k = i
+		}
+	}
+	return k
+}
+
+// The outcome of the most recent run of each signal, for /healthz.
+
+type health struct {
+	sync.Mutex
+	signals []string
+	runs    map[string]runStatus
+}
+
+type runStatus struct {
+	when time.Time
+	err  error
+}
+
+func newHealth(schedule []scheduled) *health {
+	signals := make([]string, 0, len(schedule))
+	for _, s := range schedule {
+		signals = append(signals, s.signal)
+	}
+	return &health{signals: signals, runs: make(map[string]runStatus)}
+}
+
+func (h *health) record(name string, when time.Time, err error) {
+	h.Lock()
+	defer h.Unlock()
+	h.runs[name] = runStatus{when, err}
+}
+
+func (h *health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+	var body strings.Builder
+	healthy := true
+	for _, s := range h.signals {
+		run, found := h.runs[s]
+		switch {
+		case !found:
+			fmt.Fprintf(&body, "%s not run yet\n", s)
+		case run.err != nil:
+			healthy = false
+			fmt.Fprintf(&body, "%s failed at %s: %v\n", s, run.when.UTC().Format(time.RFC3339), run.err)
+		default:
+			fmt.Fprintf(&body, "%s ok at %s\n", s, run.when.UTC().Format(time.RFC3339))
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprint(w, body.String())
+}
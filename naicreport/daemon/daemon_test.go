@@ -0,0 +1,101 @@
+package daemon
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"naicreport/util"
+)
+
+func TestParseEvery(t *testing.T) {
+	schedule, err := parseEvery("memhog=6h, cpuhog=1h")
+	if err != nil || len(schedule) != 2 || schedule[0] != (scheduled{"cpuhog", time.Hour}) ||
+		schedule[1] != (scheduled{"memhog", 6 * time.Hour}) {
+		t.Fatalf("Bad schedule %v %v", schedule, err)
+	}
+	for _, bad := range []string{"", "cpuhog", "cpuhog=1h,cpuhog=2h", "idle=1h", "cpuhog=0s", "cpuhog=1d"} {
+		if _, err := parseEvery(bad); err == nil {
+			t.Fatalf("Bad schedule accepted: %s", bad)
+		}
+	}
+}
+
+func TestEarliest(t *testing.T) {
+	t0 := time.Date(2023, 9, 11, 12, 0, 0, 0, time.UTC)
+	if earliest([]time.Time{t0, t0.Add(-time.Hour), t0.Add(-time.Hour)}) != 1 ||
+		earliest([]time.Time{{}, {}}) != 0 {
+		t.Fatalf("Bad earliest")
+	}
+}
+
+func TestHealth(t *testing.T) {
+	schedule, _ := parseEvery("cpuhog=1h,memhog=1h")
+	h := newHealth(schedule)
+	t0 := time.Date(2023, 9, 11, 12, 0, 0, 0, time.UTC)
+
+	h.record("cpuhog", t0, nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK ||
+		w.Body.String() != "cpuhog ok at 2023-09-11T12:00:00Z\nmemhog not run yet\n" {
+		t.Fatalf("Bad health %d %q", w.Code, w.Body.String())
+	}
+
+	h.record("memhog", t0, errors.New("no data"))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusServiceUnavailable ||
+		w.Body.String() != "cpuhog ok at 2023-09-11T12:00:00Z\nmemhog failed at 2023-09-11T12:00:00Z: no data\n" {
+		t.Fatalf("Bad health %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestSinks(t *testing.T) {
+	var body, contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bytes, _ := io.ReadAll(r.Body)
+		body, contentType = string(bytes), r.Header.Get("Content-Type")
+	}))
+	defer server.Close()
+
+	sinks := sinkOptions{webhook: server.URL}
+	if err := sinks.check(); err != nil {
+		t.Fatalf("Good sinks rejected %v", err)
+	}
+	err := sinks.send("cpuhog", "{\"id\":1}\n", 1, &util.AnalysisOptions{Jsonl: true})
+	if err != nil || body != "{\"id\":1}\n" || contentType != "application/x-ndjson" {
+		t.Fatalf("Bad post %q %q %v", body, contentType, err)
+	}
+
+	// Nothing is sent for a run without reports
+	body = ""
+	err = sinks.send("cpuhog", "", 0, &util.AnalysisOptions{})
+	if err != nil || body != "" {
+		t.Fatalf("Empty run posted %q %v", body, err)
+	}
+
+	for _, bad := range []sinkOptions{
+		{webhook: "ftp://example.com/"},
+		{webhook: "example.com"},
+		{mailTo: "a@example.com,", mailFrom: "naicreport@localhost", smtpServer: "localhost:25"},
+		{mailTo: "a@example.com", smtpServer: "localhost:25"},
+	} {
+		if bad.check() == nil {
+			t.Fatalf("Bad sinks accepted %v", bad)
+		}
+	}
+}
+
+func TestMailMessage(t *testing.T) {
+	msg := string(mailMessage("naicreport@localhost", []string{"a@example.com", "b@example.com"},
+		"naicreport cpuhog: 1 new violations", "New CPU hog detected\n"))
+	if msg != "From: naicreport@localhost\nTo: a@example.com, b@example.com\n"+
+		"Subject: naicreport cpuhog: 1 new violations\nMIME-Version: 1.0\n"+
+		"Content-Type: text/plain; charset=utf-8\n\nNew CPU hog detected\n" {
+		t.Fatalf("Bad message %q", msg)
+	}
+}
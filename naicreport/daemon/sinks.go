@@ -0,0 +1,121 @@
+// The sinks that the daemon sends the reports of a run to in addition to stdout: a webhook, to
+// which the reports are posted, and mail, by which they are sent to a list of addresses.
+
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+
+	"naicreport/util"
+)
+
+type sinkOptions struct {
+	webhook    string
+	mailTo     string
+	mailFrom   string
+	smtpServer string
+}
+
+// The time allowed for posting to the webhook.
+
+const webhookTimeout = 30 * time.Second
+
+func (o *sinkOptions) check() error {
+	if o.webhook != "" {
+		u, err := url.Parse(o.webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Bad -webhook %s, must be an http or https URL", o.webhook)
+		}
+	}
+	if o.mailTo != "" {
+		for _, addr := range o.recipients() {
+			if addr == "" {
+				return fmt.Errorf("Bad -mail-to %s, must be a comma-separated list of addresses", o.mailTo)
+			}
+		}
+		if o.mailFrom == "" || o.smtpServer == "" {
+			return errors.New("-mail-to requires -mail-from and -smtp-server")
+		}
+	}
+	return nil
+}
+
+func (o *sinkOptions) recipients() []string {
+	addrs := strings.Split(o.mailTo, ",")
+	for i := range addrs {
+		addrs[i] = strings.TrimSpace(addrs[i])
+	}
+	return addrs
+}
+
+// Send the output of a run of the signal, which has `count` reports formatted by the output options,
+// to the webhook and by mail, if they are given.  Nothing is sent for a run without reports.
+
+func (o *sinkOptions) send(signal, output string, count int, analysisOpts *util.AnalysisOptions) error {
+	if count == 0 {
+		return nil
+	}
+	if o.webhook != "" {
+		err := postWebhook(o.webhook, output, contentType(analysisOpts))
+		if err != nil {
+			return err
+		}
+	}
+	if o.mailTo != "" {
+		subject := fmt.Sprintf("naicreport %s: %d new violations", signal, count)
+		err := smtp.SendMail(o.smtpServer, nil, o.mailFrom, o.recipients(),
+			mailMessage(o.mailFrom, o.recipients(), subject, output))
+		if err != nil {
+			return fmt.Errorf("Could not send mail: %w", err)
+		}
+	}
+	return nil
+}
+
+func postWebhook(webhook, output, contentType string) error {
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(webhook, contentType, strings.NewReader(output))
+	if err != nil {
+		return fmt.Errorf("Could not post to the webhook: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("The webhook failed: %s", resp.Status)
+	}
+	return nil
+}
+
+func contentType(analysisOpts *util.AnalysisOptions) string {
+	switch {
+	case analysisOpts.Csv:
+		return "text/csv; charset=utf-8"
+	case analysisOpts.Jsonl:
+		return "application/x-ndjson"
+	case analysisOpts.Json || analysisOpts.JsonReports:
+		return "application/json"
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
+
+// The message has the output as its plain-text body, whatever its format.  net/smtp converts the
+// line endings to CRLF.
+
+func mailMessage(from string, to []string, subject, output string) []byte {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\n", from)
+	fmt.Fprintf(&msg, "To: %s\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\n", subject)
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\n")
+	fmt.Fprintf(&msg, "\n")
+	msg.WriteString(output)
+	return msg.Bytes()
+}
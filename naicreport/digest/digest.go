@@ -0,0 +1,267 @@
+// Combine the stateful analyses into a single digest report.  Each analysis is run over the same
+// time window with the same options and reads and writes its own state as usual, but the reports
+// are merged into one output, with a section per analysis.
+//
+// Report format (when not JSON):
+//
+//     CPU hogs
+//     ========
+//
+//     <the ml-cpuhog report, or "None">
+//
+//     Dead weight
+//     ===========
+//
+//     <the ml-deadweight report, or "None">
+//
+//     ...
+//
+// With --json or --json-reports the output is a JSON object whose fields are the signal names
+// ("cpuhog", "deadweight", "gpuhog", "memhog") and whose values are the JSON outputs of the
+// analyses.  With --jsonl each line is an object {"signal": <signal name>, "data": <event>}.
+//
+// The analyses read disjoint log files and have separate states, so with --parallel they are run
+// concurrently, each reading up to --concurrency files at a time.  Either way, all the analyses are
+// run, and if any of them fail then the errors of all of them are returned and nothing is written.
+
+package digest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"naicreport/jobstate"
+	"naicreport/mlcpuhog"
+	"naicreport/mldeadweight"
+	"naicreport/mlgpuhog"
+	"naicreport/mlmemhog"
+	"naicreport/util"
+)
+
+type analyzer func(
+	context.Context,
+	*util.StandardOptions,
+	*util.AnalysisOptions,
+) ([]*util.JobReport, map[jobstate.JobKey]*jobstate.JobState, error)
+
+type signal struct {
+	name      string
+	title     string
+	stateFile string
+	analyze   analyzer
+}
+
+var signals = []signal{
+	signal{
+		name:      "cpuhog",
+		title:     "CPU hogs",
+		stateFile: mlcpuhog.CpuhogStateFilename,
+		analyze: func(
+			ctx context.Context,
+			progOpts *util.StandardOptions,
+			analysisOpts *util.AnalysisOptions,
+		) ([]*util.JobReport, map[jobstate.JobKey]*jobstate.JobState, error) {
+			return mlcpuhog.Analyze(ctx, progOpts, analysisOpts, mlcpuhog.DefaultCpuPeakScale)
+		},
+	},
+	signal{
+		name:      "deadweight",
+		title:     "Dead weight",
+		stateFile: mldeadweight.DeadweightStateFilename,
+		analyze: func(
+			ctx context.Context,
+			progOpts *util.StandardOptions,
+			analysisOpts *util.AnalysisOptions,
+		) ([]*util.JobReport, map[jobstate.JobKey]*jobstate.JobState, error) {
+			return mldeadweight.Analyze(ctx, progOpts, analysisOpts, false)
+		},
+	},
+	signal{
+		name:      "gpuhog",
+		title:     "GPU hogs",
+		stateFile: mlgpuhog.GpuhogStateFilename,
+		analyze:   mlgpuhog.Analyze,
+	},
+	signal{
+		name:      "memhog",
+		title:     "Memory hogs",
+		stateFile: mlmemhog.MemhogStateFilename,
+		analyze:   mlmemhog.Analyze,
+	},
+}
+
+func Digest(progname string, args []string) error {
+	progOpts := util.NewStandardOptions(progname + " digest")
+	analysisOpts := util.NewAnalysisOptions(progOpts)
+	parallel := progOpts.Container.Bool("parallel", false, "Run the analyses concurrently")
+	err := progOpts.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if analysisOpts.Csv {
+		return errors.New("The digest can't be formatted as CSV")
+	}
+
+	// The observed data are different for each analysis
+	if analysisOpts.Fields != "" {
+		return errors.New("The digest can't be restricted to some fields, --fields is not supported")
+	}
+
+	// The analyses would all write their diffs to the same file
+	if analysisOpts.Diff != "" {
+		return errors.New("The digest can't write the changes to the states, --diff is not supported")
+	}
+
+	// Each analysis would read the logs separately, but stdin can be read only once
+	if progOpts.FromStdin() {
+		return errors.New("The digest can't read from stdin")
+	}
+
+	err = progOpts.CheckDataPaths(!analysisOpts.DryRun)
+	if err != nil {
+		return err
+	}
+
+	if analysisOpts.SinceLastRun {
+		err = util.ApplySinceLastRun(progOpts, "digest")
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+
+	// Run all the analyses before writing anything, so that an error in one does not leave the
+	// state of another updated without its report having been produced.
+
+	reports := make([][]*util.JobReport, len(signals))
+	states := make([]map[jobstate.JobKey]*jobstate.JobState, len(signals))
+	errs := make([]error, len(signals))
+	analyze := func(i int) {
+		s := signals[i]
+		reports[i], states[i], errs[i] = s.analyze(ctx, progOpts, analysisOpts)
+		if errs[i] != nil {
+			errs[i] = fmt.Errorf("%s: %w", s.name, errs[i])
+		}
+	}
+	if *parallel {
+		// The analyses' counts are added to the run manifest here, as the analyses can't add to it
+		// concurrently.
+		for _, s := range signals {
+			progOpts.RunCounts(s.name)
+		}
+		var wg sync.WaitGroup
+		for i := range signals {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				analyze(i)
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i := range signals {
+			analyze(i)
+		}
+	}
+	err = errors.Join(errs...)
+	if err != nil {
+		return err
+	}
+
+	var output strings.Builder
+	if analysisOpts.Jsonl {
+		for i, s := range signals {
+			top := util.TopReports(reports[i], analysisOpts.TopN)
+			err = util.SortReportsByOptions(top, analysisOpts)
+			if err != nil {
+				return err
+			}
+			for _, r := range top {
+				bytes, err := json.Marshal(struct {
+					Signal string `json:"signal"`
+					Data   any    `json:"data"`
+				}{s.name, r.Data})
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(&output, "%s\n", bytes)
+			}
+		}
+	} else if analysisOpts.Json || analysisOpts.JsonReports {
+		sections := make(map[string]json.RawMessage)
+		for i, s := range signals {
+			var section strings.Builder
+			err = util.WriteReports(&section, reports[i], nil, analysisOpts)
+			if err != nil {
+				return err
+			}
+			sections[s.name] = json.RawMessage(section.String())
+		}
+		bytes, err := json.Marshal(sections)
+		if err != nil {
+			return err
+		}
+		output.Write(bytes)
+	} else {
+		for i, s := range signals {
+			fmt.Fprintf(&output, "%s\n%s\n\n", s.title, strings.Repeat("=", len(s.title)))
+			if len(reports[i]) == 0 {
+				output.WriteString("None\n\n")
+				continue
+			}
+			err = util.WriteReports(&output, reports[i], nil, analysisOpts)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	events := 0
+	for _, r := range reports {
+		events += len(r)
+	}
+	err = util.WriteReportOutput(progOpts.OutputFile, output.String(), events == 0, analysisOpts.QuietIfEmpty)
+	if err != nil {
+		return err
+	}
+
+	if analysisOpts.DryRun {
+		err = progOpts.WriteRunManifest()
+		if err != nil {
+			return err
+		}
+		return analysisOpts.EventsResult(events)
+	}
+	for i, s := range signals {
+		err = jobstate.WriteJobState(progOpts.DataPath, s.stateFile, states[i], analysisOpts.StateBackups)
+		if err != nil {
+			return err
+		}
+	}
+	if analysisOpts.MetricsFile != "" {
+		metrics := make(map[string][]*util.JobReport)
+		for i, s := range signals {
+			metrics[s.name] = reports[i]
+		}
+		err = util.WriteMetrics(analysisOpts.MetricsFile, metrics, progOpts.Clock.Now().UTC())
+		if err != nil {
+			return err
+		}
+	}
+	if analysisOpts.SinceLastRun {
+		err = util.RecordLastRun(progOpts, "digest", progOpts.Clock.Now().UTC())
+		if err != nil {
+			return err
+		}
+	}
+	err = progOpts.WriteRunManifest()
+	if err != nil {
+		return err
+	}
+	return analysisOpts.EventsResult(events)
+}
@@ -0,0 +1,54 @@
+package digest
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"naicreport/util"
+)
+
+func TestDigestParallel(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	dataPath := path.Join(wd, "../../sonar_test_data0")
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+
+	// The analyses produce the same digest whether they are run concurrently or not
+	outputs := make([]string, 0)
+	for _, parallel := range []string{"--parallel=false", "--parallel"} {
+		filename := path.Join(td_name, "digest"+parallel+".json")
+		err = Digest("test", []string{"--data-path", dataPath, "--from", "2023-09-01", "--to", "2023-09-12",
+			"--dry-run", "--json", "--output-file", filename, parallel})
+		if err != nil {
+			t.Fatalf("Digest %s failed %v", parallel, err)
+		}
+		bytes, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("ReadFile failed %v", err)
+		}
+		outputs = append(outputs, string(bytes))
+	}
+	if !strings.Contains(outputs[0], `"cpuhog":[{`) || outputs[0] != outputs[1] {
+		t.Fatalf("Bad digests\n%s\n%s", outputs[0], outputs[1])
+	}
+
+	// The errors of all the analyses are returned
+	err = Digest("test", []string{"--data-path", dataPath, "--from", "2023-10-01", "--to", "2023-10-02",
+		"--dry-run", "--max-data-age", "24h", "--parallel"})
+	if !errors.Is(err, util.ErrStaleData) {
+		t.Fatalf("Expected stale data, got %v", err)
+	}
+	for _, s := range signals {
+		if !strings.Contains(err.Error(), s.name+": ") {
+			t.Fatalf("No error for %s in %v", s.name, err)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Generate synthetic log data for testing and demonstrating the analyses, in the format and the
+// directory layout of the real logs.
+//
+// `--signal` names the kind of log to generate; only cpuhog is supported for now.  For each of
+// `--jobs` jobs, a host is picked among `--hosts` hosts named ml1, ml2, ..., and a start time, a
+// duration, a user, a command, and the load of the job are picked at random; the job then has a
+// record at every recordInterval in its lifetime, in the file for the day of the record, as if
+// sonalyze had been run on the job periodically.  Every job starts and has its first record within
+// the time window and ends before the end of the window.
+//
+// The data are generated from a random number generator seeded with `--seed`, so the same options
+// always generate the same data.  Existing files are not overwritten.
+
+package gentestdata
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"naicreport/storage"
+	"naicreport/util"
+)
+
+// The time between the records of a job, and the minimum duration of a job.
+
+const recordInterval = 2 * time.Hour
+
+// The number of cores of each generated host.
+
+const hostCores = 64
+
+var cpuhogFields = []string{"now", "jobm", "user", "duration", "host", "cpu-peak", "gpu-peak",
+	"rcpu-avg", "rcpu-peak", "rmem-avg", "rmem-peak", "start", "end", "cmd", "tag"}
+
+var commands = []string{"python3.9", "python3", "java", "julia", "matlab", "R"}
+
+func GenTestdata(progname string, args []string) error {
+	container := flag.NewFlagSet(progname+" gen-testdata", flag.ExitOnError)
+	signalPtr := container.String("signal", "cpuhog", "The kind of log to generate, only cpuhog for now")
+	fromPtr := container.String("from", "1d",
+		"Start of the time window, yyyy-mm-dd or Nd (days ago) or Nw (weeks ago)")
+	toPtr := container.String("to", "", "End of the time window, ditto (default today)")
+	outPtr := container.String("out", "", "Root directory of the generated data (required)")
+	jobsPtr := container.Int("jobs", 10, "Number of jobs")
+	hostsPtr := container.Int("hosts", 3, "Number of hosts")
+	seedPtr := container.Int64("seed", 1, "Seed for the random number generator")
+	err := container.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *signalPtr != "cpuhog" {
+		return fmt.Errorf("Unknown signal %s, must be cpuhog", *signalPtr)
+	}
+	out, err := util.CleanPath(*outPtr, "-out")
+	if err != nil {
+		return err
+	}
+	if *jobsPtr < 0 || *hostsPtr < 1 {
+		return errors.New("-jobs must not be negative and -hosts must be positive")
+	}
+	now := time.Now()
+	from, err := util.ParseWhen(*fromPtr, now)
+	if err != nil {
+		return fmt.Errorf("Bad -from value %s: %w", *fromPtr, err)
+	}
+	to := now.UTC()
+	if *toPtr != "" {
+		to, err = util.ParseWhen(*toPtr, now)
+		if err != nil {
+			return fmt.Errorf("Bad -to value %s: %w", *toPtr, err)
+		}
+	}
+	// As for the analyses, the window ends at midnight after the `to` day.
+	to = time.Date(to.Year(), to.Month(), to.Day()+1, 0, 0, 0, 0, time.UTC)
+	if !from.Before(to) {
+		return errors.New("The time window is empty")
+	}
+
+	rng := rand.New(rand.NewSource(*seedPtr))
+	days := generateCpuhog(rng, from, to, *jobsPtr, *hostsPtr)
+	return writeDays(out, *signalPtr+".csv", cpuhogFields, days)
+}
+
+// Generate the records for the jobs, returning them by the directory of the day of the record, eg
+// 2023/09/05, in the order of their `now` fields.
+
+func generateCpuhog(rng *rand.Rand, from, to time.Time, jobs, hosts int) map[string][]map[string]string {
+	days := make(map[string][]map[string]string)
+	users := jobs/2 + 1
+	ids := make(map[string]bool)
+	for j := 0; j < jobs; j++ {
+		host := fmt.Sprintf("ml%d", 1+rng.Intn(hosts))
+		var id int
+		for {
+			id = 100000 + rng.Intn(9900000)
+			if !ids[host+"/"+strconv.Itoa(id)] {
+				break
+			}
+		}
+		ids[host+"/"+strconv.Itoa(id)] = true
+		user := fmt.Sprintf("user%d", 1+rng.Intn(users))
+		cmd := commands[rng.Intn(len(commands))]
+
+		// The job starts early enough in the window that it lasts at least recordInterval, which
+		// guarantees a record.
+		latestStart := int(to.Sub(from)/time.Minute) - int(recordInterval/time.Minute)
+		start := from.Add(time.Duration(rng.Intn(latestStart)) * time.Minute)
+		duration := recordInterval + time.Duration(rng.Intn(46*60))*time.Minute
+		end := start.Add(duration)
+		if !end.Before(to) {
+			end = to.Add(-time.Minute)
+		}
+
+		rcpuPeak := 10 + rng.Intn(91)
+		rcpuAvg := 1 + rng.Intn(rcpuPeak)
+		rmemPeak := 1 + rng.Intn(100)
+		rmemAvg := 1 + rng.Intn(rmemPeak)
+
+		for now := start.Truncate(recordInterval).Add(recordInterval); !now.After(end); now = now.Add(recordInterval) {
+			record := map[string]string{
+				"now":       now.Format("2006-01-02 15:04"),
+				"jobm":      strconv.Itoa(id),
+				"user":      user,
+				"duration":  formatDuration(now.Sub(start)),
+				"host":      host,
+				"cpu-peak":  strconv.Itoa(rcpuPeak * hostCores),
+				"gpu-peak":  "0",
+				"rcpu-avg":  strconv.Itoa(rcpuAvg),
+				"rcpu-peak": strconv.Itoa(rcpuPeak),
+				"rmem-avg":  strconv.Itoa(rmemAvg),
+				"rmem-peak": strconv.Itoa(rmemPeak),
+				"start":     start.Format("2006-01-02 15:04"),
+				"end":       now.Format("2006-01-02 15:04"),
+				"cmd":       cmd,
+				"tag":       "cpuhog",
+			}
+			day := now.Format("2006/01/02")
+			days[day] = append(days[day], record)
+		}
+	}
+	for _, records := range days {
+		sort.SliceStable(records, func(i, j int) bool {
+			return records[i]["now"] < records[j]["now"]
+		})
+	}
+	return days
+}
+
+// The format of the `duration` field, eg 1d 4h0m.
+
+func formatDuration(d time.Duration) string {
+	minutes := int(d / time.Minute)
+	return fmt.Sprintf("%dd %dh%dm", minutes/(24*60), minutes/60%24, minutes%60)
+}
+
+// Write the records of each day to the file in the directory for the day under `out`.  If any of the
+// files exists then nothing is written.
+
+func writeDays(out, filename string, fields []string, days map[string][]map[string]string) error {
+	for day := range days {
+		p := path.Join(out, day, filename)
+		if _, err := os.Stat(p); err == nil {
+			return fmt.Errorf("%s exists, not overwriting it", p)
+		}
+	}
+	for day, records := range days {
+		err := os.MkdirAll(path.Join(out, day), 0755)
+		if err != nil {
+			return err
+		}
+		err = storage.WriteFreeCSV(path.Join(out, day, filename), fields, records)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package gentestdata
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"naicreport/mlcpuhog"
+	"naicreport/util"
+)
+
+func TestGenerateCpuhog(t *testing.T) {
+	from := time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 9, 4, 0, 0, 0, 0, time.UTC)
+	days := generateCpuhog(rand.New(rand.NewSource(7)), from, to, 12, 3)
+	again := generateCpuhog(rand.New(rand.NewSource(7)), from, to, 12, 3)
+	if len(days) == 0 || len(days) > 3 || len(days) != len(again) {
+		t.Fatalf("Bad days %d %d", len(days), len(again))
+	}
+	for day, records := range days {
+		if len(records) != len(again[day]) {
+			t.Fatalf("Not deterministic for %s", day)
+		}
+		for i, r := range records {
+			for k, v := range r {
+				if again[day][i][k] != v {
+					t.Fatalf("Not deterministic for %s: %v %v", day, r, again[day][i])
+				}
+			}
+		}
+	}
+
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	err = writeDays(td_name, "cpuhog.csv", cpuhogFields, days)
+	if err != nil {
+		t.Fatalf("writeDays failed %q", err)
+	}
+	err = writeDays(td_name, "cpuhog.csv", cpuhogFields, days)
+	if err == nil {
+		t.Fatalf("Existing files overwritten")
+	}
+
+	// The cpuhog analysis finds every job
+	progOpts, analysisOpts, err := util.NewEmbeddedOptions("ml-cpuhog", td_name, from, to, nil)
+	if err != nil {
+		t.Fatalf("NewEmbeddedOptions failed %q", err)
+	}
+	reports, _, err := mlcpuhog.Analyze(context.Background(), progOpts, analysisOpts,
+		mlcpuhog.DefaultCpuPeakScale)
+	if err != nil {
+		t.Fatalf("Analyze failed %q", err)
+	}
+	if len(reports) != 12 {
+		t.Fatalf("Expected 12 reports, got %d", len(reports))
+	}
+	if _, err := os.Stat(path.Join(td_name, "2023/09/01/cpuhog.csv")); err != nil {
+		t.Fatalf("No file for the first day: %v", err)
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	if formatDuration(28*time.Hour+5*time.Minute) != "1d 4h5m" || formatDuration(2*time.Hour) != "0d 2h0m" {
+		t.Fatalf("Bad formatDuration")
+	}
+}
@@ -0,0 +1,469 @@
+// The pipeline shared by the analyses of the logs of the ML nodes (ml-cpuhog, ml-deadweight,
+// ml-gpuhog, ml-memhog): read the state, read and consolidate the logs, merge the jobs into the
+// state, purge and expire old jobs, report the new violations, and write the state.  The analyses
+// differ only in the log they read, the fields whose maxima they take, and the reports they make,
+// see Analysis.
+
+package jobstate
+
+import (
+	"context"
+	"math"
+	"path"
+	"text/template"
+	"time"
+
+	"naicreport/storage"
+	"naicreport/util"
+)
+
+// An analysis of the logs.  Name is the name of the analysis, eg "cpuhog": the logs are the files
+// "<Name>.csv" and the verb is "ml-<Name>".  The state is kept in StateFilename and the summaries
+// of the logs are cached in CacheFilename, both in the data directory.
+//
+// PeakFields are the fields whose maxima are taken across a job's records, in the order of the
+// Peaks of the LoggedJob, see storage.JobSummary.  Event is an event of the analysis, for checking
+// --fields, and Templates are the default templates of the text reports, see
+// util/reporttemplate.go.
+//
+// Report makes the reports for the new violations, whose times are formatted by `times`.
+
+type Analysis struct {
+	Name          string
+	StateFilename string
+	CacheFilename string
+	PeakFields    []string
+	Event         any
+	Templates     string
+	Report        func(violations []*Violation, now time.Time, times *util.TimeFormatter,
+		templates *template.Template) ([]*util.JobReport, error)
+}
+
+// The view of a job across all the records read from the logs.  (job#, host) identifies the job
+// uniquely, unless jobs are keyed cross-host (--cross-host), in which case the job# alone does and
+// Host is a list of hosts, see JobKey.
+//
+// Peaks are the Max across all records seen for the job of the fields given by the analysis.  This
+// is necessary as sonalyze will have a limited window in which to gather statistics and its view
+// will change over time.
+
+type LoggedJob struct {
+	Id        uint32          // synthesized job id
+	Host      string          // host name, or a list of them if cross-host
+	User      string          // user's login name
+	Cmd       string          // command name, normalized by the command map
+	RawCmd    string          // command name as logged
+	FirstSeen time.Time       // timestamp of record in which job is first seen
+	LastSeen  time.Time       // ditto the record in which the job is last seen
+	FirstFile time.Time       // the date of the earliest log file with a record for the job
+	Start     time.Time       // the start field of the first record for the job
+	End       time.Time       // the end field of the last record for the job
+	Mark      storage.JobMark // the mark of the job# in the records, see storage.CombineJobMarks
+	Duration  time.Duration   // the time the job has run, see util.JobDuration
+	Peaks     []float64       // the maxima of Analysis.PeakFields
+}
+
+// A new violation: a job of the state that is reported, with its view in the logs.  If --job-marks
+// was given and the records of the job mark it as started before sonalyze's time window then
+// StartedBeforeWindow is true, see storage.JobMark.
+
+type Violation struct {
+	Key                 JobKey
+	State               *JobState
+	Job                 *LoggedJob
+	StartedBeforeWindow bool
+}
+
+// Run the analysis as its verb does once its options have been parsed, but pass the reports for the
+// new violations to `emit` instead of writing them.  Unless this is a dry run, the state, the
+// metrics, and the record of the last run are then written.  If `emit` returns an error then
+// nothing is written, so that the violations are reported again on the next run.  The run manifest
+// is not written.
+
+func RunAnalysis(
+	ctx context.Context,
+	progOpts *util.StandardOptions,
+	analysisOpts *util.AnalysisOptions,
+	a *Analysis,
+	emit func([]*util.JobReport) error,
+) error {
+	err := progOpts.CheckDataPaths(!analysisOpts.DryRun)
+	if err != nil {
+		return err
+	}
+	if analysisOpts.SinceLastRun {
+		err = util.ApplySinceLastRun(progOpts, "ml-"+a.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Analyze updates the state that it reads, so the state before the run is read here.
+	var before map[JobKey]*JobState
+	if analysisOpts.Diff != "" {
+		before, err = ReadJobStateForAnalysis(
+			progOpts.DataPath, a.StateFilename, analysisOpts.RecoverState, progOpts.Log)
+		if err != nil {
+			return err
+		}
+	}
+
+	reports, state, err := Analyze(ctx, progOpts, analysisOpts, a)
+	if err != nil {
+		return err
+	}
+	err = emit(reports)
+	if err != nil {
+		return err
+	}
+	if analysisOpts.Diff != "" {
+		err = WriteStateDiff(analysisOpts.Diff, a.Name, before, state, analysisOpts.Json || analysisOpts.Jsonl)
+		if err != nil {
+			return err
+		}
+	}
+
+	if analysisOpts.DryRun {
+		return nil
+	}
+	err = WriteJobState(progOpts.DataPath, a.StateFilename, state, analysisOpts.StateBackups)
+	if err != nil {
+		return err
+	}
+	if analysisOpts.MetricsFile != "" {
+		err = util.WriteMetrics(analysisOpts.MetricsFile,
+			map[string][]*util.JobReport{a.Name: reports}, progOpts.Clock.Now().UTC())
+		if err != nil {
+			return err
+		}
+	}
+	if analysisOpts.SinceLastRun {
+		err = util.RecordLastRun(progOpts, "ml-"+a.Name, progOpts.Clock.Now().UTC())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run the analysis for the time window and return the reports for the new violations along with
+// the updated state.  The caller must write the state unless this is a dry run.
+
+func Analyze(
+	ctx context.Context,
+	progOpts *util.StandardOptions,
+	analysisOpts *util.AnalysisOptions,
+	a *Analysis,
+) ([]*util.JobReport, map[JobKey]*JobState, error) {
+	state, err := ReadJobStateForAnalysis(
+		progOpts.DataPath, a.StateFilename, analysisOpts.RecoverState, progOpts.Log)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Jobs on hosts that are not selected by the host filter are set aside, so that they are neither
+	// reported nor purged, and are put back into the state before it is returned.
+	hosts, err := analysisOpts.HostFilter()
+	if err != nil {
+		return nil, nil, err
+	}
+	times, err := analysisOpts.ReportTimes()
+	if err != nil {
+		return nil, nil, err
+	}
+	firstViolation, err := analysisOpts.FirstViolationTime()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = analysisOpts.CheckFields(a.Name, a.Event)
+	if err != nil {
+		return nil, nil, err
+	}
+	templates, err := analysisOpts.ReportTemplates(a.Templates)
+	if err != nil {
+		return nil, nil, err
+	}
+	otherJobs := RemoveJobs(state, func(j *JobState) bool {
+		return !hosts.Matches(j.Host)
+	})
+
+	// The staleness of the logs is checked before they are read, see --max-data-age.
+	err = analysisOpts.CheckDataAge(progOpts, func() (time.Time, error) {
+		return storage.NewestFileDateInRoots(progOpts.DataPaths, progOpts.From, progOpts.To, a.Name+".csv")
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	commands, err := analysisOpts.Commands()
+	if err != nil {
+		return nil, nil, err
+	}
+	delimiter, err := analysisOpts.LogDelimiterRune()
+	if err != nil {
+		return nil, nil, err
+	}
+	comment, err := analysisOpts.LogCommentRune()
+	if err != nil {
+		return nil, nil, err
+	}
+	format := storage.CSVFormat{Comma: delimiter, Comment: comment}
+	var cache *storage.SummaryCache
+	if analysisOpts.Cache && !progOpts.FromStdin() {
+		cache = storage.OpenSummaryCache(
+			path.Join(progOpts.DataPath, a.CacheFilename), a.Name, a.PeakFields, format)
+	}
+	logs, filesRead, parseErrors, err := ReadLogFiles(
+		ctx, a.Name, a.PeakFields, progOpts.DataPaths, progOpts.From, progOpts.To,
+		analysisOpts.Concurrency, commands, analysisOpts.CrossHost, hosts, format, cache)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range parseErrors {
+		progOpts.Log.Warnf("%s", e)
+	}
+	if cache != nil {
+		err = cache.Save()
+		if err != nil {
+			progOpts.Log.Warnf("Could not write the cache: %v", err)
+		}
+	}
+	counts := progOpts.RunCounts(a.Name)
+	counts.Files = filesRead
+	counts.Records = len(logs)
+
+	var coverage util.Coverage
+	for _, job := range logs {
+		coverage.Add(job.FirstSeen, job.LastSeen)
+	}
+	progOpts.Log.Infof("%s: %s", a.Name, coverage.Describe(progOpts.From, progOpts.To))
+
+	// The duration of a job can only be computed once all its records have been consolidated.
+	skewed := 0
+	for _, job := range logs {
+		var ok bool
+		job.Duration, ok = util.JobDuration(job.Start, job.End, job.FirstSeen, job.LastSeen)
+		if !ok {
+			skewed++
+		}
+	}
+	if skewed > 0 {
+		progOpts.Log.Warnf("%d jobs end before they start (clock skew?), their duration is taken to be zero", skewed)
+	}
+
+	ignore, err := analysisOpts.IgnoreList()
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, job := range logs {
+		if ignore.Ignores(job.User, job.Host, job.Id) {
+			delete(logs, k)
+			delete(state, k)
+		}
+	}
+
+	now := progOpts.Clock.Now().UTC()
+
+	// Jobs that have not run for long enough are not added to the state, so that they can become
+	// candidates on a later run, when they have run longer.
+	candidates, tooShort := 0, 0
+	for _, job := range logs {
+		if analysisOpts.IsTooShort(job.Start, job.End) {
+			tooShort++
+			continue
+		}
+		if EnsureJob(state, job.Id, job.Host, analysisOpts.CrossHost,
+			job.Start, firstViolation(now, job.FirstSeen, job.FirstFile), job.LastSeen, job.Duration) {
+			candidates++
+		}
+	}
+	counts.Candidates = candidates
+	progOpts.Log.Infof("%d candidates, %d too short", candidates, tooShort)
+
+	purgeDate := util.MinTime(progOpts.From, progOpts.To.AddDate(0, 0, -2))
+	purged := PurgeJobsBefore(state, purgeDate)
+	counts.Purged = purged
+	progOpts.Log.Infof("%d purged", purged)
+
+	// Jobs that never left their grace period are dropped once they have not been seen since the
+	// purge date, their violations were transient.
+	if analysisOpts.GracePeriod > 0 {
+		expired := RemoveJobs(state, func(j *JobState) bool {
+			return !j.IsReported && j.LastSeen.Before(purgeDate)
+		})
+		progOpts.Log.Infof("%d expired in their grace period", len(expired))
+	}
+
+	if analysisOpts.ReescalateAfter > 0 {
+		isActive := func(k JobKey) bool {
+			_, found := logs[k]
+			return found
+		}
+		reescalated := ReescalateJobs(state, isActive, now.Add(-analysisOpts.ReescalateAfter))
+		progOpts.Log.Infof("%d reescalated", reescalated)
+	}
+
+	if analysisOpts.Seed {
+		seeded := MarkAllReported(state, now)
+		progOpts.Log.Infof("%d seeded", seeded)
+		AddJobs(state, otherJobs)
+		return make([]*util.JobReport, 0), state, nil
+	}
+
+	// Jobs that are in their grace period are set aside so that they are not reported yet.  They are
+	// put back into the state unreported, and are reported by a later run if they are still seen.
+	pendingJobs := RemoveJobs(state, func(j *JobState) bool {
+		return !j.IsReported && analysisOpts.InGracePeriod(j.FirstViolation, j.LastSeen)
+	})
+	progOpts.Log.Infof("%d in their grace period", len(pendingJobs))
+	violations := NewViolations(state, logs, now, analysisOpts.JobMarks, analysisOpts.DryRun)
+	counts.Events = len(violations)
+	AddJobs(state, pendingJobs)
+	AddJobs(state, otherJobs)
+	reports, err := a.Report(violations, now, times, templates)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reports, state, nil
+}
+
+// Return the violations of all jobs in state that have not yet been reported and are in logs, with
+// their views in logs.  Unless dryRun is true the jobs are marked as reported at time `now` in
+// state.  If jobMarks is true then the violations of jobs whose records mark them as started before
+// sonalyze's time window are marked as such.
+//
+// An unreported job that is not in logs, because it was held back by --grace-period on an earlier
+// run whose window is not that of this run, is left pending, to be reported when it is seen again.
+
+func NewViolations(
+	state map[JobKey]*JobState,
+	logs map[JobKey]*LoggedJob,
+	now time.Time,
+	jobMarks bool,
+	dryRun bool,
+) []*Violation {
+	violations := make([]*Violation, 0)
+	for k, jobState := range state {
+		job, found := logs[k]
+		if !jobState.IsReported && found {
+			if !dryRun {
+				jobState.IsReported = true
+				jobState.LastReported = now
+			}
+			violations = append(violations, &Violation{
+				Key:                 k,
+				State:               jobState,
+				Job:                 job,
+				StartedBeforeWindow: jobMarks && job.Mark.StartedBefore(),
+			})
+		}
+	}
+	return violations
+}
+
+// Read and consolidate the log files "<name>.csv" for the time window from the data roots,
+// returning the jobs, the number of files that were read, and descriptions of the rows of the files
+// that were dropped because they can't be parsed (see storage.DescribeParseErrors); the rest of
+// such a file is read.  See storage.EnumerateFilesInRoots for how files that exist under several
+// roots are handled.  Unreadable files are skipped, but if the context is cancelled then reading
+// stops and an error wrapping the context's error is returned.
+//
+// Up to `concurrency` files are read and parsed concurrently, but the records are consolidated in
+// the order of the files, so the result does not depend on the concurrency.
+//
+// A record that has no `now` field is taken to have been logged at the start of the day of the
+// file.
+//
+// The command names are normalized by `commands`, and the raw name of the first record is retained.
+// Records for commands that are excluded by `commands` are skipped.
+// If crossHost is true then a job's records are consolidated across hosts, see JobKey.
+// The host names are normalized by `hosts`, and records for hosts that are not matched by `hosts`
+// are skipped.
+//
+// The files are read in the given format, which is checked before any file is read.
+//
+// The records of each file are first summarized by job, see storage.JobSummary, with the maxima of
+// peakFields.  If cache is not nil then the summaries of files that are unchanged since they were
+// cached are taken from it.
+
+func ReadLogFiles(
+	ctx context.Context,
+	name string,
+	peakFields []string,
+	dataPaths []string,
+	from, to time.Time,
+	concurrency int,
+	commands *util.CommandMap,
+	crossHost bool,
+	hosts *util.HostFilter,
+	format storage.CSVFormat,
+	cache *storage.SummaryCache,
+) (map[JobKey]*LoggedJob, int, []string, error) {
+	if err := format.Validate(); err != nil {
+		return nil, 0, nil, err
+	}
+	filenames, err := storage.EnumerateFilesInRoots(dataPaths, from, to, name+".csv")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	jobs := make(map[JobKey]*LoggedJob)
+	summaries, diags, errs := storage.ReadJobSummaries(
+		ctx, filenames, concurrency, name, peakFields, format, cache)
+	filesRead := 0
+	parseErrors := make([]string, 0)
+	for i, fileJobs := range summaries {
+		if err := errs[i]; err != nil {
+			if ctx.Err() != nil {
+				return nil, 0, nil, err
+			}
+			continue
+		}
+		filesRead++
+		if e := storage.DescribeParseErrors(filenames[i], diags[i]); e != "" {
+			parseErrors = append(parseErrors, e)
+		}
+		// The date is zero for stdin, which is the only file if it is read.
+		fileDate, _ := storage.FileDate(filenames[i])
+
+		for _, s := range fileJobs {
+			host := hosts.Normalize(s.Host)
+			if !hosts.Matches(host) || commands.Excludes(s.Cmd) {
+				continue
+			}
+
+			key := NewJobKey(s.Id, host, crossHost)
+			if r, present := jobs[key]; present {
+				// id and user are fixed, and so is host unless the job is keyed cross-host
+				if crossHost {
+					r.Host = AddHost(r.Host, host)
+				}
+				// FIXME: cmd can change b/c of sonalyze's view on the job.
+				util.WidenSpan(&r.FirstSeen, &r.LastSeen, s.FirstSeen, s.LastSeen)
+				r.FirstFile = util.MinTime(r.FirstFile, fileDate)
+				r.Mark = storage.CombineJobMarks(r.Start, r.End, r.Mark, s.Start, s.End, s.Mark)
+				util.WidenSpan(&r.Start, &r.End, s.Start, s.End)
+				for j := range r.Peaks {
+					r.Peaks[j] = math.Max(r.Peaks[j], s.Peaks[j])
+				}
+			} else {
+				jobs[key] = &LoggedJob{
+					Id:        s.Id,
+					Host:      host,
+					User:      s.User,
+					Cmd:       commands.Normalize(s.Cmd),
+					RawCmd:    s.Cmd,
+					FirstSeen: s.FirstSeen,
+					LastSeen:  s.LastSeen,
+					FirstFile: fileDate,
+					Start:     s.Start,
+					End:       s.End,
+					Mark:      s.Mark,
+					Peaks:     append([]float64(nil), s.Peaks...),
+				}
+			}
+		}
+	}
+
+	return jobs, filesRead, parseErrors, nil
+}
@@ -0,0 +1,124 @@
+// The changes made to the state by a run of an analysis, for --diff.
+
+package jobstate
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"naicreport/util"
+)
+
+// The jobs that were added to the state, the jobs that were removed from it (purged, expired, or
+// ignored), and the jobs that were reported, each sorted by host and job#.  A job is reported if it
+// was not reported before the run and is after it, or if it was reported again (see ReescalateJobs).
+
+type StateDiff struct {
+	Added    []JobKey
+	Removed  []JobKey
+	Reported []JobKey
+}
+
+// Compare the state before a run with the state after it.  Neither is modified.
+
+func DiffJobState(before, after map[JobKey]*JobState) *StateDiff {
+	diff := &StateDiff{Added: make([]JobKey, 0), Removed: make([]JobKey, 0), Reported: make([]JobKey, 0)}
+	for k, a := range after {
+		b, found := before[k]
+		if !found {
+			diff.Added = append(diff.Added, k)
+		}
+		if a.IsReported && (!found || !b.IsReported || !a.LastReported.Equal(b.LastReported)) {
+			diff.Reported = append(diff.Reported, k)
+		}
+	}
+	for k := range before {
+		if _, found := after[k]; !found {
+			diff.Removed = append(diff.Removed, k)
+		}
+	}
+	for _, keys := range [][]JobKey{diff.Added, diff.Removed, diff.Reported} {
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].Host != keys[j].Host {
+				return keys[i].Host < keys[j].Host
+			}
+			return keys[i].Id < keys[j].Id
+		})
+	}
+	return diff
+}
+
+// Format the diff for the analysis, eg "cpuhog", as text or as a JSON object.  The text is a summary
+// line followed by a line listing the jobs of each kind of change there is:
+//
+//   cpuhog: 2 added, 0 removed, 1 reported
+//     added: ml6/1606710 ml8/3514819
+//     reported: ml6/1606710
+//
+// where a job is host/job#, or just job# if it is keyed cross-host.  The JSON object is
+//
+//   {"analysis":"cpuhog","added":[{"id":1606710,"host":"ml6"},...],"removed":[],"reported":[...]}
+//
+// where the host is absent if the job is keyed cross-host.
+
+func (diff *StateDiff) Format(analysis string, asJson bool) (string, error) {
+	if asJson {
+		type jsonKey struct {
+			Id   uint32 `json:"id"`
+			Host string `json:"host,omitempty"`
+		}
+		jsonKeys := func(keys []JobKey) []jsonKey {
+			result := make([]jsonKey, 0, len(keys))
+			for _, k := range keys {
+				result = append(result, jsonKey{k.Id, k.Host})
+			}
+			return result
+		}
+		bytes, err := json.Marshal(struct {
+			Analysis string    `json:"analysis"`
+			Added    []jsonKey `json:"added"`
+			Removed  []jsonKey `json:"removed"`
+			Reported []jsonKey `json:"reported"`
+		}{analysis, jsonKeys(diff.Added), jsonKeys(diff.Removed), jsonKeys(diff.Reported)})
+		if err != nil {
+			return "", err
+		}
+		return string(bytes) + "\n", nil
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "%s: %d added, %d removed, %d reported\n",
+		analysis, len(diff.Added), len(diff.Removed), len(diff.Reported))
+	for _, change := range []struct {
+		name string
+		keys []JobKey
+	}{{"added", diff.Added}, {"removed", diff.Removed}, {"reported", diff.Reported}} {
+		if len(change.keys) == 0 {
+			continue
+		}
+		names := make([]string, 0, len(change.keys))
+		for _, k := range change.keys {
+			name := strconv.FormatUint(uint64(k.Id), 10)
+			if k.Host != "" {
+				name = k.Host + "/" + name
+			}
+			names = append(names, name)
+		}
+		fmt.Fprintf(&out, "  %s: %s\n", change.name, strings.Join(names, " "))
+	}
+	return out.String(), nil
+}
+
+// Write the diff between the states before and after a run of the analysis to the file, formatted
+// as by StateDiff.Format.
+
+func WriteStateDiff(filename, analysis string, before, after map[JobKey]*JobState, asJson bool) error {
+	text, err := DiffJobState(before, after).Format(analysis, asJson)
+	if err != nil {
+		return err
+	}
+	return util.WriteOutput(filename, text)
+}
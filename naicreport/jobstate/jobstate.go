@@ -8,16 +8,33 @@
 package jobstate
 
 import (
-	"os"
+	"errors"
+	"fmt"
+	"io/fs"
 	"path"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"naicreport/storage"
+	"naicreport/util"
 )
 
 // Information about CPU hogs stored in the persistent state.  Other data that are needed for
 // generating the report can be picked up from the log data for the job ID.
+//
+// ViolationCount is the number of analysis runs in which the job was seen, and LastReported is the
+// time the job was last reported (the zero time if it has not been reported).
+//
+// If CrossHost is true then the job is identified by its Id alone, and Host is a comma-separated
+// list of the hosts it has been seen on, see JobKey.
+//
+// Acked is true if an operator has acknowledged the violation (see `naicreport ack`), with an
+// optional Note; an acknowledged job is considered reported and is never reescalated.
+//
+// Duration is the longest time the job has been seen to run, see util.JobDuration.  It is kept to
+// the minute in the state file.
 
 type JobState struct {
 	Id                uint32
@@ -26,18 +43,55 @@ type JobState struct {
 	FirstViolation    time.Time
 	LastSeen          time.Time
 	IsReported        bool
+	ViolationCount    int
+	LastReported      time.Time
+	CrossHost         bool
+	Acked             bool
+	Note              string
+	Duration          time.Duration
 }
 
 // On the ML nodes, (job#, host) identifies a job uniquely because job#s are not coordinated across
-// hosts and no job is cross-host.
+// hosts and no job is cross-host.  On the Slurm clusters, job#s are cluster-wide and a job can run
+// on several hosts, so the job# alone identifies the job; the key of such a cross-host job has an
+// empty Host.
 
 type JobKey struct {
 	Id   uint32
 	Host string
 }
 
+// Return the key for the job, which depends on whether jobs are keyed cross-host.
+
+func NewJobKey(id uint32, host string, crossHost bool) JobKey {
+	if crossHost {
+		return JobKey{Id: id}
+	}
+	return JobKey{Id: id, Host: host}
+}
+
+// Add a host to a comma-separated list of hosts if it is not already in it, and return the new
+// list, which is sorted.
+
+func AddHost(hosts, host string) string {
+	if hosts == "" {
+		return host
+	}
+	names := strings.Split(hosts, ",")
+	for _, name := range names {
+		if name == host {
+			return hosts
+		}
+	}
+	names = append(names, host)
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
 // Read the job state from disk and return a parsed and error-checked data structure.  Bogus records
-// are silently dropped.
+// are silently dropped.  The fields violationCount, lastReported, crossHost, acked, note, and
+// durationMinutes were added later and are optional, defaulting to zero values.  Each job is keyed as it
+// was when it was written.
 //
 // If this returns an error, it is the error returned from storage.ReadFreeCSV, see that for more
 // information.  No new errors are generated here.
@@ -61,7 +115,16 @@ func ReadJobState(dataPath, filename string) (map[JobKey]*JobState, error) {
 			// Bogus record
 			continue
 		}
-		key := JobKey{id, host}
+		violationCount := int(storage.GetUint32Default(repr, "violationCount", 0, &success))
+		lastReported := storage.GetRFC3339Default(repr, "lastReported", time.Time{}, &success)
+		crossHost := storage.GetBoolDefault(repr, "crossHost", false, &success)
+		acked := storage.GetBoolDefault(repr, "acked", false, &success)
+		note := storage.GetStringDefault(repr, "note", "")
+		duration := time.Duration(storage.GetUint32Default(repr, "durationMinutes", 0, &success)) * time.Minute
+		if !success {
+			continue
+		}
+		key := NewJobKey(id, host, crossHost)
 		state[key] = &JobState{
 			Id: id,
 			Host: host,
@@ -69,29 +132,93 @@ func ReadJobState(dataPath, filename string) (map[JobKey]*JobState, error) {
 			FirstViolation: firstViolation,
 			LastSeen: lastSeen,
 			IsReported: isReported,
+			ViolationCount: violationCount,
+			LastReported: lastReported,
+			CrossHost: crossHost,
+			Acked: acked,
+			Note: note,
+			Duration: duration,
 		}
 	}
 	return state, nil
 }
 
+// As ReadJobState, but if the state file does not exist then return an empty state.  Any other error
+// (eg, the file can't be read because of its permissions, or it can't be parsed) is propagated, as
+// silently resetting the state would lead to redundant reports.  The data path util.StdinDataPath
+// has no state, so the state is empty.
+
 func ReadJobStateOrEmpty(dataPath, filename string) (map[JobKey]*JobState, error) {
+	if dataPath == util.StdinDataPath {
+		return make(map[JobKey]*JobState), nil
+	}
 	state, err := ReadJobState(dataPath, filename)
 	if err == nil {
 		return state, nil
 	}
-	_, isPathErr := err.(*os.PathError)
-	if isPathErr {
+	if errors.Is(err, fs.ErrNotExist) {
 		return make(map[JobKey]*JobState), nil
 	}
 	return nil, err
 }
 
-// If state does not have the job then add it.  In either case set its LastSeen field to lastSeen.
-// Return true if added, false if not.
+// As ReadJobStateOrEmpty, but if the state file is missing or can't be read or parsed then the
+// state is read from its most recent backup that can be read, see storage.RotateBackups, so that a
+// lost or damaged state file does not make every violation be reported again.  Which file was used
+// is logged.  If there is no state file and no backup then the state is empty, and if neither the
+// state file nor any backup can be read then the error is that for the state file.
+
+func ReadJobStateWithRecovery(dataPath, filename string, log *util.Logger) (map[JobKey]*JobState, error) {
+	if dataPath == util.StdinDataPath {
+		return make(map[JobKey]*JobState), nil
+	}
+	state, err := ReadJobState(dataPath, filename)
+	if err == nil {
+		log.Infof("Read the state from %s", filename)
+		return state, nil
+	}
+	stateErr := err
+	for n := 1; ; n++ {
+		backup := fmt.Sprintf("%s.%d", filename, n)
+		state, err := ReadJobState(dataPath, backup)
+		if err == nil {
+			log.Warnf("Could not read the state from %s (%v), read it from the backup %s", filename, stateErr, backup)
+			return state, nil
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		log.Warnf("Could not read the state from the backup %s: %v", backup, err)
+	}
+	if errors.Is(stateErr, fs.ErrNotExist) {
+		log.Infof("No state in %s or its backups, the state is empty", filename)
+		return make(map[JobKey]*JobState), nil
+	}
+	return nil, stateErr
+}
+
+// Read the state as the analyses do: with ReadJobStateWithRecovery if `recover` is true (see
+// --recover-state), otherwise with ReadJobStateOrEmpty.
+
+func ReadJobStateForAnalysis(
+	dataPath, filename string,
+	recover bool,
+	log *util.Logger,
+) (map[JobKey]*JobState, error) {
+	if recover {
+		return ReadJobStateWithRecovery(dataPath, filename, log)
+	}
+	return ReadJobStateOrEmpty(dataPath, filename)
+}
+
+// If state does not have the job then add it, keyed according to crossHost.  In either case set its
+// LastSeen field to lastSeen, increment its ViolationCount, and widen its Duration to duration, and
+// for a cross-host job add the host (which may itself be a list) to its hosts.  Return true if added,
+// false if not.
 
-func EnsureJob(state map[JobKey]*JobState, id uint32, host string,
-	started, firstViolation, lastSeen time.Time) bool {
-	k := JobKey{Id: id, Host: host}
+func EnsureJob(state map[JobKey]*JobState, id uint32, host string, crossHost bool,
+	started, firstViolation, lastSeen time.Time, duration time.Duration) bool {
+	k := NewJobKey(id, host, crossHost)
 	v, found := state[k]
 	if !found {
 		state[k] = &JobState {
@@ -101,13 +228,48 @@ func EnsureJob(state map[JobKey]*JobState, id uint32, host string,
 				FirstViolation: firstViolation,
 				LastSeen: lastSeen,
 				IsReported: false,
+				ViolationCount: 1,
+				CrossHost: crossHost,
+				Duration: duration,
 			};
 		return true
 	}
+	if crossHost {
+		for _, h := range strings.Split(host, ",") {
+			v.Host = AddHost(v.Host, h)
+		}
+	}
 	v.LastSeen = lastSeen
+	v.ViolationCount++
+	if duration > v.Duration {
+		v.Duration = duration
+	}
 	return false
 }
 
+// Remove the jobs for which `remove` returns true from the state and return them.
+
+func RemoveJobs(state map[JobKey]*JobState, remove func(*JobState) bool) map[JobKey]*JobState {
+	removed := make(map[JobKey]*JobState)
+	for k, jobState := range state {
+		if remove(jobState) {
+			removed[k] = jobState
+		}
+	}
+	for k := range removed {
+		delete(state, k)
+	}
+	return removed
+}
+
+// Add the jobs to the state, replacing any jobs with the same keys.
+
+func AddJobs(state map[JobKey]*JobState, jobs map[JobKey]*JobState) {
+	for k, jobState := range jobs {
+		state[k] = jobState
+	}
+}
+
 // Purge already-reported jobs from the state if they haven't been seen since before the given
 // date, this is to reduce the risk of being confused by jobs whose IDs are reused.
 
@@ -126,13 +288,51 @@ func PurgeJobsBefore(state map[JobKey]*JobState, purgeDate time.Time) int {
 	return deleted
 }
 
+// Clear IsReported for reported jobs that are still active (as determined by isActive) and that
+// were last reported before the cutoff, so that they will be reported again.  Jobs for which the
+// time of the last report is unknown, and acknowledged jobs, are left alone.  Returns the number of
+// jobs affected.
+
+func ReescalateJobs(state map[JobKey]*JobState, isActive func(JobKey) bool, cutoff time.Time) int {
+	reescalated := 0
+	for k, jobState := range state {
+		if jobState.IsReported && !jobState.Acked && !jobState.LastReported.IsZero() &&
+			jobState.LastReported.Before(cutoff) && isActive(k) {
+			jobState.IsReported = false
+			reescalated++
+		}
+	}
+	return reescalated
+}
+
+// Mark all jobs in the state as reported at time `now`, without reporting them.  This is used to
+// seed the state so that old violations are not suddenly reported; the jobs that are still active
+// are reescalated as if they had been reported, see ReescalateJobs.  Returns the number of jobs
+// that were marked.
+
+func MarkAllReported(state map[JobKey]*JobState, now time.Time) int {
+	marked := 0
+	for _, jobState := range state {
+		if !jobState.IsReported {
+			jobState.IsReported = true
+			jobState.LastReported = now
+			marked++
+		}
+	}
+	return marked
+}
+
+// Write the job state to disk, after rotating the `backups` most recent generations of the state
+// file, see storage.RotateBackups.  Nothing is written for the data path util.StdinDataPath.
+//
 // TODO: It's possible this should sort the output by increasing ID (host then job ID).  This
 // basically amounts to creating an array of job IDs, sorting that, and then walking it and looking
 // up data by ID when writing.  This is nice because it means that files can be diffed.
-//
-// TODO: It's possible this should rename the existing state file as a .bak file.
 
-func WriteJobState(dataPath, filename string, data map[JobKey]*JobState) error {
+func WriteJobState(dataPath, filename string, data map[JobKey]*JobState, backups int) error {
+	if dataPath == util.StdinDataPath {
+		return nil
+	}
 	output_records := make([]map[string]string, 0)
 	for _, r := range data {
 		m := make(map[string]string)
@@ -142,11 +342,32 @@ func WriteJobState(dataPath, filename string, data map[JobKey]*JobState) error {
 		m["firstViolation"] = r.FirstViolation.Format(time.RFC3339)
 		m["lastSeen"] = r.LastSeen.Format(time.RFC3339)
 		m["isReported"] = strconv.FormatBool(r.IsReported)
+		m["violationCount"] = strconv.Itoa(r.ViolationCount)
+		if !r.LastReported.IsZero() {
+			m["lastReported"] = r.LastReported.Format(time.RFC3339)
+		}
+		if r.CrossHost {
+			m["crossHost"] = "true"
+		}
+		if r.Acked {
+			m["acked"] = "true"
+		}
+		if r.Note != "" {
+			m["note"] = r.Note
+		}
+		if r.Duration > 0 {
+			m["durationMinutes"] = strconv.FormatInt(int64(r.Duration/time.Minute), 10)
+		}
 		output_records = append(output_records, m)
 	}
-	fields := []string{"id", "host", "startedOnOrBefore", "firstViolation", "lastSeen", "isReported"}
+	fields := []string{"id", "host", "startedOnOrBefore", "firstViolation", "lastSeen", "isReported",
+		"violationCount", "lastReported", "crossHost", "acked", "note", "durationMinutes"}
 	stateFilename := path.Join(dataPath, filename)
-	err := storage.WriteFreeCSV(stateFilename, fields, output_records)
+	err := storage.RotateBackups(stateFilename, backups)
+	if err != nil {
+		return err
+	}
+	err = storage.WriteFreeCSV(stateFilename, fields, output_records)
 	if err != nil {
 		return err
 	}
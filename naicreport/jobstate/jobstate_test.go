@@ -1,9 +1,11 @@
 package jobstate
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"path"
+	"strings"
 	"testing"
 	"time"
 )
@@ -17,6 +19,8 @@ func TestWriteState(t *testing.T) {
 		FirstViolation:    time.Date(2023, 6, 15, 10, 20, 30, 0, time.UTC),
 		LastSeen:          time.Date(2023, 9, 11, 15, 37, 0, 0, time.UTC),
 		IsReported:        false,
+		ViolationCount:    3,
+		LastReported:      time.Date(2023, 9, 10, 8, 0, 0, 0, time.UTC),
 	}
 	s[JobKey{Id: s1.Id, Host: s1.Host}] = s1
 
@@ -24,7 +28,7 @@ func TestWriteState(t *testing.T) {
 	if err != nil {
 		t.Fatalf("MkdirTemp failed %q", err)
 	}
-	err = WriteJobState(td_name, "jobstate.csv", s)
+	err = WriteJobState(td_name, "jobstate.csv", s, 0)
 	if err != nil {
 		t.Fatalf("Could not write: %q", err)
 	}
@@ -39,7 +43,7 @@ func TestWriteState(t *testing.T) {
 	if err != nil {
 		t.Fatalf("ReadAll failed %q", err)
 	}
-	expect := "id=10,host=hello,startedOnOrBefore=2023-06-14T16:00:00Z,firstViolation=2023-06-15T10:20:30Z,lastSeen=2023-09-11T15:37:00Z,isReported=false\n"
+	expect := "id=10,host=hello,startedOnOrBefore=2023-06-14T16:00:00Z,firstViolation=2023-06-15T10:20:30Z,lastSeen=2023-09-11T15:37:00Z,isReported=false,violationCount=3,lastReported=2023-09-10T08:00:00Z\n"
 	if string(all) != expect {
 		t.Fatalf("File contents wrong %q", all)
 	}
@@ -60,8 +64,319 @@ func TestWriteState(t *testing.T) {
 		}
 		if v.Id != s1.Id || v.Host != s1.Host || !v.StartedOnOrBefore.Equal(s1.StartedOnOrBefore) ||
 			!v.FirstViolation.Equal(s1.FirstViolation) || !v.LastSeen.Equal(s1.LastSeen) ||
-			v.IsReported != s1.IsReported {
+			v.IsReported != s1.IsReported || v.ViolationCount != s1.ViolationCount ||
+			!v.LastReported.Equal(s1.LastReported) {
 			t.Fatalf("Bad contents")
 		}
 	}
 }
+
+func TestWriteStateAcked(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	s := map[JobKey]*JobState{
+		JobKey{10, "a"}: &JobState{Id: 10, Host: "a", IsReported: true, Acked: true, Note: "emailed user, twice"},
+		JobKey{11, "a"}: &JobState{Id: 11, Host: "a", IsReported: true},
+	}
+	err = WriteJobState(td_name, "jobstate.csv", s, 0)
+	if err != nil {
+		t.Fatalf("Could not write: %q", err)
+	}
+	newState, err := ReadJobState(td_name, "jobstate.csv")
+	if err != nil {
+		t.Fatalf("ReadJobState failed %q", err)
+	}
+	v10, v11 := newState[JobKey{10, "a"}], newState[JobKey{11, "a"}]
+	if v10 == nil || !v10.Acked || v10.Note != "emailed user, twice" || v11 == nil || v11.Acked ||
+		v11.Note != "" {
+		t.Fatalf("Bad contents %v %v", v10, v11)
+	}
+}
+
+func TestReadOldState(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	old := "id=10,host=hello,startedOnOrBefore=2023-06-14T16:00:00Z,firstViolation=2023-06-15T10:20:30Z,lastSeen=2023-09-11T15:37:00Z,isReported=true\n"
+	err = os.WriteFile(path.Join(td_name, "jobstate.csv"), []byte(old), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	state, err := ReadJobState(td_name, "jobstate.csv")
+	if err != nil {
+		t.Fatalf("ReadJobState failed %q", err)
+	}
+	v, found := state[JobKey{Id: 10, Host: "hello"}]
+	if !found || !v.IsReported || v.ViolationCount != 0 || !v.LastReported.IsZero() || v.Acked ||
+		v.Note != "" {
+		t.Fatalf("Bad contents")
+	}
+}
+
+func TestReescalateJobs(t *testing.T) {
+	now := time.Date(2023, 9, 11, 12, 0, 0, 0, time.UTC)
+	s := map[JobKey]*JobState{
+		JobKey{1, "a"}: &JobState{Id: 1, Host: "a", IsReported: true, LastReported: now.AddDate(0, 0, -5)},
+		JobKey{2, "a"}: &JobState{Id: 2, Host: "a", IsReported: true, LastReported: now.AddDate(0, 0, -1)},
+		JobKey{3, "a"}: &JobState{Id: 3, Host: "a", IsReported: true, LastReported: now.AddDate(0, 0, -5)},
+		JobKey{4, "a"}: &JobState{Id: 4, Host: "a", IsReported: true},
+		JobKey{5, "a"}: &JobState{Id: 5, Host: "a", IsReported: true, LastReported: now.AddDate(0, 0, -5),
+			Acked: true},
+	}
+	isActive := func(k JobKey) bool {
+		return k.Id != 3
+	}
+	n := ReescalateJobs(s, isActive, now.AddDate(0, 0, -3))
+	if n != 1 || s[JobKey{1, "a"}].IsReported || !s[JobKey{2, "a"}].IsReported ||
+		!s[JobKey{3, "a"}].IsReported || !s[JobKey{4, "a"}].IsReported || !s[JobKey{5, "a"}].IsReported {
+		t.Fatalf("Bad reescalation")
+	}
+}
+
+func TestReadJobStateOrEmpty(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+
+	// Missing file is empty state
+	state, err := ReadJobStateOrEmpty(td_name, "jobstate.csv")
+	if err != nil || len(state) != 0 {
+		t.Fatalf("Failed on missing file: %v", err)
+	}
+
+	// Garbled file is an error
+	err = os.WriteFile(path.Join(td_name, "jobstate.csv"), []byte("id=10,\"host=hello\n"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	_, err = ReadJobStateOrEmpty(td_name, "jobstate.csv")
+	if err == nil {
+		t.Fatalf("Garbled file was accepted")
+	}
+
+	// A directory where the file should be is an error
+	_, err = ReadJobStateOrEmpty(path.Dir(td_name), path.Base(td_name))
+	if err == nil {
+		t.Fatalf("Directory was accepted")
+	}
+}
+
+func TestCrossHost(t *testing.T) {
+	t0 := time.Date(2023, 9, 11, 12, 0, 0, 0, time.UTC)
+	s := make(map[JobKey]*JobState)
+	if !EnsureJob(s, 10, "c1", true, t0, t0, t0, 0) || EnsureJob(s, 10, "b1,c1", true, t0, t0, t0, 0) {
+		t.Fatalf("Bad EnsureJob")
+	}
+	if !EnsureJob(s, 10, "c1", false, t0, t0, t0, 0) || len(s) != 2 {
+		t.Fatalf("Bad keying")
+	}
+	v := s[JobKey{Id: 10}]
+	if v.Host != "b1,c1" || v.ViolationCount != 2 || !v.CrossHost {
+		t.Fatalf("Bad cross-host job %v", v)
+	}
+
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	err = WriteJobState(td_name, "jobstate.csv", s, 0)
+	if err != nil {
+		t.Fatalf("Could not write: %q", err)
+	}
+	newState, err := ReadJobState(td_name, "jobstate.csv")
+	if err != nil {
+		t.Fatalf("ReadJobState failed %q", err)
+	}
+	v, found := newState[JobKey{Id: 10}]
+	if len(newState) != 2 || !found || v.Host != "b1,c1" || !v.CrossHost {
+		t.Fatalf("Bad contents")
+	}
+	v, found = newState[JobKey{Id: 10, Host: "c1"}]
+	if !found || v.CrossHost {
+		t.Fatalf("Bad contents")
+	}
+}
+
+func TestAddHost(t *testing.T) {
+	if AddHost("", "c1") != "c1" || AddHost("c1", "c1") != "c1" || AddHost("c1,c3", "c2") != "c1,c2,c3" {
+		t.Fatalf("Bad AddHost")
+	}
+}
+
+func TestRemoveJobs(t *testing.T) {
+	s := map[JobKey]*JobState{
+		JobKey{1, "a"}: &JobState{Id: 1, Host: "a"},
+		JobKey{2, "b"}: &JobState{Id: 2, Host: "b"},
+	}
+	removed := RemoveJobs(s, func(j *JobState) bool { return j.Host == "b" })
+	if len(s) != 1 || s[JobKey{1, "a"}] == nil || len(removed) != 1 || removed[JobKey{2, "b"}] == nil {
+		t.Fatalf("Bad RemoveJobs")
+	}
+	AddJobs(s, removed)
+	if len(s) != 2 || s[JobKey{2, "b"}] == nil {
+		t.Fatalf("Bad AddJobs")
+	}
+}
+
+func TestReadJobStateWithRecovery(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	write := func(filename, contents string) {
+		err := os.WriteFile(path.Join(td_name, filename), []byte(contents), 0644)
+		if err != nil {
+			t.Fatalf("WriteFile failed %q", err)
+		}
+	}
+	good := func(id int) string {
+		return fmt.Sprintf("id=%d,host=a,startedOnOrBefore=2023-06-14T16:00:00Z,"+
+			"firstViolation=2023-06-15T10:20:30Z,lastSeen=2023-09-11T15:37:00Z,isReported=true\n", id)
+	}
+	garbled := "id=10,\"host=hello\n"
+	has := func(state map[JobKey]*JobState, id uint32) bool {
+		_, found := state[JobKey{Id: id, Host: "a"}]
+		return len(state) == 1 && found
+	}
+
+	// No state and no backups is empty state
+	state, err := ReadJobStateWithRecovery(td_name, "jobstate.csv", nil)
+	if err != nil || len(state) != 0 {
+		t.Fatalf("Failed on missing file: %v", err)
+	}
+
+	// A missing or garbled state file is recovered from the most recent good backup
+	write("jobstate.csv.1", good(1))
+	state, err = ReadJobStateWithRecovery(td_name, "jobstate.csv", nil)
+	if err != nil || !has(state, 1) {
+		t.Fatalf("Not recovered from missing file: %v", err)
+	}
+	write("jobstate.csv", garbled)
+	write("jobstate.csv.1", garbled)
+	write("jobstate.csv.2", good(2))
+	state, err = ReadJobStateWithRecovery(td_name, "jobstate.csv", nil)
+	if err != nil || !has(state, 2) {
+		t.Fatalf("Not recovered from garbled file: %v", err)
+	}
+
+	// A good state file is used as is
+	write("jobstate.csv", good(3))
+	state, err = ReadJobStateWithRecovery(td_name, "jobstate.csv", nil)
+	if err != nil || !has(state, 3) {
+		t.Fatalf("State file not used: %v", err)
+	}
+
+	// If nothing can be read then the error is reported
+	write("jobstate.csv", garbled)
+	write("jobstate.csv.2", garbled)
+	_, err = ReadJobStateWithRecovery(td_name, "jobstate.csv", nil)
+	if err == nil {
+		t.Fatalf("Garbled files were accepted")
+	}
+}
+
+func TestDuration(t *testing.T) {
+	t0 := time.Date(2023, 9, 11, 12, 0, 0, 0, time.UTC)
+	s := make(map[JobKey]*JobState)
+	EnsureJob(s, 10, "a", false, t0, t0, t0, 3*time.Hour)
+	EnsureJob(s, 10, "a", false, t0, t0, t0, 2*time.Hour)
+	EnsureJob(s, 11, "a", false, t0, t0, t0, 0)
+	if s[JobKey{Id: 10, Host: "a"}].Duration != 3*time.Hour {
+		t.Fatalf("Bad duration %v", s[JobKey{Id: 10, Host: "a"}].Duration)
+	}
+	s[JobKey{Id: 10, Host: "a"}].Duration = 51*time.Hour + 5*time.Minute
+	s[JobKey{Id: 11, Host: "a"}].Duration = 20 * time.Minute
+
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	err = WriteJobState(td_name, "jobstate.csv", s, 0)
+	if err != nil {
+		t.Fatalf("Could not write: %q", err)
+	}
+	newState, err := ReadJobState(td_name, "jobstate.csv")
+	if err != nil {
+		t.Fatalf("ReadJobState failed %q", err)
+	}
+	if len(newState) != 2 || newState[JobKey{Id: 10, Host: "a"}].Duration != 51*time.Hour+5*time.Minute ||
+		newState[JobKey{Id: 11, Host: "a"}].Duration != 20*time.Minute {
+		t.Fatalf("Bad contents")
+	}
+	contents, err := os.ReadFile(path.Join(td_name, "jobstate.csv"))
+	if err != nil || !strings.Contains(string(contents), "durationMinutes=3065") {
+		t.Fatalf("Bad state file %q %v", contents, err)
+	}
+}
+
+func TestDiffJobState(t *testing.T) {
+	now := time.Date(2023, 9, 11, 12, 0, 0, 0, time.UTC)
+	before := map[JobKey]*JobState{
+		JobKey{1, "b"}: &JobState{Id: 1, Host: "b"},
+		JobKey{2, "a"}: &JobState{Id: 2, Host: "a", IsReported: true, LastReported: now.AddDate(0, 0, -5)},
+		JobKey{3, "a"}: &JobState{Id: 3, Host: "a", IsReported: true, LastReported: now.AddDate(0, 0, -5)},
+		JobKey{4, "a"}: &JobState{Id: 4, Host: "a"},
+	}
+	after := map[JobKey]*JobState{
+		// Reported this run
+		JobKey{1, "b"}: &JobState{Id: 1, Host: "b", IsReported: true, LastReported: now},
+		// Reported again after reescalation
+		JobKey{2, "a"}: &JobState{Id: 2, Host: "a", IsReported: true, LastReported: now},
+		// Unchanged
+		JobKey{3, "a"}: &JobState{Id: 3, Host: "a", IsReported: true, LastReported: now.AddDate(0, 0, -5)},
+		// New and reported, cross-host
+		JobKey{Id: 5}: &JobState{Id: 5, Host: "a,b", IsReported: true, LastReported: now, CrossHost: true},
+		// New and not reported
+		JobKey{6, "a"}: &JobState{Id: 6, Host: "a"},
+	}
+	diff := DiffJobState(before, after)
+	text, err := diff.Format("cpuhog", false)
+	if err != nil {
+		t.Fatalf("Format failed %v", err)
+	}
+	expect := "cpuhog: 2 added, 1 removed, 3 reported\n" +
+		"  added: 5 a/6\n" +
+		"  removed: a/4\n" +
+		"  reported: 5 a/2 b/1\n"
+	if text != expect {
+		t.Fatalf("Bad text diff %q", text)
+	}
+	text, err = diff.Format("cpuhog", true)
+	if err != nil {
+		t.Fatalf("Format failed %v", err)
+	}
+	expect = `{"analysis":"cpuhog","added":[{"id":5},{"id":6,"host":"a"}],"removed":[{"id":4,"host":"a"}],` +
+		`"reported":[{"id":5},{"id":2,"host":"a"},{"id":1,"host":"b"}]}` + "\n"
+	if text != expect {
+		t.Fatalf("Bad JSON diff %s", text)
+	}
+
+	text, err = DiffJobState(before, before).Format("cpuhog", false)
+	if err != nil || text != "cpuhog: 0 added, 0 removed, 0 reported\n" {
+		t.Fatalf("Bad empty diff %q %v", text, err)
+	}
+}
+
+func TestNewViolations(t *testing.T) {
+	now := time.Date(2023, 9, 12, 0, 0, 0, 0, time.UTC)
+	seen := JobKey{Id: 10, Host: "ml6"}
+	unseen := JobKey{Id: 11, Host: "ml6"}
+	state := map[JobKey]*JobState{
+		seen:   &JobState{Id: 10, Host: "ml6"},
+		unseen: &JobState{Id: 11, Host: "ml6"},
+	}
+	logs := map[JobKey]*LoggedJob{seen: &LoggedJob{Id: 10, Host: "ml6"}}
+
+	// A job that is not in the logs is left pending
+	violations := NewViolations(state, logs, now, false, false)
+	if len(violations) != 1 || violations[0].Key != seen || violations[0].Job != logs[seen] {
+		t.Fatalf("Bad violations %v", violations)
+	}
+	if !state[seen].IsReported || !state[seen].LastReported.Equal(now) || state[unseen].IsReported {
+		t.Fatalf("Bad state %v %v", state[seen], state[unseen])
+	}
+}
@@ -0,0 +1,52 @@
+// Print a JSON Schema for the events of an analysis as they are written with --json (as array
+// elements) and --jsonl, generated from the analysis's event struct, so that it is always in sync
+// with the output.  See util.EventSchema.
+
+package jsonschema
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"naicreport/mlcpuhog"
+	"naicreport/mldeadweight"
+	"naicreport/mlgpuhog"
+	"naicreport/mlmemhog"
+	"naicreport/util"
+)
+
+var events = map[string]func() any{
+	"cpuhog":     mlcpuhog.NewEvent,
+	"deadweight": mldeadweight.NewEvent,
+	"gpuhog":     mlgpuhog.NewEvent,
+	"memhog":     mlmemhog.NewEvent,
+}
+
+func JsonSchema(progname string, args []string) error {
+	container := flag.NewFlagSet(progname+" json-schema", flag.ExitOnError)
+	signalPtr := container.String("signal", "",
+		"The analysis whose events to describe: cpuhog, deadweight, gpuhog, or memhog (required)")
+	outputFilePtr := container.String("output-file", "", "Write the schema to this file (default stdout)")
+	err := container.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	schema, err := signalSchema(*signalPtr)
+	if err != nil {
+		return err
+	}
+	return util.WriteOutput(*outputFilePtr, string(schema)+"\n")
+}
+
+func signalSchema(signal string) ([]byte, error) {
+	if signal == "" {
+		return nil, errors.New("-signal requires a value")
+	}
+	newEvent, found := events[signal]
+	if !found {
+		return nil, fmt.Errorf("Unknown signal %s, must be cpuhog, deadweight, gpuhog, or memhog", signal)
+	}
+	return util.EventSchema("naicreport "+signal+" event", newEvent())
+}
@@ -0,0 +1,55 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSignalSchema(t *testing.T) {
+	for signal, newEvent := range events {
+		bytes, err := signalSchema(signal)
+		if err != nil {
+			t.Fatalf("signalSchema failed for %s: %v", signal, err)
+		}
+		var schema struct {
+			Properties map[string]any `json:"properties"`
+			Required   []string       `json:"required"`
+		}
+		err = json.Unmarshal(bytes, &schema)
+		if err != nil {
+			t.Fatalf("Bad schema for %s: %v", signal, err)
+		}
+
+		// The fields of the events as marshaled are properties, and the required properties are
+		// always marshaled
+		bytes, err = json.Marshal(newEvent())
+		if err != nil {
+			t.Fatalf("Marshal failed %v", err)
+		}
+		var event map[string]any
+		err = json.Unmarshal(bytes, &event)
+		if err != nil {
+			t.Fatalf("Unmarshal failed %v", err)
+		}
+		for name := range event {
+			if _, found := schema.Properties[name]; !found {
+				t.Fatalf("No property %s for %s", name, signal)
+			}
+		}
+		if len(schema.Required) == 0 || schema.Required[0] != "hostname" {
+			t.Fatalf("Bad required fields for %s: %v", signal, schema.Required)
+		}
+		for _, name := range schema.Required {
+			if _, found := event[name]; !found {
+				t.Fatalf("Required property %s is omitted for %s", name, signal)
+			}
+		}
+	}
+
+	if _, err := signalSchema("nosuchhog"); err == nil {
+		t.Fatalf("Unknown signal accepted")
+	}
+	if _, err := signalSchema(""); err == nil {
+		t.Fatalf("Empty signal accepted")
+	}
+}
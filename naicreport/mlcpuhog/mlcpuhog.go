@@ -21,256 +21,254 @@
 //       Job#: n
 //       User: username
 //       Command: command name
-//       Violation first detected: <date>  // this is the timestamp of the earliest record
+//       Violation first detected: <date>  // by default the time of the run, see below
 //       Started on or before: <date>      // this is the start-time in the earliest record
 //       Observed data:
-//          CPU peak = n cores
+//          CPU peak = n cores                // "n of m cores" if the host's config is known
 //          CPU utilization avg/peak = n%, m%
 //          Memory utilization avg/peak = n%, m%
+//
+// The `cpu-peak` field in the log is in the unit used by sonalyze, a percentage where 100
+// corresponds to one full core; thus on a system with 64 cores the value can reach 6400.  The
+// reported "CPU peak" is a number of cores, obtained by dividing the logged value by the value of
+// the --cpu-peak-scale option, which defaults to 100.  Should the log format change to log cores
+// directly, set --cpu-peak-scale=1.
+//
+// The time the violation was first detected is selected by --first-violation-source: with `run`,
+// the default, it is the time of the run that first found the job in violation, with `record` the
+// timestamp of the job's earliest record in the time window, and with `file` the date of the
+// earliest log file with a record for the job.
 
 package mlcpuhog
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
+	_ "embed"
+	"errors"
 	"math"
-	"os"
-	"path"
+	"text/template"
 	"time"
 
 	"naicreport/jobstate"
-	"naicreport/storage"
 	"naicreport/util"
 )
 
+// The default templates of the text reports, see util/reporttemplate.go.
+
+//go:embed report.tmpl
+var reportTemplates string
+
 const (
-	cpuhogFilename = "cpuhog-state.csv"
+	// The default divisor for converting the logged cpu-peak value to cores, see above.  Exported
+	// for the benefit of `digest`.
+	DefaultCpuPeakScale = 100
+
+	// The name of the state file in the data directory, exported for the benefit of `reset`.
+	CpuhogStateFilename = "cpuhog-state.csv"
+
+	// The name of the cache of summaries of the log files in the data directory, see --cache.
+	CpuhogCacheFilename = "cpuhog-cache.gob"
 )
 
-// The cpuhogState represents the view of a job across all the records read from the logs.  Here, too,
-// (job#, host) identifies the job uniquely.
+// The fields whose maxima are taken across a job's records, in the order of the Peaks of the job
+// summaries, see storage.JobSummary.
 
-type cpuhogState struct {
-	id        uint32        // synthesized job id
-	host      string        // a single host name, since ml nodes
-	user      string        // user's login name
-	cmd       string        // ???
-	duration  time.Duration // ???
-	firstSeen time.Time     // timestamp of record in which job is first seen
-	lastSeen  time.Time     // ditto the record in which the job is last seen
-	start     time.Time     // the start field of the first record for the job
-	end       time.Time     // the end field of the last record for the job
-	cpuPeak   float64       // this and the following are the Max across all
-	gpuPeak   float64       //   records seen for the job, this is necessary
-	rcpuAvg   float64       //     as sonalyze will have a limited window in which
-	rcpuPeak  float64       //       to gather statistics and its view will change
-	rmemAvg   float64       //         over time
-	rmemPeak  float64       //
-}
+var cpuhogPeakFields = []string{"cpu-peak", "gpu-peak", "rcpu-avg", "rcpu-peak", "rmem-avg", "rmem-peak"}
+
+// The indices of the fields in the Peaks of a jobstate.LoggedJob.
+
+const (
+	cpuPeakIx = iota
+	gpuPeakIx
+	rcpuAvgIx
+	rcpuPeakIx
+	rmemAvgIx
+	rmemPeakIx
+)
 
 func MlCpuhog(progname string, args []string) error {
-	progOpts := util.NewStandardOptions(progname + "ml-cpuhog")
-	jsonOutput := progOpts.Container.Bool("json", false, "Format output as JSON")
+	progOpts := util.NewStandardOptions(progname + " ml-cpuhog")
+	analysisOpts := util.NewAnalysisOptions(progOpts)
+	cpuPeakScale := progOpts.Container.Float64("cpu-peak-scale", DefaultCpuPeakScale,
+		"Divisor converting the logged cpu-peak value to cores")
 	err := progOpts.Parse(args)
 	if err != nil {
 		return err
 	}
+	if *cpuPeakScale <= 0 {
+		return errors.New("The value of --cpu-peak-scale must be positive")
+	}
 
-	hogState, err := jobstate.ReadJobStateOrEmpty(progOpts.DataPath, cpuhogFilename)
+	events := 0
+	err = Run(context.Background(), progOpts, analysisOpts, *cpuPeakScale, func(reports []*util.JobReport) error {
+		events = len(reports)
+		return util.OutputReports(progOpts, analysisOpts, reports, NewEvent())
+	})
 	if err != nil {
 		return err
 	}
-
-	logs, err := readLogFiles(progOpts.DataPath, progOpts.From, progOpts.To)
+	err = progOpts.WriteRunManifest()
 	if err != nil {
 		return err
 	}
+	return analysisOpts.EventsResult(events)
+}
 
-	now := time.Now().UTC()
+// Run the cpuhog analysis as the ml-cpuhog verb does once its options have been parsed, but pass
+// the reports for the new violations to `emit` instead of writing them, see jobstate.RunAnalysis.
+// This is the entry point for running the analysis from another program, see
+// util.NewEmbeddedOptions.
 
-	candidates := 0
-	for _, job := range logs {
-		if jobstate.EnsureJob(hogState, job.id, job.host, job.start, now, job.lastSeen) {
-			candidates++
-		}
-	}
-	if progOpts.Verbose {
-		fmt.Fprintf(os.Stderr, "%d candidates\n", candidates)
+func Run(
+	ctx context.Context,
+	progOpts *util.StandardOptions,
+	analysisOpts *util.AnalysisOptions, cpuPeakScale float64,
+	emit func([]*util.JobReport) error,
+) error {
+	a, err := newCpuhogAnalysis(analysisOpts, cpuPeakScale)
+	if err != nil {
+		return err
 	}
+	return jobstate.RunAnalysis(ctx, progOpts, analysisOpts, a, emit)
+}
 
-	purgeDate := util.MinTime(progOpts.From, progOpts.To.AddDate(0, 0, -2))
-	purged := jobstate.PurgeJobsBefore(hogState, purgeDate)
-	if progOpts.Verbose {
-		fmt.Fprintf(os.Stderr, "%d purged\n", purged)
-	}
+// Run the cpuhog analysis for the time window and return the reports for the new violations
+// along with the updated state.  The caller must write the state unless this is a dry run.
 
-	events := createCpuhogReport(hogState, logs)
-	if *jsonOutput {
-		bytes, err := json.Marshal(events)
-		if err != nil {
-			return err
-		}
-		fmt.Print(string(bytes))
-	} else {
-		writeCpuhogReport(events)
+func Analyze(
+	ctx context.Context,
+	progOpts *util.StandardOptions,
+	analysisOpts *util.AnalysisOptions, cpuPeakScale float64,
+) ([]*util.JobReport, map[jobstate.JobKey]*jobstate.JobState, error) {
+	a, err := newCpuhogAnalysis(analysisOpts, cpuPeakScale)
+	if err != nil {
+		return nil, nil, err
 	}
+	return jobstate.Analyze(ctx, progOpts, analysisOpts, a)
+}
 
-	return jobstate.WriteJobState(progOpts.DataPath, cpuhogFilename, hogState)
+// The cpuhog analysis depends on the configuration of the hosts, see --config-file, and on the
+// scale of the cpu-peak values.
+
+func newCpuhogAnalysis(analysisOpts *util.AnalysisOptions, cpuPeakScale float64) (*jobstate.Analysis, error) {
+	systems, err := analysisOpts.SystemConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &jobstate.Analysis{
+		Name:          "cpuhog",
+		StateFilename: CpuhogStateFilename,
+		CacheFilename: CpuhogCacheFilename,
+		PeakFields:    cpuhogPeakFields,
+		Event:         &perEvent{},
+		Templates:     reportTemplates,
+		Report: func(
+			violations []*jobstate.Violation,
+			now time.Time,
+			times *util.TimeFormatter,
+			templates *template.Template,
+		) ([]*util.JobReport, error) {
+			return formatCpuhogReports(createCpuhogReport(violations, cpuPeakScale, times), systems, templates)
+		},
+	}, nil
 }
 
+// The order of the fields is the column order of the CSV output and must not change.
+
 type perEvent struct {
-	Host              string `json:"hostname"`
-	Id                uint32 `json:"id"`
-	User              string `json:"user"`
-	Cmd               string `json:"cmd"`
-	StartedOnOrBefore string `json:"started-on-or-before"`
-	FirstViolation    string `json:"first-violation"`
-	CpuPeak           uint32 `json:"cpu-peak"`
-	RCpuAvg           uint32 `json:"rcpu-avg"`
-	RCpuPeak          uint32 `json:"rcpu-peak"`
-	RMemAvg           uint32 `json:"rmem-avg"`
-	RMemPeak          uint32 `json:"rmem-peak"`
+	Host                string  `json:"hostname"`
+	Id                  uint32  `json:"id"`
+	User                string  `json:"user"`
+	Cmd                 string  `json:"cmd"`
+	RawCmd              string  `json:"raw-cmd"`
+	StartedOnOrBefore   string  `json:"started-on-or-before"`
+	FirstViolation      string  `json:"first-violation"`
+	CpuPeak             uint32  `json:"cpu-peak" unit:"cores"`
+	RCpuAvg             uint32  `json:"rcpu-avg" unit:"percent"`
+	RCpuPeak            uint32  `json:"rcpu-peak" unit:"percent"`
+	RMemAvg             uint32  `json:"rmem-avg" unit:"percent"`
+	RMemPeak            uint32  `json:"rmem-peak" unit:"percent"`
+	EventId             string  `json:"event-id"`
+	RunningFor          string  `json:"running-for"`
+	StartedBeforeWindow bool    `json:"started-before-window,omitempty"`
+	severity            float64 // see cpuhogSeverity
 }
 
-func createCpuhogReport(
-	hogState map[jobstate.JobKey]*jobstate.JobState,
-	logs map[jobstate.JobKey]*cpuhogState) []*perEvent {
+// A new event of the analysis, for describing the fields of the events, see util.EventSchema.
 
-	events := make([]*perEvent, 0)
-	for k, jobState := range hogState {
-		if !jobState.IsReported {
-			jobState.IsReported = true
-			job, _ := logs[k]
-			events = append(events,
-				&perEvent{
-					Host:              jobState.Host,
-					Id:                jobState.Id,
-					User:              job.user,
-					Cmd:               job.cmd,
-					StartedOnOrBefore: jobState.StartedOnOrBefore.Format(util.DateTimeFormat),
-					FirstViolation:    jobState.FirstViolation.Format(util.DateTimeFormat),
-					CpuPeak:           uint32(job.cpuPeak / 100),
-					RCpuAvg:           uint32(job.rcpuAvg),
-					RCpuPeak:          uint32(job.rcpuPeak),
-					RMemAvg:           uint32(job.rmemAvg),
-					RMemPeak:          uint32(job.rmemPeak),
-				})
-		}
-	}
-	return events
+func NewEvent() any {
+	return &perEvent{}
 }
 
-func writeCpuhogReport(events []*perEvent) {
-	reports := make([]*util.JobReport, 0)
-	for _, e := range events {
-		report := fmt.Sprintf(
-			`New CPU hog detected (uses a lot of CPU and no GPU) on host "%s":
-  Job#: %d
-  User: %s
-  Command: %s
-  Started on or before: %s
-  Violation first detected: %s
-  Observed data:
-    CPU peak = %d cores
-    CPU utilization avg/peak = %d%%, %d%%
-    Memory utilization avg/peak = %d%%, %d%%
+// The severity of a CPU hog is the peak number of cores it used, scaled up by its peak share of the
+// host and by the number of hours it was observed in the logs (at least one, so that briefly
+// observed jobs are ranked by their CPU use alone).
 
-`,
-			e.Host,
-			e.Id,
-			e.User,
-			e.Cmd,
-			e.StartedOnOrBefore,
-			e.FirstViolation,
-			e.CpuPeak,
-			e.RCpuAvg,
-			e.RCpuPeak,
-			e.RMemAvg,
-			e.RMemPeak)
-		reports = append(reports, &util.JobReport{Id: e.Id, Host: e.Host, Report: report})
-	}
+func cpuhogSeverity(cpuPeak, rcpuPeak uint32, observed time.Duration) float64 {
+	return float64(cpuPeak) * (1 + float64(rcpuPeak)/100) * math.Max(observed.Hours(), 1)
+}
+
+// Create events for the new violations.  The cpu-peak value from the log is divided by cpuPeakScale
+// to obtain the peak number of cores, and the times are formatted by `times`.
 
-	util.SortReports(reports)
-	for _, r := range reports {
-		fmt.Print(r.Report)
+func createCpuhogReport(
+	violations []*jobstate.Violation,
+	cpuPeakScale float64,
+	times *util.TimeFormatter,
+) []*perEvent {
+	events := make([]*perEvent, 0)
+	for _, v := range violations {
+		jobState, job := v.State, v.Job
+		cpuPeak := uint32(job.Peaks[cpuPeakIx] / cpuPeakScale)
+		rcpuPeak := uint32(job.Peaks[rcpuPeakIx])
+		events = append(events,
+			&perEvent{
+				Host:                jobState.Host,
+				Id:                  jobState.Id,
+				User:                job.User,
+				Cmd:                 job.Cmd,
+				RawCmd:              job.RawCmd,
+				StartedOnOrBefore:   times.Format(jobState.StartedOnOrBefore),
+				FirstViolation:      times.Format(jobState.FirstViolation),
+				EventId:             util.EventId(v.Key.Host, jobState.Id, jobState.FirstViolation),
+				RunningFor:          util.FormatDuration(jobState.Duration),
+				StartedBeforeWindow: v.StartedBeforeWindow,
+				CpuPeak:             cpuPeak,
+				RCpuAvg:             uint32(job.Peaks[rcpuAvgIx]),
+				RCpuPeak:            rcpuPeak,
+				RMemAvg:             uint32(job.Peaks[rmemAvgIx]),
+				RMemPeak:            uint32(job.Peaks[rmemPeakIx]),
+				severity:            cpuhogSeverity(cpuPeak, rcpuPeak, job.LastSeen.Sub(job.FirstSeen)),
+			})
 	}
+	return events
 }
 
-func readLogFiles(dataPath string, from, to time.Time) (map[jobstate.JobKey]*cpuhogState, error) {
-	files, err := storage.EnumerateFiles(dataPath, from, to, "cpuhog.csv")
-	if err != nil {
-		return nil, err
-	}
+// If the host's configuration is known then the CPU peak is shown relative to its number of cores.
 
-	jobs := make(map[jobstate.JobKey]*cpuhogState)
-	for _, filePath := range files {
-		records, err := storage.ReadFreeCSV(path.Join(dataPath, filePath))
-		if err != nil {
-			continue
+func formatCpuhogReports(
+	events []*perEvent,
+	systems *util.SystemConfigs,
+	templates *template.Template,
+) ([]*util.JobReport, error) {
+	reports := make([]*util.JobReport, 0)
+	for _, e := range events {
+		cores := 0
+		if system := systems.Lookup(e.Host); system != nil && system.CpuCores > 0 {
+			cores = system.CpuCores
 		}
-
-		for _, r := range records {
-			success := true
-
-			tag := storage.GetString(r, "tag", &success)
-			success = success && tag == "cpuhog"
-			now := storage.GetDateTime(r, "now", &success)
-			id := storage.GetJobMark(r, "jobm", &success)
-			user := storage.GetString(r, "user", &success)
-			host := storage.GetString(r, "host", &success)
-			cmd := storage.GetString(r, "cmd", &success)
-			cpuPeak := storage.GetFloat64(r, "cpu-peak", &success)
-			gpuPeak := storage.GetFloat64(r, "gpu-peak", &success)
-			rcpuAvg := storage.GetFloat64(r, "rcpu-avg", &success)
-			rcpuPeak := storage.GetFloat64(r, "rcpu-peak", &success)
-			rmemAvg := storage.GetFloat64(r, "rmem-avg", &success)
-			rmemPeak := storage.GetFloat64(r, "rmem-peak", &success)
-			start := storage.GetDateTime(r, "start", &success)
-			end := storage.GetDateTime(r, "end", &success)
-
-			if !success {
-				continue
-			}
-
-			key := jobstate.JobKey{id, host}
-			if r, present := jobs[key]; present {
-				// id, user, and host are fixed - host b/c this is the view of a job on the ml nodes
-				// FIXME: cmd can change b/c of sonalyze's view on the job.
-				r.firstSeen = util.MinTime(r.firstSeen, now)
-				r.lastSeen = util.MaxTime(r.lastSeen, now)
-				r.start = util.MinTime(r.start, start)
-				r.end = util.MaxTime(r.end, end)
-				// FIXME: duration can change
-				r.cpuPeak = math.Max(r.cpuPeak, cpuPeak)
-				r.gpuPeak = math.Max(r.gpuPeak, gpuPeak)
-				r.rcpuAvg = math.Max(r.rcpuAvg, rcpuAvg)
-				r.rcpuPeak = math.Max(r.rcpuPeak, rcpuPeak)
-				r.rmemAvg = math.Max(r.rmemAvg, rmemAvg)
-				r.rmemPeak = math.Max(r.rmemPeak, rmemPeak)
-			} else {
-				firstSeen := now
-				lastSeen := now
-				duration := time.Duration(0) // FIXME
-				jobs[key] = &cpuhogState{
-					id,
-					host,
-					user,
-					cmd,
-					duration,
-					firstSeen,
-					lastSeen,
-					start,
-					end,
-					cpuPeak,
-					gpuPeak,
-					rcpuAvg,
-					rcpuPeak,
-					rmemAvg,
-					rmemPeak,
-				}
-			}
+		data := struct {
+			*perEvent
+			Cores int
+		}{e, cores}
+		report, err := util.FormatReport(templates, "cpuhog", data)
+		if err != nil {
+			return nil, err
 		}
+		reports = append(reports, &util.JobReport{
+			Id: e.Id, Host: e.Host, User: e.User, Report: report, Data: e, Severity: e.severity,
+		})
 	}
 
-	return jobs, nil
+	return reports, nil
 }
@@ -1,14 +1,37 @@
 package mlcpuhog
 
 import (
+	"context"
+	"errors"
 	"os"
 	"path"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"naicreport/jobstate"
+	"naicreport/storage"
+	"naicreport/util"
 )
 
+// Read the cpuhog logs as the analysis does.
+
+func readLogFiles(
+	ctx context.Context,
+	dataPaths []string,
+	from, to time.Time,
+	concurrency int,
+	commands *util.CommandMap,
+	crossHost bool,
+	hosts *util.HostFilter,
+	cache *storage.SummaryCache,
+) (map[jobstate.JobKey]*jobstate.LoggedJob, int, []string, error) {
+	return jobstate.ReadLogFiles(
+		ctx, "cpuhog", cpuhogPeakFields, dataPaths, from, to, concurrency, commands, crossHost, hosts,
+		storage.DefaultCSVFormat, cache)
+}
+
 func TestReadLogFiles(t *testing.T) {
 	wd, err := os.Getwd()
 	if err != nil {
@@ -19,7 +42,7 @@ func TestReadLogFiles(t *testing.T) {
 	dataPath := path.Join(wd, "../../sonar_test_data0")
 	from := time.Date(2023, 9, 3, 0, 0, 0, 0, time.UTC)
 	to := time.Date(2023, 9, 4, 0, 0, 0, 0, time.UTC)
-	jobLog, err := readLogFiles(dataPath, from, to)
+	jobLog, _, _, err := readLogFiles(context.Background(), []string{dataPath}, from, to, 1, nil, false, nil, nil)
 	if err != nil {
 		t.Fatalf("Could not read: %q", err)
 	}
@@ -31,13 +54,13 @@ func TestReadLogFiles(t *testing.T) {
 	if !found {
 		t.Fatalf("Could not find record")
 	}
-	if x.id != 2166356 || x.host != "ml6" || x.user != "poyenyt" || x.cmd != "python3.9" ||
-		x.firstSeen != time.Date(2023, 9, 3, 20, 0, 0, 0, time.UTC) ||
-		x.lastSeen != time.Date(2023, 9, 3, 20, 0, 0, 0, time.UTC) ||
-		x.start != time.Date(2023, 9, 3, 15, 10, 0, 0, time.UTC) ||
-		x.end != time.Date(2023, 9, 3, 16, 50, 0, 0, time.UTC) ||
-		x.cpuPeak != 2615 || x.gpuPeak != 0 || x.rcpuAvg != 3 || x.rcpuPeak != 41 ||
-		x.rmemAvg != 12 || x.rmemPeak != 14 {
+	if x.Id != 2166356 || x.Host != "ml6" || x.User != "poyenyt" || x.Cmd != "python3.9" ||
+		x.FirstSeen != time.Date(2023, 9, 3, 20, 0, 0, 0, time.UTC) ||
+		x.LastSeen != time.Date(2023, 9, 3, 20, 0, 0, 0, time.UTC) ||
+		x.Start != time.Date(2023, 9, 3, 15, 10, 0, 0, time.UTC) ||
+		x.End != time.Date(2023, 9, 3, 16, 50, 0, 0, time.UTC) ||
+		x.Peaks[cpuPeakIx] != 2615 || x.Peaks[gpuPeakIx] != 0 || x.Peaks[rcpuAvgIx] != 3 || x.Peaks[rcpuPeakIx] != 41 ||
+		x.Peaks[rmemAvgIx] != 12 || x.Peaks[rmemPeakIx] != 14 {
 		t.Fatalf("Bad record %v", x)
 	}
 
@@ -49,24 +72,894 @@ func TestReadLogFiles(t *testing.T) {
 
 	from = time.Date(2023, 9, 6, 0, 0, 0, 0, time.UTC)
 	to = time.Date(2023, 9, 8, 0, 0, 0, 0, time.UTC)
-	jobLog, err = readLogFiles(dataPath, from, to)
+	jobLog, filesRead, _, err := readLogFiles(context.Background(), []string{dataPath}, from, to, 4, nil, false, nil, nil)
 	if err != nil {
 		t.Fatalf("Could not read: %q", err)
 	}
+	if filesRead != 2 {
+		t.Fatalf("Bad file count %d", filesRead)
+	}
 
 	x, found = jobLog[jobstate.JobKey{Id: 2712710, Host: "ml6"}]
 	if !found {
 		t.Fatalf("Could not find record")
 	}
 
-	if x.id != 2712710 || x.host != "ml6" || x.user != "hermanno" || x.cmd != "kited" ||
-		x.firstSeen != time.Date(2023, 9, 6, 12, 0, 0, 0, time.UTC) ||
-		x.lastSeen != time.Date(2023, 9, 7, 14, 0, 0, 0, time.UTC) ||
-		x.start != time.Date(2023, 9, 6, 7, 35, 0, 0, time.UTC) ||
-		x.end != time.Date(2023, 9, 7, 13, 55, 0, 0, time.UTC) ||
-		x.cpuPeak != 1274 || x.gpuPeak != 0 || x.rcpuAvg != 3 || x.rcpuPeak != 20 ||
-		x.rmemAvg != 2 || x.rmemPeak != 2 {
+	if x.Id != 2712710 || x.Host != "ml6" || x.User != "hermanno" || x.Cmd != "kited" ||
+		x.FirstSeen != time.Date(2023, 9, 6, 12, 0, 0, 0, time.UTC) ||
+		x.LastSeen != time.Date(2023, 9, 7, 14, 0, 0, 0, time.UTC) ||
+		x.Start != time.Date(2023, 9, 6, 7, 35, 0, 0, time.UTC) ||
+		x.End != time.Date(2023, 9, 7, 13, 55, 0, 0, time.UTC) ||
+		x.Peaks[cpuPeakIx] != 1274 || x.Peaks[gpuPeakIx] != 0 || x.Peaks[rcpuAvgIx] != 3 || x.Peaks[rcpuPeakIx] != 20 ||
+		x.Peaks[rmemAvgIx] != 2 || x.Peaks[rmemPeakIx] != 2 {
+		t.Fatalf("Bad record %v", x)
+	}
+
+}
+
+func TestReadLogFilesNoNow(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+
+	// The first record has no `now` field and is dated by the file's directory.
+	dataPath := path.Join(wd, "../../sonar_test_data0")
+	from := time.Date(2023, 8, 20, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 8, 21, 0, 0, 0, 0, time.UTC)
+	jobLog, _, _, err := readLogFiles(context.Background(), []string{dataPath}, from, to, 1, nil, false, nil, nil)
+	if err != nil {
+		t.Fatalf("Could not read: %q", err)
+	}
+	x, found := jobLog[jobstate.JobKey{Id: 2200100, Host: "ml7"}]
+	if !found {
+		t.Fatalf("Could not find record")
+	}
+	if x.FirstSeen != from || x.LastSeen != time.Date(2023, 8, 20, 14, 0, 0, 0, time.UTC) ||
+		x.Peaks[cpuPeakIx] != 1900 {
 		t.Fatalf("Bad record %v", x)
 	}
+}
 
+func TestReadLogFilesCommandMap(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	filename := path.Join(td_name, "commands.txt")
+	err = os.WriteFile(filename, []byte("python.* python\n"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	commands, err := util.NewCommandMap(filename, "")
+	if err != nil {
+		t.Fatalf("NewCommandMap failed %v", err)
+	}
+
+	dataPath := path.Join(wd, "../../sonar_test_data0")
+	from := time.Date(2023, 9, 3, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 9, 4, 0, 0, 0, 0, time.UTC)
+	jobLog, _, _, err := readLogFiles(context.Background(), []string{dataPath}, from, to, 1, commands, false, nil, nil)
+	if err != nil {
+		t.Fatalf("Could not read: %q", err)
+	}
+	x, found := jobLog[jobstate.JobKey{Id: 2166356, Host: "ml6"}]
+	if !found {
+		t.Fatalf("Could not find record")
+	}
+	if x.Cmd != "python" || x.RawCmd != "python3.9" {
+		t.Fatalf("Bad command %s %s", x.Cmd, x.RawCmd)
+	}
+}
+
+func TestReadLogFilesStripDomain(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	err = os.MkdirAll(path.Join(td_name, "2023/09/03"), 0755)
+	if err != nil {
+		t.Fatalf("MkdirAll failed %q", err)
+	}
+	records := `now=2023-09-03 20:00,jobm=10,user=joe,host=ml6,cpu-peak=2615,gpu-peak=0,rcpu-avg=3,rcpu-peak=41,rmem-avg=12,rmem-peak=14,start=2023-09-03 15:10,end=2023-09-03 16:50,cmd=python,tag=cpuhog
+now=2023-09-03 21:00,jobm=10,user=joe,host=ml6.hpc.uio.no,cpu-peak=3000,gpu-peak=0,rcpu-avg=3,rcpu-peak=41,rmem-avg=12,rmem-peak=14,start=2023-09-03 15:10,end=2023-09-03 17:50,cmd=python,tag=cpuhog
+`
+	err = os.WriteFile(path.Join(td_name, "2023/09/03/cpuhog.csv"), []byte(records), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	from := time.Date(2023, 9, 3, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 9, 4, 0, 0, 0, 0, time.UTC)
+
+	// By default the host names are distinct
+	jobLog, _, _, err := readLogFiles(context.Background(), []string{td_name}, from, to, 1, nil, false, nil, nil)
+	if err != nil || len(jobLog) != 2 {
+		t.Fatalf("Bad job log %v %v", jobLog, err)
+	}
+
+	hosts, err := util.NewHostFilter("ml6")
+	if err != nil {
+		t.Fatalf("NewHostFilter failed %v", err)
+	}
+	hosts.StripDomains("hpc.uio.no")
+	jobLog, _, _, err = readLogFiles(context.Background(), []string{td_name}, from, to, 1, nil, false, hosts, nil)
+	if err != nil {
+		t.Fatalf("Could not read: %q", err)
+	}
+	x, found := jobLog[jobstate.JobKey{Id: 10, Host: "ml6"}]
+	if len(jobLog) != 1 || !found || x.Host != "ml6" || x.Peaks[cpuPeakIx] != 3000 ||
+		!x.End.Equal(time.Date(2023, 9, 3, 17, 50, 0, 0, time.UTC)) {
+		t.Fatalf("Bad consolidation %v", jobLog)
+	}
+}
+
+func TestReadLogFilesParseError(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	err = os.MkdirAll(path.Join(td_name, "2023/09/03"), 0755)
+	if err != nil {
+		t.Fatalf("MkdirAll failed %q", err)
+	}
+	// The second line has a bare quote
+	records := `now=2023-09-03 20:00,jobm=10,user=joe,host=ml6,cpu-peak=2615,gpu-peak=0,rcpu-avg=3,rcpu-peak=41,rmem-avg=12,rmem-peak=14,start=2023-09-03 15:10,end=2023-09-03 16:50,cmd=python,tag=cpuhog
+now=2023-09-03 20:00,jobm=11,user=joe,host=ml6,cpu-peak=2615,gpu-peak=0,rcpu-avg=3,rcpu-peak=41,rmem-avg=12,rmem-peak=14,start=2023-09-03 15:10,end=2023-09-03 16:50,cmd=py"thon,tag=cpuhog
+now=2023-09-03 21:00,jobm=12,user=joe,host=ml6,cpu-peak=3000,gpu-peak=0,rcpu-avg=3,rcpu-peak=41,rmem-avg=12,rmem-peak=14,start=2023-09-03 15:10,end=2023-09-03 17:50,cmd=python,tag=cpuhog
+`
+	err = os.WriteFile(path.Join(td_name, "2023/09/03/cpuhog.csv"), []byte(records), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	from := time.Date(2023, 9, 3, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 9, 4, 0, 0, 0, 0, time.UTC)
+
+	// The records before and after the bad one are read, and the bad one is described
+	jobLog, filesRead, parseErrors, err := readLogFiles(context.Background(), []string{td_name}, from, to, 1,
+		nil, false, nil, nil)
+	if err != nil || filesRead != 1 || len(jobLog) != 2 {
+		t.Fatalf("Bad job log %v %d %v", jobLog, filesRead, err)
+	}
+	if jobLog[jobstate.JobKey{Id: 10, Host: "ml6"}] == nil || jobLog[jobstate.JobKey{Id: 12, Host: "ml6"}] == nil {
+		t.Fatalf("Bad job log %v", jobLog)
+	}
+	if len(parseErrors) != 1 || !strings.Contains(parseErrors[0], "2023/09/03/cpuhog.csv: 1 of the rows") {
+		t.Fatalf("Bad parse errors %v", parseErrors)
+	}
+}
+
+func TestReadLogFilesExcludeCommands(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	commands, err := util.NewCommandMap("", "python*")
+	if err != nil {
+		t.Fatalf("NewCommandMap failed %v", err)
+	}
+
+	dataPath := path.Join(wd, "../../sonar_test_data0")
+	from := time.Date(2023, 9, 3, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 9, 4, 0, 0, 0, 0, time.UTC)
+	jobLog, _, _, err := readLogFiles(context.Background(), []string{dataPath}, from, to, 1, commands, false, nil, nil)
+	if err != nil {
+		t.Fatalf("Could not read: %q", err)
+	}
+	if _, found := jobLog[jobstate.JobKey{Id: 2166356, Host: "ml6"}]; found {
+		t.Fatalf("Excluded command was not excluded")
+	}
+}
+
+func TestReadLogFilesCancelled(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+
+	dataPath := path.Join(wd, "../../sonar_test_data0")
+	from := time.Date(2023, 9, 3, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 9, 4, 0, 0, 0, 0, time.UTC)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, _, err = readLogFiles(ctx, []string{dataPath}, from, to, 1, nil, false, nil, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Unexpected error from cancelled read: %v", err)
+	}
+}
+
+func TestCpuPeakScale(t *testing.T) {
+	violations := []*jobstate.Violation{
+		&jobstate.Violation{
+			Key:   jobstate.JobKey{Id: 10, Host: "ml6"},
+			State: &jobstate.JobState{Id: 10, Host: "ml6"},
+			Job:   &jobstate.LoggedJob{Id: 10, Host: "ml6", User: "u", Cmd: "c", Peaks: []float64{2615, 0, 0, 0, 0, 0}},
+		},
+	}
+
+	// The logged cpu-peak is in percent of a core, so the default scale yields 26 cores.
+	events := createCpuhogReport(violations, DefaultCpuPeakScale, nil)
+	if len(events) != 1 || events[0].CpuPeak != 26 {
+		t.Fatalf("Bad cpu peak with default scale")
+	}
+
+	events = createCpuhogReport(violations, 1, nil)
+	if len(events) != 1 || events[0].CpuPeak != 2615 {
+		t.Fatalf("Bad cpu peak with unit scale")
+	}
+}
+
+func TestJobMarks(t *testing.T) {
+	now := time.Date(2023, 9, 12, 0, 0, 0, 0, time.UTC)
+	key := jobstate.JobKey{Id: 10, Host: "ml6"}
+	logs := map[jobstate.JobKey]*jobstate.LoggedJob{
+		key: &jobstate.LoggedJob{Id: 10, Host: "ml6", User: "u", Cmd: "c", Mark: storage.JobMarkBoth,
+			Peaks: make([]float64, len(cpuhogPeakFields))},
+	}
+	hogState := map[jobstate.JobKey]*jobstate.JobState{key: &jobstate.JobState{Id: 10, Host: "ml6"}}
+	events := createCpuhogReport(jobstate.NewViolations(hogState, logs, now, false, true), DefaultCpuPeakScale, nil)
+	if len(events) != 1 || events[0].StartedBeforeWindow {
+		t.Fatalf("Job reported as started before the window without --job-marks")
+	}
+	events = createCpuhogReport(jobstate.NewViolations(hogState, logs, now, true, true), DefaultCpuPeakScale, nil)
+	if len(events) != 1 || !events[0].StartedBeforeWindow {
+		t.Fatalf("Job not reported as started before the window")
+	}
+	logs[key].Mark = storage.JobMarkEnd
+	events = createCpuhogReport(jobstate.NewViolations(hogState, logs, now, true, true), DefaultCpuPeakScale, nil)
+	if len(events) != 1 || events[0].StartedBeforeWindow {
+		t.Fatalf("Job reported as started before the window")
+	}
+}
+
+func TestFormatCpuhogReportsConfig(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	filename := path.Join(td_name, "config.json")
+	err = os.WriteFile(filename, []byte(`[{"hostname": "ml6.hpc.uio.no", "cpu_cores": 64}]`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	systems, err := util.LoadSystemConfig(filename)
+	if err != nil {
+		t.Fatalf("LoadSystemConfig failed %v", err)
+	}
+
+	templates, err := util.NewReportTemplates(reportTemplates, "", nil)
+	if err != nil {
+		t.Fatalf("NewReportTemplates failed %v", err)
+	}
+	events := []*perEvent{{Host: "ml6", Id: 1, CpuPeak: 26}, {Host: "ml7", Id: 2, CpuPeak: 12}}
+	reports, err := formatCpuhogReports(events, systems, templates)
+	if err != nil {
+		t.Fatalf("formatCpuhogReports failed %v", err)
+	}
+	if !strings.Contains(reports[0].Report, "CPU peak = 26 of 64 cores\n") ||
+		!strings.Contains(reports[1].Report, "CPU peak = 12 cores\n") {
+		t.Fatalf("Bad reports %s%s", reports[0].Report, reports[1].Report)
+	}
+}
+
+func TestFormatCpuhogReportsTemplate(t *testing.T) {
+	templates, err := util.NewReportTemplates(reportTemplates, "", nil)
+	if err != nil {
+		t.Fatalf("NewReportTemplates failed %v", err)
+	}
+	events := []*perEvent{{
+		Host: "ml6", Id: 10, User: "joe", Cmd: "python", RawCmd: "python3",
+		StartedOnOrBefore: "2023-09-03 10:00", FirstViolation: "2023-09-03 11:00",
+		CpuPeak: 26, RCpuAvg: 10, RCpuPeak: 20, RMemAvg: 1, RMemPeak: 2, RunningFor: "1h30m",
+	}}
+	reports, err := formatCpuhogReports(events, nil, templates)
+	if err != nil {
+		t.Fatalf("formatCpuhogReports failed %v", err)
+	}
+	expect := `New CPU hog detected (uses a lot of CPU and no GPU) on host "ml6":
+  Job#: 10
+  User: joe
+  Command: python (python3)
+  Started on or before: 2023-09-03 10:00
+  Running for: 1h30m
+  Violation first detected: 2023-09-03 11:00
+  Observed data:
+    CPU peak = 26 cores
+    CPU utilization avg/peak = 10%, 20%
+    Memory utilization avg/peak = 1%, 2%
+
+`
+	if reports[0].Report != expect {
+		t.Fatalf("Bad default report %q", reports[0].Report)
+	}
+
+	templates, err = util.NewReportTemplates(reportTemplates, "", map[string]bool{"cpu-peak": true})
+	if err != nil {
+		t.Fatalf("NewReportTemplates failed %v", err)
+	}
+	reports, err = formatCpuhogReports(events, nil, templates)
+	if err != nil || !strings.HasSuffix(reports[0].Report, "  Observed data:\n    CPU peak = 26 cores\n\n") {
+		t.Fatalf("Bad report with selected fields %q %v", reports[0].Report, err)
+	}
+}
+
+func TestReadLogFilesStdin(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	input, err := os.Open(path.Join(wd, "../../sonar_test_data0/2023/09/03/cpuhog.csv"))
+	if err != nil {
+		t.Fatalf("Open failed: %q", err)
+	}
+	defer input.Close()
+	saved := os.Stdin
+	os.Stdin = input
+	defer func() { os.Stdin = saved }()
+
+	// The time window does not matter when reading from stdin
+	from := time.Date(2023, 9, 5, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 9, 6, 0, 0, 0, 0, time.UTC)
+	jobLog, filesRead, _, err := readLogFiles(context.Background(), []string{util.StdinDataPath}, from, to, 1,
+		nil, false, nil, nil)
+	if err != nil {
+		t.Fatalf("Could not read: %q", err)
+	}
+	if filesRead != 1 || len(jobLog) != 1 {
+		t.Fatalf("Unexpected job log %d %d", filesRead, len(jobLog))
+	}
+	if _, found := jobLog[jobstate.JobKey{Id: 2166356, Host: "ml6"}]; !found {
+		t.Fatalf("Could not find record")
+	}
+}
+
+func TestAnalyzePurge(t *testing.T) {
+	dataPath, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+
+	// With now pinned to September 7 and a window of two days, the window starts on September 5 and
+	// the purge date is the start of the window.  Reported jobs last seen before it are purged.
+	boundary := time.Date(2023, 9, 5, 0, 0, 0, 0, time.UTC)
+	before := jobstate.JobKey{Id: 1, Host: "ml6"}
+	at := jobstate.JobKey{Id: 2, Host: "ml6"}
+	state := map[jobstate.JobKey]*jobstate.JobState{
+		before: &jobstate.JobState{Id: 1, Host: "ml6", LastSeen: boundary.Add(-time.Minute), IsReported: true},
+		at:     &jobstate.JobState{Id: 2, Host: "ml6", LastSeen: boundary, IsReported: true},
+	}
+	err = jobstate.WriteJobState(dataPath, CpuhogStateFilename, state, 0)
+	if err != nil {
+		t.Fatalf("WriteJobState failed %v", err)
+	}
+
+	progOpts := util.NewStandardOptions("test")
+	progOpts.Clock = &util.FakeClock{T: time.Date(2023, 9, 7, 12, 0, 0, 0, time.UTC)}
+	analysisOpts := util.NewAnalysisOptions(progOpts)
+	err = progOpts.Parse([]string{"--data-path", dataPath, "--from", "2d"})
+	if err != nil {
+		t.Fatalf("Parse failed %v", err)
+	}
+	_, newState, err := Analyze(context.Background(), progOpts, analysisOpts, DefaultCpuPeakScale)
+	if err != nil {
+		t.Fatalf("Analyze failed %v", err)
+	}
+	_, haveBefore := newState[before]
+	_, haveAt := newState[at]
+	if haveBefore || !haveAt || progOpts.RunCounts("cpuhog").Purged != 1 {
+		t.Fatalf("Bad purge %v", newState)
+	}
+}
+
+func TestCpuhogSeverity(t *testing.T) {
+	// Brief observations count as one hour, so only the CPU use matters
+	if cpuhogSeverity(10, 50, 0) != 15 || cpuhogSeverity(10, 50, 30*time.Minute) != 15 {
+		t.Fatalf("Bad severity for brief observation")
+	}
+	if cpuhogSeverity(10, 50, 4*time.Hour) != 60 || cpuhogSeverity(20, 0, 2*time.Hour) != 40 {
+		t.Fatalf("Bad severity for long observation")
+	}
+
+	now := time.Date(2023, 9, 12, 0, 0, 0, 0, time.UTC)
+	violations := []*jobstate.Violation{
+		&jobstate.Violation{
+			Key:   jobstate.JobKey{Id: 10, Host: "ml6"},
+			State: &jobstate.JobState{Id: 10, Host: "ml6"},
+			Job: &jobstate.LoggedJob{Id: 10, Host: "ml6", Peaks: []float64{1000, 0, 0, 100, 0, 0},
+				FirstSeen: now.Add(-3 * time.Hour), LastSeen: now},
+		},
+	}
+	templates, err := util.NewReportTemplates(reportTemplates, "", nil)
+	if err != nil {
+		t.Fatalf("NewReportTemplates failed %v", err)
+	}
+	reports, err := formatCpuhogReports(
+		createCpuhogReport(violations, DefaultCpuPeakScale, nil), nil, templates)
+	if err != nil || len(reports) != 1 || reports[0].Severity != 60 {
+		t.Fatalf("Bad report severity %v", reports)
+	}
+}
+
+func TestReadLogFilesCached(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+
+	// Consolidating cached summaries yields the same jobs as reading the files
+	dataPath := path.Join(wd, "../../sonar_test_data0")
+	from := time.Date(2023, 5, 28, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 9, 12, 0, 0, 0, 0, time.UTC)
+	expect, _, _, err := readLogFiles(context.Background(), []string{dataPath}, from, to, 1, nil, false, nil, nil)
+	if err != nil {
+		t.Fatalf("Could not read: %q", err)
+	}
+	cacheName := path.Join(td_name, CpuhogCacheFilename)
+	for i := 0; i < 2; i++ {
+		cache := storage.OpenSummaryCache(cacheName, "cpuhog", cpuhogPeakFields, storage.DefaultCSVFormat)
+		jobLog, _, _, err := readLogFiles(context.Background(), []string{dataPath}, from, to, 1, nil, false, nil, cache)
+		if err != nil {
+			t.Fatalf("Could not read: %q", err)
+		}
+		if len(jobLog) != len(expect) {
+			t.Fatalf("Bad job count %d %d", len(jobLog), len(expect))
+		}
+		for k, v := range expect {
+			if w := jobLog[k]; w == nil || !reflect.DeepEqual(w, v) {
+				t.Fatalf("Bad job %v %v", v, w)
+			}
+		}
+		err = cache.Save()
+		if err != nil {
+			t.Fatalf("Could not save: %q", err)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	input, err := os.ReadFile(path.Join(wd, "../../sonar_test_data0/2023/09/03/cpuhog.csv"))
+	if err != nil {
+		t.Fatalf("ReadFile failed %q", err)
+	}
+	err = os.MkdirAll(path.Join(td_name, "2023/09/03"), 0755)
+	if err == nil {
+		err = os.WriteFile(path.Join(td_name, "2023/09/03/cpuhog.csv"), input, 0644)
+	}
+	if err != nil {
+		t.Fatalf("Could not set up data %q", err)
+	}
+
+	from := time.Date(2023, 9, 3, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 9, 4, 0, 0, 0, 0, time.UTC)
+	progOpts, analysisOpts, err := util.NewEmbeddedOptions("test", td_name, from, to, nil)
+	if err != nil {
+		t.Fatalf("NewEmbeddedOptions failed %q", err)
+	}
+	stateFile := path.Join(td_name, CpuhogStateFilename)
+
+	// If the reports can't be emitted then the state is not written
+	failure := errors.New("no")
+	err = Run(context.Background(), progOpts, analysisOpts, DefaultCpuPeakScale,
+		func(reports []*util.JobReport) error {
+			return failure
+		})
+	if err != failure {
+		t.Fatalf("Bad error %v", err)
+	}
+	if _, err = os.Stat(stateFile); err == nil {
+		t.Fatalf("State written")
+	}
+
+	var emitted []*util.JobReport
+	err = Run(context.Background(), progOpts, analysisOpts, DefaultCpuPeakScale,
+		func(reports []*util.JobReport) error {
+			emitted = reports
+			return nil
+		})
+	if err != nil || len(emitted) != 1 || emitted[0].Id != 2166356 {
+		t.Fatalf("Bad run %v %v", emitted, err)
+	}
+	if _, err = os.Stat(stateFile); err != nil {
+		t.Fatalf("State not written %v", err)
+	}
+}
+
+func TestRunSeedReescalate(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	input, err := os.ReadFile(path.Join(wd, "../../sonar_test_data0/2023/09/03/cpuhog.csv"))
+	if err != nil {
+		t.Fatalf("ReadFile failed %q", err)
+	}
+	err = os.MkdirAll(path.Join(td_name, "2023/09/03"), 0755)
+	if err == nil {
+		err = os.WriteFile(path.Join(td_name, "2023/09/03/cpuhog.csv"), input, 0644)
+	}
+	if err != nil {
+		t.Fatalf("Could not set up data %q", err)
+	}
+
+	t0 := time.Date(2023, 9, 4, 12, 0, 0, 0, time.UTC)
+	run := func(now time.Time, args ...string) []*util.JobReport {
+		progOpts := util.NewStandardOptions("test")
+		progOpts.Clock = &util.FakeClock{T: now}
+		analysisOpts := util.NewAnalysisOptions(progOpts)
+		err := progOpts.Parse(append([]string{"--data-path", td_name, "--from", "2023-09-03", "--to", "2023-09-03"},
+			args...))
+		if err != nil {
+			t.Fatalf("Parse failed %v", err)
+		}
+		var emitted []*util.JobReport
+		err = Run(context.Background(), progOpts, analysisOpts, DefaultCpuPeakScale,
+			func(reports []*util.JobReport) error {
+				emitted = reports
+				return nil
+			})
+		if err != nil {
+			t.Fatalf("Run failed %v", err)
+		}
+		return emitted
+	}
+
+	// The seeded job counts as reported by the seeding run, and is reescalated once it has been
+	// reported for longer than the interval.
+	if reports := run(t0, "--seed"); len(reports) != 0 {
+		t.Fatalf("Jobs reported when seeding %v", reports)
+	}
+	if reports := run(t0.Add(time.Hour), "--reescalate-after", "24h"); len(reports) != 0 {
+		t.Fatalf("Seeded job reescalated too early %v", reports)
+	}
+	if reports := run(t0.Add(25*time.Hour), "--reescalate-after", "24h"); len(reports) != 1 ||
+		reports[0].Id != 2166356 {
+		t.Fatalf("Seeded job not reescalated %v", reports)
+	}
+}
+
+func TestRunLogDelimiter(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	input, err := os.ReadFile(path.Join(wd, "../../sonar_test_data0/2023/09/03/cpuhog.csv"))
+	if err != nil {
+		t.Fatalf("ReadFile failed %q", err)
+	}
+	err = os.MkdirAll(path.Join(td_name, "2023/09/03"), 0755)
+	if err == nil {
+		err = os.WriteFile(path.Join(td_name, "2023/09/03/cpuhog.csv"),
+			[]byte(strings.ReplaceAll(string(input), ",", "\t")), 0644)
+	}
+	if err != nil {
+		t.Fatalf("Could not set up data %q", err)
+	}
+
+	run := func(args ...string) ([]*util.JobReport, error) {
+		progOpts := util.NewStandardOptions("test")
+		progOpts.Clock = &util.FakeClock{T: time.Date(2023, 9, 4, 12, 0, 0, 0, time.UTC)}
+		analysisOpts := util.NewAnalysisOptions(progOpts)
+		err := progOpts.Parse(append([]string{"--data-path", td_name, "--from", "2023-09-03", "--to", "2023-09-03",
+			"--dry-run"}, args...))
+		if err != nil {
+			t.Fatalf("Parse failed %v", err)
+		}
+		var emitted []*util.JobReport
+		err = Run(context.Background(), progOpts, analysisOpts, DefaultCpuPeakScale,
+			func(reports []*util.JobReport) error {
+				emitted = reports
+				return nil
+			})
+		return emitted, err
+	}
+
+	// Read as comma-separated, each line is a single field and no job is found
+	if reports, err := run(); err != nil || len(reports) != 0 {
+		t.Fatalf("Bad comma-separated run %v %v", reports, err)
+	}
+	if reports, err := run("--log-delimiter", "tab"); err != nil || len(reports) != 1 ||
+		reports[0].Id != 2166356 {
+		t.Fatalf("Bad tab-separated run %v %v", reports, err)
+	}
+	if _, err := run("--log-delimiter", "\t\t"); err == nil {
+		t.Fatalf("Bad delimiter accepted")
+	}
+	if _, err := run("--log-delimiter", "\""); err == nil {
+		t.Fatalf("Invalid delimiter accepted")
+	}
+}
+
+func TestRunLogComment(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	input, err := os.ReadFile(path.Join(wd, "../../sonar_test_data0/2023/09/03/cpuhog.csv"))
+	if err != nil {
+		t.Fatalf("ReadFile failed %q", err)
+	}
+	// The job's records are commented out, and the note has a stray quote
+	commented := "# Job 2166356 is \"not\" a hog, see the ticket\n#" +
+		strings.ReplaceAll(strings.TrimSuffix(string(input), "\n"), "\n", "\n#") + "\n"
+	err = os.MkdirAll(path.Join(td_name, "2023/09/03"), 0755)
+	if err == nil {
+		err = os.WriteFile(path.Join(td_name, "2023/09/03/cpuhog.csv"), []byte(commented), 0644)
+	}
+	if err != nil {
+		t.Fatalf("Could not set up data %q", err)
+	}
+
+	run := func(args ...string) ([]*util.JobReport, error) {
+		progOpts := util.NewStandardOptions("test")
+		progOpts.Clock = &util.FakeClock{T: time.Date(2023, 9, 4, 12, 0, 0, 0, time.UTC)}
+		analysisOpts := util.NewAnalysisOptions(progOpts)
+		err := progOpts.Parse(append([]string{"--data-path", td_name, "--from", "2023-09-03", "--to", "2023-09-03",
+			"--dry-run"}, args...))
+		if err != nil {
+			t.Fatalf("Parse failed %v", err)
+		}
+		var emitted []*util.JobReport
+		err = Run(context.Background(), progOpts, analysisOpts, DefaultCpuPeakScale,
+			func(reports []*util.JobReport) error {
+				emitted = reports
+				return nil
+			})
+		return emitted, err
+	}
+
+	// Without the comment character the records are read with a "#now" field and the job is found
+	if reports, err := run(); err != nil || len(reports) != 1 || reports[0].Id != 2166356 {
+		t.Fatalf("Bad run without comments %v %v", reports, err)
+	}
+	if reports, err := run("--log-comment", "#"); err != nil || len(reports) != 0 {
+		t.Fatalf("Bad run with comments %v %v", reports, err)
+	}
+	if _, err := run("--log-comment", "##"); err == nil {
+		t.Fatalf("Bad comment character accepted")
+	}
+	if _, err := run("--log-comment", ","); err == nil {
+		t.Fatalf("Comment character equal to the delimiter accepted")
+	}
+}
+
+func TestAnalyzeMinDuration(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	dataPath := path.Join(wd, "../../sonar_test_data0")
+
+	// The jobs in the sample data have run for between 20 minutes and two days.  The short ones are
+	// neither reported nor added to the state, so they can be reported when they have run longer.
+	for _, c := range []struct {
+		minDuration string
+		ids         []uint32
+	}{
+		{"0", []uint32{3635362, 1606710, 1741945, 2166356, 2712710, 3043187, 3129396, 3208159, 1114425,
+			2253420, 3514819}},
+		{"2h", []uint32{3635362, 1606710, 1741945, 2712710, 3129396, 3208159, 1114425, 2253420}},
+		{"24h", []uint32{1606710, 2712710, 2253420}},
+	} {
+		progOpts := util.NewStandardOptions("test")
+		analysisOpts := util.NewAnalysisOptions(progOpts)
+		err = progOpts.Parse([]string{"--data-path", dataPath, "--from", "2023-09-01", "--to", "2023-09-12",
+			"--dry-run", "--min-duration", c.minDuration})
+		if err != nil {
+			t.Fatalf("Parse failed %v", err)
+		}
+		reports, newState, err := Analyze(context.Background(), progOpts, analysisOpts, DefaultCpuPeakScale)
+		if err != nil {
+			t.Fatalf("Analyze failed %v", err)
+		}
+		util.SortReports(reports)
+		if len(reports) != len(c.ids) || len(newState) != len(c.ids) {
+			t.Fatalf("Bad reports for %s: %d %d", c.minDuration, len(reports), len(newState))
+		}
+		for i, r := range reports {
+			if r.Id != c.ids[i] {
+				t.Fatalf("Bad report for %s: %v", c.minDuration, r)
+			}
+		}
+	}
+}
+
+func TestAnalyzeGracePeriod(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	dataPath := path.Join(wd, "../../sonar_test_data0")
+
+	// The violations are first detected at the time of the run, here midnight on September 5, so a
+	// job is reported only if it was logged after that plus the grace period.  A job in its grace
+	// period is not reported, but is kept in the state.
+	for _, c := range []struct {
+		gracePeriod string
+		ids         []uint32
+	}{
+		{"0", []uint32{3635362, 1606710, 1741945, 2166356, 2712710, 3043187, 3129396, 3208159, 1114425,
+			2253420, 3514819}},
+		{"1h", []uint32{3635362, 2712710, 3043187, 3129396, 3208159, 1114425, 2253420}},
+		{"24h", []uint32{2712710, 3043187, 3129396, 3208159, 1114425, 2253420}},
+	} {
+		progOpts := util.NewStandardOptions("test")
+		progOpts.Clock = &util.FakeClock{T: time.Date(2023, 9, 5, 0, 0, 0, 0, time.UTC)}
+		analysisOpts := util.NewAnalysisOptions(progOpts)
+		err = progOpts.Parse([]string{"--data-path", dataPath, "--from", "2023-09-01", "--to", "2023-09-12",
+			"--dry-run", "--grace-period", c.gracePeriod})
+		if err != nil {
+			t.Fatalf("Parse failed %v", err)
+		}
+		reports, newState, err := Analyze(context.Background(), progOpts, analysisOpts, DefaultCpuPeakScale)
+		if err != nil {
+			t.Fatalf("Analyze failed %v", err)
+		}
+		util.SortReports(reports)
+		if len(reports) != len(c.ids) || len(newState) != 11 {
+			t.Fatalf("Bad reports for %s: %d %d", c.gracePeriod, len(reports), len(newState))
+		}
+		for i, r := range reports {
+			if r.Id != c.ids[i] {
+				t.Fatalf("Bad report for %s: %v", c.gracePeriod, r)
+			}
+		}
+	}
+}
+
+func TestRunGracePeriodWindowMoved(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	input, err := os.ReadFile(path.Join(wd, "../../sonar_test_data0/2023/09/02/cpuhog.csv"))
+	if err != nil {
+		t.Fatalf("ReadFile failed %q", err)
+	}
+	err = os.MkdirAll(path.Join(td_name, "2023/09/02"), 0755)
+	if err == nil {
+		err = os.WriteFile(path.Join(td_name, "2023/09/02/cpuhog.csv"), input, 0644)
+	}
+	if err != nil {
+		t.Fatalf("Could not set up data %q", err)
+	}
+
+	run := func(args ...string) []*util.JobReport {
+		progOpts := util.NewStandardOptions("test")
+		analysisOpts := util.NewAnalysisOptions(progOpts)
+		err := progOpts.Parse(append([]string{"--data-path", td_name}, args...))
+		if err != nil {
+			t.Fatalf("Parse failed %v", err)
+		}
+		var emitted []*util.JobReport
+		err = Run(context.Background(), progOpts, analysisOpts, DefaultCpuPeakScale,
+			func(reports []*util.JobReport) error {
+				emitted = reports
+				return nil
+			})
+		if err != nil {
+			t.Fatalf("Run failed %v", err)
+		}
+		return emitted
+	}
+
+	// The jobs are held back by the grace period and saved to the state unreported.  When the window
+	// has moved past them they are not in the logs, and they remain pending until they are seen again.
+	if reports := run("--from", "2023-09-02", "--to", "2023-09-02", "--grace-period", "1000h"); len(reports) != 0 {
+		t.Fatalf("Jobs reported in their grace period %v", reports)
+	}
+	if reports := run("--from", "2023-09-10", "--to", "2023-09-10"); len(reports) != 0 {
+		t.Fatalf("Jobs reported outside the window %v", reports)
+	}
+	if reports := run("--from", "2023-09-02", "--to", "2023-09-02"); len(reports) != 3 {
+		t.Fatalf("Pending jobs not reported %v", reports)
+	}
+}
+
+func TestAnalyzeFirstViolationSource(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	dataPath := path.Join(wd, "../../sonar_test_data0")
+
+	// The first record of job 3208159 is at 22:00 on September 7 but in the file for September 8.
+	key := jobstate.JobKey{Id: 3208159, Host: "ml6"}
+	for _, c := range []struct {
+		source string
+		first  time.Time
+	}{
+		{"run", time.Date(2023, 9, 5, 0, 0, 0, 0, time.UTC)},
+		{"record", time.Date(2023, 9, 7, 22, 0, 0, 0, time.UTC)},
+		{"file", time.Date(2023, 9, 8, 0, 0, 0, 0, time.UTC)},
+	} {
+		progOpts := util.NewStandardOptions("test")
+		progOpts.Clock = &util.FakeClock{T: time.Date(2023, 9, 5, 0, 0, 0, 0, time.UTC)}
+		analysisOpts := util.NewAnalysisOptions(progOpts)
+		err = progOpts.Parse([]string{"--data-path", dataPath, "--from", "2023-09-01", "--to", "2023-09-12",
+			"--dry-run", "--first-violation-source", c.source})
+		if err != nil {
+			t.Fatalf("Parse failed %v", err)
+		}
+		_, newState, err := Analyze(context.Background(), progOpts, analysisOpts, DefaultCpuPeakScale)
+		if err != nil {
+			t.Fatalf("Analyze failed %v", err)
+		}
+		if j := newState[key]; j == nil || !j.FirstViolation.Equal(c.first) {
+			t.Fatalf("Bad first violation for %s: %v", c.source, j)
+		}
+	}
+
+	progOpts := util.NewStandardOptions("test")
+	analysisOpts := util.NewAnalysisOptions(progOpts)
+	err = progOpts.Parse([]string{"--data-path", dataPath, "--dry-run", "--first-violation-source", "log"})
+	if err != nil {
+		t.Fatalf("Parse failed %v", err)
+	}
+	_, _, err = Analyze(context.Background(), progOpts, analysisOpts, DefaultCpuPeakScale)
+	if err == nil {
+		t.Fatalf("Bad --first-violation-source accepted")
+	}
+}
+
+func TestAnalyzeMaxDataAge(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	dataPath := path.Join(wd, "../../sonar_test_data0")
+
+	// The newest file is for September 11, so the data are 36h old at noon on September 13.
+	for _, c := range []struct {
+		from, to, maxAge string
+		stale            bool
+	}{
+		{"2023-09-01", "2023-09-12", "48h", false},
+		{"2023-09-01", "2023-09-12", "24h", true},
+		{"2023-09-12", "2023-09-13", "48h", true},
+		{"2023-09-01", "2023-09-12", "0", false},
+	} {
+		progOpts := util.NewStandardOptions("test")
+		progOpts.Clock = &util.FakeClock{T: time.Date(2023, 9, 13, 12, 0, 0, 0, time.UTC)}
+		analysisOpts := util.NewAnalysisOptions(progOpts)
+		err = progOpts.Parse([]string{"--data-path", dataPath, "--from", c.from, "--to", c.to,
+			"--dry-run", "--max-data-age", c.maxAge})
+		if err != nil {
+			t.Fatalf("Parse failed %v", err)
+		}
+		_, _, err := Analyze(context.Background(), progOpts, analysisOpts, DefaultCpuPeakScale)
+		if c.stale != errors.Is(err, util.ErrStaleData) || (!c.stale && err != nil) {
+			t.Fatalf("Bad result for %v: %v", c, err)
+		}
+	}
 }
@@ -21,199 +21,190 @@
 package mldeadweight
 
 import (
-	"encoding/json"
-
-	"fmt"
-	"os"
-	"path"
+	"context"
+	_ "embed"
+	"strings"
+	"text/template"
 	"time"
 
 	"naicreport/jobstate"
-	"naicreport/storage"
 	"naicreport/util"
 )
 
+// The default templates of the text reports, see util/reporttemplate.go.
+
+//go:embed report.tmpl
+var reportTemplates string
+
 const (
-	deadweightFilename = "deadweight-state.csv"
-)
+	// The name of the state file in the data directory, exported for the benefit of `reset`.
+	DeadweightStateFilename = "deadweight-state.csv"
 
-type deadweightJob struct {
-	id        uint32
-	host      string
-	user      string
-	cmd       string
-	firstSeen time.Time
-	lastSeen  time.Time
-	start     time.Time
-	end       time.Time
-}
+	// The name of the cache of summaries of the log files in the data directory, see --cache.
+	DeadweightCacheFilename = "deadweight-cache.gob"
+)
 
 func MlDeadweight(progname string, args []string) error {
-	progOpts := util.NewStandardOptions(progname + "ml-deadweight")
-	jsonOutput := progOpts.Container.Bool("json", false, "Format output as JSON")
+	progOpts := util.NewStandardOptions(progname + " ml-deadweight")
+	analysisOpts := util.NewAnalysisOptions(progOpts)
+	coalesceHosts := progOpts.Container.Bool("coalesce-hosts", false,
+		"With --cross-host, list the hosts of a job that is seen on several hosts in the text report")
 	err := progOpts.Parse(args)
 	if err != nil {
 		return err
 	}
 
-	state, err := jobstate.ReadJobStateOrEmpty(progOpts.DataPath, deadweightFilename)
+	events := 0
+	err = Run(context.Background(), progOpts, analysisOpts, *coalesceHosts, func(reports []*util.JobReport) error {
+		events = len(reports)
+		return util.OutputReports(progOpts, analysisOpts, reports, NewEvent())
+	})
 	if err != nil {
 		return err
 	}
-
-	logs, err := readDeadweightLogFiles(progOpts.DataPath, progOpts.From, progOpts.To)
+	err = progOpts.WriteRunManifest()
 	if err != nil {
 		return err
 	}
+	return analysisOpts.EventsResult(events)
+}
 
-	now := time.Now().UTC()
+// Run the deadweight analysis as the ml-deadweight verb does once its options have been parsed, but
+// pass the reports for the new violations to `emit` instead of writing them, see
+// jobstate.RunAnalysis.  This is the entry point for running the analysis from another program, see
+// util.NewEmbeddedOptions.  See Analyze for `coalesceHosts`.
+
+func Run(
+	ctx context.Context,
+	progOpts *util.StandardOptions,
+	analysisOpts *util.AnalysisOptions,
+	coalesceHosts bool,
+	emit func([]*util.JobReport) error,
+) error {
+	return jobstate.RunAnalysis(ctx, progOpts, analysisOpts, newDeadweightAnalysis(coalesceHosts), emit)
+}
 
-	candidates := 0
-	for _, job := range logs {
-		if jobstate.EnsureJob(state, job.id, job.host, job.start, now, job.lastSeen) {
-			candidates++
-		}
-	}
-	if progOpts.Verbose {
-		fmt.Fprintf(os.Stderr, "%d candidates\n", candidates)
-	}
+// Run the deadweight analysis for the time window and return the reports for the new violations
+// along with the updated state.  The caller must write the state unless this is a dry run.
+//
+// If coalesceHosts is true and jobs are keyed cross-host (--cross-host) then the text report of a
+// job that has been seen on several hosts lists the hosts, see createDeadweightReport.  Without
+// --cross-host the option has no effect, as jobs with the same job# on several hosts are unrelated.
+
+func Analyze(
+	ctx context.Context,
+	progOpts *util.StandardOptions,
+	analysisOpts *util.AnalysisOptions,
+	coalesceHosts bool,
+) ([]*util.JobReport, map[jobstate.JobKey]*jobstate.JobState, error) {
+	return jobstate.Analyze(ctx, progOpts, analysisOpts, newDeadweightAnalysis(coalesceHosts))
+}
 
-	purgeDate := util.MinTime(progOpts.From, progOpts.To.AddDate(0, 0, -2))
-	purged := jobstate.PurgeJobsBefore(state, purgeDate)
-	if progOpts.Verbose {
-		fmt.Fprintf(os.Stderr, "%d purged\n", purged)
+// The deadweight analysis takes no maxima from the logs, the severity of an event is the time since
+// the job was last seen.
+
+func newDeadweightAnalysis(coalesceHosts bool) *jobstate.Analysis {
+	return &jobstate.Analysis{
+		Name:          "deadweight",
+		StateFilename: DeadweightStateFilename,
+		CacheFilename: DeadweightCacheFilename,
+		Event:         &perEvent{},
+		Templates:     reportTemplates,
+		Report: func(
+			violations []*jobstate.Violation,
+			now time.Time,
+			times *util.TimeFormatter,
+			templates *template.Template,
+		) ([]*util.JobReport, error) {
+			return formatDeadweightReports(createDeadweightReport(violations, now, times, coalesceHosts), templates)
+		},
 	}
+}
 
-	events := createDeadweightReport(state, logs)
-	if *jsonOutput {
-		bytes, err := json.Marshal(events)
-		if err != nil {
-			return err
-		}
-		fmt.Print(string(bytes))
-	} else {
-		writeDeadweightReport(events)
-	}
+// The order of the fields is the column order of the CSV output and must not change.
 
-	return jobstate.WriteJobState(progOpts.DataPath, deadweightFilename, state)
+type perEvent struct {
+	Host                string  `json:"hostname"`
+	Id                  uint32  `json:"id"`
+	User                string  `json:"user"`
+	Cmd                 string  `json:"cmd"`
+	RawCmd              string  `json:"raw-cmd"`
+	StartedOnOrBefore   string  `json:"started-on-or-before"`
+	FirstViolation      string  `json:"first-violation"`
+	LastSeen            string  `json:"last-seen"`
+	EventId             string  `json:"event-id"`
+	RunningFor          string  `json:"running-for"`
+	StartedBeforeWindow bool    `json:"started-before-window,omitempty"`
+	unseenHours         float64 // hours since the job was last seen, the severity
+	coalesced           bool    // Host is a list of the hosts of a job keyed cross-host
 }
 
-type perEvent struct {
-	Host              string `json:"hostname"`
-	Id                uint32 `json:"id"`
-	User              string `json:"user"`
-	Cmd               string `json:"cmd"`
-	StartedOnOrBefore string `json:"started-on-or-before"`
-	FirstViolation    string `json:"first-violation"`
-	LastSeen          string `json:"last-seen"`
+// A new event of the analysis, for describing the fields of the events, see util.EventSchema.
+
+func NewEvent() any {
+	return &perEvent{}
 }
 
-func createDeadweightReport(state map[jobstate.JobKey]*jobstate.JobState, logs map[jobstate.JobKey]*deadweightJob) []*perEvent {
-	events := make([]*perEvent, 0)
-	for k, j := range state {
-		if !j.IsReported {
-			j.IsReported = true
-			loggedJob, _ := logs[k]
-			events = append(events,
-				&perEvent{
-					Host:              j.Host,
-					Id:                j.Id,
-					User:              loggedJob.user,
-					Cmd:               loggedJob.cmd,
-					StartedOnOrBefore: j.StartedOnOrBefore.Format(util.DateTimeFormat),
-					FirstViolation:    j.FirstViolation.Format(util.DateTimeFormat),
-					LastSeen:          j.LastSeen.Format(util.DateTimeFormat),
-				})
-		}
-	}
-	return events
+// True if the event is for the job on several hosts, which are listed by Hosts, for the template.
+
+func (e *perEvent) Coalesced() bool {
+	return e.coalesced
 }
 
-func writeDeadweightReport(events []*perEvent) {
-	reports := make([]*util.JobReport, 0)
-	for _, e := range events {
-		report := fmt.Sprintf(
-			`New pointless job detected (zombie, defunct, or hung) on host "%s":
-  Job#: %d
-  User: %s
-  Command: %s
-  Started on or before: %s
-  Violation first detected: %s
-  Last seen: %s
-`,
-			e.Host,
-			e.Id,
-			e.User,
-			e.Cmd,
-			e.StartedOnOrBefore,
-			e.FirstViolation,
-			e.LastSeen)
-		reports = append(reports, &util.JobReport{Id: e.Id, Host: e.Host, Report: report})
-	}
+// The hosts of the event, separated by ", ", for the template.
 
-	util.SortReports(reports)
-	for _, r := range reports {
-		fmt.Print(r.Report)
-	}
+func (e *perEvent) Hosts() string {
+	return strings.Join(strings.Split(e.Host, ","), ", ")
 }
 
-func readDeadweightLogFiles(dataPath string, from, to time.Time) (map[jobstate.JobKey]*deadweightJob, error) {
-	files, err := storage.EnumerateFiles(dataPath, from, to, "deadweight.csv")
-	if err != nil {
-		return nil, err
+// Create events for the new violations.  The times are formatted by `times`, and the time since a
+// job was last seen is taken relative to `now`.
+//
+// If coalesce is true then the event for a job that is keyed cross-host and has been seen on
+// several hosts is marked as coalesced, so that the text report lists the hosts.  Only a job that
+// is keyed cross-host is one job on several hosts, jobs with the same job# on different hosts are
+// otherwise unrelated and are separate events.
+
+func createDeadweightReport(
+	violations []*jobstate.Violation,
+	now time.Time,
+	times *util.TimeFormatter,
+	coalesce bool,
+) []*perEvent {
+	events := make([]*perEvent, 0)
+	for _, v := range violations {
+		j := v.State
+		events = append(events,
+			&perEvent{
+				Host:                j.Host,
+				Id:                  j.Id,
+				User:                v.Job.User,
+				Cmd:                 v.Job.Cmd,
+				RawCmd:              v.Job.RawCmd,
+				StartedOnOrBefore:   times.Format(j.StartedOnOrBefore),
+				FirstViolation:      times.Format(j.FirstViolation),
+				LastSeen:            times.Format(j.LastSeen),
+				EventId:             util.EventId(v.Key.Host, j.Id, j.FirstViolation),
+				RunningFor:          util.FormatDuration(j.Duration),
+				StartedBeforeWindow: v.StartedBeforeWindow,
+				unseenHours:         now.Sub(j.LastSeen).Hours(),
+				coalesced:           coalesce && strings.Contains(j.Host, ","),
+			})
 	}
+	return events
+}
 
-	jobs := make(map[jobstate.JobKey]*deadweightJob)
-	for _, filePath := range files {
-		records, err := storage.ReadFreeCSV(path.Join(dataPath, filePath))
+func formatDeadweightReports(events []*perEvent, templates *template.Template) ([]*util.JobReport, error) {
+	reports := make([]*util.JobReport, 0)
+	for _, e := range events {
+		report, err := util.FormatReport(templates, "deadweight", e)
 		if err != nil {
-			continue
-		}
-
-		for _, r := range records {
-			success := true
-			tag := storage.GetString(r, "tag", &success)
-			success = success && tag == "deadweight"
-			now := storage.GetDateTime(r, "now", &success)
-			id := storage.GetJobMark(r, "jobm", &success)
-			user := storage.GetString(r, "user", &success)
-			host := storage.GetString(r, "host", &success)
-			cmd := storage.GetString(r, "cmd", &success)
-			start := storage.GetDateTime(r, "start", &success)
-			end := storage.GetDateTime(r, "end", &success)
-			// TODO: duration
-
-			if !success {
-				continue
-			}
-
-			key := jobstate.JobKey{Id: id, Host: host}
-			if r, present := jobs[key]; present {
-				// id, user, and host are fixed - host b/c this is the view of a job on the ml nodes
-				// TODO: cmd can change b/c of sonalyze's view on the job.
-				r.firstSeen = util.MinTime(r.firstSeen, now)
-				r.lastSeen = util.MaxTime(r.lastSeen, now)
-				r.start = util.MinTime(r.start, start)
-				r.end = util.MaxTime(r.end, end)
-				// TODO: Duration
-			} else {
-				firstSeen := now
-				lastSeen := now
-				jobs[key] = &deadweightJob{
-					id,
-					host,
-					user,
-					cmd,
-					firstSeen,
-					lastSeen,
-					start,
-					end,
-					// TODO: duration
-				}
-			}
-
+			return nil, err
 		}
+		reports = append(reports, &util.JobReport{
+			Id: e.Id, Host: e.Host, User: e.User, Report: report, Data: e, Severity: e.unseenHours,
+		})
 	}
 
-	return jobs, nil
+	return reports, nil
 }
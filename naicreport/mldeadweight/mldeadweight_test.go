@@ -0,0 +1,86 @@
+package mldeadweight
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"naicreport/util"
+)
+
+func TestCoalesceHosts(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	defer os.RemoveAll(td_name)
+	log := `now=2023-09-11 12:00,jobm=10,user=a,host=ml7,cmd=python,start=2023-09-11 11:00,end=2023-09-11 12:00,tag=deadweight
+now=2023-09-11 12:00,jobm=10,user=a,host=ml6,cmd=python,start=2023-09-11 10:00,end=2023-09-11 12:00,tag=deadweight
+now=2023-09-11 12:00,jobm=11,user=b,host=ml6,cmd=python,start=2023-09-11 10:00,end=2023-09-11 12:00,tag=deadweight
+`
+	err = os.MkdirAll(path.Join(td_name, "2023/09/11"), 0755)
+	if err == nil {
+		err = os.WriteFile(path.Join(td_name, "2023/09/11/deadweight.csv"), []byte(log), 0644)
+	}
+	if err != nil {
+		t.Fatalf("Could not set up data %q", err)
+	}
+
+	now := time.Date(2023, 9, 11, 14, 0, 0, 0, time.UTC)
+	analyze := func(args ...string) []*util.JobReport {
+		progOpts := util.NewStandardOptions("test")
+		progOpts.Clock = &util.FakeClock{T: now}
+		analysisOpts := util.NewAnalysisOptions(progOpts)
+		err := progOpts.Parse(append([]string{"--data-path", td_name, "--from", "2023-09-11", "--to", "2023-09-11"},
+			args...))
+		if err != nil {
+			t.Fatalf("Parse failed %v", err)
+		}
+		reports, _, err := Analyze(context.Background(), progOpts, analysisOpts, true)
+		if err != nil {
+			t.Fatalf("Analyze failed %v", err)
+		}
+		util.SortReports(reports)
+		return reports
+	}
+
+	// Without --cross-host the jobs with the same job# and user on two hosts are unrelated.
+	reports := analyze()
+	if len(reports) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(reports))
+	}
+	for _, r := range reports {
+		if e := r.Data.(*perEvent); strings.Contains(e.Host, ",") || e.coalesced {
+			t.Fatalf("Bad event %v", e)
+		}
+	}
+
+	// With --cross-host job 10 is one job on both hosts, whose report lists the hosts.
+	reports = analyze("--cross-host")
+	if len(reports) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(reports))
+	}
+	for _, r := range reports {
+		e := r.Data.(*perEvent)
+		switch e.Id {
+		case 10:
+			if e.Host != "ml6,ml7" || !e.coalesced || e.StartedOnOrBefore != "2023-09-11 10:00" ||
+				e.EventId != util.EventId("", 10, now) {
+				t.Fatalf("Bad coalesced event %v", e)
+			}
+			if !strings.HasPrefix(r.Report,
+				"New pointless job detected (zombie, defunct, or hung) on several hosts:\n  Hosts: ml6, ml7\n  Job#: 10\n") {
+				t.Fatalf("Bad report %s", r.Report)
+			}
+		case 11:
+			if e.Host != "ml6" || e.coalesced {
+				t.Fatalf("Bad event %v", e)
+			}
+		default:
+			t.Fatalf("Bad event %v", e)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+// The ml-nodes gpuhog analysis is the mirror image of the cpuhog analysis: it runs every 12h (at
+// least), examining data from the previous 24h, and will append information about jobs that hold
+// on to GPUs but barely use them to a daily log.  As for cpuhog this generates a fair amount of
+// redundancy under normal circumstances.
+//
+// The present component runs occasionally (tbd) and filters / resolves the redundancy and creates
+// formatted reports about new violations.  For this it maintains state about what it's already seen
+// and reported.
+//
+// For now this code is specific to the ML nodes, hence the "ml" in all the names.
+//
+// Requirements:
+//
+//  - a job that appears in the gpuhog log is a gpu hog and should be reported
+//  - the report is (for now) some textual output of the form shown below
+//  - we don't want to report jobs redundantly, so there will have to be persistent state
+//  - we don't want the state to grow without bound
+//
+// Report format (when not JSON):
+//
+//     New GPU hog detected (holds GPUs with low utilization) on host "XX":
+//       Job#: n
+//       User: username
+//       Command: command name
+//       Violation first detected: <date>  // as for cpuhog, see --first-violation-source
+//       Started on or before: <date>      // this is the start-time in the earliest record
+//       Observed data:
+//          GPU peak = n cards
+//          GPU utilization avg/peak = n%, m%
+//          GPU memory utilization avg/peak = n%, m%
+
+package mlgpuhog
+
+import (
+	"context"
+	_ "embed"
+	"text/template"
+	"time"
+
+	"naicreport/jobstate"
+	"naicreport/util"
+)
+
+// The default templates of the text reports, see util/reporttemplate.go.
+
+//go:embed report.tmpl
+var reportTemplates string
+
+const (
+	// The name of the state file in the data directory, exported for the benefit of `reset`.
+	GpuhogStateFilename = "gpuhog-state.csv"
+
+	// The name of the cache of summaries of the log files in the data directory, see --cache.
+	GpuhogCacheFilename = "gpuhog-cache.gob"
+)
+
+// The fields whose maxima are taken across a job's records, in the order of the Peaks of the job
+// summaries, see storage.JobSummary.
+
+var gpuhogPeakFields = []string{"gpu-peak", "rgpu-avg", "rgpu-peak", "rgpumem-avg", "rgpumem-peak"}
+
+// The indices of the fields in the Peaks of a jobstate.LoggedJob.
+
+const (
+	gpuPeakIx = iota
+	rgpuAvgIx
+	rgpuPeakIx
+	rgpumemAvgIx
+	rgpumemPeakIx
+)
+
+func MlGpuhog(progname string, args []string) error {
+	progOpts := util.NewStandardOptions(progname + " ml-gpuhog")
+	analysisOpts := util.NewAnalysisOptions(progOpts)
+	err := progOpts.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	events := 0
+	err = Run(context.Background(), progOpts, analysisOpts, func(reports []*util.JobReport) error {
+		events = len(reports)
+		return util.OutputReports(progOpts, analysisOpts, reports, NewEvent())
+	})
+	if err != nil {
+		return err
+	}
+	err = progOpts.WriteRunManifest()
+	if err != nil {
+		return err
+	}
+	return analysisOpts.EventsResult(events)
+}
+
+// Run the gpuhog analysis as the ml-gpuhog verb does once its options have been parsed, but pass
+// the reports for the new violations to `emit` instead of writing them, see jobstate.RunAnalysis.
+// This is the entry point for running the analysis from another program, see
+// util.NewEmbeddedOptions.
+
+func Run(
+	ctx context.Context,
+	progOpts *util.StandardOptions,
+	analysisOpts *util.AnalysisOptions,
+	emit func([]*util.JobReport) error,
+) error {
+	return jobstate.RunAnalysis(ctx, progOpts, analysisOpts, gpuhogAnalysis, emit)
+}
+
+// Run the gpuhog analysis for the time window and return the reports for the new violations
+// along with the updated state.  The caller must write the state unless this is a dry run.
+
+func Analyze(
+	ctx context.Context,
+	progOpts *util.StandardOptions,
+	analysisOpts *util.AnalysisOptions,
+) ([]*util.JobReport, map[jobstate.JobKey]*jobstate.JobState, error) {
+	return jobstate.Analyze(ctx, progOpts, analysisOpts, gpuhogAnalysis)
+}
+
+var gpuhogAnalysis = &jobstate.Analysis{
+	Name:          "gpuhog",
+	StateFilename: GpuhogStateFilename,
+	CacheFilename: GpuhogCacheFilename,
+	PeakFields:    gpuhogPeakFields,
+	Event:         &perEvent{},
+	Templates:     reportTemplates,
+	Report: func(
+		violations []*jobstate.Violation,
+		now time.Time,
+		times *util.TimeFormatter,
+		templates *template.Template,
+	) ([]*util.JobReport, error) {
+		return formatGpuhogReports(createGpuhogReport(violations, times), templates)
+	},
+}
+
+// The order of the fields is the column order of the CSV output and must not change.
+
+type perEvent struct {
+	Host                string `json:"hostname"`
+	Id                  uint32 `json:"id"`
+	User                string `json:"user"`
+	Cmd                 string `json:"cmd"`
+	RawCmd              string `json:"raw-cmd"`
+	StartedOnOrBefore   string `json:"started-on-or-before"`
+	FirstViolation      string `json:"first-violation"`
+	GpuPeak             uint32 `json:"gpu-peak" unit:"cards"`
+	RGpuAvg             uint32 `json:"rgpu-avg" unit:"percent"`
+	RGpuPeak            uint32 `json:"rgpu-peak" unit:"percent"`
+	RGpuMemAvg          uint32 `json:"rgpumem-avg" unit:"percent"`
+	RGpuMemPeak         uint32 `json:"rgpumem-peak" unit:"percent"`
+	EventId             string `json:"event-id"`
+	RunningFor          string `json:"running-for"`
+	StartedBeforeWindow bool   `json:"started-before-window,omitempty"`
+}
+
+// A new event of the analysis, for describing the fields of the events, see util.EventSchema.
+
+func NewEvent() any {
+	return &perEvent{}
+}
+
+// Create events for the new violations, whose times are formatted by `times`.
+
+func createGpuhogReport(violations []*jobstate.Violation, times *util.TimeFormatter) []*perEvent {
+	events := make([]*perEvent, 0)
+	for _, v := range violations {
+		jobState, job := v.State, v.Job
+		events = append(events,
+			&perEvent{
+				Host:                jobState.Host,
+				Id:                  jobState.Id,
+				User:                job.User,
+				Cmd:                 job.Cmd,
+				RawCmd:              job.RawCmd,
+				StartedOnOrBefore:   times.Format(jobState.StartedOnOrBefore),
+				FirstViolation:      times.Format(jobState.FirstViolation),
+				EventId:             util.EventId(v.Key.Host, jobState.Id, jobState.FirstViolation),
+				RunningFor:          util.FormatDuration(jobState.Duration),
+				StartedBeforeWindow: v.StartedBeforeWindow,
+				GpuPeak:             uint32(job.Peaks[gpuPeakIx] / 100),
+				RGpuAvg:             uint32(job.Peaks[rgpuAvgIx]),
+				RGpuPeak:            uint32(job.Peaks[rgpuPeakIx]),
+				RGpuMemAvg:          uint32(job.Peaks[rgpumemAvgIx]),
+				RGpuMemPeak:         uint32(job.Peaks[rgpumemPeakIx]),
+			})
+	}
+	return events
+}
+
+func formatGpuhogReports(events []*perEvent, templates *template.Template) ([]*util.JobReport, error) {
+	reports := make([]*util.JobReport, 0)
+	for _, e := range events {
+		report, err := util.FormatReport(templates, "gpuhog", e)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, &util.JobReport{
+			Id: e.Id, Host: e.Host, User: e.User, Report: report, Data: e, Severity: float64(e.GpuPeak),
+		})
+	}
+
+	return reports, nil
+}
@@ -0,0 +1,71 @@
+package mlgpuhog
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"naicreport/jobstate"
+	"naicreport/storage"
+	"naicreport/util"
+)
+
+func TestReadLogFiles(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+
+	// The file on September 5 has two records for one job and one for another
+	dataPath := path.Join(wd, "../../sonar_test_data0")
+	from := time.Date(2023, 9, 5, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 9, 6, 0, 0, 0, 0, time.UTC)
+	jobLog, _, _, err := jobstate.ReadLogFiles(context.Background(), "gpuhog", gpuhogPeakFields,
+		[]string{dataPath}, from, to, 1, nil, false, nil, storage.DefaultCSVFormat, nil)
+	if err != nil {
+		t.Fatalf("Could not read: %q", err)
+	}
+
+	if len(jobLog) != 2 {
+		t.Fatalf("Unexpected job log length %d", len(jobLog))
+	}
+	x, found := jobLog[jobstate.JobKey{Id: 1249151, Host: "ml7"}]
+	if !found {
+		t.Fatalf("Could not find record")
+	}
+	if x.Id != 1249151 || x.Host != "ml7" || x.User != "larsbent" || x.Cmd != "python" ||
+		x.FirstSeen != time.Date(2023, 9, 5, 10, 0, 0, 0, time.UTC) ||
+		x.LastSeen != time.Date(2023, 9, 5, 12, 0, 0, 0, time.UTC) ||
+		x.Start != time.Date(2023, 9, 5, 7, 55, 0, 0, time.UTC) ||
+		x.End != time.Date(2023, 9, 5, 11, 55, 0, 0, time.UTC) ||
+		x.Peaks[gpuPeakIx] != 300 || x.Peaks[rgpuAvgIx] != 3 || x.Peaks[rgpuPeakIx] != 5 ||
+		x.Peaks[rgpumemAvgIx] != 11 || x.Peaks[rgpumemPeakIx] != 12 {
+		t.Fatalf("Bad record %v", x)
+	}
+}
+
+func TestReadLogFilesHostFilter(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	hosts, err := util.NewHostFilter("ml6")
+	if err != nil {
+		t.Fatalf("NewHostFilter failed %v", err)
+	}
+
+	// The file on September 5 has jobs on ml6 and ml7
+	dataPath := path.Join(wd, "../../sonar_test_data0")
+	from := time.Date(2023, 9, 5, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 9, 6, 0, 0, 0, 0, time.UTC)
+	jobLog, _, _, err := jobstate.ReadLogFiles(context.Background(), "gpuhog", gpuhogPeakFields,
+		[]string{dataPath}, from, to, 1, nil, false, hosts, storage.DefaultCSVFormat, nil)
+	if err != nil {
+		t.Fatalf("Could not read: %q", err)
+	}
+	if _, found := jobLog[jobstate.JobKey{Id: 77331, Host: "ml6"}]; len(jobLog) != 1 || !found {
+		t.Fatalf("Bad filtering")
+	}
+}
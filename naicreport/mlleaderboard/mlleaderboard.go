@@ -0,0 +1,168 @@
+// Generate a leaderboard of the users that have consumed the most resources on the ML systems in
+// the time window.  The data are taken from the live sonar logs, by means of `sonalyze jobs`.
+//
+// For each job, the consumption of a resource is taken to be the average utilization of the
+// resource times the duration of the job, so CPU consumption is in core-hours, GPU consumption in
+// card-hours, and memory consumption in GB-hours.  The consumption is summed across all the jobs of
+// each user, and the relative consumption is the user's share of the total for all users.
+//
+// Report format (when not JSON):
+//
+//   User            CPU-hours   CPU%  GPU-hours   GPU%   Mem-GBh   Mem%
+//   someuser           1234.5   45.2       12.0    3.1     500.0   12.4
+//   ...
+
+package mlleaderboard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"naicreport/storage"
+	"naicreport/util"
+)
+
+const (
+	sonalyzeFormat = "user,duration,cpu-avg,gpu-avg,mem-avg"
+)
+
+type perUser struct {
+	User       string  `json:"user"`
+	CpuHours   float64 `json:"cpu-hours"`
+	CpuPercent float64 `json:"cpu-pct"`
+	GpuHours   float64 `json:"gpu-hours"`
+	GpuPercent float64 `json:"gpu-pct"`
+	MemGBHours float64 `json:"mem-gb-hours"`
+	MemPercent float64 `json:"mem-pct"`
+}
+
+func MlLeaderboard(progname string, args []string) error {
+	// Parse and sanitize options
+
+	progOpts := util.NewStandardOptions(progname + " ml-leaderboard")
+	sonalyzePathPtr := progOpts.Container.String("sonalyze", "", "Path to sonalyze executable (required)")
+	rankByPtr := progOpts.Container.String("rank-by", "cpu", "Rank users by consumption of cpu, gpu, or mem")
+	jsonOutput := progOpts.Container.Bool("json", false, "Format output as JSON")
+	err := progOpts.Parse(args)
+	if err != nil {
+		return err
+	}
+	sonalyzePath, err := util.CleanPath(*sonalyzePathPtr, "-sonalyze")
+	if err != nil {
+		return err
+	}
+	var key func(u *perUser) float64
+	switch *rankByPtr {
+	case "cpu":
+		key = func(u *perUser) float64 { return u.CpuHours }
+	case "gpu":
+		key = func(u *perUser) float64 { return u.GpuHours }
+	case "mem":
+		key = func(u *perUser) float64 { return u.MemGBHours }
+	default:
+		return errors.New("The value of --rank-by must be cpu, gpu, or mem")
+	}
+
+	// Assemble sonalyze arguments and run it, collecting its output
+
+	arguments := util.SonalyzeArgs("jobs", progOpts, "", sonalyzeFormat)
+	arguments = append(arguments, "-u", "-")
+	stdout, err := util.RunSonalyze(sonalyzePath, arguments)
+	if err != nil {
+		return err
+	}
+
+	// Interpret the output from sonalyze, aggregate and rank
+
+	users, err := parseOutput(stdout)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(users, func(i, j int) bool {
+		return key(users[i]) > key(users[j])
+	})
+
+	var output strings.Builder
+	if *jsonOutput {
+		bytes, err := json.Marshal(users)
+		if err != nil {
+			return err
+		}
+		output.Write(bytes)
+	} else {
+		writeLeaderboard(&output, users)
+	}
+	err = util.WriteOutput(progOpts.OutputFile, output.String())
+	if err != nil {
+		return err
+	}
+	return progOpts.WriteRunManifest()
+}
+
+func writeLeaderboard(out io.Writer, users []*perUser) {
+	fmt.Fprintf(out, "%-15s %10s %6s %10s %6s %10s %6s\n",
+		"User", "CPU-hours", "CPU%", "GPU-hours", "GPU%", "Mem-GBh", "Mem%")
+	for _, u := range users {
+		fmt.Fprintf(out, "%-15s %10.1f %6.1f %10.1f %6.1f %10.1f %6.1f\n",
+			u.User, u.CpuHours, u.CpuPercent, u.GpuHours, u.GpuPercent, u.MemGBHours, u.MemPercent)
+	}
+}
+
+// The output from sonalyze has one record per job.  Aggregate them by user and compute the relative
+// values.  The result is sorted by user name.
+
+func parseOutput(output string) ([]*perUser, error) {
+	rows, err := storage.ParseFreeCSV(strings.NewReader(output))
+	if err != nil {
+		return nil, err
+	}
+
+	byUser := make(map[string]*perUser)
+	var cpuTotal, gpuTotal, memTotal float64
+	for _, row := range rows {
+		success := true
+		user := storage.GetString(row, "user", &success)
+		duration := storage.GetDuration(row, "duration", &success)
+		cpuAvg := storage.GetFloat64(row, "cpu-avg", &success)
+		gpuAvg := storage.GetFloat64(row, "gpu-avg", &success)
+		memAvg := storage.GetFloat64(row, "mem-avg", &success)
+		if !success {
+			continue
+		}
+		hours := duration.Hours()
+		u, found := byUser[user]
+		if !found {
+			u = &perUser{User: user}
+			byUser[user] = u
+		}
+		u.CpuHours += cpuAvg / 100 * hours
+		u.GpuHours += gpuAvg / 100 * hours
+		u.MemGBHours += memAvg * hours
+		cpuTotal += cpuAvg / 100 * hours
+		gpuTotal += gpuAvg / 100 * hours
+		memTotal += memAvg * hours
+	}
+
+	users := make([]*perUser, 0)
+	for _, u := range byUser {
+		u.CpuPercent = percentOf(u.CpuHours, cpuTotal)
+		u.GpuPercent = percentOf(u.GpuHours, gpuTotal)
+		u.MemPercent = percentOf(u.MemGBHours, memTotal)
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].User < users[j].User
+	})
+	return users, nil
+}
+
+func percentOf(x, total float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return x / total * 100
+}
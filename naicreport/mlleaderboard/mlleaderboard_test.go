@@ -0,0 +1,30 @@
+package mlleaderboard
+
+import (
+	"testing"
+)
+
+func TestParseOutput(t *testing.T) {
+	output := `user=a,duration=0d 2h0m,cpu-avg=200,gpu-avg=0,mem-avg=10
+user=b,duration=1d 0h0m,cpu-avg=100,gpu-avg=50,mem-avg=2
+user=a,duration=0d 1h0m,cpu-avg=400,gpu-avg=100,mem-avg=4
+user=c,duration=bogus,cpu-avg=100,gpu-avg=100,mem-avg=1
+`
+	users, err := parseOutput(output)
+	if err != nil {
+		t.Fatalf("parseOutput failed: %v", err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("Bad number of users %d", len(users))
+	}
+	a, b := users[0], users[1]
+	if a.User != "a" || a.CpuHours != 8 || a.GpuHours != 1 || a.MemGBHours != 24 {
+		t.Fatalf("Bad record for a: %v", a)
+	}
+	if b.User != "b" || b.CpuHours != 24 || b.GpuHours != 12 || b.MemGBHours != 48 {
+		t.Fatalf("Bad record for b: %v", b)
+	}
+	if a.CpuPercent != 25 || b.CpuPercent != 75 || a.GpuPercent+b.GpuPercent < 99.9 {
+		t.Fatalf("Bad percentages %v %v", a, b)
+	}
+}
@@ -0,0 +1,196 @@
+// The ml-nodes memhog analysis finds jobs that hold a lot of memory while barely computing, which
+// blocks other jobs from being scheduled, and appends information about them to a daily log in the
+// same way as the cpuhog analysis.
+//
+// The present component consolidates the log records and creates formatted reports about new
+// violations, maintaining state about what it has already seen and reported, just as for cpuhog.
+//
+// Report format (when not JSON):
+//
+//     New memory hog detected (high memory, low CPU/GPU) on host "XX":
+//       Job#: n
+//       User: username
+//       Command: command name
+//       Started on or before: <date>
+//       Violation first detected: <date>
+//       Observed data:
+//          Memory utilization avg/peak = n%, m%
+//          CPU utilization avg/peak = n%, m%
+//          GPU utilization avg/peak = n%, m%
+
+package mlmemhog
+
+import (
+	"context"
+	_ "embed"
+	"text/template"
+	"time"
+
+	"naicreport/jobstate"
+	"naicreport/util"
+)
+
+// The default templates of the text reports, see util/reporttemplate.go.
+
+//go:embed report.tmpl
+var reportTemplates string
+
+const (
+	// The name of the state file in the data directory, exported for the benefit of `reset`.
+	MemhogStateFilename = "memhog-state.csv"
+
+	// The name of the cache of summaries of the log files in the data directory, see --cache.
+	MemhogCacheFilename = "memhog-cache.gob"
+)
+
+// The fields whose maxima are taken across a job's records, in the order of the Peaks of the job
+// summaries, see storage.JobSummary.
+
+var memhogPeakFields = []string{"rmem-avg", "rmem-peak", "rcpu-avg", "rcpu-peak", "rgpu-avg", "rgpu-peak"}
+
+// The indices of the fields in the Peaks of a jobstate.LoggedJob.
+
+const (
+	rmemAvgIx = iota
+	rmemPeakIx
+	rcpuAvgIx
+	rcpuPeakIx
+	rgpuAvgIx
+	rgpuPeakIx
+)
+
+func MlMemhog(progname string, args []string) error {
+	progOpts := util.NewStandardOptions(progname + " ml-memhog")
+	analysisOpts := util.NewAnalysisOptions(progOpts)
+	err := progOpts.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	events := 0
+	err = Run(context.Background(), progOpts, analysisOpts, func(reports []*util.JobReport) error {
+		events = len(reports)
+		return util.OutputReports(progOpts, analysisOpts, reports, NewEvent())
+	})
+	if err != nil {
+		return err
+	}
+	err = progOpts.WriteRunManifest()
+	if err != nil {
+		return err
+	}
+	return analysisOpts.EventsResult(events)
+}
+
+// Run the memhog analysis as the ml-memhog verb does once its options have been parsed, but pass
+// the reports for the new violations to `emit` instead of writing them, see jobstate.RunAnalysis.
+// This is the entry point for running the analysis from another program, see
+// util.NewEmbeddedOptions.
+
+func Run(
+	ctx context.Context,
+	progOpts *util.StandardOptions,
+	analysisOpts *util.AnalysisOptions,
+	emit func([]*util.JobReport) error,
+) error {
+	return jobstate.RunAnalysis(ctx, progOpts, analysisOpts, memhogAnalysis, emit)
+}
+
+// Run the memhog analysis for the time window and return the reports for the new violations
+// along with the updated state.  The caller must write the state unless this is a dry run.
+
+func Analyze(
+	ctx context.Context,
+	progOpts *util.StandardOptions,
+	analysisOpts *util.AnalysisOptions,
+) ([]*util.JobReport, map[jobstate.JobKey]*jobstate.JobState, error) {
+	return jobstate.Analyze(ctx, progOpts, analysisOpts, memhogAnalysis)
+}
+
+var memhogAnalysis = &jobstate.Analysis{
+	Name:          "memhog",
+	StateFilename: MemhogStateFilename,
+	CacheFilename: MemhogCacheFilename,
+	PeakFields:    memhogPeakFields,
+	Event:         &perEvent{},
+	Templates:     reportTemplates,
+	Report: func(
+		violations []*jobstate.Violation,
+		now time.Time,
+		times *util.TimeFormatter,
+		templates *template.Template,
+	) ([]*util.JobReport, error) {
+		return formatMemhogReports(createMemhogReport(violations, times), templates)
+	},
+}
+
+// The order of the fields is the column order of the CSV output and must not change.
+
+type perEvent struct {
+	Host                string `json:"hostname"`
+	Id                  uint32 `json:"id"`
+	User                string `json:"user"`
+	Cmd                 string `json:"cmd"`
+	RawCmd              string `json:"raw-cmd"`
+	StartedOnOrBefore   string `json:"started-on-or-before"`
+	FirstViolation      string `json:"first-violation"`
+	RMemAvg             uint32 `json:"rmem-avg" unit:"percent"`
+	RMemPeak            uint32 `json:"rmem-peak" unit:"percent"`
+	RCpuAvg             uint32 `json:"rcpu-avg" unit:"percent"`
+	RCpuPeak            uint32 `json:"rcpu-peak" unit:"percent"`
+	RGpuAvg             uint32 `json:"rgpu-avg" unit:"percent"`
+	RGpuPeak            uint32 `json:"rgpu-peak" unit:"percent"`
+	EventId             string `json:"event-id"`
+	RunningFor          string `json:"running-for"`
+	StartedBeforeWindow bool   `json:"started-before-window,omitempty"`
+}
+
+// A new event of the analysis, for describing the fields of the events, see util.EventSchema.
+
+func NewEvent() any {
+	return &perEvent{}
+}
+
+// Create events for the new violations, whose times are formatted by `times`.
+
+func createMemhogReport(violations []*jobstate.Violation, times *util.TimeFormatter) []*perEvent {
+	events := make([]*perEvent, 0)
+	for _, v := range violations {
+		jobState, job := v.State, v.Job
+		events = append(events,
+			&perEvent{
+				Host:                jobState.Host,
+				Id:                  jobState.Id,
+				User:                job.User,
+				Cmd:                 job.Cmd,
+				RawCmd:              job.RawCmd,
+				StartedOnOrBefore:   times.Format(jobState.StartedOnOrBefore),
+				FirstViolation:      times.Format(jobState.FirstViolation),
+				EventId:             util.EventId(v.Key.Host, jobState.Id, jobState.FirstViolation),
+				RunningFor:          util.FormatDuration(jobState.Duration),
+				StartedBeforeWindow: v.StartedBeforeWindow,
+				RMemAvg:             uint32(job.Peaks[rmemAvgIx]),
+				RMemPeak:            uint32(job.Peaks[rmemPeakIx]),
+				RCpuAvg:             uint32(job.Peaks[rcpuAvgIx]),
+				RCpuPeak:            uint32(job.Peaks[rcpuPeakIx]),
+				RGpuAvg:             uint32(job.Peaks[rgpuAvgIx]),
+				RGpuPeak:            uint32(job.Peaks[rgpuPeakIx]),
+			})
+	}
+	return events
+}
+
+func formatMemhogReports(events []*perEvent, templates *template.Template) ([]*util.JobReport, error) {
+	reports := make([]*util.JobReport, 0)
+	for _, e := range events {
+		report, err := util.FormatReport(templates, "memhog", e)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, &util.JobReport{
+			Id: e.Id, Host: e.Host, User: e.User, Report: report, Data: e, Severity: float64(e.RMemPeak),
+		})
+	}
+
+	return reports, nil
+}
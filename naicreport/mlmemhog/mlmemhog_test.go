@@ -0,0 +1,47 @@
+package mlmemhog
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"naicreport/jobstate"
+	"naicreport/storage"
+)
+
+func TestReadLogFiles(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+
+	// The file on September 5 has two records for one job
+	dataPath := path.Join(wd, "../../sonar_test_data0")
+	from := time.Date(2023, 9, 5, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 9, 6, 0, 0, 0, 0, time.UTC)
+	jobLog, _, _, err := jobstate.ReadLogFiles(context.Background(), "memhog", memhogPeakFields,
+		[]string{dataPath}, from, to, 1, nil, false, nil, storage.DefaultCSVFormat, nil)
+	if err != nil {
+		t.Fatalf("Could not read: %q", err)
+	}
+
+	if len(jobLog) != 1 {
+		t.Fatalf("Unexpected job log length %d", len(jobLog))
+	}
+	x, found := jobLog[jobstate.JobKey{Id: 2312004, Host: "ml8"}]
+	if !found {
+		t.Fatalf("Could not find record")
+	}
+	if x.Id != 2312004 || x.Host != "ml8" || x.User != "hermanno" || x.Cmd != "python3.10" ||
+		x.FirstSeen != time.Date(2023, 9, 5, 10, 0, 0, 0, time.UTC) ||
+		x.LastSeen != time.Date(2023, 9, 5, 12, 0, 0, 0, time.UTC) ||
+		x.Start != time.Date(2023, 9, 5, 7, 0, 0, 0, time.UTC) ||
+		x.End != time.Date(2023, 9, 5, 12, 0, 0, 0, time.UTC) ||
+		x.Peaks[rmemAvgIx] != 65 || x.Peaks[rmemPeakIx] != 70 ||
+		x.Peaks[rcpuAvgIx] != 2 || x.Peaks[rcpuPeakIx] != 3 ||
+		x.Peaks[rgpuAvgIx] != 0 || x.Peaks[rgpuPeakIx] != 1 {
+		t.Fatalf("Bad record %v", x)
+	}
+}
@@ -0,0 +1,163 @@
+// Find the ML nodes that have been essentially idle for an extended period, so that they can be
+// powered down or reassigned.  The data are taken from the live sonar logs, by means of `sonalyze
+// load`, bucketed hourly, as for ml-webload.
+//
+// A host is idle in an hour if both its relative CPU and relative GPU utilization are below the
+// --idle-threshold (in percent of the system's capacity).  A host is reported if its longest run of
+// idle hours in the time window lasts for at least --idle-duration.  Hours for which there are no
+// data (nothing was logged for the host) do not break a run.
+//
+// Report format (when not JSON):
+//
+//   Idle node detected on host "ml6":
+//     Idle for 36 hours, from 2023-09-05 10:00 to 2023-09-06 22:00
+//     CPU utilization avg idle/window = 1%, 12%
+//     GPU utilization avg idle/window = 0%, 5%
+
+package mlwebload
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"naicreport/util"
+)
+
+const (
+	defaultIdleThreshold = 5
+	defaultIdleDuration  = 24 * time.Hour
+)
+
+type idleHost struct {
+	Host       string  `json:"hostname"`
+	IdleFrom   string  `json:"idle-from"`
+	IdleTo     string  `json:"idle-to"`
+	IdleHours  float64 `json:"idle-hours"`
+	RCpuIdle   float64 `json:"rcpu-avg-idle"`
+	RGpuIdle   float64 `json:"rgpu-avg-idle"`
+	RCpuWindow float64 `json:"rcpu-avg"`
+	RGpuWindow float64 `json:"rgpu-avg"`
+}
+
+func MlIdle(progname string, args []string) error {
+	// Parse and sanitize options
+
+	progOpts := util.NewStandardOptions(progname + " ml-idle")
+	sonalyzePathPtr := progOpts.Container.String("sonalyze", "", "Path to sonalyze executable (required)")
+	configFilenamePtr := progOpts.Container.String("config-file", "", "Path to system config file (required)")
+	thresholdPtr := progOpts.Container.Float64("idle-threshold", defaultIdleThreshold,
+		"Relative CPU and GPU utilization (percent) below which a host is idle")
+	durationPtr := progOpts.Container.Duration("idle-duration", defaultIdleDuration,
+		"Minimum length of an idle period for the host to be reported (eg 24h)")
+	jsonOutput := progOpts.Container.Bool("json", false, "Format output as JSON")
+	err := progOpts.Parse(args)
+	if err != nil {
+		return err
+	}
+	sonalyzePath, err := util.CleanPath(*sonalyzePathPtr, "-sonalyze")
+	if err != nil {
+		return err
+	}
+	configFilename, err := util.CleanPath(*configFilenamePtr, "-config-file")
+	if err != nil {
+		return err
+	}
+	if *thresholdPtr <= 0 {
+		return errors.New("The value of --idle-threshold must be positive")
+	}
+	if *durationPtr <= 0 {
+		return errors.New("The value of --idle-duration must be positive")
+	}
+
+	output, err := runSonalyzeLoad(sonalyzePath, configFilename, progOpts, "", "hourly", false)
+	if err != nil {
+		return err
+	}
+
+	hosts := findIdleHosts(output, *thresholdPtr, *durationPtr)
+
+	var report strings.Builder
+	if *jsonOutput {
+		bytes, err := json.Marshal(hosts)
+		if err != nil {
+			return err
+		}
+		report.Write(bytes)
+	} else {
+		writeIdleHosts(&report, hosts)
+	}
+	err = util.WriteOutput(progOpts.OutputFile, report.String())
+	if err != nil {
+		return err
+	}
+	return progOpts.WriteRunManifest()
+}
+
+func writeIdleHosts(out io.Writer, hosts []*idleHost) {
+	for _, h := range hosts {
+		fmt.Fprintf(out, `Idle node detected on host "%s":
+  Idle for %.0f hours, from %s to %s
+  CPU utilization avg idle/window = %.0f%%, %.0f%%
+  GPU utilization avg idle/window = %.0f%%, %.0f%%
+
+`,
+			h.Host, h.IdleHours, h.IdleFrom, h.IdleTo, h.RCpuIdle, h.RCpuWindow, h.RGpuIdle, h.RGpuWindow)
+	}
+}
+
+// The data for each host are hourly and sorted by time, see parseOutput.  The result is in the order
+// of the hosts in the input.
+
+func findIdleHosts(output []*hostData, threshold float64, minDuration time.Duration) []*idleHost {
+	hosts := make([]*idleHost, 0)
+	for _, hd := range output {
+		if len(hd.data) == 0 {
+			continue
+		}
+
+		var rcpuSum, rgpuSum float64
+		var bestFirst, bestLast int
+		bestLength := time.Duration(0)
+		first := -1
+		for i, d := range hd.data {
+			rcpuSum += d.rcpu
+			rgpuSum += d.rgpu
+			if d.rcpu >= threshold || d.rgpu >= threshold {
+				first = -1
+				continue
+			}
+			if first == -1 {
+				first = i
+			}
+			length := d.datetime.Add(time.Hour).Sub(hd.data[first].datetime)
+			if length > bestLength {
+				bestFirst, bestLast, bestLength = first, i, length
+			}
+		}
+		if bestLength == 0 || bestLength < minDuration {
+			continue
+		}
+
+		var rcpuIdle, rgpuIdle float64
+		for _, d := range hd.data[bestFirst : bestLast+1] {
+			rcpuIdle += d.rcpu
+			rgpuIdle += d.rgpu
+		}
+		n := float64(bestLast - bestFirst + 1)
+		hosts = append(hosts, &idleHost{
+			Host:       hd.hostname,
+			IdleFrom:   hd.data[bestFirst].datetime.Format(util.DateTimeFormat),
+			IdleTo:     hd.data[bestLast].datetime.Add(time.Hour).Format(util.DateTimeFormat),
+			IdleHours:  bestLength.Hours(),
+			RCpuIdle:   rcpuIdle / n,
+			RGpuIdle:   rgpuIdle / n,
+			RCpuWindow: rcpuSum / float64(len(hd.data)),
+			RGpuWindow: rgpuSum / float64(len(hd.data)),
+		})
+	}
+	return hosts
+}
@@ -0,0 +1,40 @@
+package mlwebload
+
+import (
+	"testing"
+	"time"
+)
+
+const idleTestOutput = `datetime=2023-09-05 10:00,cpu=1250.5,mem=100,gpu=0,gpumem=0,rcpu=23,rmem=10,rgpu=0,rgpumem=0,gpus=none,host=ml6
+datetime=2023-09-05 11:00,cpu=10,mem=10,gpu=0,gpumem=0,rcpu=1,rmem=1,rgpu=0,rgpumem=0,gpus=none,host=ml6
+datetime=2023-09-05 12:00,cpu=10,mem=10,gpu=0,gpumem=0,rcpu=3,rmem=1,rgpu=2,rgpumem=0,gpus=none,host=ml6
+datetime=2023-09-05 14:00,cpu=10,mem=10,gpu=0,gpumem=0,rcpu=2,rmem=1,rgpu=0,rgpumem=0,gpus=none,host=ml6
+datetime=2023-09-05 15:00,cpu=10,mem=10,gpu=0,gpumem=0,rcpu=2,rmem=1,rgpu=20,rgpumem=0,gpus=none,host=ml6
+datetime=2023-09-05 10:00,cpu=20,mem=2,gpu=0,gpumem=0,rcpu=1,rmem=1,rgpu=0,rgpumem=0,gpus=unknown,host=ml8
+datetime=2023-09-05 11:00,cpu=20,mem=2,gpu=0,gpumem=0,rcpu=30,rmem=1,rgpu=0,rgpumem=0,gpus=unknown,host=ml8
+`
+
+func TestFindIdleHosts(t *testing.T) {
+	output, err := parseOutput(idleTestOutput)
+	if err != nil {
+		t.Fatalf("parseOutput failed %v", err)
+	}
+
+	// ml6 is idle from 11:00 to 15:00, with a gap at 13:00 that does not break the run; ml8 is idle
+	// for one hour only.
+	hosts := findIdleHosts(output, 5, 4*time.Hour)
+	if len(hosts) != 1 {
+		t.Fatalf("Unexpected number of idle hosts %d", len(hosts))
+	}
+	h := hosts[0]
+	if h.Host != "ml6" || h.IdleFrom != "2023-09-05 11:00" || h.IdleTo != "2023-09-05 15:00" ||
+		h.IdleHours != 4 || h.RCpuIdle != 2 || h.RGpuIdle != 2.0/3 || h.RCpuWindow != 31.0/5 ||
+		h.RGpuWindow != 22.0/5 {
+		t.Fatalf("Bad idle host %v", h)
+	}
+
+	hosts = findIdleHosts(output, 5, time.Hour)
+	if len(hosts) != 2 || hosts[1].Host != "ml8" || hosts[1].IdleHours != 1 {
+		t.Fatalf("Bad idle hosts %v", hosts)
+	}
+}
@@ -6,10 +6,12 @@ package mlwebload
 import (
 	"encoding/json"
 	"errors"
-	"io"
+	"flag"
+	"fmt"
+	"math"
 	"os"
-	"os/exec"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -18,15 +20,6 @@ import (
 	"naicreport/util"
 )
 
-type systemConfig struct {
-	Hostname string    `json:"hostname"`
-	Description string `json:"description"`
-	CpuCores int       `json:"cpu_cores"`
-	MemGB int          `json:"mem_gb"`
-	GpuCards int       `json:"gpu_cards"`
-	GpuMemGB int       `json:"gpumem_gb"`
-}
-
 func MlWebload(progname string, args []string) error {
 	// Parse and sanitize options
 
@@ -37,6 +30,24 @@ func MlWebload(progname string, args []string) error {
 	tagPtr := progOpts.Container.String("tag", "", "Tag for output files")
 	hourlyPtr := progOpts.Container.Bool("hourly", true, "Bucket data hourly")
 	dailyPtr := progOpts.Container.Bool("daily", false, "Bucket data daily")
+	influxPtr := progOpts.Container.Bool("influx", false,
+		"Write the data as InfluxDB line protocol to stdout or --output-file instead of plot files")
+	toleratePartialPtr := progOpts.Container.Bool("tolerate-partial", false,
+		"If sonalyze fails but produced some output, use the output and log a warning")
+	xLabelFormatPtr := progOpts.Container.String("x-label-format", DefaultXLabelFormat,
+		"Go time layout for the x labels of the plots, eg \"2006-01-02 15:04 MST\"")
+	timezonePtr := progOpts.Container.String("timezone", "",
+		"Time zone for the x labels of the plots, eg Europe/Oslo or Local (default UTC)")
+	mergeHostsPtr := progOpts.Container.String("merge-hosts", "",
+		"Merge the hosts into one series named "+MergedHostname+" by \"sum\" or \"average\" of their values")
+	userPtr := progOpts.Container.String("user", "",
+		"Plot the load of this user's jobs only, the user is added to the tag of the output files")
+	prunePtr := progOpts.Container.Bool("prune", false,
+		"Remove the plot files with the same tag for hosts that have no data in this run")
+	histogramPtr := progOpts.Container.Bool("histogram", false,
+		"Write the number of points of each host in each load band as JSON to stdout or --output-file instead of plot files")
+	loadBandsPtr := progOpts.Container.String("load-bands", DefaultLoadBands,
+		"Comma-separated increasing boundaries (in percent) of the load bands of --histogram")
 	err := progOpts.Parse(args)
 	if err != nil {
 		return err
@@ -53,150 +64,636 @@ func MlWebload(progname string, args []string) error {
 	if err != nil {
 		return err
 	}
-		
-	// Assemble sonalyze arguments and run it, collecting its output
-
-	arguments := []string{
-		"load",
-		"--data-path", progOpts.DataPath,
-		"--config-file", configFilename,
-		"--fmt=csvnamed," + sonalyzeFormat,
-	};
-	if progOpts.HaveFrom {
-		arguments = append(arguments, "--from", progOpts.FromStr)
-	}
-	if progOpts.HaveTo {
-		arguments = append(arguments, "--to", progOpts.ToStr)
-	}
-	// This isn't completely clean but it's good enough for not-insane users.
-	// We can use flag.Visit() to do a better job.  This is true in general.
-	var bucketing string
-	if *dailyPtr {
-		arguments = append(arguments, "--daily")
-		bucketing = "daily"
+	labels, err := util.NewTimeFormatter(*xLabelFormatPtr, *timezonePtr)
+	if err != nil {
+		return err
+	}
+
+	// --hourly is on by default, so it is requested along with --daily only if it is given
+	// explicitly.  Then sonalyze is run once, with hourly bucketing, and the daily data are computed
+	// from the hourly data.
+	hourlyGiven := false
+	progOpts.Container.Visit(func(f *flag.Flag) {
+		if f.Name == "hourly" {
+			hourlyGiven = true
+		}
+	})
+	var bucketings []string
+	if *dailyPtr && hourlyGiven && *hourlyPtr {
+		bucketings = []string{"hourly", "daily"}
+	} else if *dailyPtr {
+		bucketings = []string{"daily"}
 	} else if *hourlyPtr {
-		arguments = append(arguments, "--hourly")
-		bucketing = "hourly"
+		bucketings = []string{"hourly"}
 	} else {
 		return errors.New("One of --daily or --hourly is required")
 	}
-
-	cmd := exec.Command(sonalyzePath, arguments...)
-	var stdout strings.Builder
-	var stderr strings.Builder
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err = cmd.Run()
+	if len(bucketings) > 1 && *influxPtr {
+		return errors.New("--influx can't be combined with both --hourly and --daily")
+	}
+	if *histogramPtr && *influxPtr {
+		return errors.New("--histogram can't be combined with --influx")
+	}
+	if len(bucketings) > 1 && *histogramPtr {
+		return errors.New("--histogram can't be combined with both --hourly and --daily")
+	}
+	if *prunePtr && (*influxPtr || *histogramPtr) {
+		return errors.New("--prune can't be combined with --influx or --histogram, which write no plot files")
+	}
+	bounds, err := parseLoadBands(*loadBandsPtr)
 	if err != nil {
-		return errors.Join(err, errors.New(stderr.String()))
+		return err
+	}
+	if *mergeHostsPtr != "" && *mergeHostsPtr != "sum" && *mergeHostsPtr != "average" {
+		return fmt.Errorf("Bad --merge-hosts value %s, must be sum or average", *mergeHostsPtr)
 	}
 
-	// Interpret the output from sonalyze
-
-	output, err := parseOutput(stdout.String())
+	output, err := runSonalyzeLoad(
+		sonalyzePath, configFilename, progOpts, *userPtr, bucketings[0], *toleratePartialPtr)
 	if err != nil {
 		return err
 	}
+	if *mergeHostsPtr != "" {
+		output = mergeHosts(output, *mergeHostsPtr == "average")
+	}
+
+	if *influxPtr {
+		err = util.WriteOutput(progOpts.OutputFile, formatInflux(output, *userPtr))
+		if err != nil {
+			return err
+		}
+		return progOpts.WriteRunManifest()
+	}
+	if *histogramPtr {
+		histogram, err := formatHistogram(output, bucketings[0], bounds)
+		if err != nil {
+			return err
+		}
+		err = util.WriteOutput(progOpts.OutputFile, histogram)
+		if err != nil {
+			return err
+		}
+		return progOpts.WriteRunManifest()
+	}
 
 	// Get the system config if possible
 
-	var configInfo []*systemConfig
-	configFile, err := os.Open(configFilename)
-	if err == nil {
-		bytes, err := io.ReadAll(configFile)
-		if err == nil {
-			err := json.Unmarshal(bytes, &configInfo)
+	configInfo, err := util.LoadSystemConfig(configFilename)
+	if err != nil {
+		progOpts.Log.Warnf("Could not read the system config: %v", err)
+		configInfo = nil
+	}
+
+	// Convert selected fields to JSON
+
+	for _, bucketing := range bucketings {
+		tag, data := *tagPtr, output
+		if *userPtr != "" {
+			tag = appendTag(tag, *userPtr)
+		}
+		if len(bucketings) > 1 {
+			tag = appendTag(tag, bucketing)
+			if bucketing == "daily" {
+				data = dailyBuckets(output)
+			}
+		}
+		err = writePlots(outputPath, tag, bucketing, configInfo, data, labels, progOpts.Clock.Now())
+		if err != nil {
+			return err
+		}
+		if *prunePtr {
+			// If sonalyze found no hosts at all then something is more likely wrong with the logs
+			// than with every host, so the old plots are kept.
+			if len(data) == 0 {
+				progOpts.Log.Warnf("No hosts in the data, not pruning the plot files")
+				continue
+			}
+			pruned, err := prunePlots(outputPath, tag, data)
+			for _, name := range pruned {
+				progOpts.Log.Infof("Removed the stale plot file %s", name)
+			}
 			if err != nil {
-				configInfo = nil
+				return err
 			}
 		}
 	}
+	return progOpts.WriteRunManifest()
+}
 
-	// Convert selected fields to JSON
+// The host name of the series of merged hosts.
+
+const MergedHostname = "ALL"
+
+// Merge the series of the hosts into one series for the synthetic host MergedHostname, with a point
+// for every time at which any host has a point.  The values of a point are the sums of the values
+// of the hosts that have a point at that time, or if `average` is true, their averages; a host
+// without a point at a time does not count.  The GPUs of different hosts can't be merged, so they
+// are unknown.  If there are no hosts then there is no series.
+
+func mergeHosts(output []*hostData, average bool) []*hostData {
+	if len(output) == 0 {
+		return output
+	}
+	points := make(map[int64]*datum)
+	counts := make(map[int64]int)
+	for _, hd := range output {
+		for _, d := range hd.data {
+			key := d.datetime.UnixNano()
+			p, found := points[key]
+			if !found {
+				p = &datum{datetime: d.datetime, hostname: MergedHostname}
+				points[key] = p
+			}
+			counts[key]++
+			p.cpu += d.cpu
+			p.mem += d.mem
+			p.gpu += d.gpu
+			p.gpumem += d.gpumem
+			p.rcpu += d.rcpu
+			p.rmem += d.rmem
+			p.rgpu += d.rgpu
+			p.rgpumem += d.rgpumem
+		}
+	}
+	data := make([]*datum, 0, len(points))
+	for key, p := range points {
+		if average {
+			n := float64(counts[key])
+			p.cpu /= n
+			p.mem /= n
+			p.gpu /= n
+			p.gpumem /= n
+			p.rcpu /= n
+			p.rmem /= n
+			p.rgpu /= n
+			p.rgpumem /= n
+		}
+		data = append(data, p)
+	}
+	return []*hostData{newHostData(MergedHostname, data)}
+}
 
-	return writePlots(outputPath, *tagPtr, bucketing, configInfo, output)
+// The tag of the output files of a run is the --tag, followed by the --user if there is one, and
+// then by the bucketing when several bucketings are produced by the run, eg `week-alice-daily`.
+// Append a part to the tag, or make it the tag if there is none.
+
+func appendTag(tag, part string) string {
+	if tag == "" {
+		return part
+	}
+	return tag + "-" + part
 }
 
-func writePlots(outputPath, tag, bucketing string, configInfo []*systemConfig, output []*hostData) error {
+// Compute daily data from hourly data: the values of a day are the averages of the values of its
+// hours that have data, and the GPUs in use are those that were in use in any hour; they are
+// unknown only if they are unknown for every hour.  The day of a datum is the day in the time zone
+// of its datetime, and the data of each host remain sorted by increasing time.
+
+func dailyBuckets(output []*hostData) []*hostData {
+	result := make([]*hostData, 0, len(output))
+	for _, hd := range output {
+		days := make([]*datum, 0)
+		var day *datum
+		n := 0
+		finish := func() {
+			if day != nil {
+				day.cpu /= float64(n)
+				day.mem /= float64(n)
+				day.gpu /= float64(n)
+				day.gpumem /= float64(n)
+				day.rcpu /= float64(n)
+				day.rmem /= float64(n)
+				day.rgpu /= float64(n)
+				day.rgpumem /= float64(n)
+				days = append(days, day)
+			}
+		}
+		for _, d := range hd.data {
+			y, m, dd := d.datetime.Date()
+			midnight := time.Date(y, m, dd, 0, 0, 0, 0, d.datetime.Location())
+			if day == nil || !day.datetime.Equal(midnight) {
+				finish()
+				day = &datum{datetime: midnight, hostname: d.hostname}
+				n = 0
+			}
+			n++
+			day.cpu += d.cpu
+			day.mem += d.mem
+			day.gpu += d.gpu
+			day.gpumem += d.gpumem
+			day.rcpu += d.rcpu
+			day.rmem += d.rmem
+			day.rgpu += d.rgpu
+			day.rgpumem += d.rgpumem
+			day.gpus = unionGpus(day.gpus, d.gpus)
+		}
+		finish()
+		result = append(result, &hostData{hostname: hd.hostname, data: days})
+	}
+	return result
+}
+
+// The union of two sets of GPUs, in increasing order, where nil is the unknown set.  The union is
+// unknown only if both sets are.
+
+func unionGpus(a, b []uint32) []uint32 {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	seen := make(map[uint32]bool)
+	union := make([]uint32, 0, len(a)+len(b))
+	for _, g := range append(append([]uint32{}, a...), b...) {
+		if !seen[g] {
+			seen[g] = true
+			union = append(union, g)
+		}
+	}
+	sort.Slice(union, func(i, j int) bool {
+		return union[i] < union[j]
+	})
+	return union
+}
+
+// Run `sonalyze load` with the given bucketing ("hourly" or "daily") over the time window of progOpts
+// and return the parsed output.  If user is not "" then only the load of that user's jobs is computed.
+//
+// If sonalyze fails then normally the error is returned.  But if toleratePartial is true and sonalyze
+// produced output that can be parsed and has data for some hosts, then a warning with the error is
+// logged and those data are returned; the data for the last host may be incomplete.
+
+func runSonalyzeLoad(
+	sonalyzePath, configFilename string,
+	progOpts *util.StandardOptions,
+	user, bucketing string,
+	toleratePartial bool,
+) ([]*hostData, error) {
+	arguments := util.SonalyzeArgs("load", progOpts, configFilename, sonalyzeFormat)
+	if user != "" {
+		arguments = append(arguments, "--user", user)
+	}
+	arguments = append(arguments, "--"+bucketing)
+	stdout, err := util.RunSonalyze(sonalyzePath, arguments)
+	if err == nil {
+		return parseOutput(stdout)
+	}
+	if !toleratePartial || strings.TrimSpace(stdout) == "" {
+		return nil, err
+	}
+	output, parseErr := parseOutput(stdout)
+	if parseErr != nil || len(output) == 0 {
+		return nil, err
+	}
+	progOpts.Log.Warnf("Using partial output from sonalyze for %d hosts: %v", len(output), err)
+	return output, nil
+}
+
+// The default layout of the x labels of the plots.  It has neither year nor time zone, so the
+// labels can be ambiguous for long time windows and around DST transitions; use the `t` fields of
+// the points to order them.
+
+const DefaultXLabelFormat = "01-02 15:04"
+
+// Write a JSON file for each host, dated `now`.  The x label of each point is formatted by
+// `labels`, and its `t` is its time in milliseconds since the epoch, which increases along each
+// series (see parseOutput) no matter how the labels are formatted.  The files are written all or
+// nothing, so that a dashboard never shows a mix of fresh and stale plots: all the data are first
+// written to temp files, and only if that succeeds are the temp files renamed to their final names.
+// Otherwise the temp files are removed and the old files remain in place.
+
+func writePlots(
+	outputPath, tag, bucketing string,
+	configInfo *util.SystemConfigs,
+	output []*hostData,
+	labels *util.TimeFormatter,
+	now time.Time,
+) error {
 	// configInfo may be nil
 
 	type perPoint struct {
-		X string   `json:"x"`
-		Y float64  `json:"y"`
+		X string  `json:"x"`
+		T int64   `json:"t"`
+		Y float64 `json:"y"`
 	}
 
 	type perHost struct {
-		Date string          `json:"date"`
-		Hostname string      `json:"hostname"`
-		Tag string           `json:"tag"`
-		Bucketing string     `json:"bucketing"`
-		Rcpu []perPoint      `json:"rcpu"`
-		Rgpu []perPoint      `json:"rgpu"`
-		Rmem []perPoint      `json:"rmem"`
-		Rgpumem []perPoint   `json:"rgpumem"`
-		System *systemConfig `json:"system"`
+		Date      string             `json:"date"`
+		Hostname  string             `json:"hostname"`
+		Tag       string             `json:"tag"`
+		Bucketing string             `json:"bucketing"`
+		Rcpu      []perPoint         `json:"rcpu"`
+		Rgpu      []perPoint         `json:"rgpu"`
+		Rmem      []perPoint         `json:"rmem"`
+		Rgpumem   []perPoint         `json:"rgpumem"`
+		Gpus      []gpuPoint         `json:"gpus"`
+		Summary   hostSummary        `json:"summary"`
+		System    *util.SystemConfig `json:"system"`
 	}
 
 	// Use the same timestamp for all records
-	now := time.Now().Format(util.DateTimeFormat)
+	date := now.Format(util.DateTimeFormat)
 
-	for _, hd := range output {
-		var basename string
-		if tag == "" {
-			basename = hd.hostname + ".json"
-		} else {
-			basename = hd.hostname + "-" + tag + ".json"
-		}
-		filename := path.Join(outputPath, basename)
-		output_file, err := os.CreateTemp(path.Dir(filename), "naicreport-webload")
-		if err != nil {
-			return err
+	// Temp file names and the final names they are to be renamed to.
+	tempnames := make([]string, 0, len(output))
+	filenames := make([]string, 0, len(output))
+	removeTemps := func() {
+		for _, t := range tempnames {
+			os.Remove(t)
 		}
+	}
+
+	for _, hd := range output {
+		filename := path.Join(outputPath, plotBasename(hd.hostname, tag))
 
 		rcpuData := make([]perPoint, 0)
 		rgpuData := make([]perPoint, 0)
 		rmemData := make([]perPoint, 0)
 		rgpumemData := make([]perPoint, 0)
 		for _, d := range hd.data {
-			ts := d.datetime.Format("01-02 15:04")
-			rcpuData = append(rcpuData, perPoint { ts, d.rcpu })
-			rgpuData = append(rgpuData, perPoint { ts, d.rgpu })
-			rmemData = append(rmemData, perPoint { ts, d.rmem })
-			rgpumemData = append(rgpumemData, perPoint { ts, d.rgpumem })
-		}
-		var system *systemConfig
-		if configInfo != nil {
-			for _, s := range configInfo {
-				if s.Hostname == hd.hostname {
-					system = s
-					break
-				}
-			}
+			ts := labels.Format(d.datetime)
+			ms := d.datetime.UnixMilli()
+			rcpuData = append(rcpuData, perPoint{ts, ms, d.rcpu})
+			rgpuData = append(rgpuData, perPoint{ts, ms, d.rgpu})
+			rmemData = append(rmemData, perPoint{ts, ms, d.rmem})
+			rgpumemData = append(rgpumemData, perPoint{ts, ms, d.rgpumem})
 		}
-		bytes, err := json.Marshal(perHost {
-		    Date: now,
-			Hostname: hd.hostname,
-			Tag: tag,
+		system := configInfo.Lookup(hd.hostname)
+		bytes, err := json.Marshal(perHost{
+			Date:      date,
+			Hostname:  hd.hostname,
+			Tag:       tag,
 			Bucketing: bucketing,
-			Rcpu: rcpuData,
-			Rgpu: rgpuData,
-			Rmem: rmemData,
-			Rgpumem: rgpumemData,
-			System: system,
+			Rcpu:      rcpuData,
+			Rgpu:      rgpuData,
+			Rmem:      rmemData,
+			Rgpumem:   rgpumemData,
+			Gpus:      gpuSeries(hd, labels),
+			Summary:   summarize(hd),
+			System:    system,
 		})
 		if err != nil {
+			removeTemps()
+			return err
+		}
+		output_file, err := os.CreateTemp(path.Dir(filename), "naicreport-webload")
+		if err != nil {
+			removeTemps()
+			return err
+		}
+		tempnames = append(tempnames, output_file.Name())
+		filenames = append(filenames, filename)
+		_, err = output_file.Write(bytes)
+		if err == nil {
+			err = output_file.Close()
+		} else {
+			output_file.Close()
+		}
+		if err != nil {
+			removeTemps()
 			return err
 		}
-		output_file.Write(bytes)
-
-		oldname := output_file.Name()
-		output_file.Close()
-		os.Rename(oldname, filename)
 	}
 
+	for i, t := range tempnames {
+		err := os.Rename(t, filenames[i])
+		if err != nil {
+			for _, t := range tempnames[i:] {
+				os.Remove(t)
+			}
+			return err
+		}
+	}
 	return nil
 }
 
+// The name of the plot file for the host and tag, <host>.json or <host>-<tag>.json.
+
+func plotBasename(hostname, tag string) string {
+	if tag == "" {
+		return hostname + ".json"
+	}
+	return hostname + "-" + tag + ".json"
+}
+
+// Remove the plot files in outputPath for the tag whose hosts are not in `output`, eg the files of
+// decommissioned hosts, and return the names of the files removed.  Only files written by writePlots
+// for the tag are removed: the file must be a JSON object whose hostname and tag are those of the
+// plot file by that name, so that other files in the directory, including the plots for other tags
+// (whose names can be those of plots for this tag, as host names can have dashes), are never
+// removed.  Files that can't be read are left alone.
+
+func prunePlots(outputPath, tag string, output []*hostData) ([]string, error) {
+	produced := make(map[string]bool)
+	for _, hd := range output {
+		produced[plotBasename(hd.hostname, tag)] = true
+	}
+	entries, err := os.ReadDir(outputPath)
+	if err != nil {
+		return nil, err
+	}
+	pruned := make([]string, 0)
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || !strings.HasSuffix(name, ".json") || produced[name] {
+			continue
+		}
+		filename := path.Join(outputPath, name)
+		bytes, err := os.ReadFile(filename)
+		if err != nil {
+			continue
+		}
+		var plot struct {
+			Hostname *string `json:"hostname"`
+			Tag      *string `json:"tag"`
+		}
+		if json.Unmarshal(bytes, &plot) != nil || plot.Hostname == nil || plot.Tag == nil ||
+			*plot.Tag != tag || plotBasename(*plot.Hostname, tag) != name {
+			continue
+		}
+		err = os.Remove(filename)
+		if err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, name)
+	}
+	return pruned, nil
+}
+
+// The GPUs in use at a point in time.  Y is nil for "unknown", which is encoded as null, and an empty
+// slice for "none", which is encoded as [].
+
+type gpuPoint struct {
+	X string   `json:"x"`
+	T int64    `json:"t"`
+	Y []uint32 `json:"y"`
+}
+
+func gpuSeries(hd *hostData, labels *util.TimeFormatter) []gpuPoint {
+	gpuData := make([]gpuPoint, 0)
+	for _, d := range hd.data {
+		gpuData = append(gpuData, gpuPoint{labels.Format(d.datetime), d.datetime.UnixMilli(), d.gpus})
+	}
+	return gpuData
+}
+
+// Summary statistics for each series of a host, for quick display.  A series with no known points
+// has a nil summary, which is encoded as null.
+
+type seriesSummary struct {
+	Min    float64 `json:"min"`
+	Avg    float64 `json:"avg"`
+	Peak   float64 `json:"peak"`
+	Points int     `json:"points"`
+}
+
+type hostSummary struct {
+	Rcpu    *seriesSummary `json:"rcpu"`
+	Rgpu    *seriesSummary `json:"rgpu"`
+	Rmem    *seriesSummary `json:"rmem"`
+	Rgpumem *seriesSummary `json:"rgpumem"`
+}
+
+// The GPU values of a point are considered unknown if the GPUs in use at that point are unknown.
+
+func summarize(hd *hostData) hostSummary {
+	var rcpu, rgpu, rmem, rgpumem []float64
+	for _, d := range hd.data {
+		rcpu = append(rcpu, d.rcpu)
+		rmem = append(rmem, d.rmem)
+		if d.gpus != nil {
+			rgpu = append(rgpu, d.rgpu)
+			rgpumem = append(rgpumem, d.rgpumem)
+		}
+	}
+	return hostSummary{
+		Rcpu:    summarizeSeries(rcpu),
+		Rgpu:    summarizeSeries(rgpu),
+		Rmem:    summarizeSeries(rmem),
+		Rgpumem: summarizeSeries(rgpumem),
+	}
+}
+
+func summarizeSeries(values []float64) *seriesSummary {
+	if len(values) == 0 {
+		return nil
+	}
+	s := &seriesSummary{Min: values[0], Peak: values[0], Points: len(values)}
+	sum := 0.0
+	for _, v := range values {
+		s.Min = math.Min(s.Min, v)
+		s.Peak = math.Max(s.Peak, v)
+		sum += v
+	}
+	s.Avg = sum / float64(len(values))
+	return s
+}
+
+// Format the data as InfluxDB line protocol, one line per host and time:
+//
+//   load,host=<hostname> cpu=...,mem=...,gpu=...,gpumem=...,rcpu=...,rmem=...,rgpu=...,rgpumem=... <ns>
+//
+// where the timestamp is nanoseconds since the epoch.  If user is not "" then the data are the load
+// of that user's jobs, and the lines have the tag `user=<user>` after the host.
+
+var influxTagEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ", "=", "\\=")
+
+func formatInflux(output []*hostData, user string) string {
+	var out strings.Builder
+	for _, hd := range output {
+		tags := "host=" + influxTagEscaper.Replace(hd.hostname)
+		if user != "" {
+			tags += ",user=" + influxTagEscaper.Replace(user)
+		}
+		for _, d := range hd.data {
+			fmt.Fprintf(&out, "load,%s cpu=%g,mem=%g,gpu=%g,gpumem=%g,rcpu=%g,rmem=%g,rgpu=%g,rgpumem=%g %d\n",
+				tags, d.cpu, d.mem, d.gpu, d.gpumem, d.rcpu, d.rmem, d.rgpu, d.rgpumem,
+				d.datetime.UnixNano())
+		}
+	}
+	return out.String()
+}
+
+// The default boundaries of the load bands of --histogram, in percent.
+
+const DefaultLoadBands = "25,50,75"
+
+// Parse the boundaries of the load bands, which must be increasing and positive.  The n boundaries
+// give n+1 bands: the first is from 0 to the first boundary, and the last is from the last boundary
+// up, as the relative load can be above 100%.
+
+func parseLoadBands(s string) ([]float64, error) {
+	bounds := make([]float64, 0)
+	for _, item := range strings.Split(s, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+		if err != nil || b <= 0 || (len(bounds) > 0 && b <= bounds[len(bounds)-1]) {
+			return nil, fmt.Errorf("Bad --load-bands value %s, must be increasing positive numbers", s)
+		}
+		bounds = append(bounds, b)
+	}
+	return bounds, nil
+}
+
+// A band of the histogram, from its lower boundary up to its upper boundary, which is nil (null) for
+// the last band.
+
+type loadBand struct {
+	From float64  `json:"from"`
+	To   *float64 `json:"to"`
+}
+
+type hostHistogram struct {
+	Hostname string `json:"hostname"`
+	Rcpu     []int  `json:"rcpu"`
+	Rgpu     []int  `json:"rgpu"`
+}
+
+// The distribution of the relative loads of each host over the load bands given by `bounds`: for
+// each band, the number of points of the series whose value is in the band, where a band includes
+// its lower boundary but not its upper.  As for the summaries, the GPU values of a point are not
+// counted if the GPUs in use at that point are unknown.  The result is a JSON object:
+//
+//   {"bucketing":"hourly",
+//    "bands":[{"from":0,"to":25},...,{"from":75,"to":null}],
+//    "hosts":[{"hostname":"ml6","rcpu":[10,2,0,0],"rgpu":[12,0,0,0]},...]}
+
+func formatHistogram(output []*hostData, bucketing string, bounds []float64) (string, error) {
+	type histogram struct {
+		Bucketing string          `json:"bucketing"`
+		Bands     []loadBand      `json:"bands"`
+		Hosts     []hostHistogram `json:"hosts"`
+	}
+
+	bands := make([]loadBand, 0, len(bounds)+1)
+	from := 0.0
+	for i := range bounds {
+		bands = append(bands, loadBand{From: from, To: &bounds[i]})
+		from = bounds[i]
+	}
+	bands = append(bands, loadBand{From: from})
+	band := func(v float64) int {
+		return sort.Search(len(bounds), func(i int) bool { return v < bounds[i] })
+	}
+
+	hosts := make([]hostHistogram, 0, len(output))
+	for _, hd := range output {
+		h := hostHistogram{Hostname: hd.hostname, Rcpu: make([]int, len(bands)), Rgpu: make([]int, len(bands))}
+		for _, d := range hd.data {
+			h.Rcpu[band(d.rcpu)]++
+			if d.gpus != nil {
+				h.Rgpu[band(d.rgpu)]++
+			}
+		}
+		hosts = append(hosts, h)
+	}
+	bytes, err := json.Marshal(histogram{Bucketing: bucketing, Bands: bands, Hosts: hosts})
+	if err != nil {
+		return "", err
+	}
+	return string(bytes) + "\n", nil
+}
+
 const (
 	sonalyzeFormat = "datetime,cpu,mem,gpu,gpumem,rcpu,rmem,rgpu,rgpumem,gpus,host"
 )
@@ -220,31 +717,38 @@ type hostData struct {
 	data []*datum
 }
 
-// The output from sonalyze is sorted first by host, then by increasing time.  Thus it's fine to
-// read record-by-record, bucket by host easily, and then assume that data are sorted within host.
+// The output from sonalyze is sorted first by host, then by increasing time, but nothing here
+// depends on that: the records are bucketed by host in the order in which the hosts first appear,
+// and the data for each host are then sorted by time.
+//
+// Rows that can't be parsed are skipped, but if a column requested by sonalyzeFormat is absent from
+// every row, as it would be if sonalyze dropped or renamed it, then an error naming the column is
+// returned instead of a result without data.
 
 func parseOutput(output string) ([]*hostData, error) {
 	rows, err := storage.ParseFreeCSV(strings.NewReader(output))
 	if err != nil {
 		return nil, err
 	}
+	if len(rows) > 0 {
+		for _, column := range strings.Split(sonalyzeFormat, ",") {
+			if !hasColumn(rows, column) {
+				return nil, fmt.Errorf("The output from sonalyze has no `%s` column", column)
+			}
+		}
+	}
 
-	allData := make([]*hostData, 0)
-
-	var curData []*datum
-	curHost := ""
+	hosts := make([]string, 0)
+	dataByHost := make(map[string][]*datum)
 	for _, row := range rows {
 		success := true
 		newHost := storage.GetString(row, "host", &success)
 		if !success {
 			continue
 		}
-		if newHost != curHost {
-			if curData != nil {
-				allData = append(allData, &hostData { hostname: curHost, data: curData })
-			}
-			curData = make([]*datum, 0)
-			curHost = newHost
+		if _, found := dataByHost[newHost]; !found {
+			hosts = append(hosts, newHost)
+			dataByHost[newHost] = make([]*datum, 0)
 		}
 		newDatum := &datum {
 			datetime: storage.GetDateTime(row, "datetime", &success),
@@ -276,11 +780,30 @@ func parseOutput(output string) ([]*hostData, error) {
 		if !success {
 			continue
 		}
-		curData = append(curData, newDatum)
-	}
-	if curData != nil {
-		allData = append(allData, &hostData { hostname: curHost, data: curData })
+		dataByHost[newHost] = append(dataByHost[newHost], newDatum)
 	}
 
+	allData := make([]*hostData, 0, len(hosts))
+	for _, host := range hosts {
+		allData = append(allData, newHostData(host, dataByHost[host]))
+	}
 	return allData, nil
 }
+
+// A hostData for the data, which are sorted by time.
+
+func newHostData(hostname string, data []*datum) *hostData {
+	sort.SliceStable(data, func(i, j int) bool {
+		return data[i].datetime.Before(data[j].datetime)
+	})
+	return &hostData{hostname: hostname, data: data}
+}
+
+func hasColumn(rows []map[string]string, column string) bool {
+	for _, row := range rows {
+		if _, found := row[column]; found {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,379 @@
+package mlwebload
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"naicreport/util"
+)
+
+const testOutput = `datetime=2023-09-05 10:00,cpu=1250.5,mem=100,gpu=0,gpumem=0,rcpu=23,rmem=10,rgpu=0,rgpumem=0,gpus=none,host=ml6
+datetime=2023-09-05 11:00,cpu=1300,mem=101,gpu=50,gpumem=2,rcpu=24,rmem=10,rgpu=12,rgpumem=1,gpus=1,host=ml6
+datetime=2023-09-05 10:00,cpu=20,mem=2,gpu=0,gpumem=0,rcpu=1,rmem=1,rgpu=0,rgpumem=0,gpus=unknown,host=ml8
+`
+
+func TestParseOutput(t *testing.T) {
+	output, err := parseOutput(testOutput)
+	if err != nil {
+		t.Fatalf("parseOutput failed %v", err)
+	}
+	if len(output) != 2 || output[0].hostname != "ml6" || len(output[0].data) != 2 ||
+		output[1].hostname != "ml8" || len(output[1].data) != 1 {
+		t.Fatalf("Bad structure")
+	}
+	d := output[0].data[1]
+	if d.cpu != 1300 || d.rgpu != 12 || len(d.gpus) != 1 || d.gpus[0] != 1 {
+		t.Fatalf("Bad datum %v", d)
+	}
+	if output[0].data[0].gpus == nil || len(output[0].data[0].gpus) != 0 || output[1].data[0].gpus != nil {
+		t.Fatalf("Bad gpu sets")
+	}
+}
+
+func TestFormatInflux(t *testing.T) {
+	output, err := parseOutput(testOutput)
+	if err != nil {
+		t.Fatalf("parseOutput failed %v", err)
+	}
+	expect := `load,host=ml6 cpu=1250.5,mem=100,gpu=0,gpumem=0,rcpu=23,rmem=10,rgpu=0,rgpumem=0 1693908000000000000
+load,host=ml6 cpu=1300,mem=101,gpu=50,gpumem=2,rcpu=24,rmem=10,rgpu=12,rgpumem=1 1693911600000000000
+load,host=ml8 cpu=20,mem=2,gpu=0,gpumem=0,rcpu=1,rmem=1,rgpu=0,rgpumem=0 1693908000000000000
+`
+	if got := formatInflux(output, ""); got != expect {
+		t.Fatalf("Bad line protocol:\n%s", got)
+	}
+	if got := formatInflux(output[1:], "alice"); !strings.HasPrefix(got, "load,host=ml8,user=alice cpu=20,") {
+		t.Fatalf("Bad line protocol for user:\n%s", got)
+	}
+}
+
+func TestFormatHistogram(t *testing.T) {
+	output, err := parseOutput(testOutput)
+	if err != nil {
+		t.Fatalf("parseOutput failed %v", err)
+	}
+	bounds, err := parseLoadBands("10,20")
+	if err != nil {
+		t.Fatalf("parseLoadBands failed %v", err)
+	}
+	histogram, err := formatHistogram(output, "hourly", bounds)
+	if err != nil {
+		t.Fatalf("formatHistogram failed %v", err)
+	}
+	// The GPUs of ml8 are unknown, so its rgpu value is not counted
+	expect := `{"bucketing":"hourly","bands":[{"from":0,"to":10},{"from":10,"to":20},{"from":20,"to":null}],` +
+		`"hosts":[{"hostname":"ml6","rcpu":[0,0,2],"rgpu":[1,1,0]},{"hostname":"ml8","rcpu":[1,0,0],"rgpu":[0,0,0]}]}` + "\n"
+	if histogram != expect {
+		t.Fatalf("Bad histogram %s", histogram)
+	}
+
+	for _, bad := range []string{"", "10,x", "0,10", "20,10", "10,10"} {
+		if _, err := parseLoadBands(bad); err == nil {
+			t.Fatalf("Bad load bands accepted: %s", bad)
+		}
+	}
+	bounds, err = parseLoadBands(DefaultLoadBands)
+	if err != nil || len(bounds) != 3 || bounds[2] != 75 {
+		t.Fatalf("Bad default load bands %v %v", bounds, err)
+	}
+}
+
+func TestGpuSeries(t *testing.T) {
+	output, err := parseOutput(`datetime=2023-09-05 10:00,cpu=1,mem=1,gpu=0,gpumem=0,rcpu=1,rmem=1,rgpu=0,rgpumem=0,gpus=none,host=ml6
+datetime=2023-09-05 11:00,cpu=1,mem=1,gpu=50,gpumem=2,rcpu=1,rmem=1,rgpu=12,rgpumem=1,"gpus=1,3",host=ml6
+datetime=2023-09-05 12:00,cpu=1,mem=1,gpu=0,gpumem=0,rcpu=1,rmem=1,rgpu=0,rgpumem=0,gpus=unknown,host=ml6
+`)
+	if err != nil {
+		t.Fatalf("parseOutput failed %v", err)
+	}
+	labels, _ := util.NewTimeFormatter(DefaultXLabelFormat, "")
+	bytes, err := json.Marshal(gpuSeries(output[0], labels))
+	if err != nil {
+		t.Fatalf("Marshal failed %v", err)
+	}
+	expect := `[{"x":"09-05 10:00","t":1693908000000,"y":[]},{"x":"09-05 11:00","t":1693911600000,"y":[1,3]},{"x":"09-05 12:00","t":1693915200000,"y":null}]`
+	if string(bytes) != expect {
+		t.Fatalf("Bad gpu series %s", bytes)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	output, err := parseOutput(testOutput)
+	if err != nil {
+		t.Fatalf("parseOutput failed %v", err)
+	}
+	s := summarize(output[0])
+	if *s.Rcpu != (seriesSummary{Min: 23, Avg: 23.5, Peak: 24, Points: 2}) ||
+		*s.Rgpu != (seriesSummary{Min: 0, Avg: 6, Peak: 12, Points: 2}) ||
+		*s.Rmem != (seriesSummary{Min: 10, Avg: 10, Peak: 10, Points: 2}) ||
+		*s.Rgpumem != (seriesSummary{Min: 0, Avg: 0.5, Peak: 1, Points: 2}) {
+		t.Fatalf("Bad summary %v %v %v %v", *s.Rcpu, *s.Rgpu, *s.Rmem, *s.Rgpumem)
+	}
+
+	// The GPUs of ml8 are unknown, so its GPU series are too
+	bytes, err := json.Marshal(summarize(output[1]))
+	if err != nil {
+		t.Fatalf("Marshal failed %v", err)
+	}
+	expect := `{"rcpu":{"min":1,"avg":1,"peak":1,"points":1},"rgpu":null,` +
+		`"rmem":{"min":1,"avg":1,"peak":1,"points":1},"rgpumem":null}`
+	if string(bytes) != expect {
+		t.Fatalf("Bad summary %s", bytes)
+	}
+}
+
+func TestRunSonalyzeLoadPartial(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	progOpts := &util.StandardOptions{DataPath: td_name}
+
+	// A fake sonalyze that fails after producing data for one host
+	partial := path.Join(td_name, "partial.sh")
+	ml6Output := strings.Join(strings.Split(testOutput, "\n")[:2], "\n")
+	err = os.WriteFile(partial,
+		[]byte("#!/bin/sh\ncat <<EOF\n"+ml6Output+"\nEOF\necho bad file >&2\nexit 1\n"), 0755)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	_, err = runSonalyzeLoad(partial, "", progOpts, "", "hourly", false)
+	if err == nil {
+		t.Fatalf("Partial output accepted")
+	}
+	output, err := runSonalyzeLoad(partial, "", progOpts, "", "hourly", true)
+	if err != nil || len(output) != 1 || output[0].hostname != "ml6" {
+		t.Fatalf("Bad partial output %v %v", output, err)
+	}
+
+	// A fake sonalyze that fails without output
+	failing := path.Join(td_name, "failing.sh")
+	err = os.WriteFile(failing, []byte("#!/bin/sh\necho bad file >&2\nexit 1\n"), 0755)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	_, err = runSonalyzeLoad(failing, "", progOpts, "", "hourly", true)
+	if err == nil {
+		t.Fatalf("Failure accepted")
+	}
+}
+
+func TestRunSonalyzeLoadUser(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	progOpts := &util.StandardOptions{DataPath: td_name}
+
+	// A fake sonalyze that records its arguments
+	argsFile := path.Join(td_name, "args")
+	recording := path.Join(td_name, "recording.sh")
+	err = os.WriteFile(recording, []byte("#!/bin/sh\necho \"$@\" > "+argsFile+"\n"), 0755)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	_, err = runSonalyzeLoad(recording, "", progOpts, "alice", "daily", false)
+	if err != nil {
+		t.Fatalf("runSonalyzeLoad failed %v", err)
+	}
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed %q", err)
+	}
+	if !strings.Contains(string(args), " --user alice --daily") {
+		t.Fatalf("Bad arguments %s", args)
+	}
+	if appendTag(appendTag("week", "alice"), "daily") != "week-alice-daily" {
+		t.Fatalf("Bad user tag")
+	}
+}
+
+func TestWritePlotsAllOrNothing(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	output, err := parseOutput(testOutput)
+	if err != nil {
+		t.Fatalf("parseOutput failed %v", err)
+	}
+	labels, _ := util.NewTimeFormatter(DefaultXLabelFormat, "")
+	now := time.Date(2023, 9, 11, 6, 30, 0, 0, time.UTC)
+	err = writePlots(td_name, "", "hourly", nil, output, labels, now)
+	if err != nil {
+		t.Fatalf("writePlots failed %v", err)
+	}
+	entries, err := os.ReadDir(td_name)
+	if err != nil || len(entries) != 2 || entries[0].Name() != "ml6.json" || entries[1].Name() != "ml8.json" {
+		t.Fatalf("Bad output files %v %v", entries, err)
+	}
+	bytes, err := os.ReadFile(path.Join(td_name, "ml6.json"))
+	if err != nil || !strings.Contains(string(bytes), `"date":"2023-09-11 06:30"`) {
+		t.Fatalf("Bad date %s %v", bytes, err)
+	}
+
+	// The plot for the second host can't be written since its directory does not exist, so nothing
+	// shall be written and no temp files shall remain.
+	output[1].hostname = "nosuchdir/ml8"
+	err = writePlots(td_name, "daily", "daily", nil, output, labels, now)
+	if err == nil {
+		t.Fatalf("writePlots succeeded")
+	}
+	entries, err = os.ReadDir(td_name)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Bad output files after failure %v %v", entries, err)
+	}
+}
+
+func TestPrunePlots(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	output, err := parseOutput(testOutput)
+	if err != nil {
+		t.Fatalf("parseOutput failed %v", err)
+	}
+	labels, _ := util.NewTimeFormatter(DefaultXLabelFormat, "")
+	now := time.Date(2023, 9, 11, 6, 30, 0, 0, time.UTC)
+	err = writePlots(td_name, "week", "hourly", nil, output, labels, now)
+	if err != nil {
+		t.Fatalf("writePlots failed %v", err)
+	}
+	err = writePlots(td_name, "", "hourly", nil, output, labels, now)
+	if err != nil {
+		t.Fatalf("writePlots failed %v", err)
+	}
+	// ml6-week.json is also the name of the untagged plot for the host ml6-week, and
+	// ml6-week-old.json is not a plot file for the tag
+	files := map[string]string{
+		"ml6-week-old.json": `{"hostname":"ml6-week","tag":"old"}`,
+		"ml6-week-x.json":   `{"hostname":"ml6-week","tag":"x"}`,
+		"notes.json":        `{"hostname":"ml6"}`,
+		"ml9.txt":           `{"hostname":"ml9","tag":"week"}`,
+	}
+	for name, contents := range files {
+		err = os.WriteFile(path.Join(td_name, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatalf("WriteFile failed %v", err)
+		}
+	}
+
+	// Only ml8 is in this run, so ml6-week.json is stale
+	pruned, err := prunePlots(td_name, "week", output[1:])
+	if err != nil || len(pruned) != 1 || pruned[0] != "ml6-week.json" {
+		t.Fatalf("Bad pruned files %v %v", pruned, err)
+	}
+	for _, name := range []string{"ml6.json", "ml8.json", "ml8-week.json", "ml6-week-old.json",
+		"ml6-week-x.json", "notes.json", "ml9.txt"} {
+		if _, err := os.Stat(path.Join(td_name, name)); err != nil {
+			t.Fatalf("%s was removed", name)
+		}
+	}
+}
+
+func TestDailyBuckets(t *testing.T) {
+	output, err := parseOutput(`datetime=2023-09-05 10:00,cpu=1,mem=2,gpu=0,gpumem=0,rcpu=10,rmem=1,rgpu=0,rgpumem=0,gpus=unknown,host=ml6
+datetime=2023-09-05 11:00,cpu=3,mem=4,gpu=50,gpumem=2,rcpu=20,rmem=1,rgpu=12,rgpumem=1,"gpus=3,1",host=ml6
+datetime=2023-09-05 12:00,cpu=5,mem=6,gpu=0,gpumem=0,rcpu=30,rmem=1,rgpu=0,rgpumem=0,gpus=1,host=ml6
+datetime=2023-09-06 00:00,cpu=7,mem=8,gpu=0,gpumem=0,rcpu=40,rmem=1,rgpu=0,rgpumem=0,gpus=unknown,host=ml6
+`)
+	if err != nil {
+		t.Fatalf("parseOutput failed %v", err)
+	}
+	days := dailyBuckets(output)
+	if len(days) != 1 || days[0].hostname != "ml6" || len(days[0].data) != 2 {
+		t.Fatalf("Bad structure")
+	}
+	d := days[0].data[0]
+	if !d.datetime.Equal(time.Date(2023, 9, 5, 0, 0, 0, 0, time.UTC)) || d.cpu != 3 || d.rcpu != 20 ||
+		d.gpu != 50.0/3 || len(d.gpus) != 2 || d.gpus[0] != 1 || d.gpus[1] != 3 {
+		t.Fatalf("Bad day %v", d)
+	}
+	d = days[0].data[1]
+	if !d.datetime.Equal(time.Date(2023, 9, 6, 0, 0, 0, 0, time.UTC)) || d.cpu != 7 || d.gpus != nil {
+		t.Fatalf("Bad day %v", d)
+	}
+	if appendTag("", "daily") != "daily" || appendTag("week", "daily") != "week-daily" {
+		t.Fatalf("Bad tags")
+	}
+}
+
+func TestPlotLabelsDST(t *testing.T) {
+	// In Europe/Oslo, the clocks were set back from 03:00 to 02:00 on 2023-10-29, at 01:00 UTC.
+	output, err := parseOutput(`datetime=2023-10-29 01:00,cpu=1,mem=1,gpu=0,gpumem=0,rcpu=1,rmem=1,rgpu=0,rgpumem=0,gpus=none,host=ml6
+datetime=2023-10-29 00:00,cpu=1,mem=1,gpu=0,gpumem=0,rcpu=1,rmem=1,rgpu=0,rgpumem=0,gpus=none,host=ml6
+`)
+	if err != nil {
+		t.Fatalf("parseOutput failed %v", err)
+	}
+	labels, err := util.NewTimeFormatter("2006-01-02 15:04 MST", "Europe/Oslo")
+	if err != nil {
+		t.Fatalf("NewTimeFormatter failed %v", err)
+	}
+	series := gpuSeries(output[0], labels)
+	if len(series) != 2 || series[0].X != "2023-10-29 02:00 CEST" || series[1].X != "2023-10-29 02:00 CET" ||
+		series[0].T >= series[1].T {
+		t.Fatalf("Bad series %v", series)
+	}
+}
+
+func TestMergeHosts(t *testing.T) {
+	output, err := parseOutput(testOutput)
+	if err != nil {
+		t.Fatalf("parseOutput failed %v", err)
+	}
+	merged := mergeHosts(output, false)
+	if len(merged) != 1 || merged[0].hostname != MergedHostname || len(merged[0].data) != 2 {
+		t.Fatalf("Bad structure")
+	}
+	d0, d1 := merged[0].data[0], merged[0].data[1]
+	if d0.cpu != 1270.5 || d0.rcpu != 24 || d0.gpus != nil || d1.cpu != 1300 || d1.rgpu != 12 ||
+		!d0.datetime.Before(d1.datetime) {
+		t.Fatalf("Bad sums %v %v", d0, d1)
+	}
+
+	merged = mergeHosts(output, true)
+	d0, d1 = merged[0].data[0], merged[0].data[1]
+	if d0.cpu != 635.25 || d0.rcpu != 12 || d1.cpu != 1300 {
+		t.Fatalf("Bad averages %v %v", d0, d1)
+	}
+
+	if len(mergeHosts(nil, false)) != 0 {
+		t.Fatalf("Bad merge of nothing")
+	}
+}
+
+func TestParseOutputUnsorted(t *testing.T) {
+	output, err := parseOutput(`datetime=2023-09-05 11:00,cpu=2,mem=1,gpu=0,gpumem=0,rcpu=1,rmem=1,rgpu=0,rgpumem=0,gpus=none,host=ml6
+datetime=2023-09-05 10:00,cpu=3,mem=1,gpu=0,gpumem=0,rcpu=1,rmem=1,rgpu=0,rgpumem=0,gpus=none,host=ml8
+datetime=2023-09-05 10:00,cpu=1,mem=1,gpu=0,gpumem=0,rcpu=1,rmem=1,rgpu=0,rgpumem=0,gpus=none,host=ml6
+`)
+	if err != nil {
+		t.Fatalf("parseOutput failed %v", err)
+	}
+	if len(output) != 2 || output[0].hostname != "ml6" || len(output[0].data) != 2 ||
+		output[1].hostname != "ml8" || len(output[1].data) != 1 {
+		t.Fatalf("Bad structure")
+	}
+	if output[0].data[0].cpu != 1 || output[0].data[1].cpu != 2 {
+		t.Fatalf("Data not sorted by time")
+	}
+}
+
+func TestParseOutputMissingColumn(t *testing.T) {
+	_, err := parseOutput(`datetime=2023-09-05 10:00,cpu=1,mem=1,gpu=0,gpumem=0,relcpu=1,rmem=1,rgpu=0,rgpumem=0,gpus=none,host=ml6
+`)
+	if err == nil || !strings.Contains(err.Error(), "`rcpu`") {
+		t.Fatalf("Missing column not detected: %v", err)
+	}
+
+	output, err := parseOutput("")
+	if err != nil || len(output) != 0 {
+		t.Fatalf("Bad empty output %v %v", output, err)
+	}
+}
@@ -1,26 +1,62 @@
 // Superstructure for stateful naic reporting.
 //
-// Run `naicreport help` for help.
+// Run `naicreport help` for help.  See util/exitcode.go for the exit codes.
 
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
+	"naicreport/check"
+	"naicreport/daemon"
+	"naicreport/digest"
+	"naicreport/gentestdata"
+	"naicreport/jsonschema"
 	"naicreport/mldeadweight"
 	"naicreport/mlcpuhog"
+	"naicreport/mlgpuhog"
+	"naicreport/mlleaderboard"
+	"naicreport/mlmemhog"
 	"naicreport/mlwebload"
+	"naicreport/reset"
+	"naicreport/selftest"
+	"naicreport/util"
 )
 
 func main() {
 	if len(os.Args) < 2 {
-		toplevelUsage(1)
+		toplevelUsage(util.ExitUsage)
 	}
 	var err error
 	switch os.Args[1] {
 	case "help":
-		toplevelUsage(0)
+		toplevelUsage(util.ExitOk)
+
+	case "ack":
+		err = reset.Ack(os.Args[0], os.Args[2:])
+
+	case "check":
+		err = check.Check(os.Args[0], os.Args[2:])
+
+	case "config-check":
+		err = check.ConfigCheck(os.Args[0], os.Args[2:])
+
+	case "compact":
+		err = reset.Compact(os.Args[0], os.Args[2:])
+
+	case "daemon":
+		err = daemon.Daemon(os.Args[0], os.Args[2:])
+
+	case "digest":
+		err = digest.Digest(os.Args[0], os.Args[2:])
+
+	case "gen-testdata":
+		err = gentestdata.GenTestdata(os.Args[0], os.Args[2:])
+
+	case "json-schema":
+		err = jsonschema.JsonSchema(os.Args[0], os.Args[2:])
 
 	case "ml-deadweight":
 		err = mldeadweight.MlDeadweight(os.Args[0], os.Args[2:])
@@ -28,15 +64,40 @@ func main() {
 	case "ml-cpuhog":
 		err = mlcpuhog.MlCpuhog(os.Args[0], os.Args[2:])
 
+	case "ml-gpuhog":
+		err = mlgpuhog.MlGpuhog(os.Args[0], os.Args[2:])
+
+	case "ml-memhog":
+		err = mlmemhog.MlMemhog(os.Args[0], os.Args[2:])
+
+	case "ml-idle":
+		err = mlwebload.MlIdle(os.Args[0], os.Args[2:])
+
+	case "ml-leaderboard":
+		err = mlleaderboard.MlLeaderboard(os.Args[0], os.Args[2:])
+
 	case "ml-webload":
 		err = mlwebload.MlWebload(os.Args[0], os.Args[2:])
 
+	case "reset":
+		err = reset.Reset(os.Args[0], os.Args[2:])
+
+	case "selftest":
+		err = selftest.Selftest(os.Args[0], os.Args[2:])
+
 	default:
-		toplevelUsage(1)
+		toplevelUsage(util.ExitUsage)
+	}
+	if errors.Is(err, util.ErrEventsFound) {
+		os.Exit(util.ExitEvents)
+	}
+	if errors.Is(err, util.ErrStaleData) {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(util.ExitStaleData)
 	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "ERROR: %v\n\n", err)
-		toplevelUsage(1)
+		toplevelUsage(util.ExitError)
 	}
 }
 
@@ -46,12 +107,45 @@ func toplevelUsage(code int) {
 	fmt.Fprintf(os.Stderr, "where <verb> is one of\n\n")
 	fmt.Fprintf(os.Stderr, "  help\n")
 	fmt.Fprintf(os.Stderr, "    Print help\n\n")
+	fmt.Fprintf(os.Stderr, "  ack\n")
+	fmt.Fprintf(os.Stderr, "    Acknowledge a violation so that it is not reported again\n\n")
+	fmt.Fprintf(os.Stderr, "  check\n")
+	fmt.Fprintf(os.Stderr, "    Sanity-check the data directory and report unparseable data\n\n")
+	fmt.Fprintf(os.Stderr, "  config-check\n")
+	fmt.Fprintf(os.Stderr, "    Check the system config file for errors\n\n")
+	fmt.Fprintf(os.Stderr, "  compact\n")
+	fmt.Fprintf(os.Stderr, "    Remove old jobs from the state of one of the stateful analyses\n\n")
+	fmt.Fprintf(os.Stderr, "  daemon\n")
+	fmt.Fprintf(os.Stderr, "    Run the stateful analyses on a schedule\n\n")
+	fmt.Fprintf(os.Stderr, "  digest\n")
+	fmt.Fprintf(os.Stderr, "    Run the cpuhog, deadweight, gpuhog, and memhog analyses and generate a combined report\n\n")
+	fmt.Fprintf(os.Stderr, "  gen-testdata\n")
+	fmt.Fprintf(os.Stderr, "    Generate synthetic log data for testing\n\n")
+	fmt.Fprintf(os.Stderr, "  json-schema\n")
+	fmt.Fprintf(os.Stderr, "    Print a JSON Schema for the JSON events of an analysis\n\n")
 	fmt.Fprintf(os.Stderr, "  ml-deadweight\n")
 	fmt.Fprintf(os.Stderr, "    Analyze the deadweight logs and generate a report of new violations\n\n")
 	fmt.Fprintf(os.Stderr, "  ml-cpuhog\n")
 	fmt.Fprintf(os.Stderr, "    Analyze the cpuhog logs and generate a report of new violations\n\n")
+	fmt.Fprintf(os.Stderr, "  ml-gpuhog\n")
+	fmt.Fprintf(os.Stderr, "    Analyze the gpuhog logs and generate a report of new violations\n\n")
+	fmt.Fprintf(os.Stderr, "  ml-memhog\n")
+	fmt.Fprintf(os.Stderr, "    Analyze the memhog logs and generate a report of new violations\n\n")
+	fmt.Fprintf(os.Stderr, "  ml-idle\n")
+	fmt.Fprintf(os.Stderr, "    Run sonalyze to generate a report of hosts that have been idle for a long time\n\n")
+	fmt.Fprintf(os.Stderr, "  ml-leaderboard\n")
+	fmt.Fprintf(os.Stderr, "    Run sonalyze to generate a ranking of users by resource consumption\n\n")
 	fmt.Fprintf(os.Stderr, "  ml-webload\n")
 	fmt.Fprintf(os.Stderr, "    Run sonalyze to generate plottable (JSON) load reports\n\n")
-	fmt.Fprintf(os.Stderr, "All verbs accept -h to print verb-specific help\n")
+	fmt.Fprintf(os.Stderr, "  reset\n")
+	fmt.Fprintf(os.Stderr, "    Clear the state of one of the stateful analyses\n\n")
+	fmt.Fprintf(os.Stderr, "  selftest\n")
+	fmt.Fprintf(os.Stderr, "    Check that the analyses work, on built-in sample data\n\n")
+	fmt.Fprintf(os.Stderr, "All verbs accept -h to print verb-specific help\n\n")
+	fmt.Fprintf(os.Stderr, "The exit code is %d on success, %d on failure, and %d if the command line is bad.  With\n",
+		util.ExitOk, util.ExitError, util.ExitUsage)
+	fmt.Fprintf(os.Stderr, "--exit-events, the analyses and the digest exit with %d if there are new violations, and\n",
+		util.ExitEvents)
+	fmt.Fprintf(os.Stderr, "with --max-data-age, with %d if the log data are stale\n", util.ExitStaleData)
 	os.Exit(code)
 }
@@ -0,0 +1,90 @@
+// Acknowledge a violation in the persistent state of one of the stateful analyses, eg after the
+// operator has emailed the user, optionally with a note.  An acknowledged job is marked as reported,
+// so it is not reported if it has not been already, and it is never reescalated.
+
+package reset
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"naicreport/jobstate"
+	"naicreport/util"
+)
+
+func Ack(progname string, args []string) error {
+	progOpts := util.NewStandardOptions(progname + " ack")
+	signalPtr := progOpts.Container.String("signal", "", "The analysis whose state to update (required)")
+	hostPtr := progOpts.Container.String("host", "",
+		"The host the job ran on (required unless the job# alone identifies the job)")
+	jobPtr := progOpts.Container.Uint("job", 0, "The job# (required)")
+	notePtr := progOpts.Container.String("note", "", "A note about how the violation was dealt with")
+	backupsPtr := progOpts.Container.Int("state-backups", 0,
+		"Number of generations of backups of the state file to keep (file.1, file.2, ...)")
+	err := progOpts.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	filename, err := stateFilename(*signalPtr)
+	if err != nil {
+		return err
+	}
+	if *jobPtr == 0 {
+		return errors.New("-job requires a value")
+	}
+
+	state, err := jobstate.ReadJobState(progOpts.DataPath, filename)
+	if err != nil {
+		return err
+	}
+	job, err := ackJob(state, uint32(*jobPtr), *hostPtr, *notePtr)
+	if err != nil {
+		return fmt.Errorf("%w in %s", err, filename)
+	}
+	progOpts.Log.Infof("Acknowledged job %d on %s in %s", job.Id, job.Host, filename)
+	err = jobstate.WriteJobState(progOpts.DataPath, filename, state, *backupsPtr)
+	if err != nil {
+		return err
+	}
+	return progOpts.WriteRunManifest()
+}
+
+// Find the job with the id that ran on the host (on any host if host is "") and mark it as
+// acknowledged and reported, with the note.  It is an error if there is no such job, or if the host
+// is "" and there are several jobs with the id.
+
+func ackJob(state map[jobstate.JobKey]*jobstate.JobState, id uint32, host, note string) (*jobstate.JobState, error) {
+	var found *jobstate.JobState
+	for _, j := range state {
+		if j.Id != id || host != "" && !hasHost(j.Host, host) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("Job %d is on several hosts, use -host to select one", id)
+		}
+		found = j
+	}
+	if found == nil {
+		if host == "" {
+			return nil, fmt.Errorf("No job %d", id)
+		}
+		return nil, fmt.Errorf("No job %d on %s", id, host)
+	}
+	found.Acked = true
+	found.IsReported = true
+	found.Note = note
+	return found, nil
+}
+
+// The hosts of a cross-host job are a comma-separated list.
+
+func hasHost(hosts, host string) bool {
+	for _, h := range strings.Split(hosts, ",") {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
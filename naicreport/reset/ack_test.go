@@ -0,0 +1,35 @@
+package reset
+
+import (
+	"testing"
+
+	"naicreport/jobstate"
+)
+
+func TestAckJob(t *testing.T) {
+	state := map[jobstate.JobKey]*jobstate.JobState{
+		{Id: 1, Host: "ml1"}: {Id: 1, Host: "ml1", IsReported: true},
+		{Id: 1, Host: "ml2"}: {Id: 1, Host: "ml2", IsReported: false},
+		{Id: 2}:              {Id: 2, Host: "c1,c2", CrossHost: true},
+	}
+	job, err := ackJob(state, 1, "ml2", "emailed user")
+	if err != nil || job != state[jobstate.JobKey{Id: 1, Host: "ml2"}] || !job.Acked || !job.IsReported ||
+		job.Note != "emailed user" || state[jobstate.JobKey{Id: 1, Host: "ml1"}].Acked {
+		t.Fatalf("Bad ack %v %v", job, err)
+	}
+
+	job, err = ackJob(state, 2, "c2", "")
+	if err != nil || job != state[jobstate.JobKey{Id: 2}] || !job.Acked {
+		t.Fatalf("Bad ack of cross-host job %v %v", job, err)
+	}
+
+	if _, err = ackJob(state, 1, "", ""); err == nil {
+		t.Fatalf("Ambiguous job acked")
+	}
+	if _, err = ackJob(state, 1, "ml3", ""); err == nil {
+		t.Fatalf("Job on wrong host acked")
+	}
+	if _, err = ackJob(state, 3, "", ""); err == nil {
+		t.Fatalf("Missing job acked")
+	}
+}
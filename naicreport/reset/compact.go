@@ -0,0 +1,62 @@
+// Compact the persistent state of one of the stateful analyses by removing the jobs that were last
+// seen before a cutoff, whether they have been reported or not.  The analyses purge reported jobs
+// automatically, but jobs on decommissioned nodes, or jobs that stopped appearing in the logs before
+// they were reported, can linger in the state indefinitely.  This is a deliberate maintenance
+// operation, to be run by hand or occasionally.
+
+package reset
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"naicreport/jobstate"
+	"naicreport/util"
+)
+
+func Compact(progname string, args []string) error {
+	progOpts := util.NewStandardOptions(progname + " compact")
+	signalPtr := progOpts.Container.String("signal", "", "The analysis whose state to compact (required)")
+	olderThanPtr := progOpts.Container.String("older-than", "",
+		"Remove jobs last seen before this time, yyyy-mm-dd or Nd (days ago) or Nw (weeks ago) (required)")
+	backupsPtr := progOpts.Container.Int("state-backups", 0,
+		"Number of generations of backups of the state file to keep (file.1, file.2, ...)")
+	err := progOpts.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	filename, err := stateFilename(*signalPtr)
+	if err != nil {
+		return err
+	}
+	if *olderThanPtr == "" {
+		return errors.New("-older-than requires a value")
+	}
+	cutoff, err := util.ParseWhen(*olderThanPtr, progOpts.Clock.Now())
+	if err != nil {
+		return fmt.Errorf("Bad -older-than value %s: %w", *olderThanPtr, err)
+	}
+
+	state, err := jobstate.ReadJobState(progOpts.DataPath, filename)
+	if err != nil {
+		return err
+	}
+	removed := compactState(state, cutoff)
+	progOpts.Log.Infof("Removed %d of %d jobs from %s in %s",
+		removed, removed+len(state), filename, progOpts.DataPath)
+	err = jobstate.WriteJobState(progOpts.DataPath, filename, state, *backupsPtr)
+	if err != nil {
+		return err
+	}
+	return progOpts.WriteRunManifest()
+}
+
+// Remove the jobs last seen before the cutoff from the state and return the number removed.
+
+func compactState(state map[jobstate.JobKey]*jobstate.JobState, cutoff time.Time) int {
+	return len(jobstate.RemoveJobs(state, func(j *jobstate.JobState) bool {
+		return j.LastSeen.Before(cutoff)
+	}))
+}
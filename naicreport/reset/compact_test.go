@@ -0,0 +1,23 @@
+package reset
+
+import (
+	"testing"
+	"time"
+
+	"naicreport/jobstate"
+)
+
+func TestCompactState(t *testing.T) {
+	cutoff := time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+	state := map[jobstate.JobKey]*jobstate.JobState{
+		{Id: 1, Host: "ml1"}: {Id: 1, Host: "ml1", LastSeen: cutoff.AddDate(0, 0, -1), IsReported: false},
+		{Id: 2, Host: "ml1"}: {Id: 2, Host: "ml1", LastSeen: cutoff.AddDate(0, 0, -1), IsReported: true},
+		{Id: 3, Host: "ml1"}: {Id: 3, Host: "ml1", LastSeen: cutoff, IsReported: true},
+	}
+	if removed := compactState(state, cutoff); removed != 2 {
+		t.Fatalf("Bad count %d", removed)
+	}
+	if _, found := state[jobstate.JobKey{Id: 3, Host: "ml1"}]; !found || len(state) != 1 {
+		t.Fatalf("Bad state %v", state)
+	}
+}
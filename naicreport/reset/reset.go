@@ -0,0 +1,62 @@
+// Reset the persistent state of one of the stateful analyses.  The state file is replaced by an
+// empty state file (atomically, so there is no window where a concurrently running analysis could
+// see a partially written file).  The next run of the analysis will then start from scratch; use
+// the analysis's --seed option to avoid a flood of reports for old violations.
+
+package reset
+
+import (
+	"errors"
+	"fmt"
+
+	"naicreport/jobstate"
+	"naicreport/mlcpuhog"
+	"naicreport/mldeadweight"
+	"naicreport/mlgpuhog"
+	"naicreport/mlmemhog"
+	"naicreport/util"
+)
+
+var stateFiles = map[string]string{
+	"cpuhog":     mlcpuhog.CpuhogStateFilename,
+	"deadweight": mldeadweight.DeadweightStateFilename,
+	"gpuhog":     mlgpuhog.GpuhogStateFilename,
+	"memhog":     mlmemhog.MemhogStateFilename,
+}
+
+// Return the name of the state file for the signal.
+
+func stateFilename(signal string) (string, error) {
+	if signal == "" {
+		return "", errors.New("-signal requires a value")
+	}
+	filename, found := stateFiles[signal]
+	if !found {
+		return "", fmt.Errorf("Unknown signal %s", signal)
+	}
+	return filename, nil
+}
+
+func Reset(progname string, args []string) error {
+	progOpts := util.NewStandardOptions(progname + " reset")
+	signalPtr := progOpts.Container.String("signal", "", "The analysis whose state to reset (required)")
+	backupsPtr := progOpts.Container.Int("state-backups", 0,
+		"Number of generations of backups of the state file to keep (file.1, file.2, ...)")
+	err := progOpts.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	filename, err := stateFilename(*signalPtr)
+	if err != nil {
+		return err
+	}
+
+	progOpts.Log.Infof("Resetting %s in %s", filename, progOpts.DataPath)
+	state := make(map[jobstate.JobKey]*jobstate.JobState)
+	err = jobstate.WriteJobState(progOpts.DataPath, filename, state, *backupsPtr)
+	if err != nil {
+		return err
+	}
+	return progOpts.WriteRunManifest()
+}
@@ -0,0 +1,130 @@
+// Check that naicreport works in the environment it has been deployed to, without a real data path.
+// The cpuhog analysis is run over a small fixture embedded in the executable, with a fresh state in
+// a temporary directory, and must report the job in the fixture.  With --sonalyze, the sonalyze
+// executable must also be runnable.  Each check is reported as PASS or FAIL, and the verb fails if
+// any check fails.
+//
+// Report format:
+//
+//   PASS cpuhog
+//   FAIL sonalyze: <error>
+
+package selftest
+
+import (
+	"context"
+	"embed"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"naicreport/mlcpuhog"
+	"naicreport/util"
+)
+
+// The fixture is a data directory with a cpuhog log for one job.
+
+//go:embed testdata
+var fixture embed.FS
+
+const (
+	fixtureDay  = "2023-09-05"
+	fixtureJob  = 3635362
+	fixtureHost = "ml1"
+)
+
+func Selftest(progname string, args []string) error {
+	container := flag.NewFlagSet(progname+" selftest", flag.ExitOnError)
+	sonalyzePathPtr := container.String("sonalyze", "", "Path to sonalyze executable, if it is to be checked")
+	err := container.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var output strings.Builder
+	failures := runChecks(&output, *sonalyzePathPtr)
+	err = util.WriteOutput("", output.String())
+	if err != nil {
+		return err
+	}
+	if failures > 0 {
+		return fmt.Errorf("%d selftest checks failed", failures)
+	}
+	return nil
+}
+
+// Run the checks, write the results to out, and return the number of failed checks.
+
+func runChecks(out io.Writer, sonalyzePath string) int {
+	failures := 0
+	report := func(name string, err error) {
+		if err != nil {
+			fmt.Fprintf(out, "FAIL %s: %v\n", name, err)
+			failures++
+		} else {
+			fmt.Fprintf(out, "PASS %s\n", name)
+		}
+	}
+	report("cpuhog", checkCpuhog())
+	if sonalyzePath != "" {
+		_, err := util.RunSonalyze(sonalyzePath, []string{"--version"})
+		report("sonalyze", err)
+	}
+	return failures
+}
+
+func checkCpuhog() error {
+	dataPath, err := os.MkdirTemp(os.TempDir(), "naicreport-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dataPath)
+	err = copyFixture(dataPath)
+	if err != nil {
+		return err
+	}
+
+	progOpts := util.NewStandardOptions("selftest")
+	analysisOpts := util.NewAnalysisOptions(progOpts)
+	err = progOpts.Parse([]string{"--data-path", dataPath, "--from", fixtureDay, "--to", fixtureDay})
+	if err != nil {
+		return err
+	}
+	reports, _, err := mlcpuhog.Analyze(context.Background(), progOpts, analysisOpts,
+		mlcpuhog.DefaultCpuPeakScale)
+	if err != nil {
+		return err
+	}
+	if len(reports) != 1 || reports[0].Id != fixtureJob || reports[0].Host != fixtureHost {
+		return fmt.Errorf("Expected one report for job %d on %s, got %d reports",
+			fixtureJob, fixtureHost, len(reports))
+	}
+	return nil
+}
+
+// Copy the files of the fixture into the directory dataPath.
+
+func copyFixture(dataPath string) error {
+	root, err := fs.Sub(fixture, "testdata")
+	if err != nil {
+		return err
+	}
+	return fs.WalkDir(root, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := path.Join(dataPath, name)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		bytes, err := fs.ReadFile(root, name)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, bytes, 0644)
+	})
+}
@@ -0,0 +1,26 @@
+package selftest
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestRunChecks(t *testing.T) {
+	var output strings.Builder
+	failures := runChecks(&output, "")
+	if failures != 0 || output.String() != "PASS cpuhog\n" {
+		t.Fatalf("Bad selftest %d %s", failures, output.String())
+	}
+
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	output.Reset()
+	failures = runChecks(&output, path.Join(td_name, "no-such-sonalyze"))
+	if failures != 1 || !strings.HasPrefix(output.String(), "PASS cpuhog\nFAIL sonalyze: ") {
+		t.Fatalf("Bad selftest %d %s", failures, output.String())
+	}
+}
@@ -0,0 +1,114 @@
+// The delimiter and comment character of the free CSV files.  The logs written by sonar and sonalyze
+// use commas and have no comments, but some exporters write the same `name=value` records separated
+// by tabs, and hand-maintained test data are easier to follow with comments, and those can be read
+// (and written) directly with the functions here instead of being converted first.
+//
+// A file can also be written with a UTF-8 byte order mark, for Excel on Windows.  The parsers skip
+// the mark at the start of the input whatever the format, so that such files can be read back.
+
+package storage
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"naicreport/util"
+)
+
+// The zero value is the default format.
+
+type CSVFormat struct {
+	Comma   rune // the field delimiter, ',' if zero
+	Comment rune // if not zero, lines starting with this character are skipped when reading
+	BOM     bool // if true, a UTF-8 byte order mark is written at the start of the file
+}
+
+// The format used by ParseFreeCSV, WriteFreeCSV and the other functions that don't take a format.
+
+var DefaultCSVFormat = CSVFormat{Comma: ','}
+
+// A tab-separated variant of the format.
+
+var TabCSVFormat = CSVFormat{Comma: '\t'}
+
+// The default format with `#` comment lines, for hand-maintained files.  Without the comment
+// character, a comment line is read as a row with no fields, or, if it has a `=`, as a row of junk.
+
+var CommentedCSVFormat = CSVFormat{Comma: ',', Comment: '#'}
+
+func (format CSVFormat) comma() rune {
+	if format.Comma == 0 {
+		return ','
+	}
+	return format.Comma
+}
+
+// The delimiter and comment character must be ones that encoding/csv accepts.  Checking them up
+// front gives the same error for reading and writing, and before an output file is created.
+
+func (format CSVFormat) Validate() error {
+	c := format.comma()
+	if !validCSVRune(c) {
+		return fmt.Errorf("Invalid CSV delimiter %q", c)
+	}
+	if format.Comment != 0 && (!validCSVRune(format.Comment) || format.Comment == c) {
+		return fmt.Errorf("Invalid CSV comment character %q", format.Comment)
+	}
+	return nil
+}
+
+func validCSVRune(c rune) bool {
+	return c != '\r' && c != '\n' && c != '"' && utf8.ValidRune(c) && c != utf8.RuneError
+}
+
+func (format CSVFormat) apply(rdr *csv.Reader) {
+	rdr.Comma = format.comma()
+	rdr.Comment = format.Comment
+}
+
+// Return a reader of the input without the UTF-8 byte order mark at its start, if there is one.
+
+func skipBOM(input io.Reader) io.Reader {
+	rdr, ok := input.(*bufio.Reader)
+	if !ok {
+		rdr = bufio.NewReader(input)
+	}
+	if prefix, err := rdr.Peek(len(util.Utf8BOM)); err == nil && string(prefix) == util.Utf8BOM {
+		rdr.Discard(len(prefix))
+	}
+	return rdr
+}
+
+// As ParseFreeCSV, but with the given format instead of DefaultCSVFormat.
+
+func ParseFreeCSVWithFormat(input io.Reader, format CSVFormat) ([]map[string]string, error) {
+	rows, _, err := parseFreeCSV(input, false, format)
+	return rows, err
+}
+
+// As ReadFreeCSV, but with the given format instead of DefaultCSVFormat.
+
+func ReadFreeCSVWithFormat(filename string, format CSVFormat) ([]map[string]string, error) {
+	input_file, err := openInput(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer input_file.Close()
+	return ParseFreeCSVWithFormat(bufio.NewReader(input_file), format)
+}
+
+// As WriteFreeCSV, but with the given format instead of DefaultCSVFormat.  Values that contain the
+// delimiter are quoted.  No comments are written, and the comment character is not quoted, so a row
+// whose first field name starts with it would be skipped when the file is read back.
+
+func WriteFreeCSVWithFormat(
+	filename string,
+	fields []string,
+	data []map[string]string,
+	format CSVFormat,
+) error {
+	return writeFreeCSV(filename, nil, func(int) []string { return fields }, data, false, format)
+}
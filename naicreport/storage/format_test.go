@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCSVFormat(t *testing.T) {
+	input := "a=1\tb=x,y\n\"c=2\t3\"\ta=4\n"
+	rows, err := ParseFreeCSVWithFormat(strings.NewReader(input), TabCSVFormat)
+	if err != nil {
+		t.Fatalf("ParseFreeCSVWithFormat failed %v", err)
+	}
+	if len(rows) != 2 || rows[0]["a"] != "1" || rows[0]["b"] != "x,y" || rows[1]["c"] != "2\t3" ||
+		rows[1]["a"] != "4" {
+		t.Fatalf("Bad rows %v", rows)
+	}
+
+	// The zero format is the default, commas
+	rows, err = ParseFreeCSVWithFormat(strings.NewReader("a=1,b=2\n"), CSVFormat{})
+	if err != nil || len(rows) != 1 || rows[0]["b"] != "2" {
+		t.Fatalf("Bad rows for zero format %v %v", rows, err)
+	}
+
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	filename := path.Join(td_name, "test_write")
+	err = WriteFreeCSVWithFormat(filename, []string{"c", "b", "a"}, rows, TabCSVFormat)
+	if err != nil {
+		t.Fatalf("WriteFreeCSVWithFormat failed %v", err)
+	}
+	all, err := os.ReadFile(filename)
+	if err != nil || string(all) != "b=2\ta=1\n" {
+		t.Fatalf("File contents wrong %q %v", all, err)
+	}
+	again, err := ReadFreeCSVWithFormat(filename, TabCSVFormat)
+	if err != nil || len(again) != 1 || again[0]["a"] != "1" || again[0]["b"] != "2" {
+		t.Fatalf("Bad round trip %v %v", again, err)
+	}
+
+	err = WriteFreeCSVWithFormat(filename, []string{"a"}, rows, CSVFormat{Comma: '\n'})
+	if err == nil {
+		t.Fatalf("Bad delimiter accepted")
+	}
+	_, err = ParseFreeCSVWithFormat(strings.NewReader(input), CSVFormat{Comma: '"'})
+	if err == nil {
+		t.Fatalf("Bad delimiter accepted")
+	}
+}
+
+func TestCSVFormatComments(t *testing.T) {
+	input := "# The jobs of the test\na=1,b=2\n#a=junk\n  # not a comment\n\"x=#3\",a=4\n"
+	rows, err := ParseFreeCSV(strings.NewReader(input))
+	if err != nil || len(rows) != 5 || len(rows[0]) != 0 || rows[2]["#a"] != "junk" {
+		t.Fatalf("Bad rows without comments %v %v", rows, err)
+	}
+
+	rows, err = ParseFreeCSVWithFormat(strings.NewReader(input), CommentedCSVFormat)
+	if err != nil {
+		t.Fatalf("ParseFreeCSVWithFormat failed %v", err)
+	}
+	// Only lines that start with the comment character are comments
+	if len(rows) != 3 || rows[0]["b"] != "2" || len(rows[1]) != 0 || rows[2]["x"] != "#3" ||
+		rows[2]["a"] != "4" {
+		t.Fatalf("Bad rows %v", rows)
+	}
+
+	_, err = ParseFreeCSVWithFormat(strings.NewReader(input), CSVFormat{Comma: '#', Comment: '#'})
+	if err == nil {
+		t.Fatalf("Comment character same as delimiter accepted")
+	}
+}
+
+func TestCSVFormatBOM(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	filename := path.Join(td_name, "test_write")
+	rows := []map[string]string{{"user": "b\u00f8rre", "id": "1"}}
+	err = WriteFreeCSVWithFormat(filename, []string{"user", "id"}, rows, CSVFormat{BOM: true})
+	if err != nil {
+		t.Fatalf("WriteFreeCSVWithFormat failed %v", err)
+	}
+	all, err := os.ReadFile(filename)
+	if err != nil || string(all) != "\xef\xbb\xbfuser=b\u00f8rre,id=1\n" {
+		t.Fatalf("File contents wrong %q %v", all, err)
+	}
+
+	// The mark is skipped by the readers, whatever the format
+	again, err := ReadFreeCSV(filename)
+	if err != nil || len(again) != 1 || again[0]["user"] != "b\u00f8rre" || again[0]["id"] != "1" {
+		t.Fatalf("Bad rows read back %v %v", again, err)
+	}
+	again, _, err = ReadFreeCSVWithDiagnostics(filename)
+	if err != nil || len(again) != 1 || again[0]["user"] != "b\u00f8rre" {
+		t.Fatalf("Bad rows read back with diagnostics %v %v", again, err)
+	}
+
+	// Only a mark at the start is skipped
+	rows, err = ParseFreeCSV(strings.NewReader("a=1\n\ufeffb=2\n"))
+	if err != nil || len(rows) != 2 || rows[1]["\ufeffb"] != "2" {
+		t.Fatalf("Bad rows with a mark inside %v %v", rows, err)
+	}
+}
@@ -0,0 +1,107 @@
+// Limits on the size of the free CSV input, so that a pathological or corrupt file (extremely long
+// lines, millions of columns) can't make the parser use unbounded amounts of memory.  Rows that
+// exceed the limits are dropped, and are recorded by the diagnostics if they are collected.
+
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A limit that is zero (or less) is not enforced.  Lines that are too long are discarded as they are
+// read, before they are parsed.  A quoted field can span several lines; MaxLineBytes applies to
+// each of them.
+
+type ParseLimits struct {
+	MaxFields     int // fields per row
+	MaxFieldBytes int // bytes per field
+	MaxLineBytes  int // bytes per line, including the newline
+}
+
+// The limits used by ParseFreeCSV and ParseFreeCSVWithDiagnostics.  They are far above anything
+// found in legitimate logs.
+
+var DefaultParseLimits = ParseLimits{
+	MaxFields:     1000,
+	MaxFieldBytes: 64 * 1024,
+	MaxLineBytes:  1024 * 1024,
+}
+
+// Return an error if the fields of the row exceed the limits, otherwise nil.
+
+func (limits *ParseLimits) check(fields []string) error {
+	if limits.MaxFields > 0 && len(fields) > limits.MaxFields {
+		return fmt.Errorf("%d fields, more than the limit %d", len(fields), limits.MaxFields)
+	}
+	if limits.MaxFieldBytes > 0 {
+		for _, f := range fields {
+			if len(f) > limits.MaxFieldBytes {
+				return fmt.Errorf("Field of %d bytes, more than the limit %d", len(f), limits.MaxFieldBytes)
+			}
+		}
+	}
+	return nil
+}
+
+// A reader that replaces lines that are longer than `max` bytes by empty lines, which are skipped
+// by the CSV reader, and records their (1-based) line numbers in `dropped`.  The line numbers of the
+// remaining lines are unchanged.  Only one line at a time is held in memory.
+
+type lineLimiter struct {
+	input   *bufio.Reader
+	max     int
+	line    int
+	pending []byte
+	dropped []int
+}
+
+func newLineLimiter(input io.Reader, max int) *lineLimiter {
+	return &lineLimiter{input: bufio.NewReader(input), max: max}
+}
+
+func (ll *lineLimiter) Read(p []byte) (int, error) {
+	for len(ll.pending) == 0 {
+		line, err := ll.readLine()
+		if err != nil {
+			return 0, err
+		}
+		ll.pending = line
+	}
+	n := copy(p, ll.pending)
+	ll.pending = ll.pending[n:]
+	return n, nil
+}
+
+// Return the next line, including its newline if it has one, or an empty line in place of a line
+// that is too long.  Returns io.EOF only when there is no more input.
+
+func (ll *lineLimiter) readLine() ([]byte, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := ll.input.ReadSlice('\n')
+		if !tooLong {
+			if ll.max > 0 && len(line)+len(chunk) > ll.max {
+				tooLong = true
+				line = nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil && (err != io.EOF || (len(line) == 0 && !tooLong)) {
+			return nil, err
+		}
+		ll.line++
+		if tooLong {
+			ll.dropped = append(ll.dropped, ll.line)
+			return []byte{'\n'}, nil
+		}
+		return line, nil
+	}
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLimits(t *testing.T) {
+	limits := ParseLimits{MaxFields: 3, MaxFieldBytes: 8, MaxLineBytes: 32}
+	input := "a=1,b=2\n" +
+		"a=1,b=2,c=3,d=4\n" +
+		"a=123456789\n" +
+		"a=" + strings.Repeat("x", 100) + ",b=2\n" +
+		"a=3\n" +
+		"a=" + strings.Repeat("y", 100)
+	rows, diag, err := ParseFreeCSVWithLimits(strings.NewReader(input), limits, DefaultCSVFormat)
+	if err != nil {
+		t.Fatalf("ParseFreeCSVWithLimits failed %v", err)
+	}
+	if len(rows) != 2 || rows[0]["b"] != "2" || rows[1]["a"] != "3" {
+		t.Fatalf("Bad rows %v", rows)
+	}
+	if diag.Rows != 6 || diag.DroppedRows != 4 || len(diag.Errors) != 4 {
+		t.Fatalf("Bad diagnostics %v", diag)
+	}
+	for i, prefix := range []string{"Line 2:", "Line 3:", "Line 4:", "Line 6:"} {
+		if !strings.HasPrefix(diag.Errors[i].Error(), prefix) {
+			t.Fatalf("Bad error #%d %v", i, diag.Errors[i])
+		}
+	}
+
+	// No limits
+	rows, diag, err = ParseFreeCSVWithLimits(strings.NewReader(input), ParseLimits{}, DefaultCSVFormat)
+	if err != nil || len(rows) != 6 || diag.DroppedRows != 0 {
+		t.Fatalf("Bad unlimited parse %v %v", rows, err)
+	}
+
+	// ParseFreeCSV drops the rows silently
+	saved := DefaultParseLimits
+	DefaultParseLimits = limits
+	defer func() { DefaultParseLimits = saved }()
+	rows, err = ParseFreeCSV(strings.NewReader(input))
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("Bad ParseFreeCSV %v %v", rows, err)
+	}
+}
+
+func TestLineLimiterLongLine(t *testing.T) {
+	// A line much longer than the bufio buffer, in the middle of the input
+	input := "a=1\na=" + strings.Repeat("x", 100000) + "\na=2\n"
+	rows, diag, err := ParseFreeCSVWithLimits(strings.NewReader(input), ParseLimits{MaxLineBytes: 50000},
+		DefaultCSVFormat)
+	if err != nil || len(rows) != 2 || rows[1]["a"] != "2" || diag.DroppedRows != 1 {
+		t.Fatalf("Bad parse %v %v %v", rows, diag, err)
+	}
+}
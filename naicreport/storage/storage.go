@@ -10,15 +10,24 @@ package storage
 
 import (
 	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"math"
 	"os"
+	"os/exec"
 	"path"
+	"regexp"
+	"sort"
 	"time"
 	"strconv"
 	"strings"
+	"sync"
 
 	"naicreport/util"
 )
@@ -29,74 +38,551 @@ import (
 //
 // The path shall be a clean, absolute path that ends in `/` only if the entire path is `/`.
 //
-// For the dates, only year/month/day are considered, and timestamps should be passed as UTC times
-// with hour, minute, second, and nsec as zero.
+// The timestamps should be passed as UTC times.  The files for every day that the window [from, to)
+// touches are returned, so normally from and to are midnight, but they need not be.
 //
-// The pattern shall have no path components and is typically a glob
+// The pattern shall have no path components and is typically a glob.  Compressed files that match
+// the pattern followed by one of the compression suffixes (see openInput) are also returned.
 
 func EnumerateFiles(data_path string, from time.Time, to time.Time, pattern string) ([]string, error) {
+	files, _, err := EnumerateFilesWithReport(data_path, "", from, to, pattern)
+	return files, err
+}
+
+// The days of the window for which EnumerateFilesWithReport found no files.  A day is missing if it
+// has no directory (or if the name is not a directory), which usually means that the data path or
+// prefix is wrong or that nothing was logged that day, and empty if it has a directory but no
+// matching files.
+
+type DaysReport struct {
+	Missing []time.Time
+	Empty   []time.Time
+}
+
+// As EnumerateFiles, but the `YYYY/MM/DD` directories are in the subdirectory `prefix` of data_path
+// (eg `cluster` or `cluster/logs`) if prefix is not "", and a report on the days without files is
+// returned along with the files.  The returned names are relative to data_path and start with the
+// prefix.
+
+func EnumerateFilesWithReport(
+	data_path, prefix string,
+	from, to time.Time,
+	pattern string,
+) ([]string, *DaysReport, error) {
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" && !fs.ValidPath(prefix) {
+		return nil, nil, fmt.Errorf("Bad data path prefix %s", prefix)
+	}
 	filesys := os.DirFS(data_path)
 	result := []string{}
+	report := &DaysReport{Missing: make([]time.Time, 0), Empty: make([]time.Time, 0)}
+	// The window may start after midnight, but the day's directory is still wanted
+	from = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
 	for from.Before(to) {
-		probe_fn := fmt.Sprintf("%4d/%02d/%02d/%s", from.Year(), from.Month(), from.Day(), pattern);
-		matches, err := fs.Glob(filesys, probe_fn)
+		dir := fmt.Sprintf("%4d/%02d/%02d", from.Year(), from.Month(), from.Day())
+		if prefix != "" {
+			dir = prefix + "/" + dir
+		}
+		found := 0
+		for _, suffix := range compressionSuffixes {
+			matches, err := fs.Glob(filesys, dir+"/"+pattern+suffix)
+			if err != nil {
+				return nil, nil, err
+			}
+			result = append(result, matches...)
+			found += len(matches)
+		}
+		if found == 0 {
+			if info, err := fs.Stat(filesys, dir); err == nil && info.IsDir() {
+				report.Empty = append(report.Empty, from)
+			} else {
+				report.Missing = append(report.Missing, from)
+			}
+		}
+		from = from.AddDate(0, 0, 1)
+	}
+	return result, report, nil
+}
+
+// Return the date of a file from its path as returned by EnumerateFiles or EnumerateFilesWithReport,
+// ie from its `YYYY/MM/DD` directory, as a UTC time with the time of day zero.  The second value is
+// false if the path does not have that form.
+
+func FileDate(filePath string) (time.Time, bool) {
+	probe := fileDateRe.FindStringSubmatch(filePath)
+	if probe == nil {
+		return time.Time{}, false
+	}
+	date, err := time.Parse("2006/01/02", probe[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return date, true
+}
+
+var fileDateRe = regexp.MustCompile(`(?:^|/)(\d\d\d\d/\d\d/\d\d)/[^/]+$`)
+
+// Return the date of the newest of the files matching the pattern in the time window in the roots, as
+// FileDate does, see EnumerateFilesInRoots.  The date is zero if there are no such files.
+
+func NewestFileDateInRoots(roots []string, from, to time.Time, pattern string) (time.Time, error) {
+	filenames, err := EnumerateFilesInRoots(roots, from, to, pattern)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var newest time.Time
+	for _, filename := range filenames {
+		if date, ok := FileDate(filename); ok && date.After(newest) {
+			newest = date
+		}
+	}
+	return newest, nil
+}
+
+// The suffixes of the files that openInput can read, "" being uncompressed.
+
+var compressionSuffixes = []string{"", ".gz", ".bz2", ".zst"}
+
+// As EnumerateFiles, but for several data roots, eg current logs on a fast disk and archived logs on
+// a slower volume, and the returned names are the full paths of the files, sorted by their names
+// relative to their roots (thus by date).  If a file exists under more than one root then the one
+// under the root that comes first in `roots` is used and the others are ignored; for this purpose a
+// compressed file is the same as the uncompressed file, so eg `2023/09/05/cpuhog.csv.gz` in an
+// archive is shadowed by `2023/09/05/cpuhog.csv` in an earlier root.
+//
+// The root util.StdinDataPath is not enumerated, but is returned as it is, as a file name that
+// denotes stdin to the readers.
+
+func EnumerateFilesInRoots(roots []string, from, to time.Time, pattern string) ([]string, error) {
+	type found struct {
+		relative string
+		full     string
+	}
+	seen := make(map[string]bool)
+	files := make([]found, 0)
+	for _, root := range roots {
+		if root == util.StdinDataPath {
+			files = append(files, found{"", root})
+			continue
+		}
+		names, err := EnumerateFiles(root, from, to, pattern)
 		if err != nil {
 			return nil, err
 		}
-		result = append(result, matches...)
-		from = from.AddDate(0, 0, 1)
+		added := make(map[string]bool)
+		for _, name := range names {
+			key := stripCompressionSuffix(name)
+			if seen[key] {
+				continue
+			}
+			added[key] = true
+			files = append(files, found{name, path.Join(root, name)})
+		}
+		for key := range added {
+			seen[key] = true
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].relative < files[j].relative
+	})
+	result := make([]string, 0, len(files))
+	for _, f := range files {
+		result = append(result, f.full)
 	}
 	return result, nil
 }
 
-// General "free CSV" reader, returns array of maps from field names to field values.
+func stripCompressionSuffix(name string) string {
+	for _, suffix := range compressionSuffixes {
+		if suffix != "" && strings.HasSuffix(name, suffix) {
+			return name[:len(name)-len(suffix)]
+		}
+	}
+	return name
+}
+
+// Open the file for reading, decompressing it according to its suffix: `.gz` is gzip, `.bz2` is
+// bzip2, and `.zst` is zstd, which is decompressed by running the `zstd` program.  Other files are
+// read as they are.  The file name util.StdinDataPath denotes stdin, which is not decompressed and
+// is not closed.
+
+func openInput(filename string) (io.ReadCloser, error) {
+	if filename == util.StdinDataPath {
+		return io.NopCloser(os.Stdin), nil
+	}
+	if strings.HasSuffix(filename, ".zst") {
+		return openZstd(filename)
+	}
+	input_file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasSuffix(filename, ".gz"):
+		zr, err := gzip.NewReader(bufio.NewReader(input_file))
+		if err != nil {
+			input_file.Close()
+			return nil, err
+		}
+		return &decompressor{zr, input_file}, nil
+	case strings.HasSuffix(filename, ".bz2"):
+		return &decompressor{bzip2.NewReader(bufio.NewReader(input_file)), input_file}, nil
+	default:
+		return input_file, nil
+	}
+}
+
+type decompressor struct {
+	io.Reader
+	file *os.File
+}
+
+func (d *decompressor) Close() error {
+	return d.file.Close()
+}
+
+// For zstd the file is opened first, so that a missing file yields an os.PathError as for the other
+// formats.  If the program fails, the error is returned from Read in place of EOF.
+
+type zstdReader struct {
+	stdout io.ReadCloser
+	cmd    *exec.Cmd
+	stderr strings.Builder
+	file   *os.File
+}
+
+func openZstd(filename string) (io.ReadCloser, error) {
+	input_file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	zr := &zstdReader{file: input_file}
+	zr.cmd = exec.Command("zstd", "-dc")
+	zr.cmd.Stdin = input_file
+	zr.cmd.Stderr = &zr.stderr
+	zr.stdout, err = zr.cmd.StdoutPipe()
+	if err == nil {
+		err = zr.cmd.Start()
+	}
+	if err != nil {
+		input_file.Close()
+		return nil, err
+	}
+	return zr, nil
+}
+
+func (zr *zstdReader) Read(p []byte) (int, error) {
+	n, err := zr.stdout.Read(p)
+	if err == io.EOF {
+		if werr := zr.cmd.Wait(); werr != nil {
+			return n, errors.Join(werr, errors.New(zr.stderr.String()))
+		}
+	}
+	return n, err
+}
+
+func (zr *zstdReader) Close() error {
+	if zr.cmd.ProcessState == nil {
+		zr.cmd.Process.Kill()
+		zr.cmd.Wait()
+	}
+	return zr.file.Close()
+}
+
+// General "free CSV" reader, returns array of maps from field names to field values.  Compressed
+// files are decompressed, see openInput.
 //
 // If the file can't be opened the error with be of type os.PathError.  If there is a parse error
 // then the error will be of type encoding.csv.ParseError.  Otherwise the error will be something
 // else, most likely an I/O error.
 
 func ReadFreeCSV(filename string) ([]map[string]string, error) {
-	input_file, err := os.Open(filename)
+	input_file, err := openInput(filename)
 	if err != nil {
 		return nil, err
 	}
-	input := bufio.NewReader(input_file)
-	rows, err := ParseFreeCSV(input)
-	if err != nil {
-		return nil, err
+	defer input_file.Close()
+	return ParseFreeCSV(bufio.NewReader(input_file))
+}
+
+// As ReadFreeCSV, but if the context has been cancelled then the file is not read and an error that
+// wraps the context's error is returned.
+
+func ReadFreeCSVContext(ctx context.Context, filename string) ([]map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("Reading %s: %w", filename, err)
 	}
-	input_file.Close()
-	return rows, nil
+	return ReadFreeCSV(filename)
+}
+
+// Read the files concurrently, with at most `concurrency` files being read at any time, and return
+// the contents and errors in the order of the filenames; for each file, exactly one of the two is
+// non-nil.  If the context is cancelled then the remaining files are not read, and their errors
+// wrap the context's error.
+
+func ReadFreeCSVFiles(
+	ctx context.Context,
+	filenames []string,
+	concurrency int,
+) ([][]map[string]string, []error) {
+	contents := make([][]map[string]string, len(filenames))
+	errs := make([]error, len(filenames))
+	forEachConcurrently(filenames, concurrency, func(i int, filename string) {
+		contents[i], errs[i] = ReadFreeCSVContext(ctx, filename)
+	})
+	return contents, errs
+}
+
+// As ReadFreeCSVFiles, but each file is read with ReadFreeCSVWithDiagnostics, in the given format,
+// so that a row that can't be parsed is dropped and recorded in the file's diagnostics instead of
+// making the whole file unreadable.  For each file, either the contents and the diagnostics or the
+// error are non-nil.
+
+func ReadFreeCSVFilesWithDiagnostics(
+	ctx context.Context,
+	filenames []string,
+	concurrency int,
+	format CSVFormat,
+) ([][]map[string]string, []*ParseDiagnostics, []error) {
+	contents := make([][]map[string]string, len(filenames))
+	diags := make([]*ParseDiagnostics, len(filenames))
+	errs := make([]error, len(filenames))
+	forEachConcurrently(filenames, concurrency, func(i int, filename string) {
+		if err := ctx.Err(); err != nil {
+			errs[i] = fmt.Errorf("Reading %s: %w", filename, err)
+			return
+		}
+		contents[i], diags[i], errs[i] = readFreeCSVWithDiagnostics(filename, format)
+	})
+	return contents, diags, errs
+}
+
+// Call `f` on each of the filenames and its index, with at most `concurrency` calls running at any
+// time, and return when all the calls have returned.
+
+func forEachConcurrently(filenames []string, concurrency int, f func(int, string)) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	tokens := make(chan bool, concurrency)
+	var wg sync.WaitGroup
+	for i, filename := range filenames {
+		tokens <- true
+		wg.Add(1)
+		go func(i int, filename string) {
+			defer func() {
+				<-tokens
+				wg.Done()
+			}()
+			f(i, filename)
+		}(i, filename)
+	}
+	wg.Wait()
 }
 
 // This will propagate any errors from the reader; if the reader can't error out (other than EOF),
-// then no errors will be returned.
+// then no errors will be returned.  Rows that exceed DefaultParseLimits are silently dropped.
 
 func ParseFreeCSV(input io.Reader)  ([]map[string]string, error) {
-	rdr := csv.NewReader(input)
+	rows, _, err := parseFreeCSV(input, false, DefaultCSVFormat)
+	return rows, err
+}
+
+// As ParseFreeCSV, but also return the names of each row's fields in the order they appear in the
+// row, so that the row can be written back with its columns in their original order, see
+// WriteFreeCSVOrdered.  A name that appears more than once is listed at its first appearance.
+
+func ParseFreeCSVOrdered(input io.Reader) ([]map[string]string, [][]string, error) {
+	return parseFreeCSV(input, true, DefaultCSVFormat)
+}
+
+// As ReadFreeCSV, but using ParseFreeCSVOrdered.
+
+func ReadFreeCSVOrdered(filename string) ([]map[string]string, [][]string, error) {
+	input_file, err := openInput(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer input_file.Close()
+	return ParseFreeCSVOrdered(bufio.NewReader(input_file))
+}
+
+func parseFreeCSV(
+	input io.Reader,
+	withNames bool,
+	format CSVFormat,
+) ([]map[string]string, [][]string, error) {
+	if err := format.Validate(); err != nil {
+		return nil, nil, err
+	}
+	limits := DefaultParseLimits
+	rdr := csv.NewReader(newLineLimiter(skipBOM(input), limits.MaxLineBytes))
+	format.apply(rdr)
 	// Rows arbitrarily wide, and possibly uneven.
 	rdr.FieldsPerRecord = -1
 	rows := make([]map[string]string, 0)
+	var names [][]string
+	if withNames {
+		names = make([][]string, 0)
+	}
 	for {
 		fields, err := rdr.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		if limits.check(fields) != nil {
+			continue
 		}
 		m := make(map[string]string)
+		var rowNames []string
 		for _, f := range(fields) {
 			ix := strings.IndexByte(f, '=')
 			if ix == -1 {
 				// Illegal syntax, just drop the field.
 				continue
 			}
-			m[f[:ix]] = f[ix+1:]
+			name := f[:ix]
+			if _, found := m[name]; !found && withNames {
+				rowNames = append(rowNames, name)
+			}
+			m[name] = f[ix+1:]
 		}
 		rows = append(rows, m)
+		if withNames {
+			names = append(names, rowNames)
+		}
 	}
-	return rows, nil
+	return rows, names, nil
+}
+
+// Diagnostics about the input collected by ParseFreeCSVWithDiagnostics.  A row is dropped if it can't
+// be parsed as CSV, if it exceeds the parse limits, or if it has no legal fields; a field is bad if
+// it does not have the form `<fieldname>=<value>`.  Errors holds the parse errors and limit
+// violations for the dropped rows.
+//
+// DuplicateFields records the fields that appear more than once in a row.  The row is not dropped;
+// as for ParseFreeCSV, the last value for the field wins.
+
+type ParseDiagnostics struct {
+	Rows            int
+	DroppedRows     int
+	BadFields       int
+	Errors          []error
+	DuplicateFields []DuplicateField
+}
+
+// A field name that appears more than once in the row starting on the given line (1-based).
+
+type DuplicateField struct {
+	Line  int
+	Field string
+}
+
+// As ParseFreeCSV, but parse errors do not stop the parsing: the bad rows are dropped and recorded in
+// the diagnostics instead.  Errors from the reader are propagated as for ParseFreeCSV.
+
+func ParseFreeCSVWithDiagnostics(input io.Reader) ([]map[string]string, *ParseDiagnostics, error) {
+	return ParseFreeCSVWithLimits(input, DefaultParseLimits, DefaultCSVFormat)
+}
+
+// As ParseFreeCSVWithDiagnostics, but with the given limits and format instead of
+// DefaultParseLimits and DefaultCSVFormat.
+
+func ParseFreeCSVWithLimits(
+	input io.Reader,
+	limits ParseLimits,
+	format CSVFormat,
+) ([]map[string]string, *ParseDiagnostics, error) {
+	if err := format.Validate(); err != nil {
+		return nil, nil, err
+	}
+	limiter := newLineLimiter(skipBOM(input), limits.MaxLineBytes)
+	rdr := csv.NewReader(limiter)
+	format.apply(rdr)
+	rdr.FieldsPerRecord = -1
+	rows := make([]map[string]string, 0)
+	diag := &ParseDiagnostics{Errors: make([]error, 0), DuplicateFields: make([]DuplicateField, 0)}
+	for {
+		fields, err := rdr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); !ok {
+				return nil, nil, err
+			}
+			diag.Rows++
+			diag.DroppedRows++
+			diag.Errors = append(diag.Errors, err)
+			continue
+		}
+		diag.Rows++
+		if err := limits.check(fields); err != nil {
+			line, _ := rdr.FieldPos(0)
+			diag.DroppedRows++
+			diag.Errors = append(diag.Errors, fmt.Errorf("Line %d: %w", line, err))
+			continue
+		}
+		m := make(map[string]string)
+		for _, f := range(fields) {
+			ix := strings.IndexByte(f, '=')
+			if ix == -1 {
+				diag.BadFields++
+				continue
+			}
+			name := f[:ix]
+			if _, found := m[name]; found {
+				line, _ := rdr.FieldPos(0)
+				diag.DuplicateFields = append(diag.DuplicateFields, DuplicateField{line, name})
+			}
+			m[name] = f[ix+1:]
+		}
+		if len(m) == 0 {
+			diag.DroppedRows++
+			continue
+		}
+		rows = append(rows, m)
+	}
+	for _, line := range limiter.dropped {
+		diag.Rows++
+		diag.DroppedRows++
+		diag.Errors = append(diag.Errors,
+			fmt.Errorf("Line %d: longer than the limit %d bytes", line, limits.MaxLineBytes))
+	}
+	return rows, diag, nil
+}
+
+// As ReadFreeCSV, but using ParseFreeCSVWithDiagnostics.
+
+func ReadFreeCSVWithDiagnostics(filename string) ([]map[string]string, *ParseDiagnostics, error) {
+	return readFreeCSVWithDiagnostics(filename, DefaultCSVFormat)
+}
+
+func readFreeCSVWithDiagnostics(
+	filename string,
+	format CSVFormat,
+) ([]map[string]string, *ParseDiagnostics, error) {
+	input_file, err := openInput(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer input_file.Close()
+	return ParseFreeCSVWithLimits(bufio.NewReader(input_file), DefaultParseLimits, format)
+}
+
+// Describe the rows of the file that were dropped because they could not be parsed or exceeded the
+// limits, with the first of the errors, or return "" if there were none.  Rows that were dropped only
+// because they have no `name=value` fields, such as headers, are not counted.
+
+func DescribeParseErrors(filename string, diag *ParseDiagnostics) string {
+	if diag == nil || len(diag.Errors) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s: %d of the rows can't be parsed and were dropped, the first: %v",
+		filename, len(diag.Errors), diag.Errors[0])
 }
 
 // General "free CSV" writer.  The fields that are named by `fields` will be written, if they exist
@@ -104,17 +590,79 @@ func ParseFreeCSV(input io.Reader)  ([]map[string]string, error) {
 // given.
 
 func WriteFreeCSV(filename string, fields []string, data []map[string]string) error {
+	return writeFreeCSV(filename, nil, func(int) []string { return fields }, data, false, DefaultCSVFormat)
+}
+
+// As WriteFreeCSV, but the first record of the file is a header of the bare field names, for tools
+// that want one.  The parsers in this package drop the header as a row with no `name=value` fields,
+// so use ParseFreeCSVWithDiagnostics to read such a file if the dropped rows matter.
+
+func WriteFreeCSVWithHeader(filename string, fields []string, data []map[string]string) error {
+	return writeFreeCSV(filename, fields, func(int) []string { return fields }, data, false, DefaultCSVFormat)
+}
+
+// Write the data as plain CSV for tools that don't understand the `name=value` convention: the first
+// record is a header of the field names and each row has the values of the fields in the same order,
+// with an empty value for a field that does not exist in the map.  The free CSV parsers can't read
+// the result.
+
+func WritePlainCSV(filename string, fields []string, data []map[string]string) error {
+	return writeFreeCSV(filename, fields, func(int) []string { return fields }, data, true, DefaultCSVFormat)
+}
+
+// As WriteFreeCSV, but each row has its own list of fields, as returned by ParseFreeCSVOrdered, so
+// that rows that are read and written back retain their column order.  If `fields` is nil, or
+// shorter than `data`, then the rows with no list have their fields written in sorted order.
+
+func WriteFreeCSVOrdered(filename string, fields [][]string, data []map[string]string) error {
+	return writeFreeCSV(filename, nil, func(i int) []string {
+		if i < len(fields) && fields[i] != nil {
+			return fields[i]
+		}
+		names := make([]string, 0, len(data[i]))
+		for name := range data[i] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}, data, false, DefaultCSVFormat)
+}
+
+// The header is written first if it is not nil.  If plain is true then the values are written
+// without names, and missing values as empty strings.
+
+func writeFreeCSV(
+	filename string,
+	header []string,
+	fieldsFor func(int) []string,
+	data []map[string]string,
+	plain bool,
+	format CSVFormat,
+) error {
+	if err := format.Validate(); err != nil {
+		return err
+	}
 	output_file, err := os.CreateTemp(path.Dir(filename), "naicreport-csvdata")
 	if err != nil {
 		return err
 	}
+	if format.BOM {
+		output_file.WriteString(util.Utf8BOM)
+	}
 	wr := csv.NewWriter(output_file)
-	for _, row := range data {
+	wr.Comma = format.comma()
+	if header != nil {
+		wr.Write(header)
+	}
+	for i, row := range data {
 		// TODO: With go 1.21, we can hoist this and clear() it after the write, instead of
 		// reallocating each time through the loop.
 		r := []string{}
-		for _, field_name := range fields {
-			if field_value, present := row[field_name]; present {
+		for _, field_name := range fieldsFor(i) {
+			field_value, present := row[field_name]
+			if plain {
+				r = append(r, field_value)
+			} else if present {
 				r = append(r, field_name + "=" + field_value)
 			}
 		}
@@ -129,6 +677,34 @@ func WriteFreeCSV(filename string, fields []string, data []map[string]string) er
 	return nil
 }
 
+// Keep `generations` backups of the file by renaming `<filename>.<n-1>` to `<filename>.<n>` for each
+// n from `generations` down to 2, discarding the oldest, and then making `<filename>.1` a hard link
+// to the file itself, so that the file remains in place until it is replaced.  Files that do not
+// exist are skipped.  This is to be done before the file is rewritten, so that a bad run does not
+// destroy the old contents.  If `generations` is zero or less then nothing is done.
+
+func RotateBackups(filename string, generations int) error {
+	if generations <= 0 {
+		return nil
+	}
+	for n := generations; n > 1; n-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", filename, n-1), fmt.Sprintf("%s.%d", filename, n))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	newest := filename + ".1"
+	err := os.Remove(newest)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	err = os.Link(filename, newest)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
 // The field getters take a string->string map and return the parsed field value of the appropriate
 // type (or a compatible zero value), setting *success to false if the field could not be gotten or
 // parsed.
@@ -141,6 +717,22 @@ func GetString(record map[string]string, tag string, success *bool) string {
 	return value
 }
 
+// Enumeration field: a string that must be one of the allowed values, eg the tag of a record.
+
+func GetEnum(record map[string]string, tag string, allowed []string, success *bool) string {
+	value, found := record[tag]
+	*success = *success && found
+	if *success {
+		for _, a := range allowed {
+			if value == a {
+				return value
+			}
+		}
+		*success = false
+	}
+	return value
+}
+
 // Job+mark field: a job# optionally suffixed by '<', '>', or '!'.  Drop the suffix.
 
 func GetJobMark(record map[string]string, tag string, success *bool) uint32 {
@@ -151,6 +743,83 @@ func GetJobMark(record map[string]string, tag string, success *bool) uint32 {
 	return uint32(value)
 }
 
+// The mark of a job# in a job+mark field, which says whether the job was observed in full by the
+// sonalyze run that logged the record: '<' marks a job that was already running at the start of the
+// run's time window, '>' one that was still running at its end, and '!' one that was both.  The
+// values are bit sets, JobMarkBoth is JobMarkStart|JobMarkEnd.
+
+type JobMark uint8
+
+const (
+	JobMarkNone  JobMark = 0 // no mark, the job was observed from its start to its end
+	JobMarkStart JobMark = 1 // '<', the job started before the window
+	JobMarkEnd   JobMark = 2 // '>', the job ended after the window
+	JobMarkBoth  JobMark = 3 // '!', both
+)
+
+// True if the job started before the time window of the record, so that the start time of the
+// record is only an upper bound on the job's start time.
+
+func (m JobMark) StartedBefore() bool {
+	return m&JobMarkStart != 0
+}
+
+// True if the job was still running at the end of the time window of the record.
+
+func (m JobMark) EndedAfter() bool {
+	return m&JobMarkEnd != 0
+}
+
+// Job+mark field, returning the job# and its mark, see JobMark.  The job# may have at most one mark.
+
+func GetJobAndMark(record map[string]string, tag string, success *bool) (uint32, JobMark) {
+	s, found := record[tag]
+	*success = *success && found
+	mark := JobMarkNone
+	if s != "" {
+		switch s[len(s)-1] {
+		case '<':
+			mark = JobMarkStart
+		case '>':
+			mark = JobMarkEnd
+		case '!':
+			mark = JobMarkBoth
+		}
+		if mark != JobMarkNone {
+			s = s[:len(s)-1]
+		}
+	}
+	value, err := strconv.ParseUint(s, 10, 32)
+	*success = *success && err == nil
+	return uint32(value), mark
+}
+
+// The mark of a job whose records span the start and end times start1, end1 with the mark mark1
+// and start2, end2 with mark2.  The job started before the window if the record with the earlier
+// start says so, or if the starts are the same and both records say so, and similarly for the end,
+// since a record that observed the start (or end) of the job has the job's true start (or end) time.
+
+func CombineJobMarks(start1, end1 time.Time, mark1 JobMark, start2, end2 time.Time, mark2 JobMark) JobMark {
+	var mark JobMark
+	switch {
+	case start1.Before(start2):
+		mark |= mark1 & JobMarkStart
+	case start2.Before(start1):
+		mark |= mark2 & JobMarkStart
+	default:
+		mark |= mark1 & mark2 & JobMarkStart
+	}
+	switch {
+	case end1.After(end2):
+		mark |= mark1 & JobMarkEnd
+	case end2.After(end1):
+		mark |= mark2 & JobMarkEnd
+	default:
+		mark |= mark1 & mark2 & JobMarkEnd
+	}
+	return mark
+}
+
 // Uint32 field
 
 func GetUint32(record map[string]string, tag string, success *bool) uint32 {
@@ -191,6 +860,25 @@ func GetDateTime(record map[string]string, tag string, success *bool) time.Time
 	return value
 }
 
+// Duration field on the format used by sonalyze, `DDdHHhMMm`, where there may be a space between
+// the day and hour parts, eg `0d 1h40m`.
+
+var durationRe = regexp.MustCompile(`^(\d+)d\s*(\d+)h\s*(\d+)m$`)
+
+func GetDuration(record map[string]string, tag string, success *bool) time.Duration {
+	s, found := record[tag]
+	*success = *success && found
+	probe := durationRe.FindStringSubmatch(s)
+	if probe == nil {
+		*success = false
+		return time.Duration(0)
+	}
+	days, _ := strconv.ParseUint(probe[1], 10, 32)
+	hours, _ := strconv.ParseUint(probe[2], 10, 32)
+	minutes, _ := strconv.ParseUint(probe[3], 10, 32)
+	return time.Duration(days*24+hours)*time.Hour + time.Duration(minutes)*time.Minute
+}
+
 // Time field on RFC3339 format
 
 func GetRFC3339(record map[string]string, tag string, success *bool) time.Time {
@@ -200,3 +888,143 @@ func GetRFC3339(record map[string]string, tag string, success *bool) time.Time {
 	*success = *success && err == nil
 	return value
 }
+
+// Time field as an integer number of seconds since the Unix epoch, returned in UTC
+
+func GetUnixTime(record map[string]string, tag string, success *bool) time.Time {
+	s, found := record[tag]
+	*success = *success && found
+	value, err := strconv.ParseInt(s, 10, 64)
+	*success = *success && err == nil
+	return time.Unix(value, 0).UTC()
+}
+
+// Time field as an integer number of milliseconds since the Unix epoch, returned in UTC
+
+func GetUnixTimeMillis(record map[string]string, tag string, success *bool) time.Time {
+	s, found := record[tag]
+	*success = *success && found
+	value, err := strconv.ParseInt(s, 10, 64)
+	*success = *success && err == nil
+	return time.UnixMilli(value).UTC()
+}
+
+// Byte count field, returned as a number of bytes.  The value is either a bare integer, which is a
+// count of `unit` bytes (eg 1024 for fields logged in KiB), or a number, possibly with a fraction,
+// followed by a unit suffix: `B`; `K`, `KiB`, `M`, `MiB`, `G`, `GiB`, `T`, or `TiB` for powers of
+// 1024; or `KB`, `MB`, `GB`, or `TB` for powers of 1000.  The suffix is not case-sensitive, and there
+// may be a space before it.  A value that does not fit in a uint64 can't be parsed.
+
+var bytesRe = regexp.MustCompile(`^(\d+)(\.\d+)?\s*([A-Za-z]*)$`)
+
+var byteUnits = map[string]uint64{
+	"b":   1,
+	"k":   1 << 10,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gib": 1 << 30,
+	"t":   1 << 40,
+	"tib": 1 << 40,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"tb":  1e12,
+}
+
+func GetBytes(record map[string]string, tag string, unit uint64, success *bool) uint64 {
+	s, found := record[tag]
+	*success = *success && found
+	probe := bytesRe.FindStringSubmatch(s)
+	if probe == nil {
+		*success = false
+		return 0
+	}
+	multiplier := unit
+	if probe[3] != "" {
+		var known bool
+		multiplier, known = byteUnits[strings.ToLower(probe[3])]
+		if !known {
+			*success = false
+			return 0
+		}
+	} else if probe[2] != "" {
+		// A bare count of units must be an integer
+		*success = false
+		return 0
+	}
+	if probe[2] != "" {
+		value, _ := strconv.ParseFloat(probe[1]+probe[2], 64)
+		bytes := math.Round(value * float64(multiplier))
+		if bytes >= math.Exp2(64) {
+			*success = false
+			return 0
+		}
+		return uint64(bytes)
+	}
+	value, err := strconv.ParseUint(probe[1], 10, 64)
+	if err != nil || multiplier != 0 && value > math.MaxUint64/multiplier {
+		*success = false
+		return 0
+	}
+	return value * multiplier
+}
+
+// Getters for optional fields.  If the field is absent then the default value is returned and
+// `success` is left untouched; if it is present then the value is parsed as by the corresponding
+// getter for required fields, and `success` is set to false if it can't be parsed.
+
+func GetStringDefault(record map[string]string, tag string, dflt string) string {
+	if value, found := record[tag]; found {
+		return value
+	}
+	return dflt
+}
+
+func GetUint32Default(record map[string]string, tag string, dflt uint32, success *bool) uint32 {
+	if _, found := record[tag]; found {
+		return GetUint32(record, tag, success)
+	}
+	return dflt
+}
+
+func GetFloat64Default(record map[string]string, tag string, dflt float64, success *bool) float64 {
+	if _, found := record[tag]; found {
+		return GetFloat64(record, tag, success)
+	}
+	return dflt
+}
+
+func GetBoolDefault(record map[string]string, tag string, dflt bool, success *bool) bool {
+	if _, found := record[tag]; found {
+		return GetBool(record, tag, success)
+	}
+	return dflt
+}
+
+func GetDateTimeDefault(record map[string]string, tag string, dflt time.Time, success *bool) time.Time {
+	if _, found := record[tag]; found {
+		return GetDateTime(record, tag, success)
+	}
+	return dflt
+}
+
+func GetDurationDefault(
+	record map[string]string,
+	tag string,
+	dflt time.Duration,
+	success *bool,
+) time.Duration {
+	if _, found := record[tag]; found {
+		return GetDuration(record, tag, success)
+	}
+	return dflt
+}
+
+func GetRFC3339Default(record map[string]string, tag string, dflt time.Time, success *bool) time.Time {
+	if _, found := record[tag]; found {
+		return GetRFC3339(record, tag, success)
+	}
+	return dflt
+}
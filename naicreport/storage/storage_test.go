@@ -1,9 +1,12 @@
 package storage
 
 import (
+	"context"
 	"io"
 	"os"
+	"os/exec"
 	"path"
+	"strings"
 	"testing"
 	"time"
 )
@@ -34,6 +37,102 @@ func TestEnumerateFiles(t *testing.T) {
 	}
 }
 
+func TestEnumerateFilesWithReport(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	root := path.Join(wd, "../..")
+	from := time.Date(2023, 5, 29, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 6, 3, 0, 0, 0, 0, time.UTC)
+	files, report, err := EnumerateFilesWithReport(root, "sonar_test_data0/", from, to, "ml1*.csv")
+	if err != nil {
+		t.Fatalf("EnumerateFilesWithReport returned error %q", err)
+	}
+	if !same(files, []string{
+		"sonar_test_data0/2023/05/31/ml1.hpc.uio.no.csv",
+		"sonar_test_data0/2023/06/01/ml1.hpc.uio.no.csv",
+	}) {
+		t.Fatalf("EnumerateFilesWithReport returned the wrong files %q", files)
+	}
+
+	// 2023/05/29 is a file, not a directory
+	if len(report.Missing) != 1 || report.Missing[0] != from || len(report.Empty) != 2 ||
+		report.Empty[0] != from.AddDate(0, 0, 1) || report.Empty[1] != from.AddDate(0, 0, 4) {
+		t.Fatalf("Bad report %v", report)
+	}
+
+	if d, ok := FileDate(files[0]); !ok || d != from.AddDate(0, 0, 2) {
+		t.Fatalf("Bad date for prefixed file %v", d)
+	}
+
+	// A window that does not start at midnight still includes the first day
+	files, _, err = EnumerateFilesWithReport(root, "sonar_test_data0", from.Add(50*time.Hour),
+		from.Add(74*time.Hour), "ml1*.csv")
+	if err != nil || !same(files, []string{
+		"sonar_test_data0/2023/05/31/ml1.hpc.uio.no.csv",
+		"sonar_test_data0/2023/06/01/ml1.hpc.uio.no.csv",
+	}) {
+		t.Fatalf("Bad files for sub-day window %q %v", files, err)
+	}
+
+	_, _, err = EnumerateFilesWithReport(root, "../data", from, to, "*.csv")
+	if err == nil {
+		t.Fatalf("Bad prefix accepted")
+	}
+}
+
+func TestEnumerateFilesInRoots(t *testing.T) {
+	fast, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	archive, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	for _, name := range []string{
+		path.Join(fast, "2023/09/05/cpuhog.csv"),
+		path.Join(archive, "2023/09/04/cpuhog.csv.gz"),
+		path.Join(archive, "2023/09/05/cpuhog.csv.gz"),
+		path.Join(archive, "2023/09/06/cpuhog.csv"),
+	} {
+		err = os.MkdirAll(path.Dir(name), 0755)
+		if err == nil {
+			err = os.WriteFile(name, []byte{}, 0644)
+		}
+		if err != nil {
+			t.Fatalf("Could not create %s: %v", name, err)
+		}
+	}
+
+	from := time.Date(2023, 9, 4, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 9, 7, 0, 0, 0, 0, time.UTC)
+	files, err := EnumerateFilesInRoots([]string{fast, archive}, from, to, "cpuhog.csv")
+	if err != nil {
+		t.Fatalf("EnumerateFilesInRoots failed %v", err)
+	}
+	if !same(files, []string{
+		path.Join(archive, "2023/09/04/cpuhog.csv.gz"),
+		path.Join(fast, "2023/09/05/cpuhog.csv"),
+		path.Join(archive, "2023/09/06/cpuhog.csv"),
+	}) {
+		t.Fatalf("Bad files %q", files)
+	}
+}
+
+func TestFileDate(t *testing.T) {
+	d, ok := FileDate("2023/09/05/cpuhog.csv.gz")
+	if !ok || d != time.Date(2023, 9, 5, 0, 0, 0, 0, time.UTC) {
+		t.Fatalf("Bad date %v %v", d, ok)
+	}
+	for _, bad := range []string{"cpuhog.csv", "2023/09/cpuhog.csv", "2023/13/05/cpuhog.csv"} {
+		if _, ok := FileDate(bad); ok {
+			t.Fatalf("Date for %s", bad)
+		}
+	}
+}
+
 func TestReadFreeCSV(t *testing.T) {
 	wd, err := os.Getwd()
 	if err != nil {
@@ -85,6 +184,100 @@ func TestReadFreeCSVOpenErr(t *testing.T) {
 	}
 }
 
+func TestReadFreeCSVFiles(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	good := path.Join(wd, "../../sonar_test_data0/2023/08/15/ml3.hpc.uio.no.csv")
+	bad := path.Join(wd, "../../sonar_test_data0/abracadabra.csv")
+	contents, errs := ReadFreeCSVFiles(context.Background(), []string{good, bad, good}, 2)
+	if len(contents) != 3 || len(errs) != 3 {
+		t.Fatalf("ReadFreeCSVFiles returned the wrong number of results")
+	}
+	if errs[0] != nil || errs[2] != nil || len(contents[0]) != 33 || len(contents[2]) != 33 {
+		t.Fatalf("ReadFreeCSVFiles failed to read a file: %v", errs)
+	}
+	if _, ok := errs[1].(*os.PathError); !ok || contents[1] != nil {
+		t.Fatalf("Unexpected error from reading nonexistent file: %q", errs[1])
+	}
+}
+
+func TestParseFreeCSVWithDiagnostics(t *testing.T) {
+	input := "a=1,b=2\na=\"3,b=4\nc=5,junk\njunk\na=6\n"
+	rows, diag, err := ParseFreeCSVWithDiagnostics(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ParseFreeCSVWithDiagnostics failed %v", err)
+	}
+	if len(rows) != 3 || rows[0]["b"] != "2" || rows[1]["c"] != "5" || rows[2]["a"] != "6" {
+		t.Fatalf("Bad rows %v", rows)
+	}
+	if diag.Rows != 5 || diag.DroppedRows != 2 || diag.BadFields != 2 || len(diag.Errors) != 1 {
+		t.Fatalf("Bad diagnostics %v", diag)
+	}
+}
+
+func TestParseFreeCSVDuplicateFields(t *testing.T) {
+	input := "host=ml6,a=1\nhost=ml6,a=2,host=ml7,a=3\n\"b=\nx\",b=5\n"
+	rows, diag, err := ParseFreeCSVWithDiagnostics(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ParseFreeCSVWithDiagnostics failed %v", err)
+	}
+	if len(rows) != 3 || rows[1]["host"] != "ml7" || rows[1]["a"] != "3" || rows[2]["b"] != "5" {
+		t.Fatalf("Bad rows %v", rows)
+	}
+	expect := []DuplicateField{{2, "host"}, {2, "a"}, {3, "b"}}
+	if len(diag.DuplicateFields) != len(expect) {
+		t.Fatalf("Bad duplicates %v", diag.DuplicateFields)
+	}
+	for i, d := range expect {
+		if diag.DuplicateFields[i] != d {
+			t.Fatalf("Bad duplicate #%d %v", i, diag.DuplicateFields[i])
+		}
+	}
+}
+
+func TestReadCompressed(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	root := path.Join(wd, "../../sonar_test_data0")
+	files, err := EnumerateFiles(
+		root,
+		time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2023, 10, 2, 0, 0, 0, 0, time.UTC),
+		"compressed.csv")
+	if err != nil {
+		t.Fatalf("EnumerateFiles returned error %q", err)
+	}
+	if !same(files, []string {
+		"2023/10/01/compressed.csv.gz",
+		"2023/10/01/compressed.csv.bz2",
+		"2023/10/01/compressed.csv.zst",
+	}) {
+		t.Fatalf("EnumerateFiles returned the wrong files %q", files)
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f, ".zst") {
+			if _, err := exec.LookPath("zstd"); err != nil {
+				continue
+			}
+		}
+		contents, err := ReadFreeCSV(path.Join(root, f))
+		if err != nil {
+			t.Fatalf("ReadFreeCSV failed on %s: %q", f, err)
+		}
+		if len(contents) != 2 || contents[0]["a"] != "1" || contents[1]["b"] != "4" {
+			t.Fatalf("Bad contents of %s: %q", f, contents)
+		}
+	}
+	_, err = ReadFreeCSV(path.Join(root, "2023/10/01/nonexistent.csv.zst"))
+	if _, ok := err.(*os.PathError); !ok {
+		t.Fatalf("Unexpected error from opening nonexistent file: %q", err)
+	}
+}
+
 func TestWriteFreeCSV(t *testing.T) {
 	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
 	if err != nil {
@@ -118,6 +311,73 @@ func TestWriteFreeCSV(t *testing.T) {
 	}
 }
 
+func TestFreeCSVRoundTrip(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+
+	input := "zappa=5,abra=10,cadabra=20\ncadabra=3,bad,zappa=1,cadabra=4\n"
+	rows, names, err := ParseFreeCSVOrdered(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ParseFreeCSVOrdered failed %q", err)
+	}
+	if len(rows) != 2 || len(names) != 2 ||
+		!same(names[0], []string{"zappa", "abra", "cadabra"}) ||
+		!same(names[1], []string{"cadabra", "zappa"}) ||
+		rows[1]["cadabra"] != "4" {
+		t.Fatalf("Bad result %v %v", rows, names)
+	}
+
+	filename := path.Join(td_name, "test_roundtrip")
+	rows = append(rows, map[string]string{"b": "1", "a": "2"})
+	err = WriteFreeCSVOrdered(filename, names, rows)
+	if err != nil {
+		t.Fatalf("WriteFreeCSVOrdered failed %q", err)
+	}
+	all, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile failed %q", err)
+	}
+	expect := "zappa=5,abra=10,cadabra=20\ncadabra=4,zappa=1\na=2,b=1\n"
+	if string(all) != expect {
+		t.Fatalf("File contents wrong %q", all)
+	}
+}
+
+func TestWriteCSVWithHeader(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	fields := []string{"a", "b"}
+	data := []map[string]string{{"a": "1", "b": "2", "c": "3"}, {"b": "4"}}
+
+	filename := path.Join(td_name, "test_header")
+	err = WriteFreeCSVWithHeader(filename, fields, data)
+	if err != nil {
+		t.Fatalf("WriteFreeCSVWithHeader failed %q", err)
+	}
+	all, err := os.ReadFile(filename)
+	if err != nil || string(all) != "a,b\na=1,b=2\nb=4\n" {
+		t.Fatalf("File contents wrong %q %v", all, err)
+	}
+	rows, diag, err := ReadFreeCSVWithDiagnostics(filename)
+	if err != nil || len(rows) != 2 || diag.DroppedRows != 1 || rows[1]["b"] != "4" {
+		t.Fatalf("Bad reread %v %v %v", rows, diag, err)
+	}
+
+	filename = path.Join(td_name, "test_plain")
+	err = WritePlainCSV(filename, fields, data)
+	if err != nil {
+		t.Fatalf("WritePlainCSV failed %q", err)
+	}
+	all, err = os.ReadFile(filename)
+	if err != nil || string(all) != "a,b\n1,2\n,4\n" {
+		t.Fatalf("File contents wrong %q %v", all, err)
+	}
+}
+
 func same(a []string, b []string) bool {
 	if len(a) != len(b) {
 		return false
@@ -140,6 +400,26 @@ func TestFieldGetters(t *testing.T) {
 		t.Fatalf("Failed GetString #2")
 	}
 
+	success = true
+	tags := []string{"cpuhog", "deadweight"}
+	if GetEnum(map[string]string {"tag": "deadweight"}, "tag", tags, &success) != "deadweight" || !success {
+		t.Fatalf("Failed GetEnum #1")
+	}
+	GetEnum(map[string]string {"tag": "bughunt"}, "tag", tags, &success)
+	if success {
+		t.Fatalf("Failed GetEnum #2")
+	}
+	success = true
+	GetEnum(map[string]string {"tag": "cpuhog"}, "flux", tags, &success)
+	if success {
+		t.Fatalf("Failed GetEnum #3")
+	}
+	success = true
+	GetEnum(map[string]string {"tag": ""}, "tag", nil, &success)
+	if success {
+		t.Fatalf("Failed GetEnum #4")
+	}
+
 	success = true
 	if GetJobMark(map[string]string {"fixit": "107<"}, "fixit", &success) != 107 || !success {
 		t.Fatalf("Failed GetJobMark #1")
@@ -163,6 +443,18 @@ func TestFieldGetters(t *testing.T) {
 		t.Fatalf("Failed GetJobMark #6")
 	}
 
+	success = true
+	for s, mark := range map[string]JobMark {"107": JobMarkNone, "107<": JobMarkStart, "107>": JobMarkEnd, "107!": JobMarkBoth} {
+		id, m := GetJobAndMark(map[string]string {"fixit": s}, "fixit", &success)
+		if id != 107 || m != mark || !success {
+			t.Fatalf("Failed GetJobAndMark %s", s)
+		}
+	}
+	GetJobAndMark(map[string]string {"fixit": "107<!"}, "fixit", &success)
+	if success {
+		t.Fatalf("Failed GetJobAndMark with two marks")
+	}
+
 	success = true
 	if GetUint32(map[string]string {"fixit": "107"}, "fixit", &success) != 107 || !success {
 		t.Fatalf("Failed GetUint32 #1")
@@ -237,4 +529,166 @@ func TestFieldGetters(t *testing.T) {
 	if success {
 		t.Fatalf("Failed GetRFC3339 #3")
 	}
+
+	success = true
+	if GetUnixTime(map[string]string {"now": "1694507820"}, "now", &success) !=
+		time.Date(2023, 9, 12, 8, 37, 0, 0, time.UTC) || !success {
+		t.Fatalf("Failed GetUnixTime #1")
+	}
+	GetUnixTime(map[string]string {"now": "1694507820"}, "then", &success)
+	if success {
+		t.Fatalf("Failed GetUnixTime #2")
+	}
+	success = true
+	GetUnixTime(map[string]string {"now": "1694507820.5"}, "now", &success)
+	if success {
+		t.Fatalf("Failed GetUnixTime #3")
+	}
+
+	success = true
+	if GetUnixTimeMillis(map[string]string {"now": "1694507820250"}, "now", &success) !=
+		time.Date(2023, 9, 12, 8, 37, 0, 250000000, time.UTC) || !success {
+		t.Fatalf("Failed GetUnixTimeMillis #1")
+	}
+	GetUnixTimeMillis(map[string]string {"now": "1694507820250"}, "then", &success)
+	if success {
+		t.Fatalf("Failed GetUnixTimeMillis #2")
+	}
+	success = true
+	GetUnixTimeMillis(map[string]string {"now": "2023-09-12 08:37"}, "now", &success)
+	if success {
+		t.Fatalf("Failed GetUnixTimeMillis #3")
+	}
+
+	success = true
+	if GetDuration(map[string]string {"d": "0d 1h40m"}, "d", &success) != 100*time.Minute || !success {
+		t.Fatalf("Failed GetDuration #1")
+	}
+	if GetDuration(map[string]string {"d": "2d3h5m"}, "d", &success) != 51*time.Hour+5*time.Minute ||
+		!success {
+		t.Fatalf("Failed GetDuration #2")
+	}
+	GetDuration(map[string]string {"d": "0d 1h40m"}, "e", &success)
+	if success {
+		t.Fatalf("Failed GetDuration #3")
+	}
+	success = true
+	GetDuration(map[string]string {"d": "1h40m"}, "d", &success)
+	if success {
+		t.Fatalf("Failed GetDuration #4")
+	}
+}
+
+func TestGetBytes(t *testing.T) {
+	record := map[string]string{
+		"raw":      "257282980",
+		"gib":      "245GiB",
+		"spaced":   "1.5 gib",
+		"decimal":  "2MB",
+		"bytes":    "17B",
+		"fraction": "1.5",
+		"unknown":  "3PiB",
+		"huge":     "18446744073709551615K",
+		"junk":     "lots",
+	}
+	success := true
+	if GetBytes(record, "raw", 1024, &success) != 257282980*1024 ||
+		GetBytes(record, "gib", 1024, &success) != 245<<30 ||
+		GetBytes(record, "spaced", 1024, &success) != 3<<29 ||
+		GetBytes(record, "decimal", 1024, &success) != 2000000 ||
+		GetBytes(record, "bytes", 1024, &success) != 17 || !success {
+		t.Fatalf("Bad byte counts")
+	}
+	for _, tag := range []string{"fraction", "unknown", "huge", "junk", "absent"} {
+		success = true
+		GetBytes(record, tag, 1024, &success)
+		if success {
+			t.Fatalf("Bad byte count accepted for %s", tag)
+		}
+	}
+}
+
+func TestDefaultFieldGetters(t *testing.T) {
+	r := map[string]string{"s": "ho", "n": "107", "f": "1.5", "b": "true", "bad": "x",
+		"dt": "2023-09-12 08:37", "d": "0d 1h40m", "rfc": "2023-09-12T08:37:00Z"}
+	t0 := time.Date(2023, 9, 12, 8, 37, 0, 0, time.UTC)
+	t1 := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if GetStringDefault(r, "s", "hi") != "ho" || GetStringDefault(r, "t", "hi") != "hi" {
+		t.Fatalf("Failed GetStringDefault")
+	}
+
+	// Present and absent fields both succeed
+	success := true
+	if GetUint32Default(r, "n", 1, &success) != 107 || GetUint32Default(r, "m", 1, &success) != 1 ||
+		GetFloat64Default(r, "f", 2, &success) != 1.5 || GetFloat64Default(r, "g", 2, &success) != 2 ||
+		GetBoolDefault(r, "b", false, &success) != true || GetBoolDefault(r, "c", false, &success) ||
+		GetDateTimeDefault(r, "dt", t1, &success) != t0 || GetDateTimeDefault(r, "du", t1, &success) != t1 ||
+		GetDurationDefault(r, "d", 0, &success) != 100*time.Minute ||
+		GetDurationDefault(r, "e", time.Hour, &success) != time.Hour ||
+		GetRFC3339Default(r, "rfc", t1, &success) != t0 || GetRFC3339Default(r, "rfd", t1, &success) != t1 ||
+		!success {
+		t.Fatalf("Failed default getters")
+	}
+
+	// Present but unparseable fields fail
+	for _, get := range []func(*bool){
+		func(s *bool) { GetUint32Default(r, "bad", 1, s) },
+		func(s *bool) { GetFloat64Default(r, "bad", 1, s) },
+		func(s *bool) { GetBoolDefault(r, "bad", true, s) },
+		func(s *bool) { GetDateTimeDefault(r, "bad", t1, s) },
+		func(s *bool) { GetDurationDefault(r, "bad", 0, s) },
+		func(s *bool) { GetRFC3339Default(r, "bad", t1, s) },
+	} {
+		success = true
+		get(&success)
+		if success {
+			t.Fatalf("Failed default getters on bad input")
+		}
+	}
+}
+
+func TestRotateBackups(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	filename := path.Join(td_name, "state.csv")
+
+	// Nothing to rotate
+	err = RotateBackups(filename, 2)
+	if err != nil {
+		t.Fatalf("RotateBackups failed %v", err)
+	}
+
+	// Three generations written with two backups: the oldest is discarded
+	for _, contents := range []string{"a", "b", "c"} {
+		err = RotateBackups(filename, 2)
+		if err != nil {
+			t.Fatalf("RotateBackups failed %v", err)
+		}
+		err = WriteFreeCSV(filename, []string{"x"}, []map[string]string{{"x": contents}})
+		if err != nil {
+			t.Fatalf("WriteFreeCSV failed %v", err)
+		}
+	}
+	for name, expect := range map[string]string{"state.csv": "x=c\n", "state.csv.1": "x=b\n",
+		"state.csv.2": "x=a\n"} {
+		bytes, err := os.ReadFile(path.Join(td_name, name))
+		if err != nil || string(bytes) != expect {
+			t.Fatalf("Bad %s: %q %v", name, bytes, err)
+		}
+	}
+	if _, err := os.Stat(filename + ".3"); err == nil {
+		t.Fatalf("Too many backups")
+	}
+
+	// No backups
+	err = RotateBackups(filename, 0)
+	if err != nil {
+		t.Fatalf("RotateBackups failed %v", err)
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Fatalf("File was moved")
+	}
 }
@@ -0,0 +1,288 @@
+// Per-file summaries of the jobs in the log files, and a cache of them.
+//
+// The analyses consolidate the records for each job across all the log files in the time window.
+// Consolidation is associative, so the records of each file can be summarized by job first and the
+// summaries consolidated afterwards, and the summaries of a file that has not changed since the
+// last run can be reused instead of reading and parsing the file again.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"math"
+	"os"
+	"path"
+	"time"
+
+	"naicreport/util"
+)
+
+// The summary of the records for one job in one log file.  Within a file, the job is identified by
+// its job mark, host and command name, which are the properties by which the analyses select
+// records, so that selecting summaries is the same as selecting records.  Cmd is the command name
+// as logged.  FirstSeen and LastSeen span the `now` fields of the records, and Start and End span
+// their `start` and `end` fields.  Mark is the mark of the job# in the records, combined as by
+// CombineJobMarks.  Peaks has the maxima of the fields named by the caller, in order.
+
+type JobSummary struct {
+	Id        uint32
+	Host      string
+	User      string
+	Cmd       string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Start     time.Time
+	End       time.Time
+	Mark      JobMark
+	Peaks     []float64
+}
+
+// Summarize the records with the tag by job, returning the summaries in the order of the first
+// record for each job.  The user of a job is taken from its first record.  Records that lack any of
+// the fields, or that can't be parsed, are skipped.  A record that has no `now` field is taken to
+// have been logged at the start of the day of the file, if the filename has a date.
+
+func SummarizeRecords(filename string, records []map[string]string, tag string, fields []string) []*JobSummary {
+	type jobKey struct {
+		id   uint32
+		host string
+		cmd  string
+	}
+
+	summaries := make([]*JobSummary, 0)
+	jobs := make(map[jobKey]*JobSummary)
+	fileDate, haveFileDate := FileDate(filename)
+	for _, r := range records {
+		success := true
+		GetEnum(r, "tag", []string{tag}, &success)
+		var now time.Time
+		if haveFileDate {
+			now = GetDateTimeDefault(r, "now", fileDate, &success)
+		} else {
+			now = GetDateTime(r, "now", &success)
+		}
+		id, mark := GetJobAndMark(r, "jobm", &success)
+		user := GetString(r, "user", &success)
+		host := GetString(r, "host", &success)
+		cmd := GetString(r, "cmd", &success)
+		peaks := make([]float64, len(fields))
+		for i, field := range fields {
+			peaks[i] = GetFloat64(r, field, &success)
+		}
+		start := GetDateTime(r, "start", &success)
+		end := GetDateTime(r, "end", &success)
+		if !success {
+			continue
+		}
+
+		key := jobKey{id, host, cmd}
+		if s, present := jobs[key]; present {
+			util.WidenSpan(&s.FirstSeen, &s.LastSeen, now, now)
+			s.Mark = CombineJobMarks(s.Start, s.End, s.Mark, start, end, mark)
+			util.WidenSpan(&s.Start, &s.End, start, end)
+			for i := range peaks {
+				s.Peaks[i] = math.Max(s.Peaks[i], peaks[i])
+			}
+		} else {
+			s := &JobSummary{
+				Id:        id,
+				Host:      host,
+				User:      user,
+				Cmd:       cmd,
+				FirstSeen: now,
+				LastSeen:  now,
+				Start:     start,
+				End:       end,
+				Mark:      mark,
+				Peaks:     peaks,
+			}
+			jobs[key] = s
+			summaries = append(summaries, s)
+		}
+	}
+	return summaries
+}
+
+// Read the files in the format as ReadFreeCSVFilesWithDiagnostics does and summarize each by SummarizeRecords,
+// returning the summaries, diagnostics, and errors in the order of the filenames.  A row that can't be
+// parsed is dropped, and the rest of the file is summarized; the file's diagnostics record the
+// error.  The diagnostics are nil for files that could not be read and for files whose summaries are
+// taken from the cache.
+//
+// If cache is not nil then the summaries of files that have not changed since they were cached are
+// taken from the cache, and the summaries of the files that are read are added to it, except for
+// files that have rows that can't be parsed, which are read again (and their errors reported again)
+// on every run until they are fixed.
+
+func ReadJobSummaries(
+	ctx context.Context,
+	filenames []string,
+	concurrency int,
+	tag string,
+	fields []string,
+	format CSVFormat,
+	cache *SummaryCache,
+) ([][]*JobSummary, []*ParseDiagnostics, []error) {
+	summaries := make([][]*JobSummary, len(filenames))
+	diags := make([]*ParseDiagnostics, len(filenames))
+	errs := make([]error, len(filenames))
+	toRead := make([]int, 0)
+	infos := make([]os.FileInfo, len(filenames))
+	for i, filename := range filenames {
+		if cache != nil && filename != util.StdinDataPath {
+			// The file is stat'ed before it is read, so if it is changed in between, the change
+			// will be detected on the next run.
+			if info, err := os.Stat(filename); err == nil {
+				infos[i] = info
+				if s, found := cache.lookup(filename, info); found {
+					summaries[i] = s
+					continue
+				}
+			}
+		}
+		toRead = append(toRead, i)
+	}
+
+	names := make([]string, len(toRead))
+	for j, i := range toRead {
+		names[j] = filenames[i]
+	}
+	contents, readDiags, readErrs := ReadFreeCSVFilesWithDiagnostics(ctx, names, concurrency, format)
+	for j, i := range toRead {
+		if readErrs[j] != nil {
+			errs[i] = readErrs[j]
+			continue
+		}
+		summaries[i] = SummarizeRecords(filenames[i], contents[j], tag, fields)
+		diags[i] = readDiags[j]
+		if cache != nil && infos[i] != nil && len(diags[i].Errors) == 0 {
+			cache.store(filenames[i], infos[i], summaries[i])
+		}
+	}
+	return summaries, diags, errs
+}
+
+// A cache of the job summaries of log files, stored in a file.  A file's summaries are valid as long
+// as its size and modification time are unchanged, so a file that is appended to is summarized
+// anew.  The cache is specific to the tag and fields of the summaries and to the format of the files.
+
+type SummaryCache struct {
+	filename string
+	contents summaryCacheContents
+	used     map[string]bool
+}
+
+// Version 2 added the Mark of the summaries.  Version 3 added the Comma and Comment of the format.
+const summaryCacheVersion = 3
+
+type summaryCacheContents struct {
+	Version int
+	Tag     string
+	Fields  []string
+	Comma   rune
+	Comment rune
+	Files   map[string]*summaryCacheEntry
+}
+
+type summaryCacheEntry struct {
+	Size      int64
+	ModTime   time.Time
+	Summaries []*JobSummary
+}
+
+// Load the cache from the file.  If the file does not exist or can't be read, or it was written for
+// other summaries or another format or by another version of the program, then the cache is empty;
+// it is only a cache.
+
+func OpenSummaryCache(filename, tag string, fields []string, format CSVFormat) *SummaryCache {
+	cache := &SummaryCache{
+		filename: filename,
+		used:     make(map[string]bool),
+	}
+	bs, err := os.ReadFile(filename)
+	if err == nil {
+		var contents summaryCacheContents
+		err = gob.NewDecoder(bytes.NewReader(bs)).Decode(&contents)
+		if err == nil && contents.Version == summaryCacheVersion && contents.Tag == tag &&
+			sameStrings(contents.Fields, fields) && contents.Comma == format.comma() &&
+			contents.Comment == format.Comment {
+			if contents.Files == nil {
+				contents.Files = make(map[string]*summaryCacheEntry)
+			}
+			cache.contents = contents
+			return cache
+		}
+	}
+	cache.contents = summaryCacheContents{
+		Version: summaryCacheVersion,
+		Tag:     tag,
+		Fields:  fields,
+		Comma:   format.comma(),
+		Comment: format.Comment,
+		Files:   make(map[string]*summaryCacheEntry),
+	}
+	return cache
+}
+
+// Write the cache to its file, replacing the file.  Only the files that were looked up or added
+// since the cache was opened are retained, so that files that have dropped out of the time window do
+// not accumulate.
+
+func (c *SummaryCache) Save() error {
+	for name := range c.contents.Files {
+		if !c.used[name] {
+			delete(c.contents.Files, name)
+		}
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&c.contents)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(path.Dir(c.filename), "naicreport-cache")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), c.filename)
+}
+
+func (c *SummaryCache) lookup(filename string, info os.FileInfo) ([]*JobSummary, bool) {
+	e, found := c.contents.Files[filename]
+	if !found || e.Size != info.Size() || !e.ModTime.Equal(info.ModTime()) {
+		return nil, false
+	}
+	c.used[filename] = true
+	return e.Summaries, true
+}
+
+func (c *SummaryCache) store(filename string, info os.FileInfo, summaries []*JobSummary) {
+	c.contents.Files[filename] = &summaryCacheEntry{
+		Size:      info.Size(),
+		ModTime:   info.ModTime(),
+		Summaries: summaries,
+	}
+	c.used[filename] = true
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSummarizeRecords(t *testing.T) {
+	records := []map[string]string{
+		{"tag": "cpuhog", "now": "2023-09-05 10:00", "jobm": "10!", "user": "u", "host": "ml6", "cmd": "python",
+			"cpu-peak": "5", "start": "2023-09-05 09:00", "end": "2023-09-05 10:00"},
+		{"tag": "cpuhog", "now": "2023-09-05 10:00", "jobm": "11", "user": "v", "host": "ml6", "cmd": "R",
+			"cpu-peak": "3", "start": "2023-09-05 09:30", "end": "2023-09-05 10:00"},
+		{"tag": "cpuhog", "now": "2023-09-05 11:00", "jobm": "10<", "user": "u", "host": "ml6", "cmd": "python",
+			"cpu-peak": "2", "start": "2023-09-05 09:00", "end": "2023-09-05 11:00"},
+		{"tag": "gpuhog", "now": "2023-09-05 11:00", "jobm": "12", "user": "u", "host": "ml6", "cmd": "python",
+			"cpu-peak": "2", "start": "2023-09-05 09:00", "end": "2023-09-05 11:00"},
+		{"tag": "cpuhog", "now": "2023-09-05 11:00", "jobm": "13", "user": "u", "host": "ml6", "cmd": "python",
+			"start": "2023-09-05 09:00", "end": "2023-09-05 11:00"},
+	}
+	s := SummarizeRecords("2023/09/05/cpuhog.csv", records, "cpuhog", []string{"cpu-peak"})
+	if len(s) != 2 || s[0].Id != 10 || s[1].Id != 11 {
+		t.Fatalf("Bad summaries %v", s)
+	}
+	if s[0].User != "u" || s[0].Cmd != "python" || s[0].Peaks[0] != 5 ||
+		s[0].FirstSeen != time.Date(2023, 9, 5, 10, 0, 0, 0, time.UTC) ||
+		s[0].LastSeen != time.Date(2023, 9, 5, 11, 0, 0, 0, time.UTC) ||
+		s[0].End != time.Date(2023, 9, 5, 11, 0, 0, 0, time.UTC) {
+		t.Fatalf("Bad summary %v", s[0])
+	}
+
+	// Both records of job 10 have the same start and mark it as started before the window, but only
+	// the first, which has the earlier end, marks it as ended after the window.
+	if s[0].Mark != JobMarkStart || s[1].Mark != JobMarkNone {
+		t.Fatalf("Bad marks %v %v", s[0].Mark, s[1].Mark)
+	}
+}
+
+func TestCombineJobMarks(t *testing.T) {
+	t0 := time.Date(2023, 9, 5, 9, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Hour)
+	t2 := t0.Add(2 * time.Hour)
+	if CombineJobMarks(t0, t1, JobMarkBoth, t1, t2, JobMarkNone) != JobMarkStart ||
+		CombineJobMarks(t1, t2, JobMarkNone, t0, t1, JobMarkBoth) != JobMarkStart ||
+		CombineJobMarks(t0, t2, JobMarkBoth, t0, t2, JobMarkEnd) != JobMarkEnd ||
+		CombineJobMarks(t0, t2, JobMarkBoth, t0, t2, JobMarkBoth) != JobMarkBoth ||
+		CombineJobMarks(t1, t1, JobMarkNone, t0, t2, JobMarkNone) != JobMarkNone {
+		t.Fatalf("Bad CombineJobMarks")
+	}
+	if !JobMarkBoth.StartedBefore() || !JobMarkBoth.EndedAfter() || JobMarkEnd.StartedBefore() ||
+		JobMarkStart.EndedAfter() {
+		t.Fatalf("Bad JobMark predicates")
+	}
+}
+
+func TestSummaryCache(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	filename := path.Join(td_name, "cpuhog.csv")
+	cacheName := path.Join(td_name, "cpuhog-cache.gob")
+	record := "tag=cpuhog,now=2023-09-05 10:00,jobm=%d,user=u,host=ml6,cmd=python,cpu-peak=5," +
+		"start=2023-09-05 09:00,end=2023-09-05 10:00\n"
+	write := func(contents string, mtime time.Time) {
+		err := os.WriteFile(filename, []byte(contents), 0644)
+		if err == nil {
+			err = os.Chtimes(filename, mtime, mtime)
+		}
+		if err != nil {
+			t.Fatalf("Could not write %q", err)
+		}
+	}
+	read := func() []*JobSummary {
+		cache := OpenSummaryCache(cacheName, "cpuhog", []string{"cpu-peak"}, DefaultCSVFormat)
+		summaries, _, errs := ReadJobSummaries(context.Background(), []string{filename}, 1, "cpuhog",
+			[]string{"cpu-peak"}, DefaultCSVFormat, cache)
+		if errs[0] != nil {
+			t.Fatalf("Could not read %q", errs[0])
+		}
+		err := cache.Save()
+		if err != nil {
+			t.Fatalf("Could not save %q", err)
+		}
+		return summaries[0]
+	}
+	mtime := time.Date(2023, 9, 5, 10, 0, 0, 0, time.UTC)
+
+	write(fmt.Sprintf(record, 10), mtime)
+	if s := read(); len(s) != 1 || s[0].Id != 10 {
+		t.Fatalf("Bad first read %v", s)
+	}
+
+	// Same size and time: the file is not read again
+	write(fmt.Sprintf(record, 11), mtime)
+	if s := read(); len(s) != 1 || s[0].Id != 10 {
+		t.Fatalf("Cache not used %v", s)
+	}
+
+	// Appended to: the file is read again
+	write(fmt.Sprintf(record, 11)+fmt.Sprintf(record, 12), mtime.Add(time.Hour))
+	if s := read(); len(s) != 2 || s[0].Id != 11 || s[1].Id != 12 {
+		t.Fatalf("Cache not invalidated %v", s)
+	}
+
+	// A cache for other fields is not used
+	cache := OpenSummaryCache(cacheName, "cpuhog", []string{"gpu-peak"}, DefaultCSVFormat)
+	if len(cache.contents.Files) != 0 {
+		t.Fatalf("Cache for other fields used")
+	}
+
+	// Nor is a cache for another format
+	cache = OpenSummaryCache(cacheName, "cpuhog", []string{"cpu-peak"}, TabCSVFormat)
+	if len(cache.contents.Files) != 0 {
+		t.Fatalf("Cache for other format used")
+	}
+}
+
+func TestReadJobSummariesParseError(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	filename := path.Join(td_name, "cpuhog.csv")
+	record := "tag=cpuhog,now=2023-09-05 10:00,jobm=%d,user=u,host=ml6,cmd=%s,cpu-peak=5," +
+		"start=2023-09-05 09:00,end=2023-09-05 10:00\n"
+	contents := fmt.Sprintf(record, 10, "python") + fmt.Sprintf(record, 11, `py"thon`) +
+		fmt.Sprintf(record, 12, "python")
+	err = os.WriteFile(filename, []byte(contents), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+
+	cache := OpenSummaryCache(
+		path.Join(td_name, "cpuhog-cache.gob"), "cpuhog", []string{"cpu-peak"}, DefaultCSVFormat)
+	summaries, diags, errs := ReadJobSummaries(context.Background(), []string{filename}, 1, "cpuhog",
+		[]string{"cpu-peak"}, DefaultCSVFormat, cache)
+	if errs[0] != nil {
+		t.Fatalf("Could not read %q", errs[0])
+	}
+	if len(summaries[0]) != 2 || summaries[0][0].Id != 10 || summaries[0][1].Id != 12 {
+		t.Fatalf("Bad summaries %v", summaries[0])
+	}
+	if diags[0] == nil || len(diags[0].Errors) != 1 || DescribeParseErrors(filename, diags[0]) == "" {
+		t.Fatalf("Bad diagnostics %v", diags[0])
+	}
+	// The file is not cached, so the error is found again on the next run
+	if len(cache.contents.Files) != 0 {
+		t.Fatalf("File with errors cached")
+	}
+}
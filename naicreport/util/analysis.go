@@ -0,0 +1,254 @@
+// Options shared by the stateful analyses (ml-cpuhog, ml-deadweight, ml-gpuhog, ml-memhog) and by
+// the digest that combines them.
+
+package util
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+	"unicode/utf8"
+)
+
+type AnalysisOptions struct {
+	Json            bool
+	Jsonl           bool
+	JsonUnits       bool
+	Csv             bool
+	JsonReports     bool
+	DryRun          bool
+	Seed            bool
+	SortByUser      bool
+	Sort            string
+	ReescalateAfter time.Duration
+	IgnoreUsers     string
+	IgnoreFile      string
+	SinceLastRun    bool
+	MetricsFile     string
+	Concurrency     int
+	CommandMap      string
+	ExcludeCommands string
+	CrossHost       bool
+	Hosts           string
+	TimeFormat      string
+	Timezone        string
+	TopN            int
+	ConfigFile      string
+	StateBackups    int
+	QuietIfEmpty    bool
+	Cache           bool
+	ReportTemplate  string
+	MinDuration     time.Duration
+	ExitEvents      bool
+	RecoverState    bool
+	StripDomain     string
+	Fields          string
+	GracePeriod     time.Duration
+	Diff            string
+	// The source of the time a violation was first detected, see FirstViolationTime.
+	FirstViolationSource string
+	JobMarks             bool
+	MaxDataAge           time.Duration
+	Bom                  bool
+	LogDelimiter         string
+	LogComment           string
+}
+
+// Add the analysis options to the FlagSet of progOpts.  The fields of the returned structure are
+// set when progOpts is parsed.  The analyses can read from stdin, so progOpts will accept
+// StdinDataPath as the data path.
+
+func NewAnalysisOptions(progOpts *StandardOptions) *AnalysisOptions {
+	opts := &AnalysisOptions{}
+	progOpts.allowStdin = true
+	c := progOpts.Container
+	c.BoolVar(&opts.Json, "json", false, "Format output as JSON")
+	c.BoolVar(&opts.Jsonl, "jsonl", false, "Format output as JSON Lines, one object per line")
+	c.BoolVar(&opts.JsonUnits, "json-units", false,
+		"With --json, output an object with the units of the fields and the array of events")
+	c.BoolVar(&opts.Csv, "csv", false, "Format output as CSV with a header row")
+	c.BoolVar(&opts.JsonReports, "json-reports", false, "Format the text reports as a JSON array")
+	c.BoolVar(&opts.DryRun, "dry-run", false, "Compute the report but do not update the state")
+	c.BoolVar(&opts.Seed, "seed", false, "Mark all jobs as reported without reporting them")
+	c.BoolVar(&opts.SortByUser, "sort-by-user", false, "Group the text report by user")
+	c.StringVar(&opts.Sort, "sort", "host",
+		"Order of the reports: host (then job#), user (then host), or severity (worst first)")
+	c.DurationVar(&opts.ReescalateAfter, "reescalate-after", 0,
+		"Report active jobs again if they were last reported longer ago than this (eg 72h)")
+	c.StringVar(&opts.IgnoreUsers, "ignore-users", "", "Comma-separated list of users to ignore")
+	c.StringVar(&opts.IgnoreFile, "ignore-file", "", "File listing users and host:job# pairs to ignore")
+	c.BoolVar(&opts.SinceLastRun, "since-last-run", false,
+		"Start the time window where the last successful run's window ended")
+	c.StringVar(&opts.MetricsFile, "metrics-file", "",
+		"Write Prometheus metrics for the run to this file")
+	c.IntVar(&opts.Concurrency, "concurrency", runtime.GOMAXPROCS(0),
+		"Maximum number of log files to read concurrently")
+	c.StringVar(&opts.CommandMap, "command-map", "",
+		"File of rules mapping command names to canonical names")
+	c.StringVar(&opts.ExcludeCommands, "exclude-commands", "",
+		"Comma-separated list of commands (or glob patterns) whose jobs are not analyzed")
+	c.BoolVar(&opts.CrossHost, "cross-host", false,
+		"Identify jobs by job# alone and consolidate them across hosts (for Slurm clusters)")
+	c.StringVar(&opts.Hosts, "host", "",
+		"Comma-separated list of hosts (or glob patterns) to restrict the analysis to")
+	c.StringVar(&opts.TimeFormat, "report-time-format", "",
+		"Go time layout for the times in the reports (default \"2006-01-02 15:04\")")
+	c.IntVar(&opts.TopN, "top-n", 0,
+		"Report only this many of the most severe new violations, but mark all as reported (0 = all)")
+	c.StringVar(&opts.Timezone, "timezone", "",
+		"Time zone for the times in the reports, eg Europe/Oslo or Local (default UTC)")
+	c.StringVar(&opts.ConfigFile, "config-file", "",
+		"System config file describing the hosts, for absolute figures in the reports")
+	c.IntVar(&opts.StateBackups, "state-backups", 0,
+		"Number of generations of backups of the state file to keep (file.1, file.2, ...)")
+	c.BoolVar(&opts.QuietIfEmpty, "quiet-if-empty", false,
+		"Print nothing (and remove the --output-file) if there are no new violations")
+	c.BoolVar(&opts.Cache, "cache", false,
+		"Cache summaries of the log files in the data directory, and reuse them for unchanged files")
+	c.StringVar(&opts.ReportTemplate, "report-template", "",
+		"File of text/template definitions that replace the default templates of the text reports")
+	c.DurationVar(&opts.MinDuration, "min-duration", 0,
+		"Disregard jobs that have run for less than this (eg 30m), they are reported when they have run longer")
+	c.BoolVar(&opts.ExitEvents, "exit-events", false,
+		fmt.Sprintf("Exit with code %d instead of 0 if there are new violations", ExitEvents))
+	c.BoolVar(&opts.RecoverState, "recover-state", false,
+		"If the state file is missing or can't be read, read the state from its most recent good backup")
+	c.StringVar(&opts.StripDomain, "strip-domain", "",
+		"Comma-separated list of domains to strip from the host names, eg hpc.uio.no")
+	c.StringVar(&opts.Fields, "fields", "",
+		"Comma-separated list of the observed-data fields to report, eg cpu-peak,rcpu-peak (default all)")
+	c.DurationVar(&opts.GracePeriod, "grace-period", 0,
+		"Report a violation only once it has been seen for longer than this after it was first detected (eg 1h)")
+	c.StringVar(&opts.Diff, "diff", "",
+		"Write a summary of the jobs added to, removed from, and reported from the state by the run to this file")
+	c.StringVar(&opts.FirstViolationSource, "first-violation-source", "run",
+		"The time a violation was first detected: that of the run (run), of the job's earliest record (record), or of its earliest log file (file)")
+	c.BoolVar(&opts.JobMarks, "job-marks", false,
+		"Report a job whose logged job# is marked as started before sonalyze's time window as started before the observation window")
+	c.DurationVar(&opts.MaxDataAge, "max-data-age", 0,
+		fmt.Sprintf("Fail with exit code %d if the newest log file is older than this (eg 48h), the logs of a day being current until its end", ExitStaleData))
+	c.BoolVar(&opts.Bom, "bom", false,
+		"With --csv, start the output with a UTF-8 byte order mark, for Excel on Windows")
+	c.StringVar(&opts.LogDelimiter, "log-delimiter", ",",
+		"The field delimiter of the log files, a single character or tab")
+	c.StringVar(&opts.LogComment, "log-comment", "",
+		"Skip the lines of the log files that start with this character, eg # (default none)")
+	return opts
+}
+
+// The ignore list specified by the options.
+
+func (opts *AnalysisOptions) IgnoreList() (*IgnoreList, error) {
+	return NewIgnoreList(opts.IgnoreUsers, opts.IgnoreFile)
+}
+
+// The formatter for the report times specified by the options.
+
+func (opts *AnalysisOptions) ReportTimes() (*TimeFormatter, error) {
+	return NewTimeFormatter(opts.TimeFormat, opts.Timezone)
+}
+
+// The host filter specified by the options, which also strips the domains of --strip-domain from
+// the host names.
+
+func (opts *AnalysisOptions) HostFilter() (*HostFilter, error) {
+	hf, err := NewHostFilter(opts.Hosts)
+	if err != nil {
+		return nil, err
+	}
+	hf.StripDomains(opts.StripDomain)
+	return hf, nil
+}
+
+// The system configuration specified by the options.
+
+func (opts *AnalysisOptions) SystemConfig() (*SystemConfigs, error) {
+	return LoadSystemConfig(opts.ConfigFile)
+}
+
+// True if --min-duration is given and a job with the start and end times has run for less than
+// that.  The start and end times are those of the job as logged, so the duration is the time the job
+// has run, not the time it has been observed in the time window.
+
+func (opts *AnalysisOptions) IsTooShort(start, end time.Time) bool {
+	return opts.MinDuration > 0 && end.Sub(start) < opts.MinDuration
+}
+
+// True if a violation that was first detected at firstViolation and last seen at lastSeen is still
+// in the grace period of --grace-period and should not be reported yet.  firstViolation is the time
+// of the run that first detected the violation (by default, see FirstViolationTime) and lastSeen is
+// the time of its most recent record, so a violation leaves the grace period when it has been
+// logged for longer than the grace period after its detection.
+
+func (opts *AnalysisOptions) InGracePeriod(firstViolation, lastSeen time.Time) bool {
+	return opts.GracePeriod > 0 && lastSeen.Sub(firstViolation) <= opts.GracePeriod
+}
+
+// The function that computes the time a job's violation was first detected from the time of the run,
+// `now`, the time of the job's earliest record in the time window, `firstSeen`, and the date of the
+// earliest log file with a record for the job, `firstFile`, as selected by --first-violation-source:
+// "run" (the default) selects now, "record" selects firstSeen, and "file" selects firstFile, or the
+// start of the day of firstSeen if firstFile is zero because the records were read from stdin.
+//
+// The time is that of the job's first violation only if the job was in violation from its first
+// record, and "record" and "file" can only see as far back as the time window.  The time is fixed
+// when the job enters the state (see jobstate.EnsureJob), so a later run with another source does
+// not change it for the jobs that are already known.
+
+func (opts *AnalysisOptions) FirstViolationTime() (func(now, firstSeen, firstFile time.Time) time.Time, error) {
+	switch opts.FirstViolationSource {
+	case "", "run":
+		return func(now, firstSeen, firstFile time.Time) time.Time {
+			return now
+		}, nil
+	case "record":
+		return func(now, firstSeen, firstFile time.Time) time.Time {
+			return firstSeen
+		}, nil
+	case "file":
+		return func(now, firstSeen, firstFile time.Time) time.Time {
+			if firstFile.IsZero() {
+				return time.Date(firstSeen.Year(), firstSeen.Month(), firstSeen.Day(), 0, 0, 0, 0, time.UTC)
+			}
+			return firstFile
+		}, nil
+	default:
+		return nil, fmt.Errorf("Bad --first-violation-source value %s, must be run, record, or file",
+			opts.FirstViolationSource)
+	}
+}
+
+// The command map, with the excluded commands, specified by the options.
+
+func (opts *AnalysisOptions) Commands() (*CommandMap, error) {
+	return NewCommandMap(opts.CommandMap, opts.ExcludeCommands)
+}
+
+// The field delimiter of the log files specified by the options.  Whether the character can be
+// used as a delimiter is checked when the logs are read.
+
+func (opts *AnalysisOptions) LogDelimiterRune() (rune, error) {
+	if opts.LogDelimiter == "tab" {
+		return '\t', nil
+	}
+	c, size := utf8.DecodeRuneInString(opts.LogDelimiter)
+	if size == 0 || size != len(opts.LogDelimiter) {
+		return 0, fmt.Errorf("Bad --log-delimiter value %q, must be a single character or tab",
+			opts.LogDelimiter)
+	}
+	return c, nil
+}
+
+// The comment character of the log files specified by the options, zero if there is none.  As for
+// the delimiter, whether the character can be used is checked when the logs are read.
+
+func (opts *AnalysisOptions) LogCommentRune() (rune, error) {
+	if opts.LogComment == "" {
+		return 0, nil
+	}
+	c, size := utf8.DecodeRuneInString(opts.LogComment)
+	if size != len(opts.LogComment) {
+		return 0, fmt.Errorf("Bad --log-comment value %q, must be a single character", opts.LogComment)
+	}
+	return c, nil
+}
@@ -0,0 +1,29 @@
+// The source of the current time, so that tests can pin "now".
+
+package util
+
+import (
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+}
+
+// The system clock.
+
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// A clock that always returns T, for testing.
+
+type FakeClock struct {
+	T time.Time
+}
+
+func (c *FakeClock) Now() time.Time {
+	return c.T
+}
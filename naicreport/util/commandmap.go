@@ -0,0 +1,123 @@
+// Rules for normalizing command names, so that variants of what is really the same workload (eg
+// `python3.9` and `python3.10`) are grouped under one canonical name (eg `python`), and for
+// excluding commands that are scheduler or system artifacts (eg `srun`, `sshd`) from the analyses.
+
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type commandRule struct {
+	pattern *regexp.Regexp
+	name    string
+}
+
+type CommandMap struct {
+	rules    []commandRule
+	excluded []string
+}
+
+// Create a command map from the contents of a file, which may be empty, in which case the map has no
+// rules.
+//
+// The file has one rule per line, of the form `<regex> <canonical-name>`.  The regex must match the
+// entire command name; it cannot contain blanks, but `\s` can be used.  Blank lines and lines
+// starting with `#` are ignored.
+//
+// The commands to exclude are given as a comma-separated list of command names, each of which can
+// be a glob pattern (eg `ssh*`).
+
+func NewCommandMap(filename, exclude string) (*CommandMap, error) {
+	cm := &CommandMap{rules: make([]commandRule, 0), excluded: make([]string, 0)}
+	for _, c := range strings.Split(exclude, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if _, err := path.Match(c, ""); err != nil {
+			return nil, fmt.Errorf("Bad command pattern %s", c)
+		}
+		cm.excluded = append(cm.excluded, c)
+	}
+	if filename == "" {
+		return cm, nil
+	}
+
+	input, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	scanner := bufio.NewScanner(input)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: Expected a pattern and a name", filename, lineno)
+		}
+		re, err := regexp.Compile("^(?:" + fields[0] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: Bad pattern %s", filename, lineno, fields[0])
+		}
+		cm.rules = append(cm.rules, commandRule{pattern: re, name: fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cm, nil
+}
+
+// Return the canonical name given by the first rule that matches the command, or the command itself
+// if no rule matches.  A nil map has no rules.
+
+func (cm *CommandMap) Normalize(cmd string) string {
+	if cm == nil {
+		return cmd
+	}
+	for _, r := range cm.rules {
+		if r.pattern.MatchString(cmd) {
+			return r.name
+		}
+	}
+	return cmd
+}
+
+// Return true if the command, either as given or as normalized, is matched by one of the patterns
+// of excluded commands.  A nil map excludes nothing.
+
+func (cm *CommandMap) Excludes(cmd string) bool {
+	if cm == nil {
+		return false
+	}
+	normalized := cm.Normalize(cmd)
+	for _, p := range cm.excluded {
+		if matched, _ := path.Match(p, cmd); matched {
+			return true
+		}
+		if matched, _ := path.Match(p, normalized); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Format a command for a text report: the canonical name, followed by the raw name in parentheses if
+// the two are different.
+
+func FormatCommand(cmd, rawCmd string) string {
+	if rawCmd == "" || rawCmd == cmd {
+		return cmd
+	}
+	return fmt.Sprintf("%s (%s)", cmd, rawCmd)
+}
@@ -0,0 +1,74 @@
+package util
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCommandMap(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	filename := path.Join(td_name, "commands.txt")
+	err = os.WriteFile(filename, []byte("# Interpreters\npython.* python\n\nR|Rscript R\n"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+
+	cm, err := NewCommandMap(filename, "")
+	if err != nil {
+		t.Fatalf("NewCommandMap failed %v", err)
+	}
+	if cm.Normalize("python3.9") != "python" || cm.Normalize("python") != "python" ||
+		cm.Normalize("Rscript") != "R" || cm.Normalize("ipython") != "ipython" ||
+		cm.Normalize("Rscripts") != "Rscripts" {
+		t.Fatalf("Bad normalization")
+	}
+
+	var none *CommandMap
+	if none.Normalize("python3.9") != "python3.9" {
+		t.Fatalf("Bad normalization by nil map")
+	}
+
+	err = os.WriteFile(filename, []byte("python(.* python\n"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	_, err = NewCommandMap(filename, "")
+	if err == nil {
+		t.Fatalf("Bad pattern accepted")
+	}
+}
+
+func TestCommandMapExcludes(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	filename := path.Join(td_name, "commands.txt")
+	err = os.WriteFile(filename, []byte("slurm.* scheduler\n"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+
+	cm, err := NewCommandMap(filename, "srun, ssh*,scheduler")
+	if err != nil {
+		t.Fatalf("NewCommandMap failed %v", err)
+	}
+	if !cm.Excludes("srun") || !cm.Excludes("sshd") || !cm.Excludes("slurmstepd") ||
+		cm.Excludes("srunner") || cm.Excludes("python") {
+		t.Fatalf("Bad exclusion")
+	}
+
+	var none *CommandMap
+	if none.Excludes("srun") {
+		t.Fatalf("Bad exclusion by nil map")
+	}
+
+	_, err = NewCommandMap("", "ssh[")
+	if err == nil {
+		t.Fatalf("Bad command pattern accepted")
+	}
+}
@@ -0,0 +1,23 @@
+// A stable identifier for the events of the analyses, so that a consumer of the output can
+// deduplicate the events of runs whose time windows overlap, or that report a job again.
+
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// The identifier is the first 16 hex digits of the SHA-256 hash of the host, the job#, and the time
+// of the first violation (in UTC, to the second), so it depends only on these and not on the run,
+// the time format of the report, or the Go version.  host is the host of the job's state key, which
+// is empty for a job that is keyed cross-host, so that the identifier does not change when the job
+// is seen on more hosts.
+
+func EventId(host string, id uint32, firstViolation time.Time) string {
+	key := fmt.Sprintf("%s\x00%d\x00%s", host, id, firstViolation.UTC().Format(time.RFC3339))
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:8])
+}
@@ -0,0 +1,28 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventId(t *testing.T) {
+	t0 := time.Date(2023, 8, 20, 8, 0, 0, 0, time.UTC)
+
+	// The values are fixed, as consumers may have stored them
+	if EventId("ml7", 2200100, t0) != "bfd5005a69e0ae0f" || EventId("", 2200100, t0) != "8d1e98c571507ec6" {
+		t.Fatalf("Bad EventId %s %s", EventId("ml7", 2200100, t0), EventId("", 2200100, t0))
+	}
+
+	// Fractional seconds and the time zone do not matter
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	if err != nil {
+		t.Fatalf("LoadLocation failed %v", err)
+	}
+	if EventId("ml7", 2200100, t0.Add(500*time.Millisecond).In(oslo)) != "bfd5005a69e0ae0f" {
+		t.Fatalf("EventId depends on the representation of the time")
+	}
+	if EventId("ml7", 2200101, t0) == "bfd5005a69e0ae0f" || EventId("ml7", 2200100, t0.Add(time.Second)) ==
+		"bfd5005a69e0ae0f" {
+		t.Fatalf("EventId does not depend on the job")
+	}
+}
@@ -0,0 +1,76 @@
+// The exit codes of the program.  Cron jobs and monitoring can tell a failed run from a successful
+// one, and with --exit-events a successful run of an analysis that found new violations from one
+// that found none.  With --max-data-age a run that failed because the log data are stale has an
+// exit code of its own, so that a broken log pipeline is not mistaken for another failure.
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// Success, and no new violations if --exit-events was given
+	ExitOk = 0
+
+	// The run failed
+	ExitError = 1
+
+	// The command line could not be parsed (the flag package also exits with 2)
+	ExitUsage = 2
+
+	// Success, with new violations, if --exit-events was given
+	ExitEvents = 3
+
+	// The newest log data are older than --max-data-age
+	ExitStaleData = 4
+)
+
+// Returned by the verbs of the analyses when they have succeeded and found new violations, if
+// --exit-events was given.  It is not a failure; the program exits with ExitEvents.
+
+var ErrEventsFound = errors.New("New violations were found")
+
+// The result of a successful run of an analysis verb that found `events` new violations.
+
+func (opts *AnalysisOptions) EventsResult(events int) error {
+	if opts.ExitEvents && events > 0 {
+		return ErrEventsFound
+	}
+	return nil
+}
+
+// Wrapped by the error returned by the analyses when the log data are older than --max-data-age.
+// The program exits with ExitStaleData.
+
+var ErrStaleData = errors.New("The log data are stale")
+
+// Check that the log data are no older than --max-data-age, if it was given.  newestFileDate returns
+// the date of the newest log file in the time window, or zero if there are none; the data of a day
+// are current until the end of the day, so the age of the data is the time since the end of that day.
+
+func (opts *AnalysisOptions) CheckDataAge(
+	progOpts *StandardOptions,
+	newestFileDate func() (time.Time, error),
+) error {
+	if opts.MaxDataAge <= 0 {
+		return nil
+	}
+	if progOpts.FromStdin() {
+		return errors.New("The age of the data can't be checked when reading from stdin, --max-data-age is not supported")
+	}
+	newest, err := newestFileDate()
+	if err != nil {
+		return err
+	}
+	if newest.IsZero() {
+		return fmt.Errorf("%w: there are no log files in the time window", ErrStaleData)
+	}
+	if age := progOpts.Clock.Now().Sub(newest.AddDate(0, 0, 1)); age > opts.MaxDataAge {
+		return fmt.Errorf("%w: the newest log file is for %s, which ended more than %v ago (--max-data-age)",
+			ErrStaleData, newest.Format("2006-01-02"), opts.MaxDataAge)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package util
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEventsResult(t *testing.T) {
+	opts := &AnalysisOptions{}
+	if opts.EventsResult(0) != nil || opts.EventsResult(5) != nil {
+		t.Fatalf("Events without --exit-events")
+	}
+	opts.ExitEvents = true
+	if opts.EventsResult(0) != nil || opts.EventsResult(5) != ErrEventsFound {
+		t.Fatalf("Bad events result")
+	}
+}
+
+func TestCheckDataAge(t *testing.T) {
+	progOpts := NewStandardOptions("test")
+	progOpts.Clock = &FakeClock{T: time.Date(2023, 9, 13, 12, 0, 0, 0, time.UTC)}
+	opts := NewAnalysisOptions(progOpts)
+	err := progOpts.Parse([]string{"--data-path", "/tmp", "--max-data-age", "12h"})
+	if err != nil {
+		t.Fatalf("Parse failed %v", err)
+	}
+	newest := func(date time.Time) func() (time.Time, error) {
+		return func() (time.Time, error) {
+			return date, nil
+		}
+	}
+
+	// The data of September 12 are 12h old at noon on September 13
+	if err := opts.CheckDataAge(progOpts, newest(time.Date(2023, 9, 12, 0, 0, 0, 0, time.UTC))); err != nil {
+		t.Fatalf("Current data are stale: %v", err)
+	}
+	err = opts.CheckDataAge(progOpts, newest(time.Date(2023, 9, 11, 0, 0, 0, 0, time.UTC)))
+	if !errors.Is(err, ErrStaleData) {
+		t.Fatalf("Stale data are current: %v", err)
+	}
+	if err := opts.CheckDataAge(progOpts, newest(time.Time{})); !errors.Is(err, ErrStaleData) {
+		t.Fatalf("No data are current: %v", err)
+	}
+	if err := opts.CheckDataAge(progOpts, func() (time.Time, error) {
+		return time.Time{}, errors.New("Enumeration failed")
+	}); err == nil || errors.Is(err, ErrStaleData) {
+		t.Fatalf("Bad error from a failed enumeration: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+// Selection of the observed-data fields of the reports, see --fields.
+//
+// The observed-data fields of the events of an analysis are the fields that have a `unit` tag (see
+// ReportUnits), eg `cpu-peak` and `rcpu-avg` for cpuhog, and they are named by their JSON names.
+// With --fields only the selected fields are shown in the text reports (see the function `show` in
+// reporttemplate.go) and included in the JSON and CSV output; the other fields of the events are
+// always included.
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// The names of the observed-data fields of `data`, a pointer to an event struct, in order.
+
+func ObservedFields(data any) []string {
+	names := make([]string, 0)
+	ty := reflect.TypeOf(data).Elem()
+	for i := 0; i < ty.NumField(); i++ {
+		f := ty.Field(i)
+		if f.IsExported() && f.Tag.Get("unit") != "" {
+			names = append(names, jsonFieldName(f))
+		}
+	}
+	return names
+}
+
+// The fields selected by --fields, or nil if all fields are selected.
+
+func (opts *AnalysisOptions) SelectedFields() map[string]bool {
+	if opts.Fields == "" {
+		return nil
+	}
+	selected := make(map[string]bool)
+	for _, name := range strings.Split(opts.Fields, ",") {
+		selected[strings.TrimSpace(name)] = true
+	}
+	return selected
+}
+
+// Check that the fields selected by --fields are observed-data fields of `data`, a pointer to an
+// event struct of the analysis named by `signal`.
+
+func (opts *AnalysisOptions) CheckFields(signal string, data any) error {
+	selected := opts.SelectedFields()
+	if selected == nil {
+		return nil
+	}
+	valid := ObservedFields(data)
+	if len(valid) == 0 {
+		return fmt.Errorf("The %s reports have no observed data, --fields can't be used", signal)
+	}
+	known := make(map[string]bool)
+	for _, name := range valid {
+		known[name] = true
+	}
+	for name := range selected {
+		if !known[name] {
+			return fmt.Errorf("Unknown field %q for %s, must be one of %s", name, signal,
+				strings.Join(valid, ", "))
+		}
+	}
+	return nil
+}
+
+// Return `data`, a pointer to an event struct, if `selected` is nil, and otherwise a value that is
+// marshaled to JSON as `data` is but without the observed-data fields that are not selected.  As
+// for `data`, fields with the `omitempty` option are left out if they are empty, see isEmptyField.
+
+func SelectFields(data any, selected map[string]bool) any {
+	if data == nil || selected == nil {
+		return data
+	}
+	return selectedFields{data, selected}
+}
+
+type selectedFields struct {
+	data     any
+	selected map[string]bool
+}
+
+func (s selectedFields) MarshalJSON() ([]byte, error) {
+	var out bytes.Buffer
+	out.WriteByte('{')
+	v := reflect.ValueOf(s.data).Elem()
+	ty := v.Type()
+	first := true
+	for i := 0; i < ty.NumField(); i++ {
+		f := ty.Field(i)
+		name := jsonFieldName(f)
+		if !f.IsExported() || name == "-" || (f.Tag.Get("unit") != "" && !s.selected[name]) ||
+			isEmptyField(f, v.Field(i)) {
+			continue
+		}
+		key, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(v.Field(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		if !first {
+			out.WriteByte(',')
+		}
+		first = false
+		out.Write(key)
+		out.WriteByte(':')
+		out.Write(value)
+	}
+	out.WriteByte('}')
+	return out.Bytes(), nil
+}
+
+// True if the field `f`, whose value is `v`, has the `omitempty` option and is empty as defined by
+// encoding/json: false, 0, a nil pointer or interface, or an empty array, map, slice, or string.
+
+func isEmptyField(f reflect.StructField, v reflect.Value) bool {
+	_, options, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if !strings.Contains(options, "omitempty") {
+		return false
+	}
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
+
+// True if the field `f` of an event is to be output, given the selection.
+
+func isSelectedField(f reflect.StructField, selected map[string]bool) bool {
+	return f.IsExported() && (selected == nil || f.Tag.Get("unit") == "" || selected[jsonFieldName(f)])
+}
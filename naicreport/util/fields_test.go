@@ -0,0 +1,83 @@
+package util
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type fieldsEvent struct {
+	Host     string `json:"hostname"`
+	Id       uint32 `json:"id"`
+	CpuPeak  uint32 `json:"cpu-peak" unit:"cores"`
+	RCpuAvg  uint32 `json:"rcpu-avg" unit:"percent"`
+	RCpuPeak uint32 `json:"rcpu-peak" unit:"percent"`
+	severity float64
+}
+
+func TestCheckFields(t *testing.T) {
+	fields := ObservedFields(&fieldsEvent{})
+	if strings.Join(fields, ",") != "cpu-peak,rcpu-avg,rcpu-peak" {
+		t.Fatalf("Bad observed fields %v", fields)
+	}
+	if (&AnalysisOptions{}).CheckFields("hog", &fieldsEvent{}) != nil ||
+		(&AnalysisOptions{Fields: "cpu-peak, rcpu-peak"}).CheckFields("hog", &fieldsEvent{}) != nil {
+		t.Fatalf("Good fields rejected")
+	}
+	err := (&AnalysisOptions{Fields: "cpu-peak,hostname"}).CheckFields("hog", &fieldsEvent{})
+	if err == nil || !strings.Contains(err.Error(), "cpu-peak, rcpu-avg, rcpu-peak") {
+		t.Fatalf("Bad field accepted, or bad error %v", err)
+	}
+	if (&AnalysisOptions{Fields: "cpu-peak"}).CheckFields("hog", &struct{ Host string }{}) == nil {
+		t.Fatalf("Fields accepted without observed data")
+	}
+}
+
+func TestWriteReportsFields(t *testing.T) {
+	reports := []*JobReport{
+		&JobReport{Id: 1, Host: "ml1", Data: &fieldsEvent{"ml1", 1, 10, 20, 30, 1}},
+	}
+	write := func(opts *AnalysisOptions) string {
+		var out strings.Builder
+		err := WriteReports(&out, reports, nil, opts)
+		if err != nil {
+			t.Fatalf("WriteReports failed %v", err)
+		}
+		return out.String()
+	}
+
+	if got := write(&AnalysisOptions{Json: true}); got != `[{"hostname":"ml1","id":1,"cpu-peak":10,"rcpu-avg":20,"rcpu-peak":30}]` {
+		t.Fatalf("Bad JSON %s", got)
+	}
+	if got := write(&AnalysisOptions{Json: true, Fields: "rcpu-peak"}); got != `[{"hostname":"ml1","id":1,"rcpu-peak":30}]` {
+		t.Fatalf("Bad selected JSON %s", got)
+	}
+	if got := write(&AnalysisOptions{Json: true, JsonUnits: true, Fields: "rcpu-peak"}); got != `{"units":{"rcpu-peak":"percent"},"events":[{"hostname":"ml1","id":1,"rcpu-peak":30}]}` {
+		t.Fatalf("Bad selected JSON with units %s", got)
+	}
+	if got := write(&AnalysisOptions{Jsonl: true, Fields: "cpu-peak"}); got != "{\"hostname\":\"ml1\",\"id\":1,\"cpu-peak\":10}\n" {
+		t.Fatalf("Bad selected JSONL %s", got)
+	}
+	if got := write(&AnalysisOptions{JsonReports: true, Fields: "cpu-peak"}); !strings.Contains(got, `"data":{"hostname":"ml1","id":1,"cpu-peak":10}`) {
+		t.Fatalf("Bad selected JSON reports %s", got)
+	}
+	if got := write(&AnalysisOptions{Csv: true, Fields: "rcpu-avg,cpu-peak"}); got != "hostname,id,cpu-peak,rcpu-avg\nml1,1,10,20\n" {
+		t.Fatalf("Bad selected CSV %s", got)
+	}
+}
+
+func TestSelectFieldsOmitEmpty(t *testing.T) {
+	type event struct {
+		Id      uint32 `json:"id"`
+		CpuPeak uint32 `json:"cpu-peak" unit:"cores"`
+		Marked  bool   `json:"marked,omitempty"`
+	}
+	selected := map[string]bool{"cpu-peak": true}
+	for _, e := range []*event{&event{1, 10, false}, &event{1, 10, true}} {
+		expect, _ := json.Marshal(e)
+		got, err := json.Marshal(SelectFields(e, selected))
+		if err != nil || string(got) != string(expect) {
+			t.Fatalf("Bad selected JSON %s %v", got, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Filters that restrict the analyses to a subset of the hosts, eg when debugging a single node, and
+// normalize the host names.
+
+package util
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+type HostFilter struct {
+	patterns []string
+	domains  []string
+}
+
+// Create a host filter from a comma-separated list of host names, each of which can be a glob
+// pattern (eg `ml[6-8]*`).  If the list is empty then the filter matches all hosts.
+
+func NewHostFilter(hosts string) (*HostFilter, error) {
+	hf := &HostFilter{patterns: make([]string, 0)}
+	for _, h := range strings.Split(hosts, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if _, err := path.Match(h, ""); err != nil {
+			return nil, fmt.Errorf("Bad host pattern %s", h)
+		}
+		hf.patterns = append(hf.patterns, h)
+	}
+	return hf, nil
+}
+
+// Make the filter strip the domains, a comma-separated list of domain names such as `hpc.uio.no`,
+// from the host names, see Normalize.
+
+func (hf *HostFilter) StripDomains(domains string) {
+	for _, d := range strings.Split(domains, ",") {
+		d = strings.Trim(strings.TrimSpace(d), ".")
+		if d != "" {
+			hf.domains = append(hf.domains, "."+d)
+		}
+	}
+}
+
+// Return the normalized name of the host: if the name ends with one of the domains to strip then
+// the domain is removed, so that `ml6.hpc.uio.no` and `ml6` are the same host.  The comparison is
+// case-insensitive, as for DNS names.  A nil filter returns the name unchanged.
+
+func (hf *HostFilter) Normalize(host string) string {
+	if hf == nil {
+		return host
+	}
+	for _, d := range hf.domains {
+		if len(host) > len(d) && strings.EqualFold(host[len(host)-len(d):], d) {
+			return host[:len(host)-len(d)]
+		}
+	}
+	return host
+}
+
+// Return true if the host is matched by the filter.  The host can be a comma-separated list of
+// hosts, as for a cross-host job, and is matched if any of them is.  A nil filter matches all hosts.
+
+func (hf *HostFilter) Matches(host string) bool {
+	if hf == nil || len(hf.patterns) == 0 {
+		return true
+	}
+	for _, h := range strings.Split(host, ",") {
+		for _, p := range hf.patterns {
+			if matched, _ := path.Match(p, h); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
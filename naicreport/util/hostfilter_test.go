@@ -0,0 +1,44 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestHostFilter(t *testing.T) {
+	hf, err := NewHostFilter("ml[6-8]*, ml1")
+	if err != nil {
+		t.Fatalf("NewHostFilter failed %v", err)
+	}
+	if !hf.Matches("ml6") || !hf.Matches("ml8.hpc.uio.no") || !hf.Matches("ml1") ||
+		hf.Matches("ml3") || hf.Matches("ml10") || !hf.Matches("ml3,ml7") {
+		t.Fatalf("Bad host matching")
+	}
+
+	hf, err = NewHostFilter("")
+	if err != nil || !hf.Matches("ml3") {
+		t.Fatalf("Bad empty filter")
+	}
+
+	_, err = NewHostFilter("ml[6")
+	if err == nil {
+		t.Fatalf("Bad pattern accepted")
+	}
+}
+
+func TestHostFilterNormalize(t *testing.T) {
+	var nilFilter *HostFilter
+	hf, err := NewHostFilter("")
+	if err != nil {
+		t.Fatalf("NewHostFilter failed %v", err)
+	}
+	if nilFilter.Normalize("ml6.hpc.uio.no") != "ml6.hpc.uio.no" || hf.Normalize("ml6.hpc.uio.no") != "ml6.hpc.uio.no" {
+		t.Fatalf("Names normalized by default")
+	}
+	hf.StripDomains(" hpc.uio.no, .uio.no")
+	if hf.Normalize("ml6.hpc.uio.no") != "ml6" || hf.Normalize("ML6.HPC.UIO.NO") != "ML6" ||
+		hf.Normalize("login.uio.no") != "login" || hf.Normalize("ml6") != "ml6" ||
+		hf.Normalize("hpc.uio.no") != "hpc" || hf.Normalize(".uio.no") != ".uio.no" ||
+		hf.Normalize("ml6.hpc.uio.no.example") != "ml6.hpc.uio.no.example" {
+		t.Fatalf("Bad normalization")
+	}
+}
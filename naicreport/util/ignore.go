@@ -0,0 +1,97 @@
+// Lists of users and jobs that are to be ignored by the analyses, eg service accounts that
+// legitimately run workloads that would otherwise be flagged.
+
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type ignoredJob struct {
+	hostPattern string
+	id          uint32
+}
+
+type IgnoreList struct {
+	users map[string]bool
+	jobs  []ignoredJob
+}
+
+// Create an ignore list from a comma-separated list of user names and the contents of a file, both
+// of which may be empty.
+//
+// The file has one entry per line.  An entry is either a user name or a `host:job#` pair, where the
+// host can be a glob pattern (eg `ml*:1234`).  Blank lines and lines starting with `#` are ignored.
+
+func NewIgnoreList(users string, filename string) (*IgnoreList, error) {
+	il := &IgnoreList{
+		users: make(map[string]bool),
+		jobs:  make([]ignoredJob, 0),
+	}
+	for _, u := range strings.Split(users, ",") {
+		u = strings.TrimSpace(u)
+		if u != "" {
+			il.users[u] = true
+		}
+	}
+	if filename == "" {
+		return il, nil
+	}
+
+	input, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	scanner := bufio.NewScanner(input)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		host, job, isJob := strings.Cut(line, ":")
+		if !isJob {
+			il.users[line] = true
+			continue
+		}
+		id, err := strconv.ParseUint(job, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: Bad job number %s", filename, lineno, job)
+		}
+		if _, err := path.Match(host, ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: Bad host pattern %s", filename, lineno, host)
+		}
+		il.jobs = append(il.jobs, ignoredJob{hostPattern: host, id: uint32(id)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return il, nil
+}
+
+// Return true if the job should be ignored, either because the user is ignored or because the
+// (host, job#) pair is.  The host can be a comma-separated list of hosts, as for a cross-host job,
+// and the job is ignored if the pair is ignored for any of them.
+
+func (il *IgnoreList) Ignores(user, host string, id uint32) bool {
+	if il.users[user] {
+		return true
+	}
+	for _, j := range il.jobs {
+		if j.id == id {
+			for _, h := range strings.Split(host, ",") {
+				if matched, _ := path.Match(j.hostPattern, h); matched {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
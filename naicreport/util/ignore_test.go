@@ -0,0 +1,42 @@
+package util
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestIgnoreList(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	filename := path.Join(td_name, "ignore.txt")
+	err = os.WriteFile(filename, []byte("# Service accounts\nsvc1\n\nml[12]:1234\n"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+
+	il, err := NewIgnoreList("svc2, svc3", filename)
+	if err != nil {
+		t.Fatalf("NewIgnoreList failed %v", err)
+	}
+	if !il.Ignores("svc1", "ml3", 1) || !il.Ignores("svc3", "ml3", 1) || il.Ignores("svc", "ml3", 1) {
+		t.Fatalf("Bad user matching")
+	}
+	if !il.Ignores("x", "ml2", 1234) || il.Ignores("x", "ml3", 1234) || il.Ignores("x", "ml1", 1235) {
+		t.Fatalf("Bad job matching")
+	}
+	if !il.Ignores("x", "ml3,ml2", 1234) || il.Ignores("x", "ml3,ml4", 1234) {
+		t.Fatalf("Bad job matching for host lists")
+	}
+
+	err = os.WriteFile(filename, []byte("ml1:x\n"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	_, err = NewIgnoreList("", filename)
+	if err == nil {
+		t.Fatalf("Bad job number accepted")
+	}
+}
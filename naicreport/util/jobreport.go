@@ -3,13 +3,28 @@
 package util
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
 	"sort"
+	"strings"
 )
 
+// A report on a single job.  Report is the formatted text for the job.  Data, if not nil, is the
+// structured data from which the report was formatted, it is used only for JSON output.  Severity
+// is an analysis-specific measure of how bad the violation is, higher being worse, it is used for
+// selecting the most severe reports and for sorting the reports by severity.
+
 type JobReport struct {
-	Id uint32
-	Host string
-	Report string
+	Id uint32        `json:"id"`
+	Host string      `json:"host"`
+	User string      `json:"user"`
+	Report string    `json:"report"`
+	Data any         `json:"data,omitempty"`
+	Severity float64 `json:"-"`
 }
 
 type byJobKey []*JobReport
@@ -34,3 +49,258 @@ func (a byJobKey) Less(i, j int) bool {
 func SortReports(reports []*JobReport) {
 	sort.Sort(byJobKey(reports))
 }
+
+type byUserKey []*JobReport
+
+func (a byUserKey) Len() int {
+	return len(a)
+}
+
+func (a byUserKey) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a byUserKey) Less(i, j int) bool {
+	if a[i].User != a[j].User {
+		return a[i].User < a[j].User
+	}
+	return byJobKey(a).Less(i, j)
+}
+
+// Sort reports by ascending user name first, then by host name and job ID as for SortReports.  This
+// groups all the reports for a user together.
+
+func SortReportsByUser(reports []*JobReport) {
+	sort.Sort(byUserKey(reports))
+}
+
+// Sort reports by descending severity, and reports with the same severity as for SortReports.  This
+// puts the worst offenders first.
+
+func SortReportsBySeverity(reports []*JobReport) {
+	SortReports(reports)
+	sort.SliceStable(reports, func(i, j int) bool {
+		return reports[i].Severity > reports[j].Severity
+	})
+}
+
+// Sort reports in the order selected by opts.Sort ("host", "user", or "severity"; "" is "host"),
+// see SortReports, SortReportsByUser, and SortReportsBySeverity.  opts.SortByUser is the same as
+// opts.Sort == "user".
+
+func SortReportsByOptions(reports []*JobReport, opts *AnalysisOptions) error {
+	order := opts.Sort
+	if opts.SortByUser {
+		if order != "" && order != "host" && order != "user" {
+			return errors.New("--sort-by-user can't be combined with --sort " + order)
+		}
+		order = "user"
+	}
+	switch order {
+	case "", "host":
+		SortReports(reports)
+	case "user":
+		SortReportsByUser(reports)
+	case "severity":
+		SortReportsBySeverity(reports)
+	default:
+		return fmt.Errorf("Bad --sort value %s, must be host, user, or severity", order)
+	}
+	return nil
+}
+
+// Return the n reports with the highest severity, or all the reports if n is zero or there are no
+// more than n reports.  Among reports with the same severity, those that come first by SortReports
+// are preferred.  The order of the result is unspecified.
+
+func TopReports(reports []*JobReport, n int) []*JobReport {
+	if n <= 0 || len(reports) <= n {
+		return reports
+	}
+	top := make([]*JobReport, len(reports))
+	copy(top, reports)
+	SortReportsBySeverity(top)
+	return top[:n]
+}
+
+// Select the opts.TopN most severe reports (all if opts.TopN is zero), sort them as selected by the
+// options (see SortReportsByOptions), and write them to out in the format selected by the options:
+// with opts.Csv, CSV with a header row (see WriteReportsCsv), which is written even if there are no
+// reports if `event`, a pointer to an event struct of the analysis, is not nil, preceded by a UTF-8
+// byte order mark with opts.Bom; with opts.Json, a JSON array of the Data fields of the reports, ie, the
+// analysis-specific events, or with opts.JsonUnits an object whose `units` field is ReportUnits of
+// the reports and whose `events` field is that array; with opts.Jsonl, the same objects one per
+// line (JSON Lines); with opts.JsonReports, a JSON array of the JobReport objects, which gives a
+// uniform format across all the analyses; and otherwise the text of the reports.  In every format
+// the observed-data fields that are not selected by opts.Fields are left out, see SelectFields.
+
+func WriteReports(out io.Writer, reports []*JobReport, event any, opts *AnalysisOptions) error {
+	if opts.Csv && (opts.Json || opts.Jsonl || opts.JsonReports) {
+		return errors.New("--csv can't be combined with the JSON output options")
+	}
+	if opts.Json && opts.Jsonl {
+		return errors.New("--json can't be combined with --jsonl")
+	}
+	if opts.JsonUnits && !opts.Json {
+		return errors.New("--json-units requires --json")
+	}
+	if opts.Bom && !opts.Csv {
+		return errors.New("--bom requires --csv")
+	}
+	reports = TopReports(reports, opts.TopN)
+	err := SortReportsByOptions(reports, opts)
+	if err != nil {
+		return err
+	}
+	selected := opts.SelectedFields()
+	if opts.Csv {
+		return writeReportsCsv(out, reports, event, selected, opts.Bom)
+	}
+	if opts.Json {
+		data := make([]any, 0)
+		for _, r := range reports {
+			data = append(data, SelectFields(r.Data, selected))
+		}
+		var bytes []byte
+		var err error
+		if opts.JsonUnits {
+			bytes, err = json.Marshal(struct {
+				Units  map[string]string `json:"units"`
+				Events []any             `json:"events"`
+			}{reportUnits(reports, selected), data})
+		} else {
+			bytes, err = json.Marshal(data)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(bytes)
+		return err
+	}
+	if opts.Jsonl {
+		for _, r := range reports {
+			bytes, err := json.Marshal(SelectFields(r.Data, selected))
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(out, "%s\n", bytes)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if opts.JsonReports {
+		if selected != nil {
+			selectedReports := make([]*JobReport, 0, len(reports))
+			for _, r := range reports {
+				s := *r
+				s.Data = SelectFields(r.Data, selected)
+				selectedReports = append(selectedReports, &s)
+			}
+			reports = selectedReports
+		}
+		bytes, err := MarshalReports(reports)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(bytes)
+		return err
+	}
+	for _, r := range reports {
+		_, err := fmt.Fprint(out, r.Report)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the Data fields of the reports, which must be pointers to structs of the same type, as
+// standard CSV (not free CSV) in the order given.  There is a column for each exported field of the
+// struct, in the order of the fields, and the header row has the fields' JSON names.  If there are
+// no reports then nothing is written.
+
+func WriteReportsCsv(out io.Writer, reports []*JobReport) error {
+	return writeReportsCsv(out, reports, nil, nil, false)
+}
+
+// The columns are the fields of `event`, a pointer to a struct of the type of the Data fields, if it
+// is not nil, so that the header row is written even if there are no reports.  If bom is true then
+// the output starts with a UTF-8 byte order mark, see Utf8BOM.
+
+func writeReportsCsv(out io.Writer, reports []*JobReport, event any, selected map[string]bool, bom bool) error {
+	if event == nil {
+		if len(reports) == 0 {
+			return nil
+		}
+		event = reports[0].Data
+	}
+	if bom {
+		_, err := io.WriteString(out, Utf8BOM)
+		if err != nil {
+			return err
+		}
+	}
+	w := csv.NewWriter(out)
+	ty := reflect.TypeOf(event).Elem()
+	header := make([]string, 0)
+	columns := make([]int, 0)
+	for i := 0; i < ty.NumField(); i++ {
+		f := ty.Field(i)
+		if !isSelectedField(f, selected) {
+			continue
+		}
+		header = append(header, jsonFieldName(f))
+		columns = append(columns, i)
+	}
+	w.Write(header)
+	for _, r := range reports {
+		v := reflect.ValueOf(r.Data).Elem()
+		row := make([]string, 0, len(columns))
+		for _, i := range columns {
+			row = append(row, fmt.Sprint(v.Field(i).Interface()))
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// Return the units of the fields of the Data fields of the reports, which must be pointers to structs
+// of the same type, keyed by the fields' JSON names.  The unit of a field is given by its `unit`
+// tag, eg `unit:"percent"`; fields without the tag are omitted.  If there are no reports then the
+// map is empty.
+
+func ReportUnits(reports []*JobReport) map[string]string {
+	return reportUnits(reports, nil)
+}
+
+func reportUnits(reports []*JobReport, selected map[string]bool) map[string]string {
+	units := make(map[string]string)
+	if len(reports) == 0 {
+		return units
+	}
+	ty := reflect.TypeOf(reports[0].Data).Elem()
+	for i := 0; i < ty.NumField(); i++ {
+		f := ty.Field(i)
+		if unit := f.Tag.Get("unit"); isSelectedField(f, selected) && unit != "" {
+			units[jsonFieldName(f)] = unit
+		}
+	}
+	return units
+}
+
+func jsonFieldName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" {
+		name = f.Name
+	}
+	return name
+}
+
+// Marshal the reports as a JSON array, in the order given.
+
+func MarshalReports(reports []*JobReport) ([]byte, error) {
+	return json.Marshal(reports)
+}
@@ -0,0 +1,195 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSortReports(t *testing.T) {
+	reports := []*JobReport{
+		&JobReport{Id: 3, Host: "ml2", User: "a"},
+		&JobReport{Id: 2, Host: "ml1", User: "b"},
+		&JobReport{Id: 1, Host: "ml2", User: "a"},
+		&JobReport{Id: 5, Host: "ml1", User: "a"},
+	}
+
+	SortReports(reports)
+	if reports[0].Id != 2 || reports[1].Id != 5 || reports[2].Id != 1 || reports[3].Id != 3 {
+		t.Fatalf("Bad host/id order")
+	}
+
+	SortReportsByUser(reports)
+	if reports[0].Id != 5 || reports[1].Id != 1 || reports[2].Id != 3 || reports[3].Id != 2 {
+		t.Fatalf("Bad user/host/id order")
+	}
+}
+
+func TestSortReportsByOptions(t *testing.T) {
+	reports := []*JobReport{
+		&JobReport{Id: 3, Host: "ml2", User: "a", Severity: 5},
+		&JobReport{Id: 2, Host: "ml1", User: "b", Severity: 1},
+		&JobReport{Id: 1, Host: "ml2", User: "a", Severity: 10},
+		&JobReport{Id: 5, Host: "ml1", User: "a", Severity: 5},
+	}
+
+	err := SortReportsByOptions(reports, &AnalysisOptions{Sort: "severity"})
+	if err != nil || reports[0].Id != 1 || reports[1].Id != 5 || reports[2].Id != 3 || reports[3].Id != 2 {
+		t.Fatalf("Bad severity order %v", err)
+	}
+
+	err = SortReportsByOptions(reports, &AnalysisOptions{})
+	if err != nil || reports[0].Id != 2 || reports[1].Id != 5 || reports[2].Id != 1 || reports[3].Id != 3 {
+		t.Fatalf("Bad default order %v", err)
+	}
+
+	err = SortReportsByOptions(reports, &AnalysisOptions{Sort: "user"})
+	if err != nil || reports[0].Id != 5 || reports[3].Id != 2 {
+		t.Fatalf("Bad user order %v", err)
+	}
+
+	if SortReportsByOptions(reports, &AnalysisOptions{Sort: "size"}) == nil {
+		t.Fatalf("Bad sort order accepted")
+	}
+	if SortReportsByOptions(reports, &AnalysisOptions{Sort: "severity", SortByUser: true}) == nil {
+		t.Fatalf("Conflicting sort orders accepted")
+	}
+}
+
+func TestMarshalReports(t *testing.T) {
+	reports := []*JobReport{
+		&JobReport{Id: 3, Host: "ml2", User: "a", Report: "hi\n"},
+		&JobReport{Id: 2, Host: "ml1", User: "b", Report: "ho\n", Data: map[string]int{"x": 1}},
+	}
+	bytes, err := MarshalReports(reports)
+	if err != nil {
+		t.Fatalf("MarshalReports failed %v", err)
+	}
+	expect := `[{"id":3,"host":"ml2","user":"a","report":"hi\n"},{"id":2,"host":"ml1","user":"b","report":"ho\n","data":{"x":1}}]`
+	if string(bytes) != expect {
+		t.Fatalf("Bad JSON %s", bytes)
+	}
+}
+
+func TestWriteReportsJsonl(t *testing.T) {
+	reports := []*JobReport{
+		&JobReport{Id: 3, Host: "ml2", User: "a", Report: "hi\n", Data: map[string]int{"x": 3}},
+		&JobReport{Id: 2, Host: "ml1", User: "b", Report: "ho\n", Data: map[string]int{"x": 2}},
+	}
+	var out strings.Builder
+	err := WriteReports(&out, reports, nil, &AnalysisOptions{Jsonl: true})
+	if err != nil {
+		t.Fatalf("WriteReports failed %v", err)
+	}
+	if out.String() != "{\"x\":2}\n{\"x\":3}\n" {
+		t.Fatalf("Bad JSON Lines %q", out.String())
+	}
+	// The JSON output would win
+	if WriteReports(&strings.Builder{}, reports, nil, &AnalysisOptions{Json: true, Jsonl: true}) == nil {
+		t.Fatalf("JSON and JSON Lines accepted together")
+	}
+}
+
+func TestTopReports(t *testing.T) {
+	reports := []*JobReport{
+		&JobReport{Id: 3, Host: "ml2", Severity: 5},
+		&JobReport{Id: 2, Host: "ml1", Severity: 1},
+		&JobReport{Id: 1, Host: "ml2", Severity: 10},
+		&JobReport{Id: 5, Host: "ml1", Severity: 5},
+	}
+	if len(TopReports(reports, 0)) != 4 || len(TopReports(reports, 4)) != 4 {
+		t.Fatalf("Bad unlimited selection")
+	}
+	top := TopReports(reports, 2)
+	SortReports(top)
+	if len(top) != 2 || top[0].Id != 5 || top[1].Id != 1 {
+		t.Fatalf("Bad top reports")
+	}
+	if reports[0].Id != 3 {
+		t.Fatalf("Input was reordered")
+	}
+
+	var out strings.Builder
+	reports[2].Report = "worst\n"
+	err := WriteReports(&out, reports, nil, &AnalysisOptions{TopN: 1})
+	if err != nil || out.String() != "worst\n" {
+		t.Fatalf("Bad output %q %v", out.String(), err)
+	}
+}
+
+func TestWriteReportsCsv(t *testing.T) {
+	type event struct {
+		Host    string `json:"hostname"`
+		Id      uint32 `json:"id"`
+		Cmd     string `json:"cmd,omitempty"`
+		private int
+	}
+	reports := []*JobReport{
+		&JobReport{Id: 3, Host: "ml2", Data: &event{"ml2", 3, "python", 1}},
+		&JobReport{Id: 2, Host: "ml1", Data: &event{"ml1", 2, "a, b", 2}},
+	}
+	var out strings.Builder
+	err := WriteReports(&out, reports, nil, &AnalysisOptions{Csv: true})
+	if err != nil {
+		t.Fatalf("WriteReports failed %v", err)
+	}
+	if out.String() != "hostname,id,cmd\nml1,2,\"a, b\"\nml2,3,python\n" {
+		t.Fatalf("Bad CSV %q", out.String())
+	}
+
+	err = WriteReports(&out, reports, nil, &AnalysisOptions{Csv: true, Json: true})
+	if err == nil {
+		t.Fatalf("CSV and JSON accepted together")
+	}
+
+	out.Reset()
+	err = WriteReports(&out, reports, nil, &AnalysisOptions{Csv: true, Bom: true})
+	if err != nil || out.String() != "\xef\xbb\xbfhostname,id,cmd\nml1,2,\"a, b\"\nml2,3,python\n" {
+		t.Fatalf("Bad CSV with BOM %q %v", out.String(), err)
+	}
+	err = WriteReports(&out, reports, nil, &AnalysisOptions{Json: true, Bom: true})
+	if err == nil {
+		t.Fatalf("BOM accepted without CSV")
+	}
+
+	// The header row is written even if there are no reports, if the event is known
+	type observed struct {
+		Host string `json:"hostname"`
+		Peak int    `json:"peak" unit:"percent"`
+		Avg  int    `json:"avg" unit:"percent"`
+	}
+	out.Reset()
+	err = WriteReports(&out, []*JobReport{}, &observed{}, &AnalysisOptions{Csv: true, Fields: "avg"})
+	if err != nil || out.String() != "hostname,avg\n" {
+		t.Fatalf("Bad CSV without reports %q %v", out.String(), err)
+	}
+}
+
+func TestWriteReportsJsonUnits(t *testing.T) {
+	type event struct {
+		Host    string `json:"hostname"`
+		CpuPeak uint32 `json:"cpu-peak" unit:"cores"`
+		RCpuAvg uint32 `json:"rcpu-avg" unit:"percent"`
+	}
+	reports := []*JobReport{&JobReport{Id: 1, Host: "ml1", Data: &event{"ml1", 12, 50}}}
+	var out strings.Builder
+	err := WriteReports(&out, reports, nil, &AnalysisOptions{Json: true, JsonUnits: true})
+	if err != nil {
+		t.Fatalf("WriteReports failed %v", err)
+	}
+	expect := `{"units":{"cpu-peak":"cores","rcpu-avg":"percent"},` +
+		`"events":[{"hostname":"ml1","cpu-peak":12,"rcpu-avg":50}]}`
+	if out.String() != expect {
+		t.Fatalf("Bad JSON %s", out.String())
+	}
+
+	out.Reset()
+	err = WriteReports(&out, []*JobReport{}, nil, &AnalysisOptions{Json: true, JsonUnits: true})
+	if err != nil || out.String() != `{"units":{},"events":[]}` {
+		t.Fatalf("Bad empty JSON %s %v", out.String(), err)
+	}
+
+	err = WriteReports(&out, reports, nil, &AnalysisOptions{JsonUnits: true})
+	if err == nil {
+		t.Fatalf("--json-units accepted without --json")
+	}
+}
@@ -0,0 +1,56 @@
+// Support for --since-last-run: the end of the time window of a successful run is recorded in a
+// sidecar file in the data directory, named by the verb, and the next run can start its time window
+// there.
+//
+// The logs are organized by day, so the start of the window is rounded down to the start of the
+// day of the last run.  The first day of the window may thus overlap the last day of the previous
+// window, but the analyses' state prevents the overlap from causing redundant reports, and there
+// will never be a gap.
+
+package util
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+func lastRunFilename(dataPath, verb string) string {
+	return path.Join(dataPath, verb+"-last-run.txt")
+}
+
+// If there is a record of a previous run of the verb then set the From time of progOpts to the
+// start of the day of the end of that run's window.  Otherwise leave progOpts alone.
+
+func ApplySinceLastRun(progOpts *StandardOptions, verb string) error {
+	if progOpts.FromStdin() {
+		return errors.New("--since-last-run can't be used when reading from stdin")
+	}
+	bytes, err := os.ReadFile(lastRunFilename(progOpts.DataPath, verb))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(bytes)))
+	if err != nil {
+		return err
+	}
+	t = t.UTC()
+	progOpts.HaveFrom = true
+	progOpts.From = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	progOpts.FromStr = progOpts.From.Format("2006-01-02")
+	return nil
+}
+
+// Record the end of the time window of progOpts (but no later than now) as the end of the last run
+// of the verb.
+
+func RecordLastRun(progOpts *StandardOptions, verb string, now time.Time) error {
+	highWater := MinTime(progOpts.To, now).UTC()
+	return WriteOutput(lastRunFilename(progOpts.DataPath, verb), highWater.Format(time.RFC3339)+"\n")
+}
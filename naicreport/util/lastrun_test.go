@@ -0,0 +1,52 @@
+package util
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLastRun(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+
+	// No sidecar: From is unchanged
+	opt := NewStandardOptions("hi")
+	err = opt.Parse([]string{"--data-path", td_name, "--from", "2023-09-01", "--to", "2023-09-03"})
+	if err != nil {
+		t.Fatalf("Parse failed %v", err)
+	}
+	err = ApplySinceLastRun(opt, "verb")
+	if err != nil || opt.From != time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC) {
+		t.Fatalf("Failed last run #1")
+	}
+
+	// The window ends at the start of 2023-09-04, which is before now
+	err = RecordLastRun(opt, "verb", time.Now())
+	if err != nil {
+		t.Fatalf("RecordLastRun failed %v", err)
+	}
+	opt = NewStandardOptions("hi")
+	err = opt.Parse([]string{"--data-path", td_name, "--from", "2023-09-01"})
+	if err != nil {
+		t.Fatalf("Parse failed %v", err)
+	}
+	err = ApplySinceLastRun(opt, "verb")
+	if err != nil || opt.From != time.Date(2023, 9, 4, 0, 0, 0, 0, time.UTC) || opt.FromStr != "2023-09-04" {
+		t.Fatalf("Failed last run #2: %v %v", opt.From, err)
+	}
+
+	// The window ends after now, so now is recorded
+	now := time.Date(2023, 9, 5, 13, 10, 0, 0, time.UTC)
+	opt.To = time.Date(2023, 9, 6, 0, 0, 0, 0, time.UTC)
+	err = RecordLastRun(opt, "verb", now)
+	if err != nil {
+		t.Fatalf("RecordLastRun failed %v", err)
+	}
+	err = ApplySinceLastRun(opt, "verb")
+	if err != nil || opt.From != time.Date(2023, 9, 5, 0, 0, 0, 0, time.UTC) {
+		t.Fatalf("Failed last run #3: %v %v", opt.From, err)
+	}
+}
@@ -0,0 +1,79 @@
+// A small leveled logger for diagnostic output, which goes to stderr.  The level is set by the
+// --log-level option (error, warn, info, or debug), or by -v, which is the same as debug.  The
+// default level is warn.  A logger can be used by several goroutines.
+
+package util
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+type LogLevel int
+
+const (
+	LogError LogLevel = iota
+	LogWarn
+	LogInfo
+	LogDebug
+)
+
+var logLevelNames = []string{"error", "warn", "info", "debug"}
+
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return LogError, fmt.Errorf("Bad log level %s", s)
+}
+
+func (l LogLevel) String() string {
+	if l < LogError || l > LogDebug {
+		return fmt.Sprintf("level%d", int(l))
+	}
+	return logLevelNames[l]
+}
+
+type Logger struct {
+	sync.Mutex
+	level LogLevel
+	out   io.Writer
+}
+
+// Create a logger that writes the messages at the level or more severe levels to `out`.
+
+func NewLogger(level LogLevel, out io.Writer) *Logger {
+	return &Logger{level: level, out: out}
+}
+
+// Write the message if the logger's level admits it.  The message is prefixed by the level, and a
+// newline is added.  A nil logger discards all messages.
+
+func (l *Logger) Logf(level LogLevel, format string, args ...any) {
+	if l == nil || level > l.level {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	fmt.Fprintf(l.out, "%s: %s\n", strings.ToUpper(level.String()), fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Errorf(format string, args ...any) {
+	l.Logf(LogError, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...any) {
+	l.Logf(LogWarn, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...any) {
+	l.Logf(LogInfo, format, args...)
+}
+
+func (l *Logger) Debugf(format string, args ...any) {
+	l.Logf(LogDebug, format, args...)
+}
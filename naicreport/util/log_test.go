@@ -0,0 +1,46 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var out strings.Builder
+	log := NewLogger(LogInfo, &out)
+	log.Errorf("e%d", 1)
+	log.Warnf("w%d", 2)
+	log.Infof("i%d", 3)
+	log.Debugf("d%d", 4)
+	if out.String() != "ERROR: e1\nWARN: w2\nINFO: i3\n" {
+		t.Fatalf("Bad output %q", out.String())
+	}
+
+	var none *Logger
+	none.Errorf("nothing")
+
+	level, err := ParseLogLevel("Debug")
+	if err != nil || level != LogDebug {
+		t.Fatalf("Bad level %v %v", level, err)
+	}
+	_, err = ParseLogLevel("verbose")
+	if err == nil {
+		t.Fatalf("Bad level accepted")
+	}
+}
+
+func TestLogLevelOption(t *testing.T) {
+	opts := NewStandardOptions("test")
+	err := opts.Parse([]string{"--data-path", "/tmp", "-v", "--log-level", "error"})
+	if err != nil {
+		t.Fatalf("Parse failed %v", err)
+	}
+	if opts.Log == nil || opts.Log.level != LogError {
+		t.Fatalf("Bad logger %v", opts.Log)
+	}
+	opts = NewStandardOptions("test")
+	err = opts.Parse([]string{"--data-path", "/tmp", "-v"})
+	if err != nil || opts.Log.level != LogDebug {
+		t.Fatalf("Bad logger for -v %v", err)
+	}
+}
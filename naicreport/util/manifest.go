@@ -0,0 +1,94 @@
+// A machine-readable summary of a run, for auditing.  With --run-manifest <filename>, a JSON object
+// describing the run is written to the file when the run has completed successfully, eg
+//
+//   {"verb":"ml-cpuhog","from":"2023-09-01","to":"2023-09-10","started":"2023-09-11T06:00:00Z",
+//    "duration-seconds":0.25,"analyses":{"cpuhog":{"files":10,"records":12,"candidates":12,
+//    "purged":0,"events":12}}}
+//
+// where `to` is inclusive and `analyses` is present only for the verbs that run analyses.  If the
+// window does not start and end at midnight, eg with --last, then `from` and `to` are the times of
+// its start and end instead, see formatWindow.  For each analysis, `files` is the number of log
+// files read, `records` the number of jobs found in them, `candidates` the number of jobs that were
+// new to the state, `purged` the number of jobs purged from the state, and `events` the number of
+// new violations.
+
+package util
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+type RunManifest struct {
+	Verb            string                `json:"verb"`
+	From            string                `json:"from"`
+	To              string                `json:"to"`
+	Started         string                `json:"started"`
+	DurationSeconds float64               `json:"duration-seconds"`
+	Analyses        map[string]*RunCounts `json:"analyses,omitempty"`
+	started         time.Time
+}
+
+type RunCounts struct {
+	Files      int `json:"files"`
+	Records    int `json:"records"`
+	Candidates int `json:"candidates"`
+	Purged     int `json:"purged"`
+	Events     int `json:"events"`
+}
+
+// Create a manifest for a run of the verb.  progname is as for NewStandardOptions, ending with the
+// verb.
+
+func newRunManifest(progname string) *RunManifest {
+	fields := strings.Fields(progname)
+	verb := ""
+	if len(fields) > 0 {
+		verb = fields[len(fields)-1]
+	}
+	return &RunManifest{
+		Verb:     verb,
+		Analyses: make(map[string]*RunCounts),
+	}
+}
+
+// Record that the run starts at `now`.  This is called when the options are parsed, so that the
+// time is that of the clock of the options, see StandardOptions.Clock.
+
+func (m *RunManifest) start(now time.Time) {
+	m.started = now.UTC()
+	m.Started = m.started.Format(time.RFC3339)
+}
+
+// Return the counts for the analysis, which are added to the manifest if they are not there.  If
+// there is no manifest then the counts are not recorded anywhere.
+
+func (s *StandardOptions) RunCounts(analysis string) *RunCounts {
+	if s.manifest == nil {
+		return &RunCounts{}
+	}
+	counts, found := s.manifest.Analyses[analysis]
+	if !found {
+		counts = &RunCounts{}
+		s.manifest.Analyses[analysis] = counts
+	}
+	return counts
+}
+
+// Write the manifest to the file named by --run-manifest, atomically, if the option was given.
+// This should be called at the end of a successful run.
+
+func (s *StandardOptions) WriteRunManifest() error {
+	if s.RunManifest == "" || s.manifest == nil {
+		return nil
+	}
+	m := s.manifest
+	m.From, m.To = formatWindow(s.From, s.To)
+	m.DurationSeconds = s.Clock.Now().Sub(m.started).Seconds()
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return WriteOutput(s.RunManifest, string(bytes)+"\n")
+}
@@ -0,0 +1,90 @@
+package util
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRunManifest(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	filename := path.Join(td_name, "manifest.json")
+
+	opts := NewStandardOptions("naicreport ml-cpuhog")
+	err = opts.Parse([]string{"--data-path", td_name, "--from", "2023-09-01", "--to", "2023-09-10",
+		"--run-manifest", filename})
+	if err != nil {
+		t.Fatalf("Parse failed %v", err)
+	}
+	counts := opts.RunCounts("cpuhog")
+	counts.Files = 10
+	counts.Events = 3
+	opts.RunCounts("cpuhog").Purged = 1
+	err = opts.WriteRunManifest()
+	if err != nil {
+		t.Fatalf("WriteRunManifest failed %v", err)
+	}
+
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile failed %v", err)
+	}
+	var m RunManifest
+	err = json.Unmarshal(bytes, &m)
+	if err != nil {
+		t.Fatalf("Unmarshal failed %v", err)
+	}
+	c := m.Analyses["cpuhog"]
+	if m.Verb != "ml-cpuhog" || m.From != "2023-09-01" || m.To != "2023-09-10" || m.Started == "" ||
+		len(m.Analyses) != 1 || c.Files != 10 || c.Events != 3 || c.Purged != 1 {
+		t.Fatalf("Bad manifest %s", bytes)
+	}
+
+	// Without the option, nothing is written, and the counts go nowhere
+	opts = NewStandardOptions("naicreport ml-cpuhog")
+	opts.RunCounts("cpuhog").Files = 1
+	if err = opts.WriteRunManifest(); err != nil {
+		t.Fatalf("WriteRunManifest failed %v", err)
+	}
+	var none StandardOptions
+	none.RunCounts("cpuhog").Files = 1
+}
+
+func TestRunManifestLast(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	filename := path.Join(td_name, "manifest.json")
+
+	// With --last the window ends at the time of the run, which is then shown as a time
+	opts := NewStandardOptions("naicreport ml-cpuhog")
+	opts.Clock = &FakeClock{T: time.Date(2023, 9, 11, 6, 30, 0, 0, time.UTC)}
+	err = opts.Parse([]string{"--data-path", td_name, "--last", "2d", "--run-manifest", filename})
+	if err != nil {
+		t.Fatalf("Parse failed %v", err)
+	}
+	err = opts.WriteRunManifest()
+	if err != nil {
+		t.Fatalf("WriteRunManifest failed %v", err)
+	}
+
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile failed %v", err)
+	}
+	var m RunManifest
+	err = json.Unmarshal(bytes, &m)
+	if err != nil {
+		t.Fatalf("Unmarshal failed %v", err)
+	}
+	if m.From != "2023-09-09 06:30" || m.To != "2023-09-11 06:30" || m.Started != "2023-09-11T06:30:00Z" ||
+		m.DurationSeconds != 0 {
+		t.Fatalf("Bad manifest %s", bytes)
+	}
+}
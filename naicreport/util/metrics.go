@@ -0,0 +1,59 @@
+// Metrics for Prometheus, on the format read by node_exporter's textfile collector.
+
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Write metrics about the new violations for each signal to the named file, atomically.  The
+// reports map signal names (eg "cpuhog") to the reports generated by the run for that signal.  The
+// metrics are the number of new violations per signal and per signal and host, and the time of the
+// run.
+
+func WriteMetrics(filename string, reports map[string][]*JobReport, now time.Time) error {
+	return WriteOutput(filename, formatMetrics(reports, now))
+}
+
+func formatMetrics(reports map[string][]*JobReport, now time.Time) string {
+	signals := make([]string, 0)
+	for s := range reports {
+		signals = append(signals, s)
+	}
+	sort.Strings(signals)
+
+	var out strings.Builder
+	out.WriteString("# HELP naicreport_new_violations Number of new violations found by the last run.\n")
+	out.WriteString("# TYPE naicreport_new_violations gauge\n")
+	for _, s := range signals {
+		fmt.Fprintf(&out, "naicreport_new_violations{signal=\"%s\"} %d\n", s, len(reports[s]))
+	}
+
+	out.WriteString("# HELP naicreport_new_violations_by_host Number of new violations per host found by the last run.\n")
+	out.WriteString("# TYPE naicreport_new_violations_by_host gauge\n")
+	for _, s := range signals {
+		byHost := make(map[string]int)
+		for _, r := range reports[s] {
+			byHost[r.Host]++
+		}
+		hosts := make([]string, 0)
+		for h := range byHost {
+			hosts = append(hosts, h)
+		}
+		sort.Strings(hosts)
+		for _, h := range hosts {
+			fmt.Fprintf(&out, "naicreport_new_violations_by_host{signal=\"%s\",host=\"%s\"} %d\n",
+				s, h, byHost[h])
+		}
+	}
+
+	out.WriteString("# HELP naicreport_last_run_timestamp_seconds Time of the last run.\n")
+	out.WriteString("# TYPE naicreport_last_run_timestamp_seconds gauge\n")
+	for _, s := range signals {
+		fmt.Fprintf(&out, "naicreport_last_run_timestamp_seconds{signal=\"%s\"} %d\n", s, now.Unix())
+	}
+	return out.String()
+}
@@ -0,0 +1,34 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatMetrics(t *testing.T) {
+	reports := map[string][]*JobReport{
+		"deadweight": []*JobReport{},
+		"cpuhog": []*JobReport{
+			&JobReport{Id: 1, Host: "ml6"},
+			&JobReport{Id: 2, Host: "ml1"},
+			&JobReport{Id: 3, Host: "ml6"},
+		},
+	}
+	now := time.Date(2023, 9, 12, 0, 0, 0, 0, time.UTC)
+	expect := `# HELP naicreport_new_violations Number of new violations found by the last run.
+# TYPE naicreport_new_violations gauge
+naicreport_new_violations{signal="cpuhog"} 3
+naicreport_new_violations{signal="deadweight"} 0
+# HELP naicreport_new_violations_by_host Number of new violations per host found by the last run.
+# TYPE naicreport_new_violations_by_host gauge
+naicreport_new_violations_by_host{signal="cpuhog",host="ml1"} 1
+naicreport_new_violations_by_host{signal="cpuhog",host="ml6"} 2
+# HELP naicreport_last_run_timestamp_seconds Time of the last run.
+# TYPE naicreport_last_run_timestamp_seconds gauge
+naicreport_last_run_timestamp_seconds{signal="cpuhog"} 1694476800
+naicreport_last_run_timestamp_seconds{signal="deadweight"} 1694476800
+`
+	if got := formatMetrics(reports, now); got != expect {
+		t.Fatalf("Bad metrics:\n%s", got)
+	}
+}
@@ -1,18 +1,21 @@
 // Options parser for naicreport, with standard options predefined
 //
-// TODO: allow -f and -t as abbreviations for --from and --to since sonalyze allows this.  How?  The
-// syntax may still not be quite compatible, sonalyze allows eg -f1d which would not work here.
+// -f and -t are accepted as abbreviations for --from and --to since sonalyze allows them, see
+// expandShortTimeOptions.
 
 package util
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,20 +23,48 @@ import (
 // --from and --to there's both the computed from/to time and the input strings (after vetting).
 //
 // The Parse method sets up DataPath, HaveFrom, From, HaveTo, and To; the others retain their raw
-// option values.  DataPath is cleaned and absolute.
+// option values.  DataPath is cleaned and absolute.  The value of --data-path can be a
+// comma-separated list of data roots, eg current logs on a fast disk followed by archived logs on a
+// slower volume; DataPaths then has all of them, cleaned and absolute, and DataPath is the first,
+// which is where the state is kept.  For the analyses, --data-path can also be StdinDataPath, see
+// FromStdin.  Clock is the source of the current time for the relative times of --from, --to, and
+// --last, for the analyses, and for the run manifest; it can be replaced before Parse is called,
+// for testing.  OutputFile is "" if output is to go to stdout, otherwise it too is cleaned and
+// absolute.  Log is the logger for diagnostic output, at the level given by -v and --log-level; it
+// is nil until Parse has been called.  RunManifest is "" if no run manifest is to be written,
+// otherwise it is cleaned and absolute, see WriteRunManifest.
+//
+// Normally From and To are midnight, but with --last the window is the given duration ending now
+// and neither is rounded; FromStr and ToStr are then the dates of From and To.
 
 type StandardOptions struct {
 	Container *flag.FlagSet
 	DataPath string
+	DataPaths []string
 	HaveFrom bool
 	From time.Time
 	FromStr string
 	HaveTo bool
 	To time.Time
 	ToStr string
+	Last string
+	OutputFile string
+	ConfigFile string
+	Clock Clock
 	Verbose bool
+	LogLevel string
+	Log *Logger
+	RunManifest string
+	manifest *RunManifest
+	allowStdin bool
 }
 
+// The data path that denotes standard input.  The analyses then read the log records from stdin
+// instead of from the files for the time window, and there is no state: the analysis starts from an
+// empty state and does not write it.
+
+const StdinDataPath = "-"
+
 // The idea is that the program calls NewStandardOptions to get a structure with standard options
 // added to the FlagSet, and with some helpers to parse the arguments.  The program can add more
 // flags to opts.container before calling the parser (saving the the flag pointers elsewhere) so
@@ -43,50 +74,136 @@ func NewStandardOptions(progname string) *StandardOptions {
 	opts := StandardOptions {
 		Container: nil,
 		DataPath: "",
+		DataPaths: nil,
 		HaveFrom: false,
 		From: time.Now(),
 		FromStr: "",
 		HaveTo: false,
 		To: time.Now(),
 		ToStr: "",
+		Last: "",
+		OutputFile: "",
+		ConfigFile: "",
+		Clock: RealClock{},
 		Verbose: false,
+		LogLevel: "",
+		Log: nil,
+		RunManifest: "",
+		manifest: newRunManifest(progname),
 	}
 	opts.Container = flag.NewFlagSet(progname, flag.ExitOnError)
-	opts.Container.StringVar(&opts.DataPath, "data-path", "", "Root directory of data store (required)")
+	opts.Container.StringVar(&opts.DataPath, "data-path", "",
+		"Root directory of data store, or a comma-separated list of them (required)")
 	opts.Container.StringVar(&opts.FromStr, "from", "1d",
 		"Start of log window, yyyy-mm-dd or Nd (days ago) or Nw (weeks ago)")
 	opts.Container.StringVar(&opts.ToStr, "to", "", "End of log window, ditto")
-	opts.Container.BoolVar(&opts.Verbose, "v", false, "Verbose (debugging) output")
+	opts.Container.StringVar(&opts.Last, "last", "",
+		"Log window of this duration ending now, eg 24h or 2d, instead of --from and --to")
+	opts.Container.StringVar(&opts.OutputFile, "output-file", "",
+		"Write the report to this file instead of to stdout")
+	opts.Container.StringVar(&opts.ConfigFile, "naicreport-config", "",
+		"JSON file with default values for the options")
+	opts.Container.BoolVar(&opts.Verbose, "v", false, "Verbose (debugging) output, same as --log-level debug")
+	opts.Container.StringVar(&opts.LogLevel, "log-level", "",
+		"Level of diagnostic output: error, warn, info, or debug (default warn)")
+	opts.Container.StringVar(&opts.RunManifest, "run-manifest", "",
+		"Write a JSON summary of the run to this file")
 	return &opts
 }
 
+// If there is a -naicreport-config option among the args then the config file is read and applied
+// after the args are parsed, to the options that are not given on the command line, so that those
+// override the ones in the file.
+
 func (s *StandardOptions) Parse(args []string) error {
-	err := s.Container.Parse(args)
+	err := s.Container.Parse(s.expandShortTimeOptions(args))
 	if err != nil {
 		return err
 	}
+	given := make(map[string]bool)
+	s.Container.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	if s.ConfigFile != "" {
+		err = s.applyConfigFile(s.ConfigFile, given)
+		if err != nil {
+			return err
+		}
+	}
 
-	// Clean the DataPath and make it absolute.
+	// Set up the logger.  --log-level overrides -v.
 
-	s.DataPath, err = CleanPath(s.DataPath, "-data-path")
-	if err != nil {
-		return err
+	level := LogWarn
+	if s.Verbose {
+		level = LogDebug
+	}
+	if s.LogLevel != "" {
+		level, err = ParseLogLevel(s.LogLevel)
+		if err != nil {
+			return err
+		}
+	}
+	s.Log = NewLogger(level, os.Stderr)
+
+	// Clean the DataPaths and make them absolute.
+
+	s.DataPaths = make([]string, 0)
+	for _, p := range strings.Split(s.DataPath, ",") {
+		p = strings.TrimSpace(p)
+		if p == StdinDataPath {
+			if !s.allowStdin {
+				return errors.New("-data-path - is only supported by the analyses")
+			}
+		} else {
+			p, err = CleanPath(p, "-data-path")
+			if err != nil {
+				return err
+			}
+		}
+		s.DataPaths = append(s.DataPaths, p)
+	}
+	s.DataPath = s.DataPaths[0]
+	if s.FromStdin() && len(s.DataPaths) > 1 {
+		return errors.New("-data-path - can't be combined with other data paths")
+	}
+
+	if s.OutputFile != "" {
+		s.OutputFile, err = CleanPath(s.OutputFile, "-output-file")
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.RunManifest != "" {
+		s.RunManifest, err = CleanPath(s.RunManifest, "-run-manifest")
+		if err != nil {
+			return err
+		}
+	}
+	if s.manifest != nil {
+		s.manifest.start(s.Clock.Now())
+	}
+
+	// A --last from the config file gives way to --from or --to on the command line.
+	if s.Last != "" && (given["last"] || !(given["from"] || given["to"])) {
+		return s.applyLast(given)
 	}
 
 	// Figure out the date range.  From has a sane default so always parse; To has no default so
 	// grab current day if nothing is specified.
 
+	now := s.Clock.Now()
 	s.HaveFrom = true
-	s.From, err = matchWhen(s.FromStr)
+	s.From, err = matchWhen(s.FromStr, now)
 	if err != nil {
 		return err
 	}
 
 	if s.ToStr == "" {
-		s.To = time.Now().UTC()
+		s.To = now.UTC()
 	} else {
 		s.HaveTo = true
-		s.To, err = matchWhen(s.ToStr)
+		s.To, err = matchWhen(s.ToStr, now)
 		if err != nil {
 			return err
 		}
@@ -100,6 +217,211 @@ func (s *StandardOptions) Parse(args []string) error {
 	return nil
 }
 
+// Return the options for running an analysis from another program, without a command line: they
+// are as if the verb had been run with `--data-path dataPath` and no other options, except that the
+// time window is from `from` to `to` and diagnostics go to `log` (to stderr if log is nil).  The
+// fields of the options can be changed before they are passed to the analysis, but Parse must not
+// be called.  progname names the verb, as for NewStandardOptions.
+
+func NewEmbeddedOptions(
+	progname, dataPath string,
+	from, to time.Time,
+	log *Logger,
+) (*StandardOptions, *AnalysisOptions, error) {
+	progOpts := NewStandardOptions(progname)
+	analysisOpts := NewAnalysisOptions(progOpts)
+	err := progOpts.Parse([]string{"--data-path", dataPath})
+	if err != nil {
+		return nil, nil, err
+	}
+	if !from.Before(to) {
+		return nil, nil, errors.New("The time window is empty")
+	}
+	progOpts.HaveFrom = true
+	progOpts.From = from.UTC()
+	progOpts.FromStr = progOpts.From.Format("2006-01-02")
+	progOpts.HaveTo = true
+	progOpts.To = to.UTC()
+	progOpts.ToStr = progOpts.To.Format("2006-01-02")
+	if log != nil {
+		progOpts.Log = log
+	}
+	return progOpts, analysisOpts, nil
+}
+
+// True if the log records are to be read from stdin, see StdinDataPath.
+
+func (s *StandardOptions) FromStdin() bool {
+	return s.DataPath == StdinDataPath
+}
+
+// Check that the data roots exist and are directories, and if `writable` is true, that files can be
+// created in DataPath, where the state is kept.  The analyses do this before any work is done, so
+// that they don't fail when they write the state after the report has been produced, which would
+// make the report be produced again by the next run.  Nothing is checked for StdinDataPath.
+
+func (s *StandardOptions) CheckDataPaths(writable bool) error {
+	if s.FromStdin() {
+		return nil
+	}
+	for _, p := range s.DataPaths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return fmt.Errorf("Bad data path: %w", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("Bad data path: %s is not a directory", p)
+		}
+	}
+	if writable {
+		probe, err := os.CreateTemp(s.DataPath, "naicreport-probe")
+		if err != nil {
+			return fmt.Errorf("The state can't be written to the data path: %w", err)
+		}
+		probe.Close()
+		os.Remove(probe.Name())
+	}
+	return nil
+}
+
+// Set up the window for --last.  The logs are organized by day, so the analyses will read the files
+// for every day the window touches.  --from and --to can't be `given` on the command line along
+// with --last, but the window overrides them if they come from the config file.
+
+func (s *StandardOptions) applyLast(given map[string]bool) error {
+	if given["from"] || given["to"] {
+		return errors.New("--last can't be combined with --from or --to")
+	}
+	d, err := parseLast(s.Last)
+	if err != nil {
+		return err
+	}
+	s.HaveFrom = true
+	s.HaveTo = true
+	s.To = s.Clock.Now().UTC()
+	s.From = s.To.Add(-d)
+	s.FromStr = s.From.Format("2006-01-02")
+	s.ToStr = s.To.Format("2006-01-02")
+	return nil
+}
+
+// The format of `last` is a positive Go duration (eg 24h or 90m), or Nd (days) or Nw (weeks).
+
+func parseLast(s string) (time.Duration, error) {
+	if probe := daysRe.FindStringSubmatch(s); probe != nil {
+		days, _ := strconv.ParseUint(probe[1], 10, 32)
+		s = fmt.Sprintf("%dh", days*24)
+	} else if probe := weeksRe.FindStringSubmatch(s); probe != nil {
+		weeks, _ := strconv.ParseUint(probe[1], 10, 32)
+		s = fmt.Sprintf("%dh", weeks*7*24)
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, errors.New("Bad duration for --last")
+	}
+	return d, nil
+}
+
+// sonalyze has -f and -t as short forms of --from and --to, and the value of a short option can
+// follow it as a separate argument (-f 1d), after `=` (-f=1d), or glued to it (-f1d).  Rewrite all
+// of these as --from and --to so that the FlagSet can parse them.  The glued form is only recognized
+// if the value is a well-formed time (yyyy-mm-dd, Nd, or Nw), as eg -to and -tag are options in
+// their own right.  Arguments that are the values of other options are left alone, and so is
+// everything after the first non-option argument or `--`, as for the FlagSet.
+
+func (s *StandardOptions) expandShortTimeOptions(args []string) []string {
+	expanded := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" || len(a) < 2 || a[0] != '-' {
+			return append(expanded, args[i:]...)
+		}
+		if long, found := shortTimeOptions[a[:2]]; found && !strings.HasPrefix(a, "--") {
+			value := a[2:]
+			switch {
+			case value == "":
+				expanded = append(expanded, long)
+				if i+1 < len(args) {
+					i++
+					expanded = append(expanded, args[i])
+				}
+				continue
+			case value[0] == '=':
+				expanded = append(expanded, long+value)
+				continue
+			case isWhen(value):
+				expanded = append(expanded, long+"="+value)
+				continue
+			}
+		}
+		expanded = append(expanded, a)
+		name := strings.TrimPrefix(strings.TrimPrefix(a, "-"), "-")
+		if !strings.Contains(name, "=") && i+1 < len(args) {
+			if f := s.Container.Lookup(name); f != nil {
+				if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+					i++
+					expanded = append(expanded, args[i])
+				}
+			}
+		}
+	}
+	return expanded
+}
+
+var shortTimeOptions = map[string]string{
+	"-f": "--from",
+	"-t": "--to",
+}
+
+// The config file holds a JSON object whose fields are option names (without leading dashes) and
+// whose values are the default values for those options, eg
+//
+//   { "data-path": "/home/sonar/data", "sonalyze": "/home/sonar/sonalyze", "v": true }
+//
+// Fields that do not name an option for the present verb are ignored, so one file can be shared
+// among all the verbs, and so are fields for the options that are `given` on the command line.  The
+// values must be strings, numbers, or booleans; numbers are written out in full, eg 1000000 and not
+// 1e+06, so that they are valid values for integer options.
+
+func (s *StandardOptions) applyConfigFile(filename string, given map[string]bool) error {
+	configFile, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer configFile.Close()
+	bytes, err := io.ReadAll(configFile)
+	if err != nil {
+		return err
+	}
+	var config map[string]any
+	err = json.Unmarshal(bytes, &config)
+	if err != nil {
+		return fmt.Errorf("Bad config file %s: %w", filename, err)
+	}
+	for name, value := range config {
+		if name == "naicreport-config" || s.Container.Lookup(name) == nil || given[name] {
+			continue
+		}
+		var text string
+		switch v := value.(type) {
+		case string:
+			text = v
+		case float64:
+			text = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			text = strconv.FormatBool(v)
+		default:
+			return fmt.Errorf("Bad value for %s in config file %s: must be a string, number, or boolean",
+				name, filename)
+		}
+		err = s.Container.Set(name, text)
+		if err != nil {
+			return fmt.Errorf("Bad value for %s in config file %s: %w", name, filename, err)
+		}
+	}
+	return nil
+}
+
 func CleanPath(p, optionName string) (newp string, e error) {
 	if p == "" {
 		e = errors.New(fmt.Sprintf("%s requires a value", optionName))
@@ -116,6 +438,13 @@ func CleanPath(p, optionName string) (newp string, e error) {
 	return
 }
 
+// Parse a point in time in the format of --from and --to, for verbs that have similar options.  The
+// relative formats are relative to `now`.
+
+func ParseWhen(s string, now time.Time) (time.Time, error) {
+	return matchWhen(s, now)
+}
+
 // The format of `from` and `to` is one of:
 //  YYYY-MM-DD
 //  Nd (days ago)
@@ -125,7 +454,11 @@ var dateRe = regexp.MustCompile(`^(\d\d\d\d)-(\d\d)-(\d\d)$`)
 var daysRe = regexp.MustCompile(`^(\d+)d$`)
 var weeksRe = regexp.MustCompile(`^(\d+)w$`)
 
-func matchWhen(s string) (time.Time, error) {
+func isWhen(s string) bool {
+	return dateRe.MatchString(s) || daysRe.MatchString(s) || weeksRe.MatchString(s)
+}
+
+func matchWhen(s string, now time.Time) (time.Time, error) {
 	probe := dateRe.FindSubmatch([]byte(s))
 	if probe != nil {
 		yyyy, _ := strconv.ParseUint(string(probe[1]), 10, 32)
@@ -136,15 +469,15 @@ func matchWhen(s string) (time.Time, error) {
 	probe = daysRe.FindSubmatch([]byte(s))
 	if probe != nil {
 		days, _ := strconv.ParseUint(string(probe[1]), 10, 32)
-		t := time.Now().UTC().AddDate(0, 0, -int(days))
+		t := now.UTC().AddDate(0, 0, -int(days))
 		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
 	}
 	probe = weeksRe.FindSubmatch([]byte(s))
 	if probe != nil {
 		weeks, _ := strconv.ParseUint(string(probe[1]), 10, 32)
-		t := time.Now().UTC().AddDate(0, 0, -int(weeks)*7)
+		t := now.UTC().AddDate(0, 0, -int(weeks)*7)
 		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
 	}
-	return time.Now(), errors.New("Bad time specification")
+	return now, errors.New("Bad time specification")
 }
 
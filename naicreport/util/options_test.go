@@ -3,6 +3,7 @@ package util
 import (
 	"os"
 	"path"
+	"strings"
 	"testing"
 	"time"
 )
@@ -26,6 +27,42 @@ func TestOptionsDataPath(t *testing.T) {
 	if opt.DataPath != "/ho/hum" {
 		t.Fatalf("Failed data path #3")
 	}
+
+	opt = NewStandardOptions("hi")
+	err = opt.Parse([]string{"--data-path", "/ho/hum, ho/hi"})
+	if err != nil {
+		t.Fatalf("Failed data path #4: %v", err)
+	}
+	if opt.DataPath != "/ho/hum" || len(opt.DataPaths) != 2 || opt.DataPaths[0] != "/ho/hum" ||
+		opt.DataPaths[1] != path.Join(wd, "ho/hi") {
+		t.Fatalf("Failed data path #5: %v", opt.DataPaths)
+	}
+
+	opt = NewStandardOptions("hi")
+	err = opt.Parse([]string{"--data-path", "/ho/hum,"})
+	if err == nil {
+		t.Fatalf("Empty data path accepted")
+	}
+
+	opt = NewStandardOptions("hi")
+	err = opt.Parse([]string{"--data-path", "-"})
+	if err == nil {
+		t.Fatalf("Stdin accepted without the analysis options")
+	}
+
+	opt = NewStandardOptions("hi")
+	NewAnalysisOptions(opt)
+	err = opt.Parse([]string{"--data-path", "-"})
+	if err != nil || !opt.FromStdin() || len(opt.DataPaths) != 1 {
+		t.Fatalf("Failed stdin data path: %v", err)
+	}
+
+	opt = NewStandardOptions("hi")
+	NewAnalysisOptions(opt)
+	err = opt.Parse([]string{"--data-path", "-,/ho/hum"})
+	if err == nil {
+		t.Fatalf("Stdin accepted with other data paths")
+	}
 }
 
 func TestOptionsDateRange(t *testing.T) {
@@ -44,21 +81,275 @@ func TestOptionsDateRange(t *testing.T) {
 	}
 }
 
+func TestOptionsShortFromTo(t *testing.T) {
+	now := time.Date(2023, 9, 11, 15, 37, 0, 0, time.UTC)
+	parse := func(args ...string) (*StandardOptions, *string, error) {
+		opt := NewStandardOptions("hi")
+		opt.Clock = &FakeClock{T: now}
+		tag := opt.Container.String("tag", "", "A tag")
+		opt.Container.Bool("top", false, "A flag")
+		err := opt.Parse(append([]string{"--data-path", "irrelevant"}, args...))
+		return opt, tag, err
+	}
+	for _, args := range [][]string{
+		{"-f1w", "-t2023-09-09"},
+		{"-f", "1w", "-t", "2023-09-09"},
+		{"-f=1w", "-t=2023-09-09"},
+		{"--from", "1w", "--to=2023-09-09"},
+	} {
+		opt, _, err := parse(args...)
+		if err != nil {
+			t.Fatalf("Failed %v: %v", args, err)
+		}
+		if !opt.From.Equal(time.Date(2023, 9, 4, 0, 0, 0, 0, time.UTC)) ||
+			!opt.To.Equal(time.Date(2023, 9, 10, 0, 0, 0, 0, time.UTC)) {
+			t.Fatalf("Bad window for %v: %v %v", args, opt.From, opt.To)
+		}
+	}
+
+	// Options that start with -f or -t, and option values that look like -f or -t, are left alone
+	opt, tag, err := parse("-tag", "-t2d", "-to", "3d", "-top")
+	if err != nil || *tag != "-t2d" || !opt.From.Equal(time.Date(2023, 9, 10, 0, 0, 0, 0, time.UTC)) ||
+		!opt.To.Equal(time.Date(2023, 9, 9, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Bad parse of other options: %v %q %v %v", err, *tag, opt.From, opt.To)
+	}
+
+	_, _, err = parse("-f=1x")
+	if err == nil {
+		t.Fatalf("-f=1x accepted")
+	}
+}
+
+func TestOptionsLast(t *testing.T) {
+	opt := NewStandardOptions("hi")
+	before := time.Now().UTC()
+	err := opt.Parse([]string{"--data-path", "irrelevant", "--last", "12h"})
+	if err != nil {
+		t.Fatalf("Failed --last: %v", err)
+	}
+	if opt.To.Before(before) || opt.To.Sub(opt.From) != 12*time.Hour || !opt.HaveFrom || !opt.HaveTo ||
+		opt.FromStr != opt.From.Format("2006-01-02") || opt.ToStr != opt.To.Format("2006-01-02") {
+		t.Fatalf("Bad window for --last: %v %v", opt.From, opt.To)
+	}
+
+	opt = NewStandardOptions("hi")
+	err = opt.Parse([]string{"--data-path", "irrelevant", "--last", "2d"})
+	if err != nil || opt.To.Sub(opt.From) != 48*time.Hour {
+		t.Fatalf("Failed --last in days: %v", err)
+	}
+
+	opt = NewStandardOptions("hi")
+	err = opt.Parse([]string{"--data-path", "irrelevant", "--last", "24h", "--from", "2d"})
+	if err == nil {
+		t.Fatalf("--last with --from accepted")
+	}
+
+	opt = NewStandardOptions("hi")
+	err = opt.Parse([]string{"--data-path", "irrelevant", "--last", "-1h"})
+	if err == nil {
+		t.Fatalf("Negative --last accepted")
+	}
+}
+
+func TestOptionsClock(t *testing.T) {
+	opt := NewStandardOptions("hi")
+	opt.Clock = &FakeClock{T: time.Date(2023, 9, 7, 12, 30, 0, 0, time.UTC)}
+	err := opt.Parse([]string{"--data-path", "irrelevant", "--from", "1w", "--to", "2d"})
+	if err != nil {
+		t.Fatalf("Failed date range: %v", err)
+	}
+	if opt.From != time.Date(2023, 8, 31, 0, 0, 0, 0, time.UTC) ||
+		opt.To != time.Date(2023, 9, 6, 0, 0, 0, 0, time.UTC) {
+		t.Fatalf("Bad window %v %v", opt.From, opt.To)
+	}
+
+	opt = NewStandardOptions("hi")
+	opt.Clock = &FakeClock{T: time.Date(2023, 9, 7, 12, 30, 0, 0, time.UTC)}
+	err = opt.Parse([]string{"--data-path", "irrelevant", "--last", "90m"})
+	if err != nil || opt.From != time.Date(2023, 9, 7, 11, 0, 0, 0, time.UTC) ||
+		opt.To != time.Date(2023, 9, 7, 12, 30, 0, 0, time.UTC) {
+		t.Fatalf("Bad window for --last %v %v %v", opt.From, opt.To, err)
+	}
+}
+
+func TestEmbeddedOptions(t *testing.T) {
+	from := time.Date(2023, 9, 3, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 9, 4, 0, 0, 0, 0, time.UTC)
+	progOpts, analysisOpts, err := NewEmbeddedOptions("hi", "irrelevant", from, to, nil)
+	if err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+	if !path.IsAbs(progOpts.DataPath) || progOpts.From != from || progOpts.To != to ||
+		progOpts.FromStr != "2023-09-03" || progOpts.Log == nil || analysisOpts.Concurrency < 1 ||
+		analysisOpts.Sort != "host" {
+		t.Fatalf("Bad options %v %v", progOpts, analysisOpts)
+	}
+
+	_, _, err = NewEmbeddedOptions("hi", "irrelevant", to, from, nil)
+	if err == nil {
+		t.Fatalf("Empty window accepted")
+	}
+}
+
 func TestMatchWhen(t *testing.T) {
-	tm, err := matchWhen("2023-09-12")
+	tm, err := matchWhen("2023-09-12", time.Now())
 	if err != nil || tm.Year() != 2023 || tm.Month() != 9 || tm.Day() != 12 {
 		t.Fatalf("Failed parsing day")
 	}
 
 	n3 := time.Now().UTC().AddDate(0, 0, -3)
-	tm, err = matchWhen("3d")
+	tm, err = matchWhen("3d", time.Now())
 	if err != nil || tm.Year() != n3.Year() || tm.Month() != n3.Month() || tm.Day() != n3.Day() {
 		t.Fatalf("Failed parsing days-ago")
 	}
 
 	n14 := time.Now().UTC().AddDate(0, 0, -14)
-	tm, err = matchWhen("2w")
+	tm, err = matchWhen("2w", time.Now())
 	if err != nil || tm.Year() != n14.Year() || tm.Month() != n14.Month() || tm.Day() != n14.Day() {
 		t.Fatalf("Failed parsing weeks-ago")
 	}
 }
+
+func TestOptionsOutputFile(t *testing.T) {
+	opt := NewStandardOptions("hi")
+	err := opt.Parse([]string{"--data-path", "irrelevant"})
+	if err != nil || opt.OutputFile != "" {
+		t.Fatalf("Failed output file #1")
+	}
+
+	opt = NewStandardOptions("hi")
+	err = opt.Parse([]string{"--data-path", "irrelevant", "--output-file", "report.txt"})
+	if err != nil {
+		t.Fatalf("Failed output file #2: %v", err)
+	}
+	wd, _ := os.Getwd()
+	if opt.OutputFile != path.Join(wd, "report.txt") {
+		t.Fatalf("Failed output file #3")
+	}
+}
+
+func TestOptionsConfigFile(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	configName := path.Join(td_name, "config.json")
+	err = os.WriteFile(configName,
+		[]byte(`{"data-path": "/ho/hum", "from": "2023-09-01", "v": true, "sonalyze": "x"}`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+
+	opt := NewStandardOptions("hi")
+	err = opt.Parse([]string{"--naicreport-config", configName})
+	if err != nil {
+		t.Fatalf("Failed config file #1: %v", err)
+	}
+	if opt.DataPath != "/ho/hum" || opt.FromStr != "2023-09-01" || !opt.Verbose {
+		t.Fatalf("Failed config file #2")
+	}
+
+	// Command line overrides the file
+	opt = NewStandardOptions("hi")
+	err = opt.Parse([]string{"--from", "2023-09-02", "-naicreport-config=" + configName})
+	if err != nil {
+		t.Fatalf("Failed config file #3: %v", err)
+	}
+	if opt.DataPath != "/ho/hum" || opt.FromStr != "2023-09-02" {
+		t.Fatalf("Failed config file #4")
+	}
+
+	// --last overrides the window of the file, but not one on the command line
+	opt = NewStandardOptions("hi")
+	opt.Clock = &FakeClock{T: time.Date(2023, 9, 7, 12, 30, 0, 0, time.UTC)}
+	err = opt.Parse([]string{"--naicreport-config", configName, "--last", "6h"})
+	if err != nil {
+		t.Fatalf("Failed config file with --last: %v", err)
+	}
+	if opt.From != time.Date(2023, 9, 7, 6, 30, 0, 0, time.UTC) ||
+		opt.To != time.Date(2023, 9, 7, 12, 30, 0, 0, time.UTC) {
+		t.Fatalf("Bad window for config file with --last: %v %v", opt.From, opt.To)
+	}
+	opt = NewStandardOptions("hi")
+	err = opt.Parse([]string{"--naicreport-config", configName, "--last", "6h", "--to", "2023-09-02"})
+	if err == nil {
+		t.Fatalf("--last with --to accepted with config file")
+	}
+	err = os.WriteFile(configName, []byte(`{"data-path": "/ho/hum", "last": "6h"}`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	opt = NewStandardOptions("hi")
+	err = opt.Parse([]string{"--naicreport-config", configName, "--from", "2023-09-02"})
+	if err != nil || opt.FromStr != "2023-09-02" || opt.From != time.Date(2023, 9, 2, 0, 0, 0, 0, time.UTC) {
+		t.Fatalf("--from did not override --last of the config file: %v %v", opt.From, err)
+	}
+
+	// Large numbers are valid integers, and values that are not scalars are rejected by name
+	err = os.WriteFile(configName, []byte(`{"data-path": "/ho/hum", "limit": 1000000, "ratio": 0.25}`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	opt = NewStandardOptions("hi")
+	limit := opt.Container.Int("limit", 0, "")
+	ratio := opt.Container.Float64("ratio", 0, "")
+	err = opt.Parse([]string{"--naicreport-config", configName})
+	if err != nil || *limit != 1000000 || *ratio != 0.25 {
+		t.Fatalf("Failed config file #5: %v", err)
+	}
+	err = os.WriteFile(configName, []byte(`{"data-path": ["/ho/hum"]}`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	err = NewStandardOptions("hi").Parse([]string{"--naicreport-config", configName})
+	if err == nil || !strings.Contains(err.Error(), "data-path") {
+		t.Fatalf("Failed config file #6: %v", err)
+	}
+}
+
+func TestCheckDataPaths(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	file := path.Join(td_name, "file")
+	err = os.WriteFile(file, []byte{}, 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	check := func(dataPath string, writable bool) error {
+		opt := NewStandardOptions("hi")
+		opt.allowStdin = true
+		err := opt.Parse([]string{"--data-path", dataPath})
+		if err != nil {
+			t.Fatalf("Parse failed %v", err)
+		}
+		return opt.CheckDataPaths(writable)
+	}
+	if check(td_name, true) != nil || check("-", true) != nil {
+		t.Fatalf("Good data path rejected")
+	}
+	entries, _ := os.ReadDir(td_name)
+	if len(entries) != 1 {
+		t.Fatalf("Probe file left behind")
+	}
+	if check(path.Join(td_name, "nonexistent"), false) == nil ||
+		check(td_name+","+path.Join(td_name, "nonexistent"), false) == nil {
+		t.Fatalf("Missing data path accepted")
+	}
+	if check(file, false) == nil {
+		t.Fatalf("File accepted as data path")
+	}
+
+	// Permissions don't stop root
+	if os.Geteuid() != 0 {
+		readOnly := path.Join(td_name, "ro")
+		err = os.Mkdir(readOnly, 0555)
+		if err != nil {
+			t.Fatalf("Mkdir failed %q", err)
+		}
+		if check(readOnly, false) != nil || check(readOnly, true) == nil {
+			t.Fatalf("Bad check of read-only data path")
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Output management for the reports.
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+// The UTF-8 encoding of the byte order mark U+FEFF.  Excel on Windows takes a CSV file to be in the
+// system's code page unless it starts with the mark, which is meaningless but harmless in UTF-8.
+
+const Utf8BOM = "\uFEFF"
+
+// Write the report output to the named file, or to stdout if the filename is "".  The file is
+// written atomically: the output is written to a temp file in the same directory, which is then
+// renamed, so a reader of the file will never see partial output.
+
+func WriteOutput(filename, output string) error {
+	if filename == "" {
+		fmt.Print(output)
+		return nil
+	}
+	output_file, err := os.CreateTemp(path.Dir(filename), "naicreport-output")
+	if err != nil {
+		return err
+	}
+	oldname := output_file.Name()
+	_, err = output_file.WriteString(output)
+	if err != nil {
+		output_file.Close()
+		os.Remove(oldname)
+		return err
+	}
+	err = output_file.Close()
+	if err != nil {
+		os.Remove(oldname)
+		return err
+	}
+	return os.Rename(oldname, filename)
+}
+
+// As WriteOutput, for the output of the analyses, where `empty` is true if there were no new
+// violations.  If both `empty` and `quiet` (--quiet-if-empty) are true then nothing is printed, and
+// the file, if there is one, is removed so that an old report is not mistaken for a new one.
+
+func WriteReportOutput(filename, output string, empty, quiet bool) error {
+	if !empty || !quiet {
+		return WriteOutput(filename, output)
+	}
+	if filename == "" {
+		return nil
+	}
+	err := os.Remove(filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Format the reports of an analysis, whose events are of the type of `event`, as selected by the
+// options and write them as WriteReportOutput does, to progOpts.OutputFile or stdout.
+
+func OutputReports(
+	progOpts *StandardOptions,
+	analysisOpts *AnalysisOptions,
+	reports []*JobReport,
+	event any,
+) error {
+	var output strings.Builder
+	err := WriteReports(&output, reports, event, analysisOpts)
+	if err != nil {
+		return err
+	}
+	return WriteReportOutput(progOpts.OutputFile, output.String(), len(reports) == 0, analysisOpts.QuietIfEmpty)
+}
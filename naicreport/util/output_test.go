@@ -0,0 +1,47 @@
+package util
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestWriteReportOutput(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	filename := path.Join(td_name, "report.txt")
+
+	err = WriteReportOutput(filename, "[]", true, false)
+	if err != nil {
+		t.Fatalf("WriteReportOutput failed %v", err)
+	}
+	bytes, err := os.ReadFile(filename)
+	if err != nil || string(bytes) != "[]" {
+		t.Fatalf("Bad output %q %v", bytes, err)
+	}
+
+	err = WriteReportOutput(filename, "[]", true, true)
+	if err != nil {
+		t.Fatalf("WriteReportOutput failed %v", err)
+	}
+	if _, err = os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("Report not removed %v", err)
+	}
+
+	// Removing a file that is not there is fine
+	err = WriteReportOutput(filename, "", true, true)
+	if err != nil {
+		t.Fatalf("WriteReportOutput failed %v", err)
+	}
+
+	err = WriteReportOutput(filename, "news", false, true)
+	if err != nil {
+		t.Fatalf("WriteReportOutput failed %v", err)
+	}
+	bytes, err = os.ReadFile(filename)
+	if err != nil || string(bytes) != "news" {
+		t.Fatalf("Bad output %q %v", bytes, err)
+	}
+}
@@ -0,0 +1,103 @@
+// Templates for the text reports of the analyses.
+//
+// Each analysis has a default template for the report on a job, named by the analysis (eg
+// "cpuhog") and executed with the analysis's event for the job as data.  The defaults are embedded
+// in the program, and they share the template "job" for the lines that identify the job.
+//
+// The file given by --report-template is parsed after the defaults and can redefine any of them with
+// {{define "name"}}...{{end}}, so one file can customize the reports of several analyses (which is
+// what the daemon and the digest need).  Text outside the definitions is ignored.
+//
+// The templates can use these functions:
+//
+//   command cmd rawCmd - the command of a job as the default reports show it, from the event's Cmd
+//                        and RawCmd fields
+//   show name ...      - true if any of the named observed-data fields is selected by --fields
+//   avgPeak label avgName avg peakName peak
+//                      - a line `    <label> avg/peak = <avg>%, <peak>%` with the selected values
+//                        of the pair, eg `    <label> peak = <peak>%` if only the peak is selected,
+//                        or nothing if neither is
+
+package util
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+//go:embed report.tmpl
+var commonReportTemplates string
+
+// The report templates specified by the options, for an analysis whose default templates are
+// `defaults`.
+
+func (opts *AnalysisOptions) ReportTemplates(defaults string) (*template.Template, error) {
+	return NewReportTemplates(defaults, opts.ReportTemplate, opts.SelectedFields())
+}
+
+// Parse the shared templates, then the defaults, and then the file, if filename is not "".  The
+// observed-data fields that are shown are those in `selected`, or all if it is nil.
+
+func NewReportTemplates(defaults, filename string, selected map[string]bool) (*template.Template, error) {
+	show := func(names ...string) bool {
+		if selected == nil {
+			return true
+		}
+		for _, name := range names {
+			if selected[name] {
+				return true
+			}
+		}
+		return false
+	}
+	avgPeak := func(label, avgName string, avg any, peakName string, peak any) string {
+		switch showAvg, showPeak := show(avgName), show(peakName); {
+		case showAvg && showPeak:
+			return fmt.Sprintf("    %s avg/peak = %v%%, %v%%\n", label, avg, peak)
+		case showAvg:
+			return fmt.Sprintf("    %s avg = %v%%\n", label, avg)
+		case showPeak:
+			return fmt.Sprintf("    %s peak = %v%%\n", label, peak)
+		default:
+			return ""
+		}
+	}
+	t := template.New("reports").Funcs(template.FuncMap{
+		"command": FormatCommand,
+		"show":    show,
+		"avgPeak": avgPeak,
+	})
+	t, err := t.Parse(commonReportTemplates)
+	if err != nil {
+		return nil, err
+	}
+	t, err = t.Parse(defaults)
+	if err != nil {
+		return nil, err
+	}
+	if filename != "" {
+		bytes, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		t, err = t.Parse(string(bytes))
+		if err != nil {
+			return nil, fmt.Errorf("Bad report template: %w", err)
+		}
+	}
+	return t, nil
+}
+
+// Execute the named template with the data and return the text.
+
+func FormatReport(t *template.Template, name string, data any) (string, error) {
+	var out strings.Builder
+	err := t.ExecuteTemplate(&out, name, data)
+	if err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,115 @@
+package util
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReportTemplates(t *testing.T) {
+	defaults := `{{define "hog"}}Hog on {{.Host}}:
+{{template "job" .}}{{end}}`
+	type hogEvent struct {
+		Host                string
+		Id                  uint32
+		User                string
+		Cmd                 string
+		RawCmd              string
+		StartedOnOrBefore   string
+		StartedBeforeWindow bool
+		RunningFor          string
+		FirstViolation      string
+	}
+	event := hogEvent{"ml6", 10, "joe", "python", "python3", "then", false, "3h20m", "now"}
+
+	templates, err := NewReportTemplates(defaults, "", nil)
+	if err != nil {
+		t.Fatalf("NewReportTemplates failed %v", err)
+	}
+	report, err := FormatReport(templates, "hog", event)
+	expect := "Hog on ml6:\n  Job#: 10\n  User: joe\n  Command: python (python3)\n" +
+		"  Started on or before: then\n  Running for: 3h20m\n  Violation first detected: now\n"
+	if err != nil || report != expect {
+		t.Fatalf("Bad default report %q %v", report, err)
+	}
+
+	// A job that started before the observation window has no known start time
+	report, err = FormatReport(templates, "hog",
+		hogEvent{"ml6", 10, "joe", "python", "python", "then", true, "3h20m", "now"})
+	expect = "Hog on ml6:\n  Job#: 10\n  User: joe\n  Command: python\n" +
+		"  Started: before the observation window, first observed then\n  Running for: 3h20m\n" +
+		"  Violation first detected: now\n"
+	if err != nil || report != expect {
+		t.Fatalf("Bad report for a job started before the window %q %v", report, err)
+	}
+
+	// The file can redefine the shared templates as well as the analysis's, and other text is
+	// ignored.
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	filename := path.Join(td_name, "reports.tmpl")
+	err = os.WriteFile(filename,
+		[]byte(`Ignored
+{{define "job"}}job {{.Id}} by {{.User}}{{end}}
+{{define "other"}}Not used{{end}}`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	templates, err = NewReportTemplates(defaults, filename, nil)
+	if err != nil {
+		t.Fatalf("NewReportTemplates failed %v", err)
+	}
+	report, err = FormatReport(templates, "hog", event)
+	if err != nil || report != "Hog on ml6:\njob 10 by joe" {
+		t.Fatalf("Bad custom report %q %v", report, err)
+	}
+
+	// Errors in the file are detected when it is parsed, or when the template is executed
+	err = os.WriteFile(filename, []byte(`{{define "hog"}}{{.Host}{{end}}`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	_, err = NewReportTemplates(defaults, filename, nil)
+	if err == nil {
+		t.Fatalf("Bad template accepted")
+	}
+	err = os.WriteFile(filename, []byte(`{{define "hog"}}{{.NoSuchField}}{{end}}`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	templates, err = NewReportTemplates(defaults, filename, nil)
+	if err != nil {
+		t.Fatalf("NewReportTemplates failed %v", err)
+	}
+	_, err = FormatReport(templates, "hog", event)
+	if err == nil {
+		t.Fatalf("Bad field accepted")
+	}
+	_, err = NewReportTemplates(defaults, path.Join(td_name, "nonexistent.tmpl"), nil)
+	if err == nil {
+		t.Fatalf("Missing file accepted")
+	}
+
+	// The observed data can be selected
+	defaults = `{{define "hog"}}{{if show "a" "b"}}Data:
+{{avgPeak "CPU" "a" 1 "b" 2}}{{avgPeak "Mem" "c" 3 "d" 4}}{{end}}{{end}}`
+	for _, c := range []struct {
+		selected map[string]bool
+		expect   string
+	}{
+		{nil, "Data:\n    CPU avg/peak = 1%, 2%\n    Mem avg/peak = 3%, 4%\n"},
+		{map[string]bool{"b": true, "c": true}, "Data:\n    CPU peak = 2%\n    Mem avg = 3%\n"},
+		{map[string]bool{"d": true}, ""},
+	} {
+		templates, err = NewReportTemplates(defaults, "", c.selected)
+		if err != nil {
+			t.Fatalf("NewReportTemplates failed %v", err)
+		}
+		report, err = FormatReport(templates, "hog", event)
+		if err != nil || report != c.expect {
+			t.Fatalf("Bad report for %v: %q %v", c.selected, report, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// JSON Schemas for the events of the analyses, generated from the event structs, so that the
+// description of the JSON output can't get out of sync with the output.
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// The schema of a value.  Type is a string, or a list of strings for a pointer, which can be null.
+
+type valueSchema struct {
+	Type        any          `json:"type"`
+	Items       *valueSchema `json:"items,omitempty"`
+	Description string       `json:"description,omitempty"`
+}
+
+// The properties of an object in the order of the fields of the struct, as JSON objects are
+// otherwise marshaled with their keys sorted.
+
+type orderedProperties struct {
+	names   []string
+	schemas []*valueSchema
+}
+
+func (p orderedProperties) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range p.names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(p.schemas[i])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Return a JSON Schema (draft 2020-12) for the JSON objects of the events of --json and --jsonl,
+// where `data` is a pointer to the event struct of the analysis, as for ObservedFields.  The
+// properties are the exported fields of the struct, named by their JSON names and in the order of
+// the fields.  All of them are required, except for the observed-data fields, which are omitted if
+// they are not selected by --fields, and fields that have the `omitempty` option; the unit of an
+// observed-data field is given in its description.
+
+func EventSchema(title string, data any) ([]byte, error) {
+	props := orderedProperties{names: make([]string, 0), schemas: make([]*valueSchema, 0)}
+	required := make([]string, 0)
+	ty := reflect.TypeOf(data).Elem()
+	for i := 0; i < ty.NumField(); i++ {
+		f := ty.Field(i)
+		if !f.IsExported() || f.Tag.Get("json") == "-" {
+			continue
+		}
+		name := jsonFieldName(f)
+		schema := typeSchema(f.Type)
+		unit := f.Tag.Get("unit")
+		if unit != "" {
+			schema.Description = "In " + unit + ", omitted if not selected by --fields"
+		}
+		props.names = append(props.names, name)
+		props.schemas = append(props.schemas, schema)
+		_, options, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if unit == "" && !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	return json.MarshalIndent(struct {
+		Schema     string            `json:"$schema"`
+		Title      string            `json:"title"`
+		Type       string            `json:"type"`
+		Properties orderedProperties `json:"properties"`
+		Required   []string          `json:"required"`
+	}{"https://json-schema.org/draft/2020-12/schema", title, "object", props, required}, "", "  ")
+}
+
+func typeSchema(ty reflect.Type) *valueSchema {
+	switch ty.Kind() {
+	case reflect.Bool:
+		return &valueSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &valueSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &valueSchema{Type: "number"}
+	case reflect.String:
+		return &valueSchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &valueSchema{Type: "array", Items: typeSchema(ty.Elem())}
+	case reflect.Pointer:
+		s := typeSchema(ty.Elem())
+		s.Type = []any{s.Type, "null"}
+		return s
+	default:
+		return &valueSchema{Type: "object"}
+	}
+}
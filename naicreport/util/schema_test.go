@@ -0,0 +1,33 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEventSchema(t *testing.T) {
+	type event struct {
+		Host    string   `json:"hostname"`
+		Peak    uint32   `json:"peak" unit:"percent"`
+		Gpus    []uint32 `json:"gpus"`
+		Load    *float64 `json:"load"`
+		Note    string   `json:"note,omitempty"`
+		Ignored string   `json:"-"`
+		Count   int
+		hidden  bool
+	}
+	bytes, err := EventSchema("test event", &event{})
+	if err != nil {
+		t.Fatalf("EventSchema failed %v", err)
+	}
+	compact := strings.Join(strings.Fields(string(bytes)), "")
+	expect := `{"$schema":"https://json-schema.org/draft/2020-12/schema","title":"testevent","type":"object",` +
+		`"properties":{"hostname":{"type":"string"},` +
+		`"peak":{"type":"integer","description":"Inpercent,omittedifnotselectedby--fields"},` +
+		`"gpus":{"type":"array","items":{"type":"integer"}},"load":{"type":["number","null"]},` +
+		`"note":{"type":"string"},"Count":{"type":"integer"}},` +
+		`"required":["hostname","gpus","load","Count"]}`
+	if compact != expect {
+		t.Fatalf("Bad schema %s", compact)
+	}
+}
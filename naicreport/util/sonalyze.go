@@ -0,0 +1,48 @@
+// Running sonalyze on the sonar logs, for the commands that derive their data from it.
+
+package util
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+// Assemble the arguments for running the sonalyze verb over the data path and time window of
+// progOpts, with the config file (if not "") and the fields of the output format.  The output format
+// is always csvnamed.  Further arguments can be appended to the result.
+
+func SonalyzeArgs(verb string, progOpts *StandardOptions, configFile, format string) []string {
+	arguments := []string{
+		verb,
+		"--data-path", progOpts.DataPath,
+	}
+	if configFile != "" {
+		arguments = append(arguments, "--config-file", configFile)
+	}
+	arguments = append(arguments, "--fmt=csvnamed,"+format)
+	if progOpts.HaveFrom {
+		arguments = append(arguments, "--from", progOpts.FromStr)
+	}
+	if progOpts.HaveTo {
+		arguments = append(arguments, "--to", progOpts.ToStr)
+	}
+	return arguments
+}
+
+// Run the sonalyze executable with the arguments and return its output.  If it fails, the error
+// includes anything it wrote to stderr, and the output is anything it wrote to stdout before it
+// failed, which may be useful.
+
+func RunSonalyze(sonalyzePath string, arguments []string) (string, error) {
+	cmd := exec.Command(sonalyzePath, arguments...)
+	var stdout strings.Builder
+	var stderr strings.Builder
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return stdout.String(), errors.Join(err, errors.New(stderr.String()))
+	}
+	return stdout.String(), nil
+}
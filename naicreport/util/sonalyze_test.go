@@ -0,0 +1,32 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSonalyzeArgs(t *testing.T) {
+	opts := &StandardOptions{DataPath: "/data", HaveFrom: true, FromStr: "2d"}
+	args := SonalyzeArgs("load", opts, "/config.json", "host,rcpu")
+	if strings.Join(args, " ") !=
+		"load --data-path /data --config-file /config.json --fmt=csvnamed,host,rcpu --from 2d" {
+		t.Fatalf("Bad arguments %v", args)
+	}
+	opts.HaveTo = true
+	opts.ToStr = "1d"
+	args = SonalyzeArgs("jobs", opts, "", "user")
+	if strings.Join(args, " ") != "jobs --data-path /data --fmt=csvnamed,user --from 2d --to 1d" {
+		t.Fatalf("Bad arguments %v", args)
+	}
+}
+
+func TestRunSonalyze(t *testing.T) {
+	output, err := RunSonalyze("/bin/sh", []string{"-c", "echo hello"})
+	if err != nil || output != "hello\n" {
+		t.Fatalf("Bad run: %q %v", output, err)
+	}
+	output, err = RunSonalyze("/bin/sh", []string{"-c", "echo partial; echo oops >&2; exit 1"})
+	if err == nil || !strings.Contains(err.Error(), "oops") || output != "partial\n" {
+		t.Fatalf("Bad error: %q %v", output, err)
+	}
+}
@@ -0,0 +1,176 @@
+// The system configuration file, which describes the hardware of each host.  It is the same file
+// that is passed to sonalyze with --config-file: a JSON array of objects, one per host, eg
+//
+//   [{"hostname": "ml8.hpc.uio.no", "description": "2x48 AMD EPYC 7642 (hyperthreaded), 1TB, ...",
+//     "cpu_cores": 192, "mem_gb": 1024, "gpu_cards": 4, "gpumem_gb": 160}, ...]
+//
+// Fields that are not understood are ignored.
+
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type SystemConfig struct {
+	Hostname    string `json:"hostname"`
+	Description string `json:"description"`
+	CpuCores    int    `json:"cpu_cores"`
+	MemGB       int    `json:"mem_gb"`
+	GpuCards    int    `json:"gpu_cards"`
+	GpuMemGB    int    `json:"gpumem_gb"`
+}
+
+type SystemConfigs struct {
+	hosts map[string]*SystemConfig
+}
+
+// Read the configuration file.  If the filename is "" then there is no information about any host.
+
+func LoadSystemConfig(filename string) (*SystemConfigs, error) {
+	configs := &SystemConfigs{hosts: make(map[string]*SystemConfig)}
+	if filename == "" {
+		return configs, nil
+	}
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var info []*SystemConfig
+	err = json.Unmarshal(bytes, &info)
+	if err != nil {
+		return nil, fmt.Errorf("Bad system config file %s: %w", filename, err)
+	}
+	for _, c := range info {
+		configs.hosts[c.Hostname] = c
+	}
+	return configs, nil
+}
+
+// Return the configuration of the host, or nil if it is not known.  The logs may use short host
+// names (eg `ml8`) where the config file has full names (eg `ml8.hpc.uio.no`), so if there is no
+// exact match then the host matches a config whose first name component is the same as the host's.
+// A nil SystemConfigs knows no hosts.
+
+func (sc *SystemConfigs) Lookup(host string) *SystemConfig {
+	if sc == nil {
+		return nil
+	}
+	if c, found := sc.hosts[host]; found {
+		return c
+	}
+	short, _, _ := strings.Cut(host, ".")
+	for name, c := range sc.hosts {
+		if first, _, _ := strings.Cut(name, "."); first == short {
+			return c
+		}
+	}
+	return nil
+}
+
+// Check the configuration file more strictly than LoadSystemConfig and return a description of each
+// problem, prefixed by `filename:line:`, or an empty list if there are none.  The file must be an
+// array of objects; each object must have a hostname that is not shared with another object, even
+// in its first name component (which would make Lookup ambiguous), a positive cpu_cores and mem_gb,
+// and a gpu_cards and gpumem_gb that are zero or positive, gpumem_gb being positive if gpu_cards is.
+// An error is returned only if the file can't be read.
+
+func CheckSystemConfig(filename string) ([]string, error) {
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	problems := make([]string, 0)
+	lineAt := func(offset int64) int {
+		return 1 + strings.Count(string(bytes[:offset]), "\n")
+	}
+	report := func(offset int64, format string, args ...any) {
+		problems = append(problems,
+			fmt.Sprintf("%s:%d: %s", filename, lineAt(offset), fmt.Sprintf(format, args...)))
+	}
+	reportJsonError := func(err error) {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			report(syntaxErr.Offset, "%v", err)
+		case errors.As(err, &typeErr):
+			report(typeErr.Offset, "%v", err)
+		default:
+			report(int64(len(bytes)), "%v", err)
+		}
+	}
+
+	dec := json.NewDecoder(strings.NewReader(string(bytes)))
+	tok, err := dec.Token()
+	if err != nil {
+		reportJsonError(err)
+		return problems, nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		report(0, "The config must be an array of host objects")
+		return problems, nil
+	}
+	names := make(map[string]int)      // hostname -> line
+	shortNames := make(map[string]int) // first name component -> line
+	for dec.More() {
+		// The offset is at the end of the previous token; the object starts after the separator.
+		offset := dec.InputOffset()
+		for offset < int64(len(bytes)) && strings.ContainsRune(" \t\r\n,", rune(bytes[offset])) {
+			offset++
+		}
+		var fields map[string]any
+		err = dec.Decode(&fields)
+		if err != nil {
+			reportJsonError(err)
+			return problems, nil
+		}
+		line := lineAt(offset)
+		hostname, _ := fields["hostname"].(string)
+		if hostname == "" {
+			report(offset, "Missing hostname")
+		} else {
+			short, _, _ := strings.Cut(hostname, ".")
+			if first, found := names[hostname]; found {
+				report(offset, "Duplicate host %s, first defined on line %d", hostname, first)
+			} else if first, found := shortNames[short]; found {
+				report(offset, "Host %s has the same short name as the host on line %d", hostname, first)
+			}
+			names[hostname] = line
+			if _, found := shortNames[short]; !found {
+				shortNames[short] = line
+			}
+		}
+		label := hostname
+		if label == "" {
+			label = "(no hostname)"
+		}
+		number := func(name string, positive bool) float64 {
+			v, found := fields[name]
+			n, isNumber := v.(float64)
+			switch {
+			case !found:
+				report(offset, "Host %s: missing %s", label, name)
+			case !isNumber || n < 0 || positive && n == 0:
+				report(offset, "Host %s: bad value for %s: %v", label, name, v)
+			}
+			return n
+		}
+		number("cpu_cores", true)
+		number("mem_gb", true)
+		if number("gpu_cards", false) > 0 {
+			number("gpumem_gb", true)
+		} else {
+			number("gpumem_gb", false)
+		}
+	}
+	_, err = dec.Token()
+	if err != nil {
+		reportJsonError(err)
+	}
+	return problems, nil
+}
@@ -0,0 +1,122 @@
+package util
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestLoadSystemConfig(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	configs, err := LoadSystemConfig(path.Join(wd, "../../sonar_test_data0/test_config.json"))
+	if err != nil {
+		t.Fatalf("LoadSystemConfig failed %v", err)
+	}
+	c := configs.Lookup("ml8.hpc.uio.no")
+	if c == nil || c.CpuCores != 192 || c.MemGB != 1024 || c.GpuCards != 4 || c.GpuMemGB != 160 {
+		t.Fatalf("Bad config %v", c)
+	}
+	if configs.Lookup("ml8") != c || configs.Lookup("ml1").CpuCores != 56 ||
+		configs.Lookup("ml6") != nil || configs.Lookup("ml") != nil {
+		t.Fatalf("Bad lookup")
+	}
+
+	var none *SystemConfigs
+	if none.Lookup("ml8") != nil {
+		t.Fatalf("Bad lookup in nil configs")
+	}
+	empty, err := LoadSystemConfig("")
+	if err != nil || empty.Lookup("ml8") != nil {
+		t.Fatalf("Bad empty configs %v", err)
+	}
+}
+
+func TestLoadSystemConfigUnknownFields(t *testing.T) {
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	filename := path.Join(td_name, "config.json")
+	err = os.WriteFile(filename,
+		[]byte(`[{"hostname": "ml6", "cpu_cores": 64, "interconnect": "none", "racks": [1, 2]}]`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	configs, err := LoadSystemConfig(filename)
+	if err != nil {
+		t.Fatalf("LoadSystemConfig failed %v", err)
+	}
+	if c := configs.Lookup("ml6"); c == nil || c.CpuCores != 64 || c.GpuCards != 0 {
+		t.Fatalf("Bad config %v", c)
+	}
+
+	err = os.WriteFile(filename, []byte(`{"hostname": "ml6"}`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	_, err = LoadSystemConfig(filename)
+	if err == nil {
+		t.Fatalf("Bad config file accepted")
+	}
+}
+
+func TestCheckSystemConfig(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %q", err)
+	}
+	problems, err := CheckSystemConfig(path.Join(wd, "../../sonar_test_data0/test_config.json"))
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("Bad check of good config %v %v", problems, err)
+	}
+
+	td_name, err := os.MkdirTemp(os.TempDir(), "naicreport")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed %q", err)
+	}
+	filename := path.Join(td_name, "config.json")
+	err = os.WriteFile(filename, []byte(`[
+  {"hostname": "ml1.hpc.uio.no", "cpu_cores": 56, "mem_gb": 128, "gpu_cards": 4, "gpumem_gb": 44},
+  {"hostname": "ml1.hpc.uio.no", "cpu_cores": 56, "mem_gb": 128, "gpu_cards": 0, "gpumem_gb": 0},
+  {"hostname": "ml1", "cpu_cores": 0, "mem_gb": 128, "gpu_cards": 4},
+  {"cpu_cores": "lots", "mem_gb": 128, "gpu_cards": 0, "gpumem_gb": 0},
+  {"hostname": "ml3" "cpu_cores": 1}
+]`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	problems, err = CheckSystemConfig(filename)
+	if err != nil {
+		t.Fatalf("CheckSystemConfig failed %v", err)
+	}
+	expect := []string{
+		":3: Duplicate host ml1.hpc.uio.no, first defined on line 2",
+		":4: Host ml1 has the same short name as the host on line 2",
+		":4: Host ml1: bad value for cpu_cores: 0",
+		":4: Host ml1: missing gpumem_gb",
+		":5: Missing hostname",
+		":5: Host (no hostname): bad value for cpu_cores: lots",
+		":6: invalid character",
+	}
+	if len(problems) != len(expect) {
+		t.Fatalf("Bad problems %q", problems)
+	}
+	for i, p := range problems {
+		if !strings.HasPrefix(p, filename+expect[i]) {
+			t.Fatalf("Bad problem %q, expected %q", p, expect[i])
+		}
+	}
+
+	err = os.WriteFile(filename, []byte(`{"hostname": "ml1"}`), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed %q", err)
+	}
+	problems, err = CheckSystemConfig(filename)
+	if err != nil || len(problems) != 1 {
+		t.Fatalf("Bad check of non-array %v %v", problems, err)
+	}
+}
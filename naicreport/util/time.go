@@ -3,6 +3,7 @@
 package util
 
 import (
+	"fmt"
 	"time"
 )
 
@@ -11,6 +12,40 @@ const (
 	DateTimeFormat = "2006-01-02 15:04"
 )
 
+// Formats the times in the reports in a layout and time zone chosen by the user.
+
+type TimeFormatter struct {
+	layout   string
+	location *time.Location
+}
+
+// Create a formatter for the layout (a Go time layout, DateTimeFormat if "") and the time zone (an
+// IANA name such as "Europe/Oslo", or "Local"; UTC if "").
+
+func NewTimeFormatter(layout, timezone string) (*TimeFormatter, error) {
+	if layout == "" {
+		layout = DateTimeFormat
+	}
+	location := time.UTC
+	if timezone != "" {
+		var err error
+		location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &TimeFormatter{layout: layout, location: location}, nil
+}
+
+// Format the time.  A nil formatter formats it in DateTimeFormat in UTC.
+
+func (tf *TimeFormatter) Format(t time.Time) string {
+	if tf == nil {
+		return t.UTC().Format(DateTimeFormat)
+	}
+	return t.In(tf.location).Format(tf.layout)
+}
+
 func MinTime(a, b time.Time) time.Time {
 	if a.Before(b) {
 		return a
@@ -24,3 +59,84 @@ func MaxTime(a, b time.Time) time.Time {
 	}
 	return b
 }
+
+// Widen the span from *first to *last to include the span from `newFirst` to `newLast`.  This is how
+// the analyses merge a new sighting of a job into the job's record: the first and last times the job
+// was seen widen to include the time of the sighting, and the job's start and end times widen to
+// include the start and end times of the sighting.
+
+func WidenSpan(first, last *time.Time, newFirst, newLast time.Time) {
+	*first = MinTime(*first, newFirst)
+	*last = MaxTime(*last, newLast)
+}
+
+// The time a job has run: from the start time to the end time of its records, or if either of these
+// is unknown (zero), from its first record to its last.  If the end is before the start, which is
+// clock skew, then the time is zero and ok is false.
+
+func JobDuration(start, end, firstSeen, lastSeen time.Time) (d time.Duration, ok bool) {
+	if start.IsZero() || end.IsZero() {
+		start, end = firstSeen, lastSeen
+	}
+	if end.Before(start) {
+		return 0, false
+	}
+	return end.Sub(start), true
+}
+
+// Format a duration for the reports, to the minute, eg 3h20m or, if it is a day or more, 2d3h20m.
+
+func FormatDuration(d time.Duration) string {
+	minutes := int64(d / time.Minute)
+	days, hours := minutes/(24*60), minutes/60%24
+	if days > 0 {
+		return fmt.Sprintf("%dd%dh%dm", days, hours, minutes%60)
+	}
+	return fmt.Sprintf("%dh%dm", hours, minutes%60)
+}
+
+// The span of time actually covered by the log records that were read, as opposed to the time
+// window that was requested, which may have days without data.  The zero value covers nothing.
+
+type Coverage struct {
+	Earliest time.Time
+	Latest   time.Time
+}
+
+// Extend the coverage to include the times from `first` to `last`.
+
+func (c *Coverage) Add(first, last time.Time) {
+	if c.Earliest.IsZero() || first.Before(c.Earliest) {
+		c.Earliest = first
+	}
+	if c.Latest.IsZero() || last.After(c.Latest) {
+		c.Latest = last
+	}
+}
+
+// Describe the coverage relative to the requested window [from, to).  If from and to are midnight
+// the window is shown as the dates of its first and last day, otherwise as times.
+
+func (c *Coverage) Describe(from, to time.Time) string {
+	first, last := formatWindow(from, to)
+	window := fmt.Sprintf("requested %s to %s", first, last)
+	if c.Earliest.IsZero() {
+		return "no data, " + window
+	}
+	return fmt.Sprintf("data from %s to %s, %s", c.Earliest.Format(DateTimeFormat),
+		c.Latest.Format(DateTimeFormat), window)
+}
+
+// Format the time window [from, to) as the dates of its first and last day if from and to are
+// midnight, eg with --from and --to, otherwise as the times of its start and end, eg with --last.
+
+func formatWindow(from, to time.Time) (string, string) {
+	if isMidnight(from) && isMidnight(to) {
+		return from.Format("2006-01-02"), to.AddDate(0, 0, -1).Format("2006-01-02")
+	}
+	return from.Format(DateTimeFormat), to.Format(DateTimeFormat)
+}
+
+func isMidnight(t time.Time) bool {
+	return t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0
+}
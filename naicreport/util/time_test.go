@@ -0,0 +1,84 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeFormatter(t *testing.T) {
+	t0 := time.Date(2023, 9, 5, 10, 30, 0, 0, time.UTC)
+	var none *TimeFormatter
+	if none.Format(t0) != "2023-09-05 10:30" {
+		t.Fatalf("Bad default format")
+	}
+	tf, err := NewTimeFormatter("", "")
+	if err != nil || tf.Format(t0) != "2023-09-05 10:30" {
+		t.Fatalf("Bad default formatter %v", err)
+	}
+	tf, err = NewTimeFormatter("02.01.2006 15:04 MST", "Europe/Oslo")
+	if err != nil {
+		t.Fatalf("NewTimeFormatter failed %v", err)
+	}
+	if tf.Format(t0) != "05.09.2023 12:30 CEST" {
+		t.Fatalf("Bad format %s", tf.Format(t0))
+	}
+	_, err = NewTimeFormatter("", "Nowhere/Special")
+	if err == nil {
+		t.Fatalf("Bad time zone accepted")
+	}
+}
+
+func TestWidenSpan(t *testing.T) {
+	t0 := time.Date(2023, 9, 5, 10, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Hour)
+	t2 := t1.Add(time.Hour)
+	first, last := t1, t1
+	WidenSpan(&first, &last, t2, t2)
+	if first != t1 || last != t2 {
+		t.Fatalf("Bad widening %v %v", first, last)
+	}
+	WidenSpan(&first, &last, t0, t1)
+	if first != t0 || last != t2 {
+		t.Fatalf("Bad widening %v %v", first, last)
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	from := time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 9, 11, 0, 0, 0, 0, time.UTC)
+	var c Coverage
+	if c.Describe(from, to) != "no data, requested 2023-09-01 to 2023-09-10" {
+		t.Fatalf("Bad empty coverage %s", c.Describe(from, to))
+	}
+	c.Add(time.Date(2023, 9, 5, 10, 0, 0, 0, time.UTC), time.Date(2023, 9, 6, 12, 0, 0, 0, time.UTC))
+	c.Add(time.Date(2023, 9, 4, 8, 0, 0, 0, time.UTC), time.Date(2023, 9, 5, 8, 0, 0, 0, time.UTC))
+	expect := "data from 2023-09-04 08:00 to 2023-09-06 12:00, requested 2023-09-01 to 2023-09-10"
+	if c.Describe(from, to) != expect {
+		t.Fatalf("Bad coverage %s", c.Describe(from, to))
+	}
+
+	from = time.Date(2023, 9, 5, 10, 30, 0, 0, time.UTC)
+	to = from.Add(24 * time.Hour)
+	expect = "data from 2023-09-04 08:00 to 2023-09-06 12:00, requested 2023-09-05 10:30 to 2023-09-06 10:30"
+	if c.Describe(from, to) != expect {
+		t.Fatalf("Bad coverage for sub-day window %s", c.Describe(from, to))
+	}
+}
+
+func TestJobDuration(t *testing.T) {
+	t0 := time.Date(2023, 9, 5, 10, 30, 0, 0, time.UTC)
+	t1 := t0.Add(200 * time.Minute)
+	if d, ok := JobDuration(t0, t1, t0.Add(time.Hour), t1); d != 200*time.Minute || !ok {
+		t.Fatalf("Bad duration %v", d)
+	}
+	if d, ok := JobDuration(time.Time{}, t1, t0.Add(time.Hour), t1); d != 140*time.Minute || !ok {
+		t.Fatalf("Bad duration without start %v", d)
+	}
+	if d, ok := JobDuration(t1, t0, t0, t1); d != 0 || ok {
+		t.Fatalf("Bad duration with clock skew %v", d)
+	}
+	if FormatDuration(200*time.Minute) != "3h20m" || FormatDuration(0) != "0h0m" ||
+		FormatDuration(51*time.Hour+5*time.Minute+30*time.Second) != "2d3h5m" {
+		t.Fatalf("Bad FormatDuration")
+	}
+}
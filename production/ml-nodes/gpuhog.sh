@@ -0,0 +1,22 @@
+#!/usr/bin/env bash
+#
+# Run sonalyze for the `gpuhog` use case and capture its output in a
+# file appropriate for the current time and system.
+
+sonar_dir=$HOME/sonar
+sonar_data_dir=$sonar_dir/data
+
+year=$(date +'%Y')
+month=$(date +'%m')
+day=$(date +'%d')
+
+output_directory=${sonar_data_dir}/${year}/${month}/${day}
+mkdir -p ${output_directory}
+
+# Jobs that have held on to GPUs for at least 10 minutes but have barely used them.  Reports go to
+# stdout.  It runs on the data for the last 24h.  It should be run about once every 12h.
+#
+# What's "barely"?  We define this for now as a peak relative GPU utilization of at most 10% of the
+# system's GPU capacity.  This is imperfect but at least not completely wrong.
+
+SONAR_ROOT=$sonar_data_dir $sonar_dir/sonalyze jobs --config-file=$sonar_dir/ml-nodes.json -u -  "$@" --some-gpu --max-rgpu-peak=10 --min-runtime=10m --fmt=csvnamed,tag:gpuhog,now,std,gpu-peak,rgpu,rgpumem,start,end,cmd >> ${output_directory}/gpuhog.csv
@@ -4,48 +4,50 @@
 //
 // Usage:
 //
-//   distribute filename dir1 ...
+//   distribute [--by-field fieldname] filename dir1 ...
 //
-// TODO: A better realization of this program would read the log records and place each record in a
-// file in a directory that is appropriate for it.
+// With --by-field, the lines are instead taken to be records in "free CSV" form (comma-separated
+// `name=value` fields) and each record is placed in the directory selected by a stable hash of the
+// value of the named field, so that eg all the records for one host end up in the same file.  A
+// record that lacks the field is treated as if the field's value were the empty string.
 
 package main
 
 import (
 	"bufio"
+	"encoding/csv"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"os"
 	"path"
+	"strings"
 )
 
 func main() {
-	as := os.Args
-	if len(as) < 3 {
-		fail("Usage: distribute filename dir ...")
+	byField := flag.String("by-field", "", "Distribute records by the hash of this field")
+	flag.Parse()
+	as := flag.Args()
+	if len(as) < 2 {
+		fail("Usage: distribute [--by-field fieldname] filename dir ...")
 	}
-	infilename := as[1]
-	dirs := as[2:]
+	infilename := as[0]
+	dirs := as[1:]
 
 	infile, err := os.OpenFile(infilename, os.O_RDONLY|os.O_APPEND, 0)
 	check(err, "Error opening %v: %v\n", infilename, err)
 
-	// Count lines and compute number of lines per output file
-	lines := 0
-	{
-		rdr := bufio.NewReader(infile)
-		for {
-			_, err := rdr.ReadString('\n')
-			if err == io.EOF {
-				// Subtle bug: non-LF terminated lines are not handled properly I think
-				break
-			}
-			check(err, "Error reading %v: %v\n", infilename, err)
-			lines++
-		}
-		_, err := infile.Seek(0, 0)
-		check(err, "Error seeking %v: %v\n", infilename, err)
+	if *byField != "" {
+		distributeByField(infile, infilename, *byField, dirs)
+		return
 	}
+
+	// Count lines and compute number of lines per output file
+	lines, err := countLines(bufio.NewReader(infile))
+	check(err, "Error reading %v: %v\n", infilename, err)
+	_, err = infile.Seek(0, 0)
+	check(err, "Error seeking %v: %v\n", infilename, err)
 	num_per_file := (lines + (len(dirs) - 1)) / len(dirs)
 
 	// Populate the directories
@@ -55,21 +57,120 @@ func main() {
 		outfile, err := os.Create(outfilename)
 		check(err, "Error creating %v: %v\n", outfilename, err)
 		writer := bufio.NewWriter(outfile)
-		for i := 0; i < num_per_file; i++ {
-			s, err := rdr.ReadString('\n')
-			if err == io.EOF {
-				// Subtle bug: non-LF terminated lines are not handled properly I think
-				break
-			}
-			check(err, "Error reading %v: %v\n", infilename, err)
-			_, err = writer.WriteString(s)
-			check(err, "Error writing to %v: %v\n", outfilename, err)
-		}
+		err = copyLines(rdr, writer, num_per_file)
+		check(err, "Error copying %v to %v: %v\n", infilename, outfilename, err)
 		writer.Flush()
 		outfile.Close()
 	}
 }
 
+func distributeByField(infile *os.File, infilename, field string, dirs []string) {
+	outfiles := make([]*os.File, 0)
+	bufwriters := make([]*bufio.Writer, 0)
+	writers := make([]io.Writer, 0)
+	for _, dir := range dirs {
+		outfilename := dir + "/" + path.Base(infilename)
+		outfile, err := os.Create(outfilename)
+		check(err, "Error creating %v: %v\n", outfilename, err)
+		writer := bufio.NewWriter(outfile)
+		outfiles = append(outfiles, outfile)
+		bufwriters = append(bufwriters, writer)
+		writers = append(writers, writer)
+	}
+	err := routeLines(bufio.NewReader(infile), field, writers)
+	check(err, "Error copying %v: %v\n", infilename, err)
+	for i, outfile := range outfiles {
+		bufwriters[i].Flush()
+		outfile.Close()
+	}
+}
+
+// Copy each line of the input to the writer selected by the hash of the value of the field.
+
+func routeLines(rdr *bufio.Reader, field string, writers []io.Writer) error {
+	for {
+		s, err := rdr.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if s != "" {
+			_, werr := io.WriteString(writers[pickDir(fieldValue(s, field), len(writers))], s)
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// Return the value of the field in the free CSV record on the line, or "" if the field is absent or
+// the line can't be parsed.
+
+func fieldValue(line, field string) string {
+	fields, err := csv.NewReader(strings.NewReader(line)).Read()
+	if err != nil {
+		return ""
+	}
+	prefix := field + "="
+	for _, f := range fields {
+		if strings.HasPrefix(f, prefix) {
+			return f[len(prefix):]
+		}
+	}
+	return ""
+}
+
+// Stable mapping from a field value to a directory index in [0,n).
+
+func pickDir(value string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return int(h.Sum32() % uint32(n))
+}
+
+// Count the lines in the input.  A final line that is not terminated by LF is counted as a line.
+
+func countLines(rdr *bufio.Reader) (int, error) {
+	lines := 0
+	for {
+		s, err := rdr.ReadString('\n')
+		if err == io.EOF {
+			if s != "" {
+				lines++
+			}
+			return lines, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		lines++
+	}
+}
+
+// Copy up to n lines from the input to the output.  A final line that is not terminated by LF is
+// copied as it is.
+
+func copyLines(rdr *bufio.Reader, writer io.Writer, n int) error {
+	for i := 0; i < n; i++ {
+		s, err := rdr.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if s != "" {
+			_, werr := io.WriteString(writer, s)
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return nil
+}
+
 func check(err error, msg string, irritant ...any) {
 	if err != nil {
 		fmt.Fprintf(os.Stderr, msg, irritant...)
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestUnterminatedLastLine(t *testing.T) {
+	input := "a=1\nb=2\nc=3"
+	n, err := countLines(bufio.NewReader(strings.NewReader(input)))
+	if err != nil || n != 3 {
+		t.Fatalf("Bad line count %d %v", n, err)
+	}
+
+	rdr := bufio.NewReader(strings.NewReader(input))
+	var first, second strings.Builder
+	if err := copyLines(rdr, &first, 2); err != nil {
+		t.Fatalf("Copy failed %v", err)
+	}
+	if err := copyLines(rdr, &second, 2); err != nil {
+		t.Fatalf("Copy failed %v", err)
+	}
+	if first.String() != "a=1\nb=2\n" || second.String() != "c=3" {
+		t.Fatalf("Bad output %q %q", first.String(), second.String())
+	}
+}
+
+func TestTerminatedLastLine(t *testing.T) {
+	input := "a=1\nb=2\n"
+	n, err := countLines(bufio.NewReader(strings.NewReader(input)))
+	if err != nil || n != 2 {
+		t.Fatalf("Bad line count %d %v", n, err)
+	}
+	var out strings.Builder
+	if err := copyLines(bufio.NewReader(strings.NewReader(input)), &out, 5); err != nil {
+		t.Fatalf("Copy failed %v", err)
+	}
+	if out.String() != input {
+		t.Fatalf("Bad output %q", out.String())
+	}
+}
+
+func TestRouteLines(t *testing.T) {
+	input := "host=ml1,v=1\nhost=ml2,v=2\nv=3\nhost=ml1,v=4"
+	outs := []*strings.Builder{&strings.Builder{}, &strings.Builder{}, &strings.Builder{}}
+	writers := []io.Writer{outs[0], outs[1], outs[2]}
+	if err := routeLines(bufio.NewReader(strings.NewReader(input)), "host", writers); err != nil {
+		t.Fatalf("Route failed %v", err)
+	}
+	ml1 := outs[pickDir("ml1", 3)].String()
+	if !strings.Contains(ml1, "host=ml1,v=1\n") || !strings.HasSuffix(ml1, "host=ml1,v=4") {
+		t.Fatalf("Bad routing for ml1 %q", ml1)
+	}
+	if !strings.Contains(outs[pickDir("ml2", 3)].String(), "host=ml2,v=2\n") {
+		t.Fatalf("Bad routing for ml2")
+	}
+	if !strings.Contains(outs[pickDir("", 3)].String(), "v=3\n") {
+		t.Fatalf("Bad routing for missing field")
+	}
+	total := 0
+	for _, o := range outs {
+		total += strings.Count(o.String(), "v=")
+	}
+	if total != 4 {
+		t.Fatalf("Records lost or duplicated")
+	}
+}